@@ -0,0 +1,222 @@
+// Package client is the Go client of the booking service. It sends the token or API key with
+// each call, retries the idempotent calls, returns errors that match the errors of the
+// package and reads the streaming calls with iterators.
+//
+//	c, err := client.Dial("localhost:50051", client.WithTokenSource(client.FileToken("token.jwt")))
+//	...
+//	booking, err := c.Purchase(ctx, &pb.PurchaseRequest{...})
+//	if errors.Is(err, client.ErrSeatNotAvailable) {
+//		...
+//	}
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Client calls the booking service
+type Client struct {
+	conn  *grpc.ClientConn
+	rpc   pb.BookingServiceClient
+	retry RetryPolicy
+}
+
+type options struct {
+	creds       credentials.TransportCredentials
+	tokens      TokenSource
+	apiKey      string
+	retry       RetryPolicy
+	dialOptions []grpc.DialOption
+}
+
+// Option configures the client
+type Option func(*options)
+
+// WithTransportCredentials sets the credentials of the connection, it is plaintext by default
+func WithTransportCredentials(creds credentials.TransportCredentials) Option {
+	return func(o *options) {
+		o.creds = creds
+	}
+}
+
+// WithTLSConfig connects with TLS, set Certificates in the config for mutual TLS
+func WithTLSConfig(config *tls.Config) Option {
+	return WithTransportCredentials(credentials.NewTLS(config))
+}
+
+// WithTokenSource sends the token of the source in the authorization header of each call
+func WithTokenSource(tokens TokenSource) Option {
+	return func(o *options) {
+		o.tokens = tokens
+	}
+}
+
+// WithToken sends a static token, see WithTokenSource
+func WithToken(token string) Option {
+	return WithTokenSource(StaticToken(token))
+}
+
+// WithAPIKey sends the API key in the x-api-key header of each call, a token source wins over it
+func WithAPIKey(key string) Option {
+	return func(o *options) {
+		o.apiKey = key
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = policy
+	}
+}
+
+// WithDialOptions adds options to the connection, e.g. interceptors or a stats handler
+func WithDialOptions(dialOptions ...grpc.DialOption) Option {
+	return func(o *options) {
+		o.dialOptions = append(o.dialOptions, dialOptions...)
+	}
+}
+
+// Dial creates a client of the server at target. It connects in the background, errors of
+// the connection are returned by the calls.
+func Dial(target string, opts ...Option) (*Client, error) {
+	o := options{creds: insecure.NewCredentials(), retry: DefaultRetryPolicy}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(o.creds),
+		grpc.WithChainUnaryInterceptor(o.retry.unaryInterceptor),
+		grpc.WithPerRPCCredentials(perRPCCredentials{tokens: o.tokens, apiKey: o.apiKey}),
+	}
+	conn, err := grpc.Dial(target, append(dialOptions, o.dialOptions...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", target, err)
+	}
+	return &Client{conn: conn, rpc: pb.NewBookingServiceClient(conn), retry: o.retry}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// RPC returns the generated client for the calls the client doesn't wrap. The calls send the
+// credentials and are retried, but their errors are not converted.
+func (c *Client) RPC() pb.BookingServiceClient {
+	return c.rpc
+}
+
+// Purchase buys a ticket, it is not retried as the first call may have booked the seat
+func (c *Client) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
+	booking, err := c.rpc.Purchase(ctx, req)
+	return booking, convertError(err)
+}
+
+// PurchaseBookings buys the seats of a group at once, all of them or none. It is not retried
+// either.
+func (c *Client) PurchaseBookings(ctx context.Context, purchases ...*pb.PurchaseRequest) ([]*pb.Booking, error) {
+	resp, err := c.rpc.PurchaseBookings(ctx, &pb.PurchaseBookingsRequest{Purchases: purchases})
+	return resp.GetBookings(), convertError(err)
+}
+
+// GetUserBookings returns the bookings of the caller
+func (c *Client) GetUserBookings(ctx context.Context) *BookingIterator {
+	return newBookingIterator(ctx, c.retry, func(ctx context.Context) (bookingStream, error) {
+		return c.rpc.GetUserBookings(ctx, &emptypb.Empty{})
+	})
+}
+
+// GetBookingsBySection returns the bookings of a section, admins only
+func (c *Client) GetBookingsBySection(ctx context.Context, req *pb.GetBookingsBySectionRequest) *BookingIterator {
+	return newBookingIterator(ctx, c.retry, func(ctx context.Context) (bookingStream, error) {
+		return c.rpc.GetBookingsBySection(ctx, req)
+	})
+}
+
+// RemoveUserFromTrain cancels a booking
+func (c *Client) RemoveUserFromTrain(ctx context.Context, req *pb.RemoveBookingRequest) error {
+	_, err := c.rpc.RemoveUserFromTrain(ctx, req)
+	return convertError(err)
+}
+
+// ModifySeat moves a booking to another seat
+func (c *Client) ModifySeat(ctx context.Context, req *pb.ModifySeatRequest) (*pb.Booking, error) {
+	booking, err := c.rpc.ModifySeat(ctx, req)
+	return booking, convertError(err)
+}
+
+// RequestBookingAccess asks for a booking access token to be sent to the email address
+func (c *Client) RequestBookingAccess(ctx context.Context, req *pb.RequestBookingAccessRequest) error {
+	_, err := c.rpc.RequestBookingAccess(ctx, req)
+	return convertError(err)
+}
+
+// RedeemBookingAccess exchanges a booking access token for a session token
+func (c *Client) RedeemBookingAccess(ctx context.Context, req *pb.RedeemBookingAccessRequest) (*pb.BookingAccessSession, error) {
+	session, err := c.rpc.RedeemBookingAccess(ctx, req)
+	return session, convertError(err)
+}
+
+// ClaimGuestBookings moves the guest bookings of the access token's email to the caller
+func (c *Client) ClaimGuestBookings(ctx context.Context, req *pb.ClaimGuestBookingsRequest) ([]*pb.Booking, error) {
+	resp, err := c.rpc.ClaimGuestBookings(ctx, req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return resp.Bookings, nil
+}
+
+// ListBookings returns a page of the bookings that match the request's filter, pass the
+// next page token of the response to get the following page
+func (c *Client) ListBookings(ctx context.Context, req *pb.ListBookingsRequest) (*pb.ListBookingsResponse, error) {
+	resp, err := c.rpc.ListBookings(ctx, req)
+	return resp, convertError(err)
+}
+
+// SearchBookings finds the active bookings of any user by name, email address, booking id prefix
+// or seat, the best matches first
+func (c *Client) SearchBookings(ctx context.Context, req *pb.SearchBookingsRequest) ([]*pb.Booking, error) {
+	resp, err := c.rpc.SearchBookings(ctx, req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return resp.Bookings, nil
+}
+
+// GetMyLimits returns the booking limits of the caller
+func (c *Client) GetMyLimits(ctx context.Context) (*pb.UserLimits, error) {
+	limits, err := c.rpc.GetMyLimits(ctx, &emptypb.Empty{})
+	return limits, convertError(err)
+}
+
+// CreateAPIKey creates an API key, the key is only returned by this call
+func (c *Client) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	resp, err := c.rpc.CreateAPIKey(ctx, req)
+	return resp, convertError(err)
+}
+
+// ListAPIKeys returns the API keys of an owner
+func (c *Client) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) ([]*pb.APIKey, error) {
+	resp, err := c.rpc.ListAPIKeys(ctx, req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return resp.ApiKeys, nil
+}
+
+// RevokeAPIKey revokes an API key
+func (c *Client) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.APIKey, error) {
+	key, err := c.rpc.RevokeAPIKey(ctx, req)
+	return key, convertError(err)
+}
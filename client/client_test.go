@@ -0,0 +1,264 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// fakeServer fails the first calls of each method with failures, then answers them
+type fakeServer struct {
+	pb.UnimplementedBookingServiceServer
+
+	mu            sync.Mutex
+	failures      map[string][]error
+	calls         map[string]int
+	authorization []string
+	bookings      []*pb.Booking
+}
+
+// call records the call and returns the next failure of the method
+func (s *fakeServer) call(ctx context.Context, method string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.authorization = append(s.authorization, strings.Join(append(md.Get("authorization"), md.Get("x-api-key")...), ","))
+	s.calls[method]++
+	if failures := s.failures[method]; len(failures) > 0 {
+		s.failures[method] = failures[1:]
+		return failures[0]
+	}
+	return nil
+}
+
+func (s *fakeServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
+	if err := s.call(ctx, "Purchase"); err != nil {
+		return nil, err
+	}
+	return &pb.Booking{BookingId: "b1", User: req.User, Seat: req.Seat}, nil
+}
+
+func (s *fakeServer) GetMyLimits(ctx context.Context, req *emptypb.Empty) (*pb.UserLimits, error) {
+	if err := s.call(ctx, "GetMyLimits"); err != nil {
+		return nil, err
+	}
+	return &pb.UserLimits{MaxActiveBookings: 2}, nil
+}
+
+func (s *fakeServer) GetUserBookings(req *emptypb.Empty, stream pb.BookingService_GetUserBookingsServer) error {
+	if err := s.call(stream.Context(), "GetUserBookings"); err != nil {
+		return err
+	}
+	for _, booking := range s.bookings {
+		if err := stream.Send(booking); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reasonError returns a status error with an ErrorInfo reason and extra details
+func reasonError(code codes.Code, reason string, metadata map[string]string, details ...*errdetails.RetryInfo) error {
+	st, _ := status.New(code, strings.ToLower(reason)).WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: pb.ErrorDomain, Metadata: metadata})
+	for _, detail := range details {
+		st, _ = st.WithDetails(detail)
+	}
+	return st.Err()
+}
+
+// createTestClient serves the fake server over an in-memory listener and dials it
+func createTestClient(t *testing.T, fake *fakeServer, opts ...Option) *Client {
+	fake.failures = make(map[string][]error)
+	fake.calls = make(map[string]int)
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterBookingServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	opts = append(opts, WithDialOptions(grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})))
+	c, err := Dial("bufnet", opts...)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+var fastRetries = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2}
+
+func TestTypedErrors(t *testing.T) {
+	fake := &fakeServer{}
+	c := createTestClient(t, fake, WithRetryPolicy(fastRetries))
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		err  error
+		want error
+	}{
+		{reasonError(codes.AlreadyExists, pb.REASON_SEAT_NOT_AVAILABLE, nil), ErrSeatNotAvailable},
+		{reasonError(codes.NotFound, pb.REASON_SECTION_NOT_FOUND, nil), ErrSectionNotFound},
+		{reasonError(codes.ResourceExhausted, pb.REASON_BOOKING_LIMIT_EXCEEDED, map[string]string{"rule": "active_bookings"}), ErrLimitExceeded},
+		{status.Error(codes.Unauthenticated, "missing token"), ErrUnauthenticated},
+	} {
+		fake.failures["Purchase"] = []error{test.err}
+		_, err := c.Purchase(ctx, &pb.PurchaseRequest{})
+		if !errors.Is(err, test.want) {
+			t.Errorf("Purchase() error = %v, want %v", err, test.want)
+		}
+		// The status is kept for callers inspecting the code
+		if status.Code(err) != status.Code(test.err) {
+			t.Errorf("status.Code() = %v, want %v", status.Code(err), status.Code(test.err))
+		}
+	}
+
+	fake.failures["Purchase"] = []error{reasonError(codes.ResourceExhausted, pb.REASON_BOOKING_LIMIT_EXCEEDED, map[string]string{"rule": "cancellation_cooldown"},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Minute)})}
+	_, err := c.Purchase(ctx, &pb.PurchaseRequest{})
+	var clientErr *Error
+	if !errors.As(err, &clientErr) || clientErr.Rule != "cancellation_cooldown" || clientErr.RetryAfter != time.Minute {
+		t.Errorf("Purchase() error = %#v, want the rule and the retry delay", err)
+	}
+	if fake.calls["Purchase"] != 5 {
+		t.Errorf("Purchase() calls = %v, want no retries", fake.calls["Purchase"])
+	}
+}
+
+func TestRetries(t *testing.T) {
+	fake := &fakeServer{}
+	c := createTestClient(t, fake, WithRetryPolicy(fastRetries))
+	ctx := context.Background()
+
+	// Transient errors and short rate limits are retried
+	fake.failures["GetMyLimits"] = []error{
+		status.Error(codes.Unavailable, "connection reset"),
+		reasonError(codes.ResourceExhausted, pb.REASON_RATE_LIMITED, nil, &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Millisecond)}),
+	}
+	if limits, err := c.GetMyLimits(ctx); err != nil || limits.MaxActiveBookings != 2 {
+		t.Fatalf("GetMyLimits() = %v, %v, want a retried success", limits, err)
+	}
+	if fake.calls["GetMyLimits"] != 3 {
+		t.Errorf("GetMyLimits() calls = %v, want 3", fake.calls["GetMyLimits"])
+	}
+
+	// Rate limits longer than the maximum backoff are returned
+	fake.failures["GetMyLimits"] = []error{reasonError(codes.ResourceExhausted, pb.REASON_RATE_LIMITED, nil, &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Minute)})}
+	if _, err := c.GetMyLimits(ctx); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("GetMyLimits() error = %v, want ErrRateLimited", err)
+	}
+
+	// Attempts run out
+	fake.failures["GetMyLimits"] = []error{status.Error(codes.Unavailable, "1"), status.Error(codes.Unavailable, "2"), status.Error(codes.Unavailable, "3")}
+	if _, err := c.GetMyLimits(ctx); status.Code(err) != codes.Unavailable {
+		t.Errorf("GetMyLimits() error = %v, want Unavailable", err)
+	}
+
+	// Writes are never retried
+	fake.calls["Purchase"] = 0
+	fake.failures["Purchase"] = []error{status.Error(codes.Unavailable, "connection reset")}
+	if _, err := c.Purchase(ctx, &pb.PurchaseRequest{}); status.Code(err) != codes.Unavailable || fake.calls["Purchase"] != 1 {
+		t.Errorf("Purchase() = %v after %v calls, want one Unavailable call", err, fake.calls["Purchase"])
+	}
+}
+
+func TestBookingIterator(t *testing.T) {
+	fake := &fakeServer{bookings: []*pb.Booking{{BookingId: "b1"}, {BookingId: "b2"}}}
+	c := createTestClient(t, fake, WithRetryPolicy(fastRetries), WithToken("token"))
+	ctx := context.Background()
+
+	// A stream failing before the first booking is opened again
+	fake.failures["GetUserBookings"] = []error{status.Error(codes.Unavailable, "connection reset")}
+	bookings, err := c.GetUserBookings(ctx).All()
+	if err != nil || len(bookings) != 2 || bookings[1].BookingId != "b2" {
+		t.Fatalf("GetUserBookings() = %v, %v, want both bookings", bookings, err)
+	}
+	if fake.calls["GetUserBookings"] != 2 {
+		t.Errorf("GetUserBookings() calls = %v, want 2", fake.calls["GetUserBookings"])
+	}
+
+	fake.failures["GetUserBookings"] = []error{status.Error(codes.PermissionDenied, "denied")}
+	it := c.GetUserBookings(ctx)
+	if it.Next() || !errors.Is(it.Err(), ErrPermissionDenied) {
+		t.Errorf("GetUserBookings() error = %v, want ErrPermissionDenied", it.Err())
+	}
+
+	fake.bookings = nil
+	if bookings, err := c.GetUserBookings(ctx).All(); err != nil || len(bookings) != 0 {
+		t.Errorf("GetUserBookings() of no bookings = %v, %v", bookings, err)
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens := FileToken(path)
+	if token, err := tokens.Token(ctx); err != nil || token != "first" {
+		t.Errorf("FileToken() = %q, %v, want first", token, err)
+	}
+	// The rotated token is read when the file changes
+	if err := os.WriteFile(path, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if token, err := tokens.Token(ctx); err != nil || token != "second" {
+		t.Errorf("FileToken() after a rotation = %q, %v, want second", token, err)
+	}
+
+	refreshes := 0
+	tokens = RefreshingToken(func(ctx context.Context) (string, time.Time, error) {
+		refreshes++
+		return "token", time.Now().Add(time.Hour), nil
+	}, time.Minute)
+	for i := 0; i < 3; i++ {
+		tokens.Token(ctx)
+	}
+	if refreshes != 1 {
+		t.Errorf("RefreshingToken() refreshes = %v, want the token cached", refreshes)
+	}
+	tokens = RefreshingToken(func(ctx context.Context) (string, time.Time, error) {
+		refreshes++
+		return "token", time.Now().Add(30 * time.Second), nil
+	}, time.Minute)
+	tokens.Token(ctx)
+	tokens.Token(ctx)
+	if refreshes != 3 {
+		t.Errorf("RefreshingToken() refreshes = %v, want a refresh within the leeway", refreshes)
+	}
+
+	// The token goes in the authorization header, the API key in x-api-key
+	fake := &fakeServer{}
+	c := createTestClient(t, fake, WithTokenSource(StaticToken("jwt")))
+	c.Purchase(ctx, &pb.PurchaseRequest{})
+	c.Purchase(ContextWithToken(ctx, "call"), &pb.PurchaseRequest{})
+	c = createTestClient(t, fake, WithAPIKey("key"))
+	c.Purchase(ctx, &pb.PurchaseRequest{})
+	c = createTestClient(t, fake)
+	c.Purchase(ctx, &pb.PurchaseRequest{})
+	if want := []string{"Bearer jwt", "Bearer call", "key", ""}; !reflect.DeepEqual(fake.authorization, want) {
+		t.Errorf("credentials = %q, want %q", fake.authorization, want)
+	}
+}
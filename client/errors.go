@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Errors returned by the server, match them with errors.Is. They mirror the errors of the
+// datastore, and the limits and authentication of the server.
+var (
+	ErrBookingNotFound  = errors.New("booking not found")
+	ErrSectionIsFull    = errors.New("section is full")
+	ErrSectionNotFound  = errors.New("section not found")
+	ErrSeatNotAvailable = errors.New("seat already allocated")
+	ErrInvalidSeatID    = errors.New("invalid seat id")
+	ErrLimitExceeded    = errors.New("booking limit exceeded")
+	ErrRateLimited      = errors.New("rate limited")
+
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// reasonErrors maps the ErrorInfo reasons of the server to the errors
+var reasonErrors = map[string]error{
+	pb.REASON_BOOKING_NOT_FOUND:      ErrBookingNotFound,
+	pb.REASON_SECTION_IS_FULL:        ErrSectionIsFull,
+	pb.REASON_SECTION_NOT_FOUND:      ErrSectionNotFound,
+	pb.REASON_SEAT_NOT_AVAILABLE:     ErrSeatNotAvailable,
+	pb.REASON_INVALID_SEAT_ID:        ErrInvalidSeatID,
+	pb.REASON_BOOKING_LIMIT_EXCEEDED: ErrLimitExceeded,
+	pb.REASON_RATE_LIMITED:           ErrRateLimited,
+}
+
+// codeErrors maps the status codes that don't need a reason to the errors
+var codeErrors = map[codes.Code]error{
+	codes.Unauthenticated:  ErrUnauthenticated,
+	codes.PermissionDenied: ErrPermissionDenied,
+	codes.Canceled:         context.Canceled,
+	codes.DeadlineExceeded: context.DeadlineExceeded,
+}
+
+// Error is an error returned by the server. It keeps the status, so status.FromError and
+// status.Code still work on it.
+type Error struct {
+	Code    codes.Code
+	Message string
+	// Reason of the ErrorInfo detail, empty when the server sent none
+	Reason string
+	// Rule is the limit that was exceeded: the booking limit, e.g. "active_bookings", or
+	// the rate limited method
+	Rule string
+	// RetryAfter is the delay of the RetryInfo detail, zero when the server sent none
+	RetryAfter time.Duration
+
+	status *status.Status
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+// GRPCStatus returns the status of the error
+func (e *Error) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// Is matches the errors of the package by the reason or the code of the error
+func (e *Error) Is(target error) bool {
+	if err, ok := reasonErrors[e.Reason]; ok && err == target {
+		return true
+	}
+	err, ok := codeErrors[e.Code]
+	return ok && err == target
+}
+
+// convertError converts a status error to an *Error, other errors are returned as they are
+func convertError(err error) error {
+	st, ok := status.FromError(err)
+	if err == nil || !ok {
+		return err
+	}
+	e := &Error{Code: st.Code(), Message: st.Message(), status: st}
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if detail.Domain == pb.ErrorDomain {
+				e.Reason = detail.Reason
+				e.Rule = detail.Metadata["rule"]
+			}
+		case *errdetails.RetryInfo:
+			e.RetryAfter = detail.RetryDelay.AsDuration()
+		}
+	}
+	return e
+}
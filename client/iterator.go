@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// bookingStream is a stream of bookings of GetUserBookings or GetBookingsBySection
+type bookingStream interface {
+	Recv() (*pb.Booking, error)
+}
+
+// BookingIterator reads the bookings of a streaming call
+//
+//	it := c.GetUserBookings(ctx)
+//	defer it.Close()
+//	for it.Next() {
+//		booking := it.Booking()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// The call is retried like the idempotent calls until the first booking is read, a stream
+// failing after that ends the iteration with the error.
+type BookingIterator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	retry  RetryPolicy
+	open   func(ctx context.Context) (bookingStream, error)
+
+	stream  bookingStream
+	booking *pb.Booking
+	err     error
+	done    bool
+}
+
+func newBookingIterator(ctx context.Context, retry RetryPolicy, open func(ctx context.Context) (bookingStream, error)) *BookingIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	return &BookingIterator{ctx: ctx, cancel: cancel, retry: retry, open: open}
+}
+
+// Next reads the next booking, it returns false at the end of the stream or on an error
+func (it *BookingIterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	var err error
+	if it.stream == nil {
+		err = it.retry.do(it.ctx, func() error {
+			stream, err := it.open(it.ctx)
+			if err != nil {
+				return err
+			}
+			booking, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			it.stream, it.booking = stream, booking
+			return nil
+		})
+	} else {
+		it.booking, err = it.stream.Recv()
+	}
+
+	if err != nil {
+		if err != io.EOF {
+			it.err = convertError(err)
+		}
+		it.booking = nil
+		it.Close()
+		return false
+	}
+	return true
+}
+
+// Booking returns the booking read by Next
+func (it *BookingIterator) Booking() *pb.Booking {
+	return it.booking
+}
+
+// Err returns the error that ended the iteration, nil at the end of the stream
+func (it *BookingIterator) Err() error {
+	return it.err
+}
+
+// Close cancels the call when the bookings are not read to the end
+func (it *BookingIterator) Close() {
+	it.done = true
+	it.cancel()
+}
+
+// All reads the remaining bookings
+func (it *BookingIterator) All() ([]*pb.Booking, error) {
+	var bookings []*pb.Booking
+	for it.Next() {
+		bookings = append(bookings, it.Booking())
+	}
+	return bookings, it.Err()
+}
@@ -0,0 +1,219 @@
+// Package profile reads the connection and authentication settings shared by the commands of
+// the booking service, e.g. cmd/client and cmd/tui, from a config file of named profiles, the
+// environment and the flags.
+package profile
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.in/yaml.v3"
+
+	"github.com/13thuser/exampleauth/client"
+)
+
+// DefaultAddress is the address of the server when none is configured
+const DefaultAddress = "localhost:50051"
+
+// Options are the connection and authentication settings of the client. They are read from
+// the profile in the config file, then the environment, then the flags, later ones win.
+type Options struct {
+	Address string `yaml:"address,omitempty"`
+	// Token is a JWT token, sent in the authorization header
+	Token string `yaml:"token,omitempty"`
+	// APIKey is sent in the x-api-key header, it is used when no token is set
+	APIKey string `yaml:"api_key,omitempty"`
+
+	// CAFile enables TLS, the server certificate is verified with the CA bundle
+	CAFile     string `yaml:"ca_file,omitempty"`
+	ServerName string `yaml:"server_name,omitempty"`
+	// CertFile and KeyFile are presented to the server for mutual TLS
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+}
+
+// RegisterFlags defines the flags of the options
+func (o *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Address, "address", "", "server address, BOOKING_ADDRESS or "+DefaultAddress+" by default")
+	flags.StringVar(&o.Token, "token", "", "JWT token, BOOKING_TOKEN by default")
+	flags.StringVar(&o.APIKey, "api-key", "", "API key used when no token is set, BOOKING_API_KEY by default")
+	flags.StringVar(&o.CAFile, "ca-file", "", "CA bundle of the server certificate, enables TLS (TLS_CA_FILE)")
+	flags.StringVar(&o.ServerName, "server-name", "", "name in the server certificate when it differs from the address (TLS_SERVER_NAME)")
+	flags.StringVar(&o.CertFile, "cert-file", "", "client certificate for mutual TLS (TLS_CERT_FILE)")
+	flags.StringVar(&o.KeyFile, "key-file", "", "key of the client certificate (TLS_KEY_FILE)")
+}
+
+// Merge overrides the options with the non-empty fields of other
+func (o *Options) Merge(other Options) {
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&o.Address, other.Address},
+		{&o.Token, other.Token},
+		{&o.APIKey, other.APIKey},
+		{&o.CAFile, other.CAFile},
+		{&o.ServerName, other.ServerName},
+		{&o.CertFile, other.CertFile},
+		{&o.KeyFile, other.KeyFile},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+}
+
+// envOptions reads the options from the environment. The TLS variables are the ones the
+// client used before profiles existed.
+func envOptions() Options {
+	return Options{
+		Address:    os.Getenv("BOOKING_ADDRESS"),
+		Token:      os.Getenv("BOOKING_TOKEN"),
+		APIKey:     os.Getenv("BOOKING_API_KEY"),
+		CAFile:     os.Getenv("TLS_CA_FILE"),
+		ServerName: os.Getenv("TLS_SERVER_NAME"),
+		CertFile:   os.Getenv("TLS_CERT_FILE"),
+		KeyFile:    os.Getenv("TLS_KEY_FILE"),
+	}
+}
+
+// transportCredentials uses TLS when a CA bundle is set, and presents a client certificate
+// for mutual TLS when the certificate and key are set too
+func (o Options) transportCredentials() (credentials.TransportCredentials, error) {
+	if o.CAFile == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	pem, err := os.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", o.CAFile)
+	}
+	config := &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if o.CertFile != "" && o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// ClientOptions returns the options of client.Dial: the transport credentials, and the
+// token or the API key
+func (o Options) ClientOptions() ([]client.Option, error) {
+	creds, err := o.transportCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS: %v", err)
+	}
+	opts := []client.Option{client.WithTransportCredentials(creds)}
+	switch {
+	case o.Token != "":
+		opts = append(opts, client.WithToken(o.Token))
+	case o.APIKey != "":
+		opts = append(opts, client.WithAPIKey(o.APIKey))
+	}
+	return opts, nil
+}
+
+// Config is the config file, a set of named profiles
+//
+//	current_profile: staging
+//	profiles:
+//	  staging:
+//	    address: booking.staging.example.com:443
+//	    ca_file: /etc/ssl/staging-ca.pem
+//	    token: eyJhbGciOi...
+type Config struct {
+	// CurrentProfile is used when no profile is selected, "default" when empty
+	CurrentProfile string             `yaml:"current_profile,omitempty"`
+	Profiles       map[string]Options `yaml:"profiles,omitempty"`
+}
+
+// Path returns the path of the config file, BOOKING_CONFIG overrides the default location
+// in the user's config directory
+func Path() (string, error) {
+	if path := os.Getenv("BOOKING_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the config directory, set BOOKING_CONFIG: %v", err)
+	}
+	return filepath.Join(dir, "booking", "config.yaml"), nil
+}
+
+// Load reads the config file, a missing file is an empty config
+func Load(path string) (*Config, error) {
+	config := &Config{Profiles: make(map[string]Options)}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", path, err)
+	}
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]Options)
+	}
+	return config, nil
+}
+
+// Save writes the config file, it is only readable by the user as it holds credentials
+func (c *Config) Save(path string) error {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	return nil
+}
+
+// Name returns the selected profile: the one asked for, BOOKING_PROFILE, the config's current
+// profile or "default"
+func (c *Config) Name(name string) string {
+	for _, candidate := range []string{name, os.Getenv("BOOKING_PROFILE"), c.CurrentProfile} {
+		if candidate != "" {
+			return candidate
+		}
+	}
+	return "default"
+}
+
+// Resolve merges the profile, the environment and the flags. With mustExist an explicitly
+// selected profile has to be in the config, login creates it instead.
+func (c *Config) Resolve(name string, flags Options, mustExist bool) (Options, error) {
+	selected := c.Name(name)
+	stored, ok := c.Profiles[selected]
+	if !ok && mustExist && (name != "" || os.Getenv("BOOKING_PROFILE") != "") {
+		return Options{}, fmt.Errorf("unknown profile %q", selected)
+	}
+
+	options := Options{Address: DefaultAddress}
+	options.Merge(stored)
+	options.Merge(envOptions())
+	options.Merge(flags)
+	return options, nil
+}
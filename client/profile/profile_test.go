@@ -0,0 +1,43 @@
+package profile
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("BOOKING_PROFILE", "")
+	t.Setenv("BOOKING_ADDRESS", "")
+
+	config := &Config{Profiles: map[string]Options{"staging": {Address: "staging.example.com:443", Token: "token"}}}
+	if err := config.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	config, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	// The profile is the base, the environment and the flags override it
+	options, err := config.Resolve("staging", Options{}, true)
+	if err != nil || options.Address != "staging.example.com:443" || options.Token != "token" {
+		t.Errorf("Resolve() = %+v, %v, want the stored profile", options, err)
+	}
+	t.Setenv("BOOKING_ADDRESS", "env.example.com:443")
+	if options, _ := config.Resolve("staging", Options{}, true); options.Address != "env.example.com:443" {
+		t.Errorf("Resolve() address = %v, want the environment's", options.Address)
+	}
+	if options, _ := config.Resolve("staging", Options{Address: "flag.example.com:443"}, true); options.Address != "flag.example.com:443" {
+		t.Errorf("Resolve() address = %v, want the flag's", options.Address)
+	}
+
+	if _, err := config.Resolve("missing", Options{}, true); err == nil {
+		t.Errorf("Resolve() of a missing profile succeeded")
+	}
+	// Without a profile the default address is used
+	t.Setenv("BOOKING_ADDRESS", "")
+	if options, err := config.Resolve("", Options{}, true); err != nil || options.Address != DefaultAddress {
+		t.Errorf("Resolve() without a profile = %+v, %v, want the default address", options, err)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// RetryPolicy is how the client retries idempotent calls that failed with a transient error
+type RetryPolicy struct {
+	// MaxAttempts counts the first call, 1 disables retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultRetryPolicy is used when no policy is set with WithRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+}
+
+// idempotentMethods are the unary methods that are safe to call again. Purchase, ModifySeat and
+// the other writes are never retried, the first call may have succeeded.
+var idempotentMethods = map[string]bool{
+	"/BookingService/GetMyLimits":    true,
+	"/BookingService/ListAPIKeys":    true,
+	"/BookingService/ListBookings":   true,
+	"/BookingService/SearchBookings": true,
+}
+
+// backoff returns the delay before the retry following the attempt, with full jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		delay *= p.Multiplier
+	}
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retryDelay tells whether the error is transient and how long to wait before the retry.
+// Rate limited calls wait for the delay of the server, as long as it is within MaxBackoff.
+func (p RetryPolicy) retryDelay(err error, attempt int) (time.Duration, bool) {
+	e, ok := convertError(err).(*Error)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case e.Code == codes.Unavailable, e.Code == codes.Aborted:
+		return p.backoff(attempt), true
+	case errors.Is(e, ErrRateLimited):
+		return e.RetryAfter, e.RetryAfter > 0 && e.RetryAfter <= p.MaxBackoff
+	}
+	return 0, false
+}
+
+// do calls call until it succeeds, fails with an error that isn't transient or runs out of
+// attempts
+func (p RetryPolicy) do(ctx context.Context, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= p.MaxAttempts {
+			return err
+		}
+		delay, ok := p.retryDelay(err, attempt)
+		if !ok {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// unaryInterceptor retries the idempotent methods
+func (p RetryPolicy) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if !idempotentMethods[method] {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	return p.do(ctx, func() error {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource returns the JWT token sent with each call
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a token that never changes
+type StaticToken string
+
+func (t StaticToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+// fileToken reads the token from a file, see FileToken
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+// FileToken returns a token source reading the token from a file, e.g. a token mounted by
+// the platform. The file is read again when it changes, so rotated tokens are picked up.
+func FileToken(path string) TokenSource {
+	return &fileToken{path: path}
+}
+
+func (t *fileToken) Token(ctx context.Context) (string, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && info.ModTime().Equal(t.modTime) {
+		return t.token, nil
+	}
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %v", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file %v is empty", t.path)
+	}
+	t.token, t.modTime = token, info.ModTime()
+	return t.token, nil
+}
+
+// RefreshFunc fetches a new token and returns when it expires
+type RefreshFunc func(ctx context.Context) (string, time.Time, error)
+
+// refreshingToken caches the token of a RefreshFunc, see RefreshingToken
+type refreshingToken struct {
+	refresh RefreshFunc
+	leeway  time.Duration
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// RefreshingToken returns a token source caching the token of refresh. A new token is fetched
+// when the cached one expires within leeway, so calls don't race the expiry.
+func RefreshingToken(refresh RefreshFunc, leeway time.Duration) TokenSource {
+	return &refreshingToken{refresh: refresh, leeway: leeway}
+}
+
+func (t *refreshingToken) Token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Add(t.leeway).Before(t.expiresAt) {
+		return t.token, nil
+	}
+	token, expiresAt, err := t.refresh(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh token: %v", err)
+	}
+	t.token, t.expiresAt = token, expiresAt
+	return t.token, nil
+}
+
+// callTokenKey is the context key of the token of ContextWithToken
+type callTokenKey struct{}
+
+// ContextWithToken returns a context whose calls send the token instead of the credentials of
+// the client, e.g. for a service acting for many users over one connection
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, callTokenKey{}, token)
+}
+
+// perRPCCredentials sends the token of the call or the source in the authorization header,
+// or the API key in the x-api-key header when there is no token
+type perRPCCredentials struct {
+	tokens TokenSource
+	apiKey string
+}
+
+func (c perRPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if token, ok := ctx.Value(callTokenKey{}).(string); ok {
+		return map[string]string{"authorization": "Bearer " + token}, nil
+	}
+	switch {
+	case c.tokens == nil && c.apiKey == "":
+		return nil, nil
+	case c.tokens == nil:
+		return map[string]string{"x-api-key": c.apiKey}, nil
+	}
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity is false so the client works with plaintext servers in development,
+// use TLS in production
+func (c perRPCCredentials) RequireTransportSecurity() bool {
+	return false
+}
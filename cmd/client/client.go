@@ -1,144 +1,247 @@
+// Command client is the command line client of the booking service.
+//
+//	client [global flags] <command> [flags] [args]
+//
+// Run "client help" for the commands. Exit status 2 is a usage error, 1 a local error and
+// 100 plus the gRPC status code an error returned by the server, e.g. 116 for Unauthenticated.
 package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
-	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/13thuser/exampleauth/client"
+	"github.com/13thuser/exampleauth/client/profile"
+	"github.com/13thuser/exampleauth/telemetry"
 )
 
-func createJWTToken(subject string, isAdmin bool) (string, error) {
-	// Create the claims for the JWT token
-	claims := jwt.MapClaims{
-		"sub":      subject,
-		"exp":      time.Now().Add(time.Hour).Unix(),
-		"is_admin": isAdmin,
-	}
+// Exit statuses, errors returned by the server exit with EXIT_RPC plus the gRPC status code.
+// EXIT_RPC keeps them clear of the sysexits.h statuses 64 to 78.
+const (
+	EXIT_OK    = 0
+	EXIT_ERROR = 1
+	EXIT_USAGE = 2
+	EXIT_RPC   = 100
+)
 
-	// Create the JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// usageError is an error in the command line
+type usageError struct {
+	error
+}
 
-	// Sign the token with a secret key
-	tokenString, err := token.SignedString([]byte("my-secret-key"))
-	if err != nil {
-		return "", err
-	}
+// usagef returns a usageError
+func usagef(format string, args ...interface{}) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
 
-	return tokenString, nil
+// exitCode maps the error of a command to the exit status
+func exitCode(err error) int {
+	var usage usageError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &usage), errors.Is(err, flag.ErrHelp):
+		return EXIT_USAGE
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.OK {
+		return EXIT_RPC + int(st.Code())
+	}
+	return EXIT_ERROR
 }
 
-func main() {
-	// Create a gRPC client
-	// conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
-	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+// describeError formats an error for the user, errors of the server show their code and
+// the details telling when to retry
+func describeError(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err.Error()
+	}
+	description := fmt.Sprintf("%v: %v", st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.RetryInfo:
+			description += fmt.Sprintf(" (retry in %v)", detail.RetryDelay.AsDuration().Round(time.Second))
+		case *errdetails.QuotaFailure:
+			for _, violation := range detail.Violations {
+				description += fmt.Sprintf("\n  %v: %v", violation.Subject, violation.Description)
+			}
+		}
 	}
-	defer conn.Close()
+	return description
+}
 
-	// Create a new instance of the gRPC client
-	c := pb.NewBookingServiceClient(conn)
+// command is a subcommand of the client
+type command struct {
+	name    string
+	args    string
+	summary string
+	// run parses the flags of the command and calls the server
+	run func(a *app, cmd *command, args []string) error
+}
 
-	// Prepare the JWT token
-	token, err := createJWTToken("test@example.com", true)
-	if err != nil {
-		log.Fatalf("Failed to create JWT token: %v", err)
-	}
+// commands of the client, see commands.go
+var commands = []*command{
+	purchaseCommand,
+	listMineCommand,
+	listSectionCommand,
+	searchCommand,
+	cancelCommand,
+	modifySeatCommand,
+	seatMapCommand,
+	loginCommand,
+}
 
-	// Create a new context with the JWT token as metadata
-	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", token))
-
-	response, err := c.Purchase(ctx, &pb.PurchaseRequest{
-		User: &pb.User{
-			EmailAddress: "test@example.com",
-			FirstName:    "test",
-			LastName:     "user",
-		},
-		Seat: &pb.Seat{
-			SectionId: "A",
-			SeatId:    "1",
-		},
-	})
-	if err != nil {
-		// Handle error
-		statusErr, ok := status.FromError(err)
-		if ok && statusErr.Code() == codes.Unauthenticated {
-			log.Fatalf("Authentication failed: %v", err)
-		} else {
-			log.Fatalf("RPC error: %v", err)
+// app holds the state shared by the commands
+type app struct {
+	options    profile.Options
+	profile    string
+	config     *profile.Config
+	configPath string
+	// flagOptions are the options set on the command line, login stores them in the profile
+	flagOptions profile.Options
+	timeout     time.Duration
+
+	out    *printer
+	stdin  io.Reader
+	stderr io.Writer
+
+	ctx  context.Context
+	conn *client.Client
+}
+
+// connect connects to the server on first use, the calls send the token or the API key
+func (a *app) connect() (*client.Client, error) {
+	if a.conn == nil {
+		opts, err := a.options.ClientOptions()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithDialOptions(grpc.WithStatsHandler(otelgrpc.NewClientHandler())))
+		if a.conn, err = client.Dial(a.options.Address, opts...); err != nil {
+			return nil, err
 		}
 	}
+	return a.conn, nil
+}
 
-	// Process the response
-	log.Printf("Response: %v", response)
-
-	stream, err := c.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: "A"})
-	if err != nil {
-		log.Fatalf("Failed to get bookings by section: %v", err)
+// callContext returns the context of a call with the timeout
+func (a *app) callContext() (context.Context, context.CancelFunc) {
+	if a.timeout <= 0 {
+		return context.WithCancel(a.ctx)
 	}
-	for {
-		response, err := stream.Recv()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("Failed to receive a response: %v", err)
-		}
-		log.Printf("Received streaming message: %v\n", response)
+	return context.WithTimeout(a.ctx, a.timeout)
+}
+
+// close closes the connection
+func (a *app) close() {
+	if a.conn != nil {
+		a.conn.Close()
 	}
+}
 
-	// Remove the user from the train
-	// Create a new context with the JWT token as metadata
-	ctx = metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", token))
+// usage prints the global flags and the commands
+func usage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %v [global flags] <command> [flags] [args]\n\nCommands:\n", flags.Name())
+	sorted := append([]*command(nil), commands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range sorted {
+		summary, _, _ := strings.Cut(cmd.summary, ". ")
+		fmt.Fprintf(tw, "  %v\t%v\n", cmd.name, strings.TrimSuffix(summary, "."))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+	fmt.Fprintf(w, "\nRun \"%v <command> -h\" for the flags of a command.\n", flags.Name())
+}
 
-	bookingID := response.BookingId
-	if _, err := c.RemoveUserFromTrain(ctx, &pb.RemoveBookingRequest{BookingId: bookingID}); err != nil {
-		log.Fatalf("Failed to remove user from train: %v", err)
+// run parses the global flags and runs the command, it returns the exit status
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	a := &app{ctx: ctx, stdin: stdin, stderr: stderr}
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&a.profile, "profile", "", "profile of the config file, BOOKING_PROFILE or the current profile by default")
+	a.flagOptions.RegisterFlags(flags)
+	output := flags.String("o", OUTPUT_TABLE, "output format: table, json or yaml")
+	flags.DurationVar(&a.timeout, "timeout", 30*time.Second, "timeout of each call, 0 disables it")
+
+	if err := flags.Parse(args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(stderr, "error: %v\n\n", err)
+		}
+		usage(stderr, flags)
+		return EXIT_USAGE
 	}
-	log.Printf("Removed user from train: %v", bookingID)
-
-	response, err = c.Purchase(ctx, &pb.PurchaseRequest{
-		User: &pb.User{
-			EmailAddress: "test@example.com",
-			FirstName:    "test",
-			LastName:     "user",
-		},
-		Seat: &pb.Seat{
-			SectionId: "A",
-			SeatId:    "2",
-		},
-	})
-	if err != nil {
-		// Handle error
-		statusErr, ok := status.FromError(err)
-		if ok && statusErr.Code() == codes.Unauthenticated {
-			log.Fatalf("Authentication failed: %v", err)
-		} else {
-			log.Fatalf("RPC error: %v", err)
+	if flags.NArg() == 0 || flags.Arg(0) == "help" {
+		usage(stderr, flags)
+		if flags.NArg() == 0 {
+			return EXIT_USAGE
 		}
+		return EXIT_OK
 	}
 
-	// Process the response
-	log.Printf("Response: %v", response)
+	var cmd *command
+	for _, candidate := range commands {
+		if candidate.name == flags.Arg(0) {
+			cmd = candidate
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "error: unknown command %q\n\n", flags.Arg(0))
+		usage(stderr, flags)
+		return EXIT_USAGE
+	}
+
+	err := func() error {
+		var err error
+		if a.out, err = newPrinter(stdout, *output); err != nil {
+			return usageError{err}
+		}
+		if a.configPath, err = profile.Path(); err != nil {
+			return err
+		}
+		if a.config, err = profile.Load(a.configPath); err != nil {
+			return err
+		}
+		if a.options, err = a.config.Resolve(a.profile, a.flagOptions, cmd != loginCommand); err != nil {
+			return usageError{err}
+		}
+		defer a.close()
+		return cmd.run(a, cmd, flags.Args()[1:])
+	}()
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(stderr, "error: %v\n", describeError(err))
+	}
+	return exitCode(err)
+}
 
-	bookingID = response.BookingId
-	// Modify seat
-	response, err = c.ModifySeat(ctx, &pb.ModifySeatRequest{
-		BookingId:    bookingID,
-		NewSeatId:    "3",
-		NewSectionId: "A",
-	})
+func main() {
+	// Trace the calls and propagate the trace context to the server
+	shutdownTracing, err := telemetry.Setup(context.Background(), "booking-client")
 	if err != nil {
-		log.Fatalf("Failed to modify seat: %v", err)
+		fmt.Fprintf(os.Stderr, "error: failed to set up tracing: %v\n", err)
+		os.Exit(EXIT_ERROR)
 	}
-	log.Printf("Modified seat: %v", response)
+	ctx, span := otel.Tracer("github.com/13thuser/exampleauth/cmd/client").Start(context.Background(), "booking-client")
 
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	span.End()
+	shutdownTracing(context.Background())
+	os.Exit(code)
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/client/profile"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// fakeServer answers the calls of the commands and records the authorization metadata
+type fakeServer struct {
+	pb.UnimplementedBookingServiceServer
+	bookings      []*pb.Booking
+	authorization []string
+}
+
+func (s *fakeServer) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.authorization = append(s.authorization, strings.Join(md.Get("authorization"), ","))
+}
+
+func (s *fakeServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
+	s.record(ctx)
+	booking := &pb.Booking{BookingId: "b1", User: req.User, Seat: req.Seat, PricePaid: 20, Purchaser: req.User.EmailAddress}
+	s.bookings = append(s.bookings, booking)
+	return booking, nil
+}
+
+func (s *fakeServer) GetBookingsBySection(req *pb.GetBookingsBySectionRequest, stream pb.BookingService_GetBookingsBySectionServer) error {
+	s.record(stream.Context())
+	for _, booking := range s.bookings {
+		if booking.Seat.SectionId == req.Section {
+			if err := stream.Send(booking); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) SearchBookings(ctx context.Context, req *pb.SearchBookingsRequest) (*pb.SearchBookingsResponse, error) {
+	s.record(ctx)
+	resp := &pb.SearchBookingsResponse{}
+	for _, booking := range s.bookings {
+		if strings.HasPrefix(booking.User.FirstName, req.Query) && booking.Seat.SectionId == req.Seat.GetSectionId() {
+			resp.Bookings = append(resp.Bookings, booking)
+		}
+	}
+	return resp, nil
+}
+
+func (s *fakeServer) RemoveUserFromTrain(ctx context.Context, req *pb.RemoveBookingRequest) (*emptypb.Empty, error) {
+	s.record(ctx)
+	return nil, status.Errorf(codes.NotFound, "booking %v not found", req.BookingId)
+}
+
+// runClient runs the client with the arguments and returns the exit status and the output
+func runClient(t *testing.T, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	t.Setenv("BOOKING_CONFIG", filepath.Join(t.TempDir(), "config.yaml"))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := grpc.NewServer()
+	fake := &fakeServer{}
+	pb.RegisterBookingServiceServer(srv, fake)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user@example.com"}).SignedString([]byte("key"))
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+
+	// The passenger defaults to the token's subject
+	code, stdout, stderr := runClient(t, "-address", lis.Addr().String(), "-token", token, "-o", "json",
+		"purchase", "-section", "A", "-seat", "3", "-first", "john")
+	if code != EXIT_OK {
+		t.Fatalf("purchase exit = %v, stderr %v", code, stderr)
+	}
+	var booking struct {
+		BookingID string `json:"bookingId"`
+		User      struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &booking); err != nil || booking.BookingID != "b1" || booking.User.EmailAddress != "user@example.com" {
+		t.Errorf("purchase output = %s, %v", stdout, err)
+	}
+	if fake.authorization[0] != "Bearer "+token {
+		t.Errorf("authorization = %q, want the bearer token", fake.authorization[0])
+	}
+
+	// Tables and YAML
+	code, stdout, _ = runClient(t, "-address", lis.Addr().String(), "list-section", "A")
+	if code != EXIT_OK || !strings.Contains(stdout, "BOOKING ID") || !strings.Contains(stdout, "user@example.com") {
+		t.Errorf("list-section = %v, %q", code, stdout)
+	}
+	code, stdout, _ = runClient(t, "-address", lis.Addr().String(), "search", "jo", "-section", "A")
+	if code != EXIT_OK || !strings.Contains(stdout, "b1") {
+		t.Errorf("search = %v, %q", code, stdout)
+	}
+	code, stdout, _ = runClient(t, "-address", lis.Addr().String(), "-o", "yaml", "seat-map", "-size", "4", "A")
+	if code != EXIT_OK || !strings.Contains(stdout, "section: A") || !strings.Contains(stdout, "bookingId: b1") {
+		t.Errorf("seat-map yaml = %v, %q", code, stdout)
+	}
+	code, stdout, _ = runClient(t, "-address", lis.Addr().String(), "seat-map", "-size", "4", "A")
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); code != EXIT_OK || len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != "A 3 . . X ." {
+		t.Errorf("seat-map table = %v, %q", code, stdout)
+	}
+
+	// Errors of the server exit with 100 plus their status code, 5 for NotFound
+	code, _, stderr = runClient(t, "-address", lis.Addr().String(), "cancel", "missing")
+	if code != 105 || !strings.Contains(stderr, "NotFound") {
+		t.Errorf("cancel of a missing booking = %v, %q", code, stderr)
+	}
+
+	// Usage errors
+	for _, args := range [][]string{
+		{"unknown"},
+		{"cancel"},
+		{"search", "-limit", "5"},
+		{"modify-seat", "b1", "-seat", "2"},
+		{"-o", "xml", "list-mine"},
+		{"-profile", "missing", "list-mine"},
+	} {
+		if code, _, _ := runClient(t, args...); code != EXIT_USAGE {
+			t.Errorf("%v exit = %v, want %v", args, code, EXIT_USAGE)
+		}
+	}
+}
+
+func TestLoginProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("BOOKING_CONFIG", path)
+	t.Setenv("BOOKING_PROFILE", "")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "user@example.com",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("key"))
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+	if code, _, stderr := runClient(t, "-profile", "staging", "-address", "staging.example.com:443", "login", "-token", token); code != EXIT_OK || !strings.Contains(stderr, "user@example.com") {
+		t.Fatalf("login exit = %v, %v", code, stderr)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("config file mode = %v, %v, want 0600", info, err)
+	}
+
+	config, err := profile.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if config.CurrentProfile != "staging" {
+		t.Errorf("CurrentProfile = %q, want the first profile logged in to", config.CurrentProfile)
+	}
+	if stored := config.Profiles["staging"]; stored.Address != "staging.example.com:443" || stored.Token != token {
+		t.Errorf("stored profile = %+v, want the address and the token", stored)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// newFlagSet creates the flag set of a command, -h prints its usage
+func newFlagSet(a *app, cmd *command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(a.stderr, "Usage: client %v %v\n\n%v\n", cmd.name, cmd.args, cmd.summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses flags before and after the arguments, e.g. "modify-seat <id> -seat 3", and
+// checks the number of arguments
+func parseFlags(flags *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, usageError{err}
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) < minArgs || (maxArgs >= 0 && len(positional) > maxArgs) {
+		flags.Usage()
+		return nil, usagef("%v: wrong number of arguments", flags.Name())
+	}
+	return positional, nil
+}
+
+// required checks that the flags are set
+func required(flags *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if flags.Lookup(name).Value.String() == "" {
+			return usagef("%v: -%v is required", flags.Name(), name)
+		}
+	}
+	return nil
+}
+
+// tokenSubject returns the subject of the token without verifying it, the server does that
+func tokenSubject(token string) (string, time.Time) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return "", time.Time{}
+	}
+	subject, _ := claims["sub"].(string)
+	var expiresAt time.Time
+	if exp, ok := claims["exp"].(float64); ok {
+		expiresAt = time.Unix(int64(exp), 0)
+	}
+	return subject, expiresAt
+}
+
+var purchaseCommand = &command{
+	name:    "purchase",
+	args:    "-section <section> -seat <seat> [-email <email>] [-first <name>] [-last <name>]",
+	summary: "Buy a ticket for a seat. The email defaults to the logged in user, guests book without a token.",
+	run:     runPurchase,
+}
+
+func runPurchase(a *app, cmd *command, args []string) error {
+	flags := newFlagSet(a, cmd)
+	email := flags.String("email", "", "email address of the passenger, the token's user by default")
+	first := flags.String("first", "", "first name of the passenger")
+	last := flags.String("last", "", "last name of the passenger")
+	section := flags.String("section", "", "section of the seat")
+	seat := flags.String("seat", "", "seat number")
+	if _, err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if *email == "" {
+		*email, _ = tokenSubject(a.options.Token)
+	}
+	if err := required(flags, "email", "section", "seat"); err != nil {
+		return err
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	booking, err := c.Purchase(ctx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: *email, FirstName: *first, LastName: *last},
+		Seat: &pb.Seat{SectionId: *section, SeatId: *seat},
+	})
+	if err != nil {
+		return err
+	}
+	return a.out.booking(booking)
+}
+
+var listMineCommand = &command{
+	name:    "list-mine",
+	summary: "List the bookings of the logged in user.",
+	run:     runListMine,
+}
+
+func runListMine(a *app, cmd *command, args []string) error {
+	if _, err := parseFlags(newFlagSet(a, cmd), args, 0, 0); err != nil {
+		return err
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	bookings, err := c.GetUserBookings(ctx).All()
+	if err != nil {
+		return err
+	}
+	return a.out.bookings(bookings)
+}
+
+var listSectionCommand = &command{
+	name:    "list-section",
+	args:    "<section>",
+	summary: "List the bookings of a section, admins only.",
+	run:     runListSection,
+}
+
+func runListSection(a *app, cmd *command, args []string) error {
+	positional, err := parseFlags(newFlagSet(a, cmd), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	bookings, err := c.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: positional[0]}).All()
+	if err != nil {
+		return err
+	}
+	return a.out.bookings(bookings)
+}
+
+var searchCommand = &command{
+	name:    "search",
+	args:    "[-id <prefix>] [-section <section> [-seat <seat>]] [-limit <n>] [<name or email>...]",
+	summary: "Search the active bookings by passenger name or email, booking id prefix or seat, agents and admins only.",
+	run:     runSearch,
+}
+
+func runSearch(a *app, cmd *command, args []string) error {
+	flags := newFlagSet(a, cmd)
+	id := flags.String("id", "", "start of the booking id")
+	section := flags.String("section", "", "section of the seat")
+	seat := flags.String("seat", "", "seat number, with -section")
+	limit := flags.Int("limit", 0, "maximum number of bookings, 20 by default")
+	words, err := parseFlags(flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 && *id == "" && *section == "" {
+		flags.Usage()
+		return usagef("%v: a name, an email, -id or -section is required", cmd.name)
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	req := &pb.SearchBookingsRequest{Query: strings.Join(words, " "), BookingIdPrefix: *id, Limit: int32(*limit)}
+	if *section != "" || *seat != "" {
+		req.Seat = &pb.Seat{SectionId: *section, SeatId: *seat}
+	}
+	bookings, err := c.SearchBookings(ctx, req)
+	if err != nil {
+		return err
+	}
+	return a.out.bookings(bookings)
+}
+
+var cancelCommand = &command{
+	name:    "cancel",
+	args:    "<booking-id>",
+	summary: "Cancel a booking and free its seat.",
+	run:     runCancel,
+}
+
+func runCancel(a *app, cmd *command, args []string) error {
+	positional, err := parseFlags(newFlagSet(a, cmd), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	if err := c.RemoveUserFromTrain(ctx, &pb.RemoveBookingRequest{BookingId: positional[0]}); err != nil {
+		return err
+	}
+	if a.out.format != OUTPUT_TABLE {
+		return a.out.encode([]byte(fmt.Sprintf(`{"bookingId": %q, "cancelled": true}`, positional[0])))
+	}
+	_, err = fmt.Fprintf(a.out.w, "Cancelled booking %v\n", positional[0])
+	return err
+}
+
+var modifySeatCommand = &command{
+	name:    "modify-seat",
+	args:    "<booking-id> -section <section> -seat <seat>",
+	summary: "Move a booking to another seat.",
+	run:     runModifySeat,
+}
+
+func runModifySeat(a *app, cmd *command, args []string) error {
+	flags := newFlagSet(a, cmd)
+	section := flags.String("section", "", "section of the new seat")
+	seat := flags.String("seat", "", "number of the new seat")
+	positional, err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := required(flags, "section", "seat"); err != nil {
+		return err
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	booking, err := c.ModifySeat(ctx, &pb.ModifySeatRequest{BookingId: positional[0], NewSectionId: *section, NewSeatId: *seat})
+	if err != nil {
+		return err
+	}
+	return a.out.booking(booking)
+}
+
+var seatMapCommand = &command{
+	name:    "seat-map",
+	args:    "[-size <seats>] [section...]",
+	summary: "Show the free and taken seats of the sections, admins only.",
+	run:     runSeatMap,
+}
+
+func runSeatMap(a *app, cmd *command, args []string) error {
+	flags := newFlagSet(a, cmd)
+	size := flags.Int("size", 10, "number of seats per section")
+	sections, err := parseFlags(flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if len(sections) == 0 {
+		sections = []string{"A", "B"}
+	}
+
+	c, err := a.connect()
+	if err != nil {
+		return err
+	}
+	var seatMaps []SeatMap
+	for _, section := range sections {
+		ctx, cancel := a.callContext()
+		bookings, err := c.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: section}).All()
+		cancel()
+		if err != nil {
+			return err
+		}
+		seatMaps = append(seatMaps, newSeatMap(section, *size, bookings))
+	}
+	return a.out.seatMaps(seatMaps)
+}
+
+var loginCommand = &command{
+	name:    "login",
+	args:    "-token <token> | -api-key <key> | -email <email>",
+	summary: "Store credentials and the connection flags in the profile. With -email a booking access token is sent to the address and exchanged for a session.",
+	run:     runLogin,
+}
+
+func runLogin(a *app, cmd *command, args []string) error {
+	flags := newFlagSet(a, cmd)
+	token := flags.String("token", "", "JWT token to store")
+	apiKey := flags.String("api-key", "", "API key to store")
+	email := flags.String("email", "", "email address to request a booking access token for")
+	if _, err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	set := 0
+	for _, value := range []string{*token, *apiKey, *email} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		flags.Usage()
+		return usagef("login: set one of -token, -api-key or -email")
+	}
+
+	if *email != "" {
+		session, err := a.redeemBookingAccess(*email)
+		if err != nil {
+			return err
+		}
+		*token = session.Token
+	}
+
+	name := a.config.Name(a.profile)
+	stored := a.config.Profiles[name]
+	stored.Merge(a.flagOptions)
+	stored.Token, stored.APIKey = *token, *apiKey
+	a.config.Profiles[name] = stored
+	if a.config.CurrentProfile == "" {
+		a.config.CurrentProfile = name
+	}
+	if err := a.config.Save(a.configPath); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Stored the API key in profile %q", name)
+	if *token != "" {
+		subject, expiresAt := tokenSubject(*token)
+		message = fmt.Sprintf("Logged in as %v in profile %q", subject, name)
+		if !expiresAt.IsZero() {
+			message += fmt.Sprintf(", the token expires at %v", expiresAt.Local().Format(time.DateTime))
+		}
+	}
+	_, err := fmt.Fprintln(a.stderr, message)
+	return err
+}
+
+// redeemBookingAccess asks the server to email a booking access token to the address, reads
+// the token from stdin and exchanges it for a session
+func (a *app) redeemBookingAccess(email string) (*pb.BookingAccessSession, error) {
+	c, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := a.callContext()
+	defer cancel()
+	if err := c.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: email}); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(a.stderr, "If %v has bookings an access token was sent to it. Access token: ", email)
+	line, err := bufio.NewReader(a.stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, fmt.Errorf("failed to read the access token: %v", err)
+	}
+
+	ctx, cancel = a.callContext()
+	defer cancel()
+	return c.RedeemBookingAccess(ctx, &pb.RedeemBookingAccessRequest{AccessToken: strings.TrimSpace(line)})
+}
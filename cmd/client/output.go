@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Output formats of the -o flag
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+	OUTPUT_YAML  = "yaml"
+)
+
+// printer writes the results of the commands in the selected format. JSON and YAML use the
+// proto JSON mapping, the same field names as the REST gateway.
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+// newPrinter checks the format
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_YAML:
+		return &printer{w: w, format: format}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, want table, json or yaml", format)
+}
+
+// encode writes a value that is already in its JSON form as JSON or YAML
+func (p *printer) encode(value json.RawMessage) error {
+	if p.format == OUTPUT_JSON {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, value, "", "  "); err != nil {
+			return err
+		}
+		indented.WriteByte('\n')
+		_, err := p.w.Write(indented.Bytes())
+		return err
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(value, &generic); err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	_, err = p.w.Write(content)
+	return err
+}
+
+// messages converts protos to a JSON array
+func messages[M proto.Message](msgs []M) (json.RawMessage, error) {
+	items := make([]json.RawMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		item, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return json.Marshal(items)
+}
+
+// message writes a single proto, tables are written by the caller
+func (p *printer) message(msg proto.Message) error {
+	content, err := protojson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.encode(content)
+}
+
+// bookings writes a list of bookings, a table has one row per booking
+func (p *printer) bookings(bookings []*pb.Booking) error {
+	if p.format != OUTPUT_TABLE {
+		content, err := messages(bookings)
+		if err != nil {
+			return err
+		}
+		return p.encode(content)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BOOKING ID\tPASSENGER\tEMAIL\tSECTION\tSEAT\tPRICE\tDEPARTURE")
+	for _, booking := range bookings {
+		departure := ""
+		if booking.Departure != nil {
+			departure = booking.Departure.AsTime().Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%.2f\t%v\n",
+			booking.BookingId,
+			strings.TrimSpace(booking.GetUser().GetFirstName()+" "+booking.GetUser().GetLastName()),
+			booking.GetUser().GetEmailAddress(),
+			booking.GetSeat().GetSectionId(),
+			booking.GetSeat().GetSeatId(),
+			booking.PricePaid,
+			departure)
+	}
+	return tw.Flush()
+}
+
+// booking writes a single booking
+func (p *printer) booking(booking *pb.Booking) error {
+	if p.format != OUTPUT_TABLE {
+		return p.message(booking)
+	}
+	return p.bookings([]*pb.Booking{booking})
+}
+
+// SeatMap is the occupancy of the seats of one section
+type SeatMap struct {
+	Section string       `json:"section"`
+	Seats   []SeatStatus `json:"seats"`
+}
+
+// SeatStatus tells whether a seat is taken and by which booking
+type SeatStatus struct {
+	Seat      string `json:"seat"`
+	Taken     bool   `json:"taken"`
+	BookingID string `json:"bookingId,omitempty"`
+}
+
+// newSeatMap marks the seats 1 to size of the section that are taken by the bookings.
+// Bookings of seats outside the range are added at the end.
+func newSeatMap(section string, size int, bookings []*pb.Booking) SeatMap {
+	taken := make(map[string]string)
+	for _, booking := range bookings {
+		taken[booking.GetSeat().GetSeatId()] = booking.BookingId
+	}
+
+	seatMap := SeatMap{Section: section}
+	for i := 1; i <= size; i++ {
+		seat := strconv.Itoa(i)
+		bookingID, ok := taken[seat]
+		seatMap.Seats = append(seatMap.Seats, SeatStatus{Seat: seat, Taken: ok, BookingID: bookingID})
+		delete(taken, seat)
+	}
+	for _, booking := range bookings {
+		if bookingID, ok := taken[booking.GetSeat().GetSeatId()]; ok {
+			seatMap.Seats = append(seatMap.Seats, SeatStatus{Seat: booking.GetSeat().GetSeatId(), Taken: true, BookingID: bookingID})
+		}
+	}
+	return seatMap
+}
+
+// seatMaps writes the seat maps, a table has a row per section with X for taken seats
+//
+//	SECTION  FREE  1  2  3  4
+//	A        2     X  .  .  X
+func (p *printer) seatMaps(seatMaps []SeatMap) error {
+	if p.format != OUTPUT_TABLE {
+		content, err := json.Marshal(seatMaps)
+		if err != nil {
+			return err
+		}
+		return p.encode(content)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	for i, seatMap := range seatMaps {
+		if i == 0 || len(seatMap.Seats) != len(seatMaps[i-1].Seats) {
+			header := []string{"SECTION", "FREE"}
+			for _, seat := range seatMap.Seats {
+				header = append(header, seat.Seat)
+			}
+			fmt.Fprintln(tw, strings.Join(header, "\t"))
+		}
+
+		free := 0
+		row := []string{seatMap.Section, ""}
+		for _, seat := range seatMap.Seats {
+			if seat.Taken {
+				row = append(row, "X")
+			} else {
+				row = append(row, ".")
+				free++
+			}
+		}
+		row[1] = strconv.Itoa(free)
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Operations of the generated load, the weights of the mix are set by operation
+const (
+	OP_PURCHASE         = "purchase"
+	OP_USER_BOOKINGS    = "user-bookings"
+	OP_SECTION_BOOKINGS = "section-bookings"
+	OP_MODIFY_SEAT      = "modify-seat"
+	OP_CANCEL           = "cancel"
+)
+
+// opMethods maps the operations to the RPC they call
+var opMethods = map[string]string{
+	OP_PURCHASE:         "Purchase",
+	OP_USER_BOOKINGS:    "GetUserBookings",
+	OP_SECTION_BOOKINGS: "GetBookingsBySection",
+	OP_MODIFY_SEAT:      "ModifySeat",
+	OP_CANCEL:           "RemoveUserFromTrain",
+}
+
+// replayMethods are the RPCs that can be replayed, with the type of their request
+var replayMethods = map[string]func() proto.Message{
+	"Purchase":             func() proto.Message { return &pb.PurchaseRequest{} },
+	"GetUserBookings":      func() proto.Message { return &emptypb.Empty{} },
+	"GetBookingsBySection": func() proto.Message { return &pb.GetBookingsBySectionRequest{} },
+	"ModifySeat":           func() proto.Message { return &pb.ModifySeatRequest{} },
+	"RemoveUserFromTrain":  func() proto.Message { return &pb.RemoveBookingRequest{} },
+	"GetMyLimits":          func() proto.Message { return &emptypb.Empty{} },
+}
+
+// adminMethods need an admin token
+var adminMethods = map[string]bool{
+	"GetBookingsBySection": true,
+}
+
+// call is a call made by a virtual user. Generated calls only have the method, the virtual user
+// makes up the request. Replayed calls have the recorded request and run as the recorded subject.
+type call struct {
+	method  string
+	req     proto.Message
+	subject string
+}
+
+// mix is the weighted set of operations of the generated load
+type mix []struct {
+	op     string
+	weight int
+}
+
+// parseMix parses a mix written as "<operation>=<weight>,...", e.g. "purchase=4,cancel=1"
+func parseMix(value string) (mix, error) {
+	var m mix
+	total := 0
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		op, weightValue, _ := strings.Cut(entry, "=")
+		weight, err := strconv.Atoi(weightValue)
+		if _, ok := opMethods[op]; !ok || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid mix entry %q, want <operation>=<weight> with operation one of %v", entry, strings.Join(mixOps(), ", "))
+		}
+		m = append(m, struct {
+			op     string
+			weight int
+		}{op, weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("the mix %q has no operations", value)
+	}
+	return m, nil
+}
+
+// mixOps lists the operations of a mix
+func mixOps() []string {
+	return []string{OP_PURCHASE, OP_USER_BOOKINGS, OP_SECTION_BOOKINGS, OP_MODIFY_SEAT, OP_CANCEL}
+}
+
+// weight returns the weight of an operation
+func (m mix) weight(op string) int {
+	for _, entry := range m {
+		if entry.op == op {
+			return entry.weight
+		}
+	}
+	return 0
+}
+
+// pick returns the method of an operation picked by weight
+func (m mix) pick(r *rand.Rand) string {
+	total := 0
+	for _, entry := range m {
+		total += entry.weight
+	}
+	n := r.Intn(total)
+	for _, entry := range m {
+		if n < entry.weight {
+			return opMethods[entry.op]
+		}
+		n -= entry.weight
+	}
+	return opMethods[m[len(m)-1].op]
+}
+
+// recordedCall is a line of a recorded request file. The JSON log lines of the server at debug
+// level are recorded calls, the request is then a string of JSON:
+//
+//	{"msg":"rpc","method":"/BookingService/ModifySeat","subject":"sub-9f86d081884c7d65","request":"{\"bookingId\":\"...\"}"}
+//	{"method":"Purchase","request":{"user":{"emailAddress":"john@example.com"},"seat":{"sectionId":"A","seatId":"3"}}}
+type recordedCall struct {
+	Method  string          `json:"method"`
+	Subject string          `json:"subject"`
+	Request json.RawMessage `json:"request"`
+}
+
+// readReplay reads the calls of a recorded request file. Lines that are not calls of a method
+// that can be replayed are skipped and counted.
+func readReplay(r io.Reader) ([]call, int, error) {
+	var calls []call
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		c, err := parseRecordedCall(scanner.Bytes())
+		if err != nil {
+			skipped++
+			continue
+		}
+		calls = append(calls, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, fmt.Errorf("failed to read the recorded calls: %v", err)
+	}
+	return calls, skipped, nil
+}
+
+// parseRecordedCall parses a line of a recorded request file
+func parseRecordedCall(line []byte) (call, error) {
+	var recorded recordedCall
+	if err := json.Unmarshal(line, &recorded); err != nil {
+		return call{}, err
+	}
+	method := recorded.Method[strings.LastIndex(recorded.Method, "/")+1:]
+	newRequest, ok := replayMethods[method]
+	if !ok {
+		return call{}, fmt.Errorf("method %q can't be replayed", recorded.Method)
+	}
+
+	req := newRequest()
+	request := []byte(recorded.Request)
+	var logged string
+	if json.Unmarshal(recorded.Request, &logged) == nil {
+		request = []byte(logged)
+	}
+	if len(request) > 0 {
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(request, req); err != nil {
+			return call{}, fmt.Errorf("invalid request of %v: %v", method, err)
+		}
+	}
+	return call{method: method, req: req, subject: recorded.Subject}, nil
+}
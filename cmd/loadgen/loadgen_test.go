@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/client"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// fakeServer books the seats in memory and records the subject and roles of the calls
+type fakeServer struct {
+	pb.UnimplementedBookingServiceServer
+
+	mu       sync.Mutex
+	seats    map[string]string
+	next     int
+	subjects map[string]bool
+	admins   map[string]bool
+}
+
+// caller records the subject of the call's token and whether it is an admin
+func (s *fakeServer) caller(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	claims := jwt.MapClaims{}
+	if values := md.Get("authorization"); len(values) > 0 {
+		jwt.ParseWithClaims(strings.TrimPrefix(values[0], "Bearer "), claims, func(*jwt.Token) (interface{}, error) { return []byte("secret"), nil })
+	}
+	subject, _ := claims["sub"].(string)
+	roles, _ := claims["roles"].([]interface{})
+	s.subjects[subject] = true
+	if len(roles) > 0 && roles[0] == "admin" {
+		s.admins[subject] = true
+	}
+}
+
+func (s *fakeServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caller(ctx)
+	seat := req.Seat.SectionId + req.Seat.SeatId
+	if _, ok := s.seats[seat]; ok {
+		st, _ := status.New(codes.AlreadyExists, "seat already allocated").WithDetails(&errdetails.ErrorInfo{Reason: pb.REASON_SEAT_NOT_AVAILABLE, Domain: pb.ErrorDomain})
+		return nil, st.Err()
+	}
+	s.next++
+	s.seats[seat] = fmt.Sprintf("b%d", s.next)
+	return &pb.Booking{BookingId: s.seats[seat], User: req.User, Seat: req.Seat}, nil
+}
+
+func (s *fakeServer) GetUserBookings(req *emptypb.Empty, stream pb.BookingService_GetUserBookingsServer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caller(stream.Context())
+	return nil
+}
+
+func (s *fakeServer) GetBookingsBySection(req *pb.GetBookingsBySectionRequest, stream pb.BookingService_GetBookingsBySectionServer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caller(stream.Context())
+	return nil
+}
+
+func TestRunLoad(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := grpc.NewServer()
+	fake := &fakeServer{seats: make(map[string]string), subjects: make(map[string]bool), admins: make(map[string]bool)}
+	pb.RegisterBookingServiceServer(srv, fake)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	c, err := client.Dial(lis.Addr().String(), client.WithRetryPolicy(client.RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	m, err := parseMix("purchase=3,user-bookings=1,section-bookings=1")
+	if err != nil {
+		t.Fatalf("parseMix() error = %v", err)
+	}
+	cfg := config{qps: 400, duration: 250 * time.Millisecond, users: 5, admins: 1, sections: []string{"A"}, size: 4, timeout: time.Second, seed: 1, mix: m}
+	report := runLoad(context.Background(), c, newTokenMinter("secret", time.Hour), cfg)
+
+	calls := map[string]MethodReport{}
+	for _, method := range report.Methods {
+		calls[method.Method] = method
+	}
+	if report.Calls+report.Dropped != 100 {
+		t.Errorf("calls = %v and %v dropped, want 100 calls due", report.Calls, report.Dropped)
+	}
+	// Only 4 seats can be bought, the other purchases conflict
+	if purchase := calls["Purchase"]; purchase.Codes["OK"] != 4 || purchase.Conflicts != purchase.Calls-4 || purchase.Codes["AlreadyExists"] != purchase.Conflicts {
+		t.Errorf("Purchase report = %+v, want 4 bookings and conflicts", purchase)
+	}
+	if calls["GetBookingsBySection"].Calls == 0 || calls["GetUserBookings"].Calls == 0 {
+		t.Errorf("report = %+v, want calls of every operation", report.Methods)
+	}
+	if len(fake.subjects) != 5 || len(fake.admins) != 1 || !fake.admins["loadgen-0@example.com"] {
+		t.Errorf("subjects = %v, admins = %v, want a token per virtual user and one admin", fake.subjects, fake.admins)
+	}
+
+	var out bytes.Buffer
+	if err := report.print(&out, "json"); err != nil || !json.Valid(out.Bytes()) {
+		t.Errorf("print() json = %s, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := report.print(&out, "table"); err != nil || !strings.Contains(out.String(), "AlreadyExists=") {
+		t.Errorf("print() table = %s, %v", out.String(), err)
+	}
+}
+
+func TestMix(t *testing.T) {
+	m, err := parseMix("purchase=3, cancel=1,modify-seat=0")
+	if err != nil {
+		t.Fatalf("parseMix() error = %v", err)
+	}
+	picked := map[string]int{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		picked[m.pick(r)]++
+	}
+	if picked["ModifySeat"] != 0 || picked["Purchase"] < 2800 || picked["Purchase"] > 3200 || picked["Purchase"]+picked["RemoveUserFromTrain"] != 4000 {
+		t.Errorf("picked = %v, want the weights", picked)
+	}
+
+	for _, value := range []string{"", "purchase=0", "refund=1", "purchase=-1", "purchase"} {
+		if _, err := parseMix(value); err == nil {
+			t.Errorf("parseMix(%q) succeeded", value)
+		}
+	}
+}
+
+func TestReadReplay(t *testing.T) {
+	recorded := strings.Join([]string{
+		// A log line of the server
+		`{"time":"2024-01-01T00:00:00Z","level":"INFO","msg":"rpc","method":"/BookingService/ModifySeat","code":"OK","subject":"user@example.com","request":"{\"bookingId\":\"b1\", \"newSeatId\":\"2\", \"newSectionId\":\"B\"}"}`,
+		`{"time":"2024-01-01T00:00:00Z","level":"INFO","msg":"Server started on port 50051"}`,
+		// A written call
+		`{"method":"Purchase","request":{"user":{"emailAddress":"john@example.com"},"seat":{"sectionId":"A","seatId":"3"}}}`,
+		`{"method":"GetUserBookings"}`,
+		`{"method":"/BookingService/CreateAPIKey","request":{}}`,
+		`not json`,
+		``,
+	}, "\n")
+	calls, skipped, err := readReplay(strings.NewReader(recorded))
+	if err != nil {
+		t.Fatalf("readReplay() error = %v", err)
+	}
+	if skipped != 3 || len(calls) != 3 {
+		t.Fatalf("readReplay() = %v calls, %v skipped, want 3 calls and 3 skipped lines", len(calls), skipped)
+	}
+	if modify, ok := calls[0].req.(*pb.ModifySeatRequest); !ok || calls[0].subject != "user@example.com" || modify.BookingId != "b1" || modify.NewSectionId != "B" {
+		t.Errorf("logged call = %+v, want the ModifySeat request of the subject", calls[0])
+	}
+	if purchase, ok := calls[1].req.(*pb.PurchaseRequest); !ok || purchase.Seat.SeatId != "3" || purchase.User.EmailAddress != "john@example.com" {
+		t.Errorf("written call = %+v, want the Purchase request", calls[1])
+	}
+	if calls[2].method != "GetUserBookings" {
+		t.Errorf("call without request = %+v", calls[2])
+	}
+}
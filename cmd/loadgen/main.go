@@ -0,0 +1,346 @@
+// Command loadgen puts the booking service under load. Virtual users, each with their own JWT
+// token, make a weighted mix of Purchase, GetUserBookings, GetBookingsBySection, ModifySeat and
+// RemoveUserFromTrain calls at a target rate, or replay a file of recorded calls. It reports the
+// latency percentiles, the status codes and the rate of seat conflicts of each method.
+//
+//	loadgen -qps 200 -users 50 -duration 1m -mix purchase=4,user-bookings=3,modify-seat=2
+//	loadgen -replay server.log -qps 100
+//
+// The tokens are signed with -secret or JWT_SECRET_KEY, the secret of the server, one of them
+// is required.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/client"
+	"github.com/13thuser/exampleauth/client/profile"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// tokenMinter signs the tokens of the virtual users and the replayed subjects
+type tokenMinter struct {
+	secret []byte
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func newTokenMinter(secret string, ttl time.Duration) *tokenMinter {
+	return &tokenMinter{secret: []byte(secret), ttl: ttl, tokens: make(map[string]string)}
+}
+
+// token returns the token of the subject, with the admin role or the user role. Users can
+// move and cancel their own bookings, like the sessions of guests.
+func (m *tokenMinter) token(subject string, admin bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := subject + " " + strconv.FormatBool(admin)
+	if token, ok := m.tokens[key]; ok {
+		return token, nil
+	}
+	claims := jwt.MapClaims{
+		"sub":   subject,
+		"exp":   time.Now().Add(m.ttl).Unix(),
+		"roles": []string{"user"},
+		"scope": "bookings:manage:self",
+	}
+	if admin {
+		claims["roles"] = []string{"admin"}
+		delete(claims, "scope")
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the token of %v: %v", subject, err)
+	}
+	m.tokens[key] = token
+	return token, nil
+}
+
+// config of a run
+type config struct {
+	qps      float64
+	duration time.Duration
+	users    int
+	// admins are the first virtual users, they make the calls that need an admin
+	admins   int
+	sections []string
+	size     int
+	timeout  time.Duration
+	seed     int64
+
+	mix mix
+	// replay is made in order instead of the mix when set
+	replay []call
+}
+
+// virtualUser makes calls with their own token, one at a time, and keeps track of their bookings
+type virtualUser struct {
+	email    string
+	admin    bool
+	rand     *rand.Rand
+	bookings []string
+}
+
+// randomSeat returns a seat of the train
+func (u *virtualUser) randomSeat(cfg *config) *pb.Seat {
+	return &pb.Seat{SectionId: cfg.sections[u.rand.Intn(len(cfg.sections))], SeatId: strconv.Itoa(u.rand.Intn(cfg.size) + 1)}
+}
+
+// do makes the call, it returns the method called. Moves and cancellations of a user without
+// bookings are purchases.
+func (u *virtualUser) do(ctx context.Context, c *client.Client, cfg *config, tokens *tokenMinter, next call) (string, error) {
+	subject, admin := u.email, u.admin
+	if next.subject != "" {
+		subject, admin = next.subject, adminMethods[next.method]
+	}
+	token, err := tokens.token(subject, admin)
+	if err != nil {
+		return next.method, err
+	}
+	ctx = client.ContextWithToken(ctx, token)
+
+	method := next.method
+	if (method == "ModifySeat" || method == "RemoveUserFromTrain") && next.req == nil && len(u.bookings) == 0 {
+		method = "Purchase"
+	}
+	switch method {
+	case "Purchase":
+		req, _ := next.req.(*pb.PurchaseRequest)
+		if req == nil {
+			req = &pb.PurchaseRequest{User: &pb.User{EmailAddress: u.email, FirstName: "Load", LastName: "Test"}, Seat: u.randomSeat(cfg)}
+		} else if email := req.User.GetEmailAddress(); email == "" || strings.Contains(email, "REDACTED") {
+			// The log redacts the passenger, the recorded subject books for themselves
+			req = &pb.PurchaseRequest{User: &pb.User{EmailAddress: u.email}, Seat: req.Seat}
+			if strings.Contains(next.subject, "@") {
+				req.User.EmailAddress = next.subject
+			}
+		}
+		booking, err := c.Purchase(ctx, req)
+		if err == nil && next.subject == "" {
+			u.bookings = append(u.bookings, booking.BookingId)
+		}
+		return method, err
+	case "GetUserBookings":
+		_, err := c.GetUserBookings(ctx).All()
+		return method, err
+	case "GetBookingsBySection":
+		req, _ := next.req.(*pb.GetBookingsBySectionRequest)
+		if req == nil {
+			req = &pb.GetBookingsBySectionRequest{Section: cfg.sections[u.rand.Intn(len(cfg.sections))]}
+		}
+		_, err := c.GetBookingsBySection(ctx, req).All()
+		return method, err
+	case "ModifySeat":
+		req, _ := next.req.(*pb.ModifySeatRequest)
+		if req == nil {
+			seat := u.randomSeat(cfg)
+			req = &pb.ModifySeatRequest{BookingId: u.bookings[u.rand.Intn(len(u.bookings))], NewSectionId: seat.SectionId, NewSeatId: seat.SeatId}
+		}
+		_, err := c.ModifySeat(ctx, req)
+		return method, err
+	case "RemoveUserFromTrain":
+		req, _ := next.req.(*pb.RemoveBookingRequest)
+		i := -1
+		if req == nil {
+			i = u.rand.Intn(len(u.bookings))
+			req = &pb.RemoveBookingRequest{BookingId: u.bookings[i]}
+		}
+		err := c.RemoveUserFromTrain(ctx, req)
+		if i >= 0 && (err == nil || errors.Is(err, client.ErrBookingNotFound)) {
+			u.bookings = append(u.bookings[:i], u.bookings[i+1:]...)
+		}
+		return method, err
+	case "GetMyLimits":
+		_, err := c.RPC().GetMyLimits(ctx, &emptypb.Empty{})
+		return method, err
+	}
+	return method, fmt.Errorf("method %v can't be called", method)
+}
+
+// runLoad makes the calls at the target rate until the duration is over, the replayed calls
+// run out or ctx is done. A call due when all the virtual users that can make it are busy is
+// dropped, so an overloaded server shows in the report instead of slowing the load down.
+func runLoad(ctx context.Context, c *client.Client, tokens *tokenMinter, cfg config) *Report {
+	rec := newRecorder()
+	userCalls, adminCalls := make(chan call), make(chan call)
+	var wg, ready sync.WaitGroup
+	for i := 0; i < cfg.users; i++ {
+		u := &virtualUser{email: fmt.Sprintf("loadgen-%d@example.com", i), admin: i < cfg.admins, rand: rand.New(rand.NewSource(cfg.seed + int64(i)))}
+		calls := userCalls
+		if u.admin {
+			calls = adminCalls
+		}
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			for next := range calls {
+				callCtx, cancel := context.WithTimeout(ctx, cfg.timeout)
+				start := time.Now()
+				method, err := u.do(callCtx, c, &cfg, tokens, next)
+				rec.record(method, time.Since(start), err)
+				cancel()
+			}
+		}()
+	}
+
+	ready.Wait()
+
+	r := rand.New(rand.NewSource(cfg.seed))
+	interval := time.Duration(float64(time.Second) / cfg.qps)
+	start := time.Now()
+	for i := 0; cfg.replay == nil || i < len(cfg.replay); i++ {
+		due := time.Duration(i) * interval
+		if due >= cfg.duration {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(due))):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		var next call
+		if cfg.replay != nil {
+			next = cfg.replay[i]
+		} else {
+			next = call{method: cfg.mix.pick(r)}
+		}
+		calls := userCalls
+		if adminMethods[next.method] && next.subject == "" {
+			calls = adminCalls
+		}
+		select {
+		case calls <- next:
+		default:
+			rec.drop()
+		}
+	}
+	close(userCalls)
+	close(adminCalls)
+	wg.Wait()
+	return rec.report(time.Since(start))
+}
+
+func main() {
+	var flagOptions profile.Options
+	profileName := flag.String("profile", "", "profile of the client config file for the address and TLS settings")
+	flag.StringVar(&flagOptions.Address, "address", "", "server address, BOOKING_ADDRESS or "+profile.DefaultAddress+" by default")
+	flag.StringVar(&flagOptions.CAFile, "ca-file", "", "CA bundle of the server certificate, enables TLS (TLS_CA_FILE)")
+	flag.StringVar(&flagOptions.ServerName, "server-name", "", "name in the server certificate when it differs from the address (TLS_SERVER_NAME)")
+	flag.StringVar(&flagOptions.CertFile, "cert-file", "", "client certificate for mutual TLS (TLS_CERT_FILE)")
+	flag.StringVar(&flagOptions.KeyFile, "key-file", "", "key of the client certificate (TLS_KEY_FILE)")
+
+	cfg := config{}
+	flag.Float64Var(&cfg.qps, "qps", 50, "target calls per second")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "duration of the run")
+	flag.IntVar(&cfg.users, "users", 20, "number of virtual users making calls concurrently")
+	flag.IntVar(&cfg.admins, "admins", 1, "number of the virtual users that are admins, they list the sections")
+	mixFlag := flag.String("mix", "purchase=4,user-bookings=3,section-bookings=1,modify-seat=2,cancel=1", "weights of the operations: "+strings.Join(mixOps(), ", "))
+	sections := flag.String("sections", "A,B", "comma separated sections of the train")
+	flag.IntVar(&cfg.size, "size", 10, "number of seats per section")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "timeout of each call")
+	flag.Int64Var(&cfg.seed, "seed", time.Now().UnixNano(), "seed of the random choices, to repeat a run")
+	replayFile := flag.String("replay", "", "file of recorded calls to replay instead of the mix, e.g. the JSON log of the server at debug level")
+	secret := flag.String("secret", os.Getenv("JWT_SECRET_KEY"), "secret signing the tokens, JWT_SECRET_KEY by default")
+	output := flag.String("o", "table", "output format: table or json")
+	flag.Parse()
+
+	err := func() error {
+		var err error
+		cfg.sections = strings.FieldsFunc(*sections, func(r rune) bool { return r == ',' || r == ' ' })
+		if cfg.qps <= 0 || cfg.duration <= 0 || cfg.users <= 0 || cfg.size <= 0 || cfg.timeout <= 0 || len(cfg.sections) == 0 {
+			return fmt.Errorf("-qps, -duration, -users, -size, -timeout and -sections must be positive")
+		}
+		if cfg.admins < 0 || cfg.admins > cfg.users {
+			return fmt.Errorf("-admins must be between 0 and -users")
+		}
+		// A token signed with another secret than the server's only measures the rejections
+		if *secret == "" {
+			return fmt.Errorf("-secret or JWT_SECRET_KEY is required to sign the tokens")
+		}
+		if *output != "table" && *output != "json" {
+			return fmt.Errorf("unknown output format %q, want table or json", *output)
+		}
+
+		skipped := 0
+		if *replayFile != "" {
+			f, err := os.Open(*replayFile)
+			if err != nil {
+				return fmt.Errorf("failed to open the recorded calls: %v", err)
+			}
+			cfg.replay, skipped, err = readReplay(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if len(cfg.replay) == 0 {
+				return fmt.Errorf("no calls to replay in %v, %d lines skipped", *replayFile, skipped)
+			}
+		} else {
+			if cfg.mix, err = parseMix(*mixFlag); err != nil {
+				return err
+			}
+			if cfg.mix.weight(OP_SECTION_BOOKINGS) > 0 && cfg.admins == 0 {
+				return fmt.Errorf("%v needs an admin, set -admins", OP_SECTION_BOOKINGS)
+			}
+			if cfg.mix.weight(OP_SECTION_BOOKINGS) > 0 && cfg.admins == cfg.users {
+				return fmt.Errorf("all the virtual users are admins, only %v calls would be made", OP_SECTION_BOOKINGS)
+			}
+		}
+
+		path, err := profile.Path()
+		if err != nil {
+			return err
+		}
+		clientConfig, err := profile.Load(path)
+		if err != nil {
+			return err
+		}
+		options, err := clientConfig.Resolve(*profileName, flagOptions, true)
+		if err != nil {
+			return err
+		}
+		// The virtual users send their own tokens
+		options.Token, options.APIKey = "", ""
+		opts, err := options.ClientOptions()
+		if err != nil {
+			return err
+		}
+		c, err := client.Dial(options.Address, append(opts, client.WithRetryPolicy(client.RetryPolicy{MaxAttempts: 1}))...)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		// Interrupting the run still prints the report
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report := runLoad(ctx, c, newTokenMinter(*secret, cfg.duration+time.Hour), cfg)
+		report.Skipped = skipped
+		return report.print(os.Stdout, *output)
+	}()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
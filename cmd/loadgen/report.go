@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/client"
+)
+
+// methodStats are the results of the calls of a method
+type methodStats struct {
+	latencies []time.Duration
+	codes     map[string]int
+	conflicts int
+}
+
+// recorder collects the results of the calls
+type recorder struct {
+	mu      sync.Mutex
+	methods map[string]*methodStats
+	dropped int
+}
+
+func newRecorder() *recorder {
+	return &recorder{methods: make(map[string]*methodStats)}
+}
+
+// record adds the result of a call. Conflicts are the calls that lost a seat or section to
+// another user.
+func (r *recorder) record(method string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats, ok := r.methods[method]
+	if !ok {
+		stats = &methodStats{codes: make(map[string]int)}
+		r.methods[method] = stats
+	}
+	stats.latencies = append(stats.latencies, latency)
+	stats.codes[status.Code(err).String()]++
+	if errors.Is(err, client.ErrSeatNotAvailable) || errors.Is(err, client.ErrSectionIsFull) {
+		stats.conflicts++
+	}
+}
+
+// drop counts a call that wasn't made as no virtual user was idle
+func (r *recorder) drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dropped++
+}
+
+// MethodReport are the results of the calls of a method, the latencies are in milliseconds
+type MethodReport struct {
+	Method       string         `json:"method"`
+	Calls        int            `json:"calls"`
+	Errors       int            `json:"errors"`
+	Conflicts    int            `json:"conflicts"`
+	ConflictRate float64        `json:"conflict_rate"`
+	P50          float64        `json:"p50_ms"`
+	P90          float64        `json:"p90_ms"`
+	P99          float64        `json:"p99_ms"`
+	Max          float64        `json:"max_ms"`
+	Codes        map[string]int `json:"codes"`
+}
+
+// Report are the results of a run
+type Report struct {
+	Seconds float64 `json:"seconds"`
+	Calls   int     `json:"calls"`
+	QPS     float64 `json:"qps"`
+	// Dropped calls were due when all the virtual users were busy
+	Dropped int `json:"dropped"`
+	// Skipped lines of the recorded request file
+	Skipped int            `json:"skipped,omitempty"`
+	Methods []MethodReport `json:"methods"`
+}
+
+// percentile returns the latency below which the fraction p of the sorted latencies are
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	i = min(max(i, 0), len(sorted)-1)
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// report summarizes the calls of a run that lasted elapsed
+func (r *recorder) report(elapsed time.Duration) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &Report{Seconds: elapsed.Seconds(), Dropped: r.dropped, Methods: []MethodReport{}}
+	for method, stats := range r.methods {
+		sorted := append([]time.Duration(nil), stats.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		calls := len(sorted)
+		report.Calls += calls
+		report.Methods = append(report.Methods, MethodReport{
+			Method:       method,
+			Calls:        calls,
+			Errors:       calls - stats.codes["OK"],
+			Conflicts:    stats.conflicts,
+			ConflictRate: float64(stats.conflicts) / float64(calls),
+			P50:          percentile(sorted, 0.5),
+			P90:          percentile(sorted, 0.9),
+			P99:          percentile(sorted, 0.99),
+			Max:          percentile(sorted, 1),
+			Codes:        stats.codes,
+		})
+	}
+	sort.Slice(report.Methods, func(i, j int) bool { return report.Methods[i].Method < report.Methods[j].Method })
+	if elapsed > 0 {
+		report.QPS = float64(report.Calls) / elapsed.Seconds()
+	}
+	return report
+}
+
+// print writes the report as a table or as JSON
+func (report *Report) print(w io.Writer, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	fmt.Fprintf(w, "%d calls in %.1fs, %.1f QPS, %d dropped", report.Calls, report.Seconds, report.QPS, report.Dropped)
+	if report.Skipped > 0 {
+		fmt.Fprintf(w, ", %d recorded lines skipped", report.Skipped)
+	}
+	fmt.Fprint(w, "\n\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tCALLS\tERRORS\tCONFLICTS\tP50\tP90\tP99\tMAX\tCODES")
+	for _, m := range report.Methods {
+		codes := make([]string, 0, len(m.Codes))
+		for code, count := range m.Codes {
+			codes = append(codes, fmt.Sprintf("%v=%d", code, count))
+		}
+		sort.Strings(codes)
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%.1f%%\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%v\n",
+			m.Method, m.Calls, m.Errors, 100*m.ConflictRate, m.P50, m.P90, m.P99, m.Max, strings.Join(codes, " "))
+	}
+	return tw.Flush()
+}
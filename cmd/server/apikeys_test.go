@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestBookingServer_APIKeys(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	apiKeys = db
+	defer func() { apiKeys = nil }()
+
+	// Admins manage the keys, sending the token with the Bearer scheme
+	token, err := createTestingJWTToken("adminuser@example.com", true)
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+	adminCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+
+	created, err := client.CreateAPIKey(adminCtx, &pb.CreateAPIKeyRequest{
+		Owner:  "Partner@Example.com",
+		Scopes: []string{string(PermBookingsReadSelf), string(PermBookingsWriteSelf)},
+		Ttl:    durationpb.New(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	if created.ApiKey.Owner != "partner@example.com" || created.Key == "" {
+		t.Fatalf("CreateAPIKey() = %+v", created)
+	}
+
+	if _, err := client.CreateAPIKey(adminCtx, &pb.CreateAPIKeyRequest{Owner: "partner@example.com", Scopes: []string{"bookings:everything"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateAPIKey() with unknown scope: got %v, want InvalidArgument", status.Code(err))
+	}
+
+	// The partner purchases and lists its bookings with the key
+	keyCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs(apiKeyHeader, created.Key))
+	if _, err := client.Purchase(keyCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "traveller@example.com", FirstName: "travel", LastName: "ler"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	}); err != nil {
+		t.Fatalf("Purchase() with API key error = %v", err)
+	}
+	stream, err := client.GetUserBookings(keyCtx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("GetUserBookings() with API key error = %v", err)
+	}
+	gotNumBookings := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("GetUserBookings() with API key error = %v", err)
+		}
+		gotNumBookings++
+	}
+	if gotNumBookings != 1 {
+		t.Errorf("GetUserBookings() with API key gotNumBookings = %v, want 1", gotNumBookings)
+	}
+
+	// The key's scopes don't include admin permissions
+	if _, err := client.ListAPIKeys(keyCtx, &pb.ListAPIKeysRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ListAPIKeys() with API key: got %v, want PermissionDenied", status.Code(err))
+	}
+
+	listed, err := client.ListAPIKeys(adminCtx, &pb.ListAPIKeysRequest{Owner: "partner@example.com"})
+	if err != nil {
+		t.Fatalf("ListAPIKeys() error = %v", err)
+	}
+	if len(listed.ApiKeys) != 1 || listed.ApiKeys[0].LastUsedAt == nil {
+		t.Errorf("ListAPIKeys() = %+v, want one key with last use recorded", listed.ApiKeys)
+	}
+
+	// Revoked, wrong and mixed credentials are rejected
+	if _, err := client.RevokeAPIKey(adminCtx, &pb.RevokeAPIKeyRequest{KeyId: created.ApiKey.KeyId}); err != nil {
+		t.Fatalf("RevokeAPIKey() error = %v", err)
+	}
+	rejected := map[string]metadata.MD{
+		"revoked key": metadata.Pairs(apiKeyHeader, created.Key),
+		"unknown key": metadata.Pairs(apiKeyHeader, "ea_unknown_secret"),
+		"both":        metadata.Pairs(apiKeyHeader, created.Key, "authorization", token),
+	}
+	for name, md := range rejected {
+		_, err := client.ListAPIKeys(metadata.NewOutgoingContext(ctx, md), &pb.ListAPIKeysRequest{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%v: got %v, want Unauthenticated", name, status.Code(err))
+		}
+	}
+}
+
+func TestAPIKeyValidator_ExpiredKey(t *testing.T) {
+	db := datastore.NewDatastore()
+	apiKeys = db
+	defer func() { apiKeys = nil }()
+
+	_, plainKey, err := db.CreateAPIKey(context.Background(), "partner@example.com", []string{string(PermBookingsReadSelf)}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(apiKeyHeader, plainKey))
+	if _, err := apiKeyValidator(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("apiKeyValidator() with expired key: got %v, want Unauthenticated", status.Code(err))
+	}
+
+	// API keys only get the permissions of their scopes, not the default user role
+	perms := permissionsFromClaims(jwt.MapClaims{"sub": "partner@example.com", "scp": []string{string(PermBookingsReadSelf)}})
+	if perms.Has(PermBookingsWriteSelf) {
+		t.Errorf("API key permissions include permissions outside of its scopes")
+	}
+}
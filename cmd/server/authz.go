@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Permission is a single capability granted to a caller by its roles or scopes
+type Permission string
+
+const (
+	PermBookingsReadSelf  Permission = "bookings:read:self"
+	PermBookingsReadAny   Permission = "bookings:read:any"
+	PermBookingsWriteSelf Permission = "bookings:write:self"
+	PermBookingsWriteAny  Permission = "bookings:write:any"
+	PermSectionsAdmin     Permission = "sections:admin"
+	PermAPIKeysAdmin      Permission = "apikeys:admin"
+
+	// PermBookingsManageSelf allows cancelling and modifying the caller's own bookings
+	PermBookingsManageSelf Permission = "bookings:manage:self"
+
+	// PermUsersImpersonate allows acting as another user with the "act" claim
+	PermUsersImpersonate Permission = "users:impersonate"
+
+	// PermBookingsLimitsExempt lifts the booking limits of the caller
+	PermBookingsLimitsExempt Permission = "bookings:limits:exempt"
+)
+
+// AllPermissions lists every permission understood by the server
+var AllPermissions = []Permission{
+	PermBookingsReadSelf,
+	PermBookingsReadAny,
+	PermBookingsWriteSelf,
+	PermBookingsWriteAny,
+	PermSectionsAdmin,
+	PermAPIKeysAdmin,
+	PermBookingsManageSelf,
+	PermUsersImpersonate,
+	PermBookingsLimitsExempt,
+}
+
+// Role names understood in the "roles" claim of the JWT token
+const (
+	RoleUser  = "user"
+	RoleAgent = "agent"
+	RoleAdmin = "admin"
+)
+
+// RolePermissions maps each role to the permissions it grants.
+// Tokens without any roles or scopes are treated as RoleUser.
+var RolePermissions = map[string][]Permission{
+	RoleUser: {
+		PermBookingsReadSelf,
+		PermBookingsWriteSelf,
+	},
+	RoleAgent: {
+		PermBookingsReadSelf,
+		PermBookingsWriteSelf,
+		PermBookingsReadAny,
+		PermBookingsWriteAny,
+	},
+	RoleAdmin: {
+		PermBookingsReadSelf,
+		PermBookingsWriteSelf,
+		PermBookingsReadAny,
+		PermBookingsWriteAny,
+		PermSectionsAdmin,
+		PermAPIKeysAdmin,
+		PermUsersImpersonate,
+		PermBookingsLimitsExempt,
+	},
+}
+
+// MethodPolicy describes the permissions needed to call an RPC.
+// Holding any one of the listed permissions grants access.
+type MethodPolicy struct {
+	AnyOf []Permission
+}
+
+// MethodPolicies maps the gRPC FullMethod to its policy. Methods missing from
+// the table are denied for every caller.
+var MethodPolicies = map[string]MethodPolicy{
+	"/BookingService/Purchase":             {AnyOf: []Permission{PermBookingsWriteSelf, PermBookingsWriteAny}},
+	"/BookingService/PurchaseBookings":     {AnyOf: []Permission{PermBookingsWriteSelf, PermBookingsWriteAny}},
+	"/BookingService/GetUserBookings":      {AnyOf: []Permission{PermBookingsReadSelf, PermBookingsReadAny}},
+	"/BookingService/ListBookings":         {AnyOf: []Permission{PermBookingsReadSelf, PermBookingsReadAny, PermSectionsAdmin}},
+	"/BookingService/ClaimGuestBookings":   {AnyOf: []Permission{PermBookingsWriteSelf}},
+	"/BookingService/GetMyLimits":          {AnyOf: []Permission{PermBookingsReadSelf, PermBookingsReadAny}},
+	"/BookingService/GetBookingsBySection": {AnyOf: []Permission{PermSectionsAdmin}},
+	"/BookingService/SearchBookings":       {AnyOf: []Permission{PermBookingsReadAny, PermSectionsAdmin}},
+	"/BookingService/RemoveUserFromTrain":  {AnyOf: []Permission{PermBookingsWriteAny, PermBookingsManageSelf}},
+	"/BookingService/ModifySeat":           {AnyOf: []Permission{PermBookingsWriteAny, PermBookingsManageSelf}},
+	"/BookingService/CreateAPIKey":         {AnyOf: []Permission{PermAPIKeysAdmin}},
+	"/BookingService/ListAPIKeys":          {AnyOf: []Permission{PermAPIKeysAdmin}},
+	"/BookingService/RevokeAPIKey":         {AnyOf: []Permission{PermAPIKeysAdmin}},
+}
+
+// isKnownPermission checks if the permission is in AllPermissions, API keys can only get known permissions
+func isKnownPermission(perm Permission) bool {
+	for _, p := range AllPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions is the set of permissions held by the caller
+type Permissions map[Permission]struct{}
+
+// Has reports whether the set contains the permission
+func (p Permissions) Has(perm Permission) bool {
+	_, ok := p[perm]
+	return ok
+}
+
+// permissionsFromClaims resolves the "roles" and "scope" claims into a permission set.
+// The legacy "is_admin" claim is still honoured and maps to RoleAdmin.
+func permissionsFromClaims(claims jwt.MapClaims) Permissions {
+	roles := claimStrings(claims["roles"])
+	if isAdmin, _ := claims["is_admin"].(bool); isAdmin {
+		roles = append(roles, RoleAdmin)
+	}
+
+	// OAuth style space separated scopes, or a list in "scp"
+	var scopes []string
+	if scope, ok := claims["scope"].(string); ok {
+		scopes = strings.Fields(scope)
+	}
+	scopes = append(scopes, claimStrings(claims["scp"])...)
+
+	if len(roles) == 0 && len(scopes) == 0 {
+		roles = []string{RoleUser}
+	}
+
+	perms := make(Permissions)
+	for _, role := range roles {
+		for _, perm := range RolePermissions[role] {
+			perms[perm] = struct{}{}
+		}
+	}
+	for _, scope := range scopes {
+		perms[Permission(scope)] = struct{}{}
+	}
+	return perms
+}
+
+// claimStrings reads a claim that can either be a single string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// permissionsFromContext returns the permissions stored by the token validator
+func permissionsFromContext(ctx context.Context) Permissions {
+	perms, ok := ctx.Value(permissionsKey).(Permissions)
+	if !ok {
+		return Permissions{}
+	}
+	return perms
+}
+
+// AuthzRequest holds everything an Authorizer can base its decision on
+type AuthzRequest struct {
+	// Claims of the caller's token, nil for guests
+	Claims jwt.MapClaims
+	// Permissions granted by the caller's roles and scopes
+	Permissions Permissions
+	// FullMethod of the RPC, e.g. /BookingService/ModifySeat
+	FullMethod string
+	// Request is the decoded request message, nil if it is not known yet
+	Request proto.Message
+}
+
+// Authorizer decides if a call may proceed. A non-nil error denies the call and is
+// returned to the caller as is, so it should be a gRPC status error.
+type Authorizer interface {
+	Authorize(ctx context.Context, req *AuthzRequest) error
+}
+
+// PolicyTableAuthorizer authorizes calls using the static MethodPolicies table
+type PolicyTableAuthorizer struct{}
+
+// Authorize checks the caller's permissions against the policy of the RPC
+func (PolicyTableAuthorizer) Authorize(ctx context.Context, req *AuthzRequest) error {
+	policy, ok := MethodPolicies[req.FullMethod]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "no authorization policy for %v", req.FullMethod)
+	}
+
+	for _, perm := range policy.AnyOf {
+		if req.Permissions.Has(perm) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "permission denied for %v", req.FullMethod)
+}
+
+// authorizer is called by the interceptors for every authenticated call.
+// It can be replaced at startup, e.g. by a RuleAuthorizer.
+var authorizer Authorizer = PolicyTableAuthorizer{}
+
+// authorize builds the authorization request from the context and asks the authorizer
+func authorize(ctx context.Context, fullMethod string, req interface{}) error {
+	claims, _ := ctx.Value(claimsKey).(jwt.MapClaims)
+	msg, _ := req.(proto.Message)
+	err := authorizer.Authorize(ctx, &AuthzRequest{
+		Claims:      claims,
+		Permissions: permissionsFromContext(ctx),
+		FullMethod:  fullMethod,
+		Request:     msg,
+	})
+	if status.Code(err) == codes.PermissionDenied {
+		recordAuthFailure(authFailurePermissionDenied)
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// getCtxWithClaims creates a new context with a JWT token signed from the given claims
+func getCtxWithClaims(t *testing.T, ctx context.Context, claims jwt.MapClaims) context.Context {
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecretKey))
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+	return metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", token))
+}
+
+// callRPC calls the given RPC and returns the resulting status code.
+// Streaming RPCs report their status on the first Recv.
+func callRPC(ctx context.Context, client pb.BookingServiceClient, method string) codes.Code {
+	var err error
+	switch method {
+	case "Purchase":
+		_, err = client.Purchase(ctx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: "matrix@example.com", FirstName: "matrix", LastName: "user"},
+			Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+		})
+	case "GetUserBookings":
+		var stream pb.BookingService_GetUserBookingsClient
+		if stream, err = client.GetUserBookings(ctx, &emptypb.Empty{}); err == nil {
+			_, err = stream.Recv()
+		}
+	case "GetBookingsBySection":
+		var stream pb.BookingService_GetBookingsBySectionClient
+		if stream, err = client.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: "A"}); err == nil {
+			_, err = stream.Recv()
+		}
+	case "RemoveUserFromTrain":
+		_, err = client.RemoveUserFromTrain(ctx, &pb.RemoveBookingRequest{BookingId: "unknown"})
+	case "ModifySeat":
+		_, err = client.ModifySeat(ctx, &pb.ModifySeatRequest{BookingId: "unknown", NewSectionId: "A", NewSeatId: "2"})
+	case "CreateAPIKey":
+		_, err = client.CreateAPIKey(ctx, &pb.CreateAPIKeyRequest{Owner: "partner@example.com", Scopes: []string{string(PermBookingsReadSelf)}})
+	case "ListAPIKeys":
+		_, err = client.ListAPIKeys(ctx, &pb.ListAPIKeysRequest{})
+	case "GetMyLimits":
+		_, err = client.GetMyLimits(ctx, &emptypb.Empty{})
+	case "ClaimGuestBookings":
+		_, err = client.ClaimGuestBookings(ctx, &pb.ClaimGuestBookingsRequest{AccessToken: "invalid"})
+	case "RequestBookingAccess":
+		_, err = client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "matrix@example.com"})
+	case "RevokeAPIKey":
+		_, err = client.RevokeAPIKey(ctx, &pb.RevokeAPIKeyRequest{KeyId: "unknown"})
+	}
+	return status.Code(err)
+}
+
+func TestAuthorizationMatrix(t *testing.T) {
+	ctx := context.Background()
+
+	// Every RPC is called by every kind of caller; allowed calls may still fail
+	// for other reasons (e.g. unknown booking), so only denials are asserted exactly.
+	callers := map[string]jwt.MapClaims{
+		"guest":        nil,
+		"user":         {"sub": "user@example.com", "roles": []string{RoleUser}},
+		"agent":        {"sub": "agent@example.com", "roles": []string{RoleAgent}},
+		"admin":        {"sub": "admin@example.com", "roles": []string{RoleAdmin}},
+		"legacy admin": {"sub": "legacy@example.com", "is_admin": true},
+		"no roles":     {"sub": "plain@example.com"},
+		"read scope":   {"sub": "reader@example.com", "scope": "bookings:read:self"},
+		"section scope": {
+			"sub":   "sections@example.com",
+			"scope": "sections:admin",
+		},
+	}
+
+	allowed := codes.OK
+
+	tests := map[string]map[string]codes.Code{
+		// Purchase is open to guests, but a token is authorized when provided
+		"Purchase": {
+			"guest":         allowed,
+			"user":          allowed,
+			"agent":         allowed,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      allowed,
+			"read scope":    codes.PermissionDenied,
+			"section scope": codes.PermissionDenied,
+		},
+		"GetUserBookings": {
+			"guest":         codes.Unauthenticated,
+			"user":          allowed,
+			"agent":         allowed,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      allowed,
+			"read scope":    allowed,
+			"section scope": codes.PermissionDenied,
+		},
+		"GetMyLimits": {
+			"guest":         codes.Unauthenticated,
+			"user":          allowed,
+			"agent":         allowed,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      allowed,
+			"read scope":    allowed,
+			"section scope": codes.PermissionDenied,
+		},
+		// Allowed callers are rejected for the invalid access token with Unauthenticated
+		"ClaimGuestBookings": {
+			"guest":         codes.Unauthenticated,
+			"user":          codes.Unauthenticated,
+			"agent":         codes.Unauthenticated,
+			"admin":         codes.Unauthenticated,
+			"legacy admin":  codes.Unauthenticated,
+			"no roles":      codes.Unauthenticated,
+			"read scope":    codes.PermissionDenied,
+			"section scope": codes.PermissionDenied,
+		},
+		"GetBookingsBySection": {
+			"guest":         codes.Unauthenticated,
+			"user":          codes.PermissionDenied,
+			"agent":         codes.PermissionDenied,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      codes.PermissionDenied,
+			"read scope":    codes.PermissionDenied,
+			"section scope": allowed,
+		},
+		"RemoveUserFromTrain": {
+			"guest":         codes.Unauthenticated,
+			"user":          codes.PermissionDenied,
+			"agent":         allowed,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      codes.PermissionDenied,
+			"read scope":    codes.PermissionDenied,
+			"section scope": codes.PermissionDenied,
+		},
+		"ModifySeat": {
+			"guest":         codes.Unauthenticated,
+			"user":          codes.PermissionDenied,
+			"agent":         allowed,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      codes.PermissionDenied,
+			"read scope":    codes.PermissionDenied,
+			"section scope": codes.PermissionDenied,
+		},
+	}
+
+	// The API key administration RPCs are only open to admins
+	for _, method := range []string{"CreateAPIKey", "ListAPIKeys", "RevokeAPIKey"} {
+		tests[method] = map[string]codes.Code{
+			"guest":         codes.Unauthenticated,
+			"user":          codes.PermissionDenied,
+			"agent":         codes.PermissionDenied,
+			"admin":         allowed,
+			"legacy admin":  allowed,
+			"no roles":      codes.PermissionDenied,
+			"read scope":    codes.PermissionDenied,
+			"section scope": codes.PermissionDenied,
+		}
+	}
+
+	// Guests request booking access without a token, tokens are ignored
+	tests["RequestBookingAccess"] = map[string]codes.Code{}
+	for caller := range callers {
+		tests["RequestBookingAccess"][caller] = allowed
+	}
+
+	for method, expectations := range tests {
+		for caller, want := range expectations {
+			t.Run(method+"/"+caller, func(t *testing.T) {
+				// A fresh datastore per case keeps purchases from filling the section
+				db := datastore.NewDatastore(
+					datastore.WithSections("A", "B"),
+					datastore.WithSectionSize(2))
+				client, closer := createTestServer(t, ctx, db)
+				defer closer()
+
+				callCtx := ctx
+				if claims := callers[caller]; claims != nil {
+					callCtx = getCtxWithClaims(t, ctx, claims)
+				}
+
+				got := callRPC(callCtx, client, method)
+				if want == allowed {
+					if got == codes.PermissionDenied || got == codes.Unauthenticated {
+						t.Errorf("%v by %v: got %v, want access granted", method, caller, got)
+					}
+					return
+				}
+				if got != want {
+					t.Errorf("%v by %v: got %v, want %v", method, caller, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthorize_UnknownMethodIsDenied(t *testing.T) {
+	ctx := context.WithValue(context.Background(), permissionsKey, permissionsFromClaims(jwt.MapClaims{"roles": []interface{}{RoleAdmin}}))
+	if err := authorize(ctx, "/BookingService/Unknown", nil); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("authorize() error = %v, want PermissionDenied", err)
+	}
+}
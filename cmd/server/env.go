@@ -1,14 +1,423 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-var JWT_SECRET_KEY = getSecretKey()
+	"github.com/13thuser/exampleauth/datastore"
+)
 
-// Read the secret key from the environment variable otherwise use the default value
-func getSecretKey() string {
+// Secret signing the JWT tokens, set from JWT_SECRET_KEY on start
+var JWT_SECRET_KEY string
+
+// Read the secret key from the environment variable, the server doesn't start without it
+func getSecretKey() (string, error) {
 	secretKey := os.Getenv("JWT_SECRET_KEY")
 	if secretKey == "" {
-		secretKey = "my-secret-key"
+		return "", fmt.Errorf("JWT_SECRET_KEY is required to verify the tokens")
+	}
+	return secretKey, nil
+}
+
+// Port of the HTTP /metrics endpoint, set METRICS_PORT to "off" to disable it
+var METRICS_PORT = getMetricsPort()
+
+// Read the metrics port from the environment variable otherwise use the default value
+func getMetricsPort() string {
+	switch port := os.Getenv("METRICS_PORT"); port {
+	case "":
+		return "9090"
+	case "off":
+		return ""
+	default:
+		return port
+	}
+}
+
+// Port of the REST gateway, set GATEWAY_PORT to "off" to disable it
+var GATEWAY_PORT = getGatewayPort()
+
+// Read the gateway port from the environment variable otherwise use the default value
+func getGatewayPort() string {
+	switch port := os.Getenv("GATEWAY_PORT"); port {
+	case "":
+		return "8080"
+	case "off":
+		return ""
+	default:
+		return port
+	}
+}
+
+// Path of the datastore snapshot, the datastore is loaded from it on start and saved to it on
+// shutdown. The datastore is kept in memory only when it is empty.
+var DATASTORE_FILE = os.Getenv("DATASTORE_FILE")
+
+// Set GRPC_REFLECTION to "true" to enable the server reflection service, e.g. for grpcurl
+var GRPC_REFLECTION = os.Getenv("GRPC_REFLECTION") == "true"
+
+// How long running calls are drained on shutdown before they are cancelled
+var SHUTDOWN_TIMEOUT = getShutdownTimeout()
+
+// Read the shutdown timeout from the environment variable otherwise use the default value
+func getShutdownTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return 10 * time.Second
+}
+
+// Path of the authorization policy file, rules are not used when empty
+var AUTHZ_POLICY_FILE = os.Getenv("AUTHZ_POLICY_FILE")
+
+// Set AUTHZ_POLICY_MODE to "audit" to evaluate and log the policy rules without enforcing them
+var AUTHZ_POLICY_MODE = os.Getenv("AUTHZ_POLICY_MODE")
+
+// Read the public methods from the environment and merge them over the defaults, it returns a copy
+// of the defaults when they are not configured. PUBLIC_METHODS_FILE names a file with one
+// "<public|optional|authenticated> <FullMethod>" pair per line, otherwise PUBLIC_METHODS,
+// OPTIONAL_AUTH_METHODS and AUTHENTICATED_METHODS hold comma separated FullMethods. Methods
+// configured as authenticated are removed from the defaults and require a token again.
+func getPublicMethods(defaults map[string]MethodAccess) (map[string]MethodAccess, error) {
+	configured := make(map[string]MethodAccess)
+
+	if path := os.Getenv("PUBLIC_METHODS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public methods file: %v", err)
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("public methods file line %d: want \"<public|optional|authenticated> <FullMethod>\"", i+1)
+			}
+			if err := addPublicMethod(configured, fields[1], MethodAccess(fields[0])); err != nil {
+				return nil, fmt.Errorf("public methods file line %d: %v", i+1, err)
+			}
+		}
+	} else {
+		lists := map[MethodAccess]string{
+			AccessPublic:        os.Getenv("PUBLIC_METHODS"),
+			AccessOptional:      os.Getenv("OPTIONAL_AUTH_METHODS"),
+			AccessAuthenticated: os.Getenv("AUTHENTICATED_METHODS"),
+		}
+		for access, list := range lists {
+			for _, method := range strings.Split(list, ",") {
+				if method = strings.TrimSpace(method); method == "" {
+					continue
+				}
+				if err := addPublicMethod(configured, method, access); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	methods := make(map[string]MethodAccess, len(defaults)+len(configured))
+	for method, access := range defaults {
+		methods[method] = access
+	}
+	for method, access := range configured {
+		if access == AccessAuthenticated {
+			delete(methods, method)
+		} else {
+			methods[method] = access
+		}
+	}
+	return methods, nil
+}
+
+// addPublicMethod validates the FullMethod and access mode and adds them to methods
+func addPublicMethod(methods map[string]MethodAccess, fullMethod string, access MethodAccess) error {
+	if access != AccessPublic && access != AccessOptional && access != AccessAuthenticated {
+		return fmt.Errorf("unknown access %q for %v, want public, optional or authenticated", access, fullMethod)
+	}
+	// FullMethod is always "/<service>/<method>"
+	if parts := strings.Split(fullMethod, "/"); len(parts) != 3 || parts[0] != "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("invalid method %q, want /<service>/<method>", fullMethod)
+	}
+	if existing, ok := methods[fullMethod]; ok && existing != access {
+		return fmt.Errorf("method %v is configured both %v and %v", fullMethod, existing, access)
+	}
+	methods[fullMethod] = access
+	return nil
+}
+
+// Read the rate limits from the environment, it returns nil when they are not configured.
+// RATE_LIMITS_FILE names a file with one "<FullMethod|*> <count>/<period> [burst]" entry per line,
+// otherwise RATE_LIMITS holds the same entries separated by commas, e.g. "/BookingService/Purchase 10/m 5".
+func getRateLimits() (map[string]RateLimit, error) {
+	var entries []string
+	source := "RATE_LIMITS"
+	if path := os.Getenv("RATE_LIMITS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rate limits file: %v", err)
+		}
+		entries, source = strings.Split(string(content), "\n"), "rate limits file"
+	} else if list := os.Getenv("RATE_LIMITS"); list != "" {
+		entries = strings.Split(list, ",")
+	} else {
+		return nil, nil
+	}
+
+	limits := make(map[string]RateLimit)
+	for i, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		method := fields[0]
+		if parts := strings.Split(method, "/"); method != "*" && (len(parts) != 3 || parts[0] != "" || parts[1] == "" || parts[2] == "") {
+			return nil, fmt.Errorf("%v entry %d: invalid method %q, want /<service>/<method> or *", source, i+1, method)
+		}
+		limit, err := ParseRateLimit(strings.Join(fields[1:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("%v entry %d: %v", source, i+1, err)
+		}
+		limits[method] = limit
+	}
+	return limits, nil
+}
+
+// Read the booking limits from the environment, "0" disables a limit.
+//
+//	BOOKING_MAX_ACTIVE               bookings a user can hold on the journey, defaults to 4
+//	BOOKING_MAX_SEATS_PER_PURCHASE   seats a user can buy at once, defaults to 4
+//	BOOKING_CANCELLATION_COOLDOWN    wait after a cancellation before purchasing again, off by default
+func getBookingLimits() (datastore.BookingLimits, error) {
+	limits := datastore.BookingLimits{MaxActiveBookings: 4, MaxSeatsPerPurchase: 4}
+	for name, limit := range map[string]*int{
+		"BOOKING_MAX_ACTIVE":             &limits.MaxActiveBookings,
+		"BOOKING_MAX_SEATS_PER_PURCHASE": &limits.MaxSeatsPerPurchase,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return datastore.BookingLimits{}, fmt.Errorf("invalid %v %q, want a number of bookings", name, value)
+			}
+			*limit = n
+		}
+	}
+	if value := os.Getenv("BOOKING_CANCELLATION_COOLDOWN"); value != "" {
+		cooldown, err := time.ParseDuration(value)
+		if err != nil || cooldown < 0 {
+			return datastore.BookingLimits{}, fmt.Errorf("invalid BOOKING_CANCELLATION_COOLDOWN %q, want a duration", value)
+		}
+		limits.CancellationCooldown = cooldown
+	}
+	return limits, nil
+}
+
+// Read how long cancelled bookings are kept for ListBookings from BOOKING_CANCELLED_RETENTION,
+// e.g. "72h". It defaults to 30 days, "0" keeps them forever.
+func getCancelledRetention() (time.Duration, error) {
+	value := os.Getenv("BOOKING_CANCELLED_RETENTION")
+	if value == "" {
+		return datastore.CANCELLED_RETENTION, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid BOOKING_CANCELLED_RETENTION %q, want a duration", value)
+	}
+	return retention, nil
+}
+
+// Read the TLS configuration from the environment, it returns nil when TLS is not configured.
+//
+//	TLS_CERT_FILE, TLS_KEY_FILE   server certificate and key, they enable TLS
+//	TLS_CLIENT_CA_FILE            CA bundle to verify client certificates, it enables mutual TLS
+//	TLS_CLIENT_AUTH               "require" (default) or "optional" client certificates
+//	TLS_MIN_VERSION               1.2 (default) or 1.3
+//	TLS_CIPHER_SUITES             comma separated cipher suite names, Go defaults when empty
+//	TLS_RELOAD_INTERVAL           how often the files are checked for changes, defaults to 10s
+func getTLSConfig() (*TLSConfig, error) {
+	config := &TLSConfig{
+		CertFile:          os.Getenv("TLS_CERT_FILE"),
+		KeyFile:           os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile:      os.Getenv("TLS_CLIENT_CA_FILE"),
+		RequireClientCert: true,
+		ReloadInterval:    10 * time.Second,
+	}
+	if config.CertFile == "" && config.KeyFile == "" {
+		if config.ClientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, fmt.Errorf("both TLS_CERT_FILE and TLS_KEY_FILE must be set")
+	}
+
+	switch clientAuth := os.Getenv("TLS_CLIENT_AUTH"); clientAuth {
+	case "", "require":
+	case "optional":
+		config.RequireClientCert = false
+	default:
+		return nil, fmt.Errorf("unknown TLS_CLIENT_AUTH %q, want require or optional", clientAuth)
+	}
+
+	minVersion := os.Getenv("TLS_MIN_VERSION")
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q, want 1.2 or 1.3", minVersion)
+	}
+	config.MinVersion = version
+
+	suites, err := parseCipherSuites(os.Getenv("TLS_CIPHER_SUITES"))
+	if err != nil {
+		return nil, err
+	}
+	config.CipherSuites = suites
+
+	if interval := os.Getenv("TLS_RELOAD_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_RELOAD_INTERVAL: %v", err)
+		}
+		config.ReloadInterval = d
+	}
+	return config, nil
+}
+
+// Read the cross-origin configuration of the gRPC-Web and Connect calls from the environment.
+//
+//	CORS_ALLOWED_ORIGINS   comma separated origins allowed to call the server, "*" allows all,
+//	                       browsers can only call from the server's origin when empty
+//	CORS_MAX_AGE           how long browsers cache preflight results, defaults to 2h
+func getCORSConfig() (CORSConfig, error) {
+	config := CORSConfig{MaxAge: 2 * time.Hour}
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.AllowedOrigins = append(config.AllowedOrigins, origin)
+		}
+	}
+	if value := os.Getenv("CORS_MAX_AGE"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return CORSConfig{}, fmt.Errorf("invalid CORS_MAX_AGE %q, want a duration", value)
+		}
+		config.MaxAge = maxAge
+	}
+	return config, nil
+}
+
+// Read the client certificate names that authenticate without a JWT token from TLS_SERVICE_IDENTITIES,
+// e.g. "spiffe://example.org/billing=admin,reports.internal=agent|user"
+func getServiceIdentities() (map[string][]string, error) {
+	identities := make(map[string][]string)
+	for _, entry := range strings.Split(os.Getenv("TLS_SERVICE_IDENTITIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, roles, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || roles == "" {
+			return nil, fmt.Errorf("invalid TLS_SERVICE_IDENTITIES entry %q, want <name>=<role>[|<role>]", entry)
+		}
+		identities[name] = strings.Split(roles, "|")
+	}
+	return identities, nil
+}
+
+// Read the notifier that delivers booking access tokens to guests from the environment.
+// Messages are appended to NOTIFIER_FILE when it is set, otherwise they are written to stdout.
+// BOOKING_ACCESS_URL is the page guests open with the token.
+func getNotifier() (Notifier, error) {
+	linkURL := os.Getenv("BOOKING_ACCESS_URL")
+	if path := os.Getenv("NOTIFIER_FILE"); path != "" {
+		return NewFileNotifier(path, linkURL)
+	}
+	return NewWriterNotifier(os.Stdout, linkURL), nil
+}
+
+// Read the identity rules for purchases from the environment.
+// PURCHASE_IDENTITY_MODE is "passenger" (default) or "match_subject", DISPOSABLE_EMAIL_DOMAINS_FILE
+// names a file with one domain per line that is blocked in addition to the default domains.
+func getIdentityRules() (IdentityRules, error) {
+	rules := DefaultIdentityRules()
+
+	switch mode := IdentityMode(os.Getenv("PURCHASE_IDENTITY_MODE")); mode {
+	case "":
+	case IdentityPassenger, IdentityMatchSubject:
+		rules.Mode = mode
+	default:
+		return IdentityRules{}, fmt.Errorf("unknown PURCHASE_IDENTITY_MODE %q, want %v or %v", mode, IdentityPassenger, IdentityMatchSubject)
+	}
+
+	if path := os.Getenv("DISPOSABLE_EMAIL_DOMAINS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return IdentityRules{}, fmt.Errorf("failed to read disposable email domains file: %v", err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			domain := strings.ToLower(strings.TrimSpace(line))
+			if domain == "" || strings.HasPrefix(domain, "#") {
+				continue
+			}
+			rules.DisposableDomains[domain] = struct{}{}
+		}
+	}
+	return rules, nil
+}
+
+// Read the methods admins can call while impersonating a user from IMPERSONATION_METHODS, a comma
+// separated list of FullMethods. It returns nil when they are not configured.
+func getImpersonationMethods() (map[string]struct{}, error) {
+	list := os.Getenv("IMPERSONATION_METHODS")
+	if list == "" {
+		return nil, nil
+	}
+	methods := make(map[string]struct{})
+	for _, method := range strings.Split(list, ",") {
+		if method = strings.TrimSpace(method); method == "" {
+			continue
+		}
+		if parts := strings.Split(method, "/"); len(parts) != 3 || parts[0] != "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid method %q, want /<service>/<method>", method)
+		}
+		methods[method] = struct{}{}
+	}
+	return methods, nil
+}
+
+// Read the logger from the environment. LOG_FORMAT is "text" (default) or "json", LOG_LEVEL is
+// "debug", "info" (default), "warn" or "error". Requests are logged, redacted, at debug level.
+func getLogger() (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil && os.Getenv("LOG_LEVEL") != "" {
+		return nil, fmt.Errorf("unknown LOG_LEVEL %q", os.Getenv("LOG_LEVEL"))
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown LOG_FORMAT %q, want text or json", format)
+	}
+}
+
+// Read the share of successful calls that are logged from LOG_SAMPLE_RATE, between 0 and 1 (default)
+func getLogSampleRate() (float64, error) {
+	value := os.Getenv("LOG_SAMPLE_RATE")
+	if value == "" {
+		return 1, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid LOG_SAMPLE_RATE %q, want a number between 0 and 1", value)
 	}
-	return secretKey
+	return rate, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// datastoreErrors maps the datastore errors to the code and ErrorInfo reason of their status
+var datastoreErrors = []struct {
+	err    error
+	code   codes.Code
+	reason string
+}{
+	{datastore.ErrBookingNotFound, codes.NotFound, pb.REASON_BOOKING_NOT_FOUND},
+	{datastore.ErrSectionNotFound, codes.NotFound, pb.REASON_SECTION_NOT_FOUND},
+	{datastore.ErrSectionIsFull, codes.FailedPrecondition, pb.REASON_SECTION_IS_FULL},
+	{datastore.ErrSeatNotAvailable, codes.AlreadyExists, pb.REASON_SEAT_NOT_AVAILABLE},
+	{datastore.ErrInvalidSeatID, codes.InvalidArgument, pb.REASON_INVALID_SEAT_ID},
+}
+
+// reasonStatus returns a status with an ErrorInfo detail carrying the reason
+func reasonStatus(code codes.Code, reason string, message string) error {
+	st, err := status.New(code, message).WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: pb.ErrorDomain})
+	if err != nil {
+		return status.Error(code, message)
+	}
+	return st.Err()
+}
+
+// datastoreStatus converts an error of the datastore to a status. Known errors get their code
+// and an ErrorInfo detail, other errors are Unknown. The message is prefixed with what failed.
+func datastoreStatus(err error, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...) + ": " + err.Error()
+	for _, known := range datastoreErrors {
+		if errors.Is(err, known.err) {
+			return reasonStatus(known.code, known.reason, message)
+		}
+	}
+	return status.Error(codes.Unknown, message)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+func TestDatastoreErrors(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(
+		datastore.WithSections("A"),
+		datastore.WithSectionSize(4))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	adminCtx := getCtxWithToken(t, ctx, "admin@example.com", true)
+	purchase := func(section, seat string) (*pb.Booking, error) {
+		return client.Purchase(adminCtx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: "admin@example.com", FirstName: "john", LastName: "doe"},
+			Seat: &pb.Seat{SectionId: section, SeatId: seat},
+		})
+	}
+	booking, err := purchase("A", "1")
+	if err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		call   func() error
+		code   codes.Code
+		reason string
+	}{
+		{"taken seat", func() error { _, err := purchase("A", "1"); return err }, codes.AlreadyExists, pb.REASON_SEAT_NOT_AVAILABLE},
+		{"unknown section", func() error { _, err := purchase("Z", "1"); return err }, codes.NotFound, pb.REASON_SECTION_NOT_FOUND},
+		{"invalid seat", func() error { _, err := purchase("A", "x"); return err }, codes.InvalidArgument, pb.REASON_INVALID_SEAT_ID},
+		{"unknown booking", func() error {
+			_, err := client.ModifySeat(adminCtx, &pb.ModifySeatRequest{BookingId: "missing", NewSectionId: "A", NewSeatId: "2"})
+			return err
+		}, codes.NotFound, pb.REASON_BOOKING_NOT_FOUND},
+		{"move to a taken seat", func() error {
+			if _, err := purchase("A", "2"); err != nil {
+				return err
+			}
+			_, err := client.ModifySeat(adminCtx, &pb.ModifySeatRequest{BookingId: booking.BookingId, NewSectionId: "A", NewSeatId: "2"})
+			return err
+		}, codes.AlreadyExists, pb.REASON_SEAT_NOT_AVAILABLE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(tt.call())
+			if st.Code() != tt.code {
+				t.Fatalf("code = %v (%v), want %v", st.Code(), st.Message(), tt.code)
+			}
+			var info *errdetails.ErrorInfo
+			for _, detail := range st.Details() {
+				if detail, ok := detail.(*errdetails.ErrorInfo); ok {
+					info = detail
+				}
+			}
+			if info == nil || info.Reason != tt.reason || info.Domain != pb.ErrorDomain {
+				t.Errorf("ErrorInfo = %v, want reason %v", info, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/textproto"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Content type of the responses of streaming RPCs, one JSON object per line
+const ndjsonContentType = "application/x-ndjson"
+
+// gatewayMarkerKey is the metadata key of the marker the gateway sends with its calls. Only the
+// calls carrying the marker of this process come from its gateway, the server trusts their
+// X-Forwarded-For.
+const gatewayMarkerKey = "x-booking-gateway"
+
+// gatewayMarker is the random marker of the calls of this process' gateway
+var gatewayMarker = newGatewayMarker()
+
+func newGatewayMarker() string {
+	marker, err := newTokenID()
+	if err != nil {
+		panic(err)
+	}
+	return marker
+}
+
+// fromGateway checks if the call comes from the gateway of this process
+func fromGateway(ctx context.Context) bool {
+	for _, marker := range metadata.ValueFromIncomingContext(ctx, gatewayMarkerKey) {
+		if subtle.ConstantTimeCompare([]byte(marker), []byte(gatewayMarker)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayMarkerOptions are the dial options of the gateway that add the marker to its calls
+func gatewayMarkerOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(metadata.AppendToOutgoingContext(ctx, gatewayMarkerKey, gatewayMarker), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(metadata.AppendToOutgoingContext(ctx, gatewayMarkerKey, gatewayMarker), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// gatewayHeaders are the HTTP headers passed on to the gRPC server as metadata next to the
+// Authorization header, which the gateway always passes on
+var gatewayHeaders = map[string]struct{}{
+	textproto.CanonicalMIMEHeaderKey(apiKeyHeader):    {},
+	textproto.CanonicalMIMEHeaderKey(requestIDHeader): {},
+	"Traceparent": {},
+	"Tracestate":  {},
+}
+
+// gatewayHeaderMatcher maps the gateway headers to their metadata key, other headers are
+// handled by the default matcher of the gateway
+func gatewayHeaderMatcher(key string) (string, bool) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	if _, ok := gatewayHeaders[key]; ok {
+		return key, true
+	}
+	// The token is passed on as "authorization" already, don't copy it to a second key
+	if key == "Authorization" {
+		return "", false
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// newGateway creates the handler of the REST gateway. It translates the HTTP calls to gRPC
+// calls to the server at endpoint, so they go through the same interceptors as every other
+// call. The OpenAPI spec of the gateway is served on /openapi.yaml.
+func newGateway(ctx context.Context, endpoint string, dialOptions ...grpc.DialOption) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(gatewayHeaderMatcher),
+		runtime.WithForwardResponseOption(markStream),
+	)
+	dialOptions = append(dialOptions, gatewayMarkerOptions()...)
+	if err := pb.RegisterBookingServiceHandlerFromEndpoint(ctx, mux, endpoint, dialOptions); err != nil {
+		return nil, fmt.Errorf("failed to register gateway: %v", err)
+	}
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(pb.OpenAPISpec)
+	})
+	handler.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(&gatewayResponseWriter{ResponseWriter: w}, r)
+	}))
+	return handler, nil
+}
+
+// markStream is called by the gateway without a message before it forwards the responses
+// of a streaming RPC, it switches the response to NDJSON
+func markStream(ctx context.Context, w http.ResponseWriter, msg proto.Message) error {
+	if gw, ok := w.(*gatewayResponseWriter); ok && msg == nil {
+		gw.stream = true
+	}
+	return nil
+}
+
+// gatewayResponseWriter sets the NDJSON content type on the responses of streaming RPCs.
+// The gateway writes each message of the stream on a line of its own.
+type gatewayResponseWriter struct {
+	http.ResponseWriter
+	stream      bool
+	wroteHeader bool
+}
+
+func (w *gatewayResponseWriter) WriteHeader(code int) {
+	if w.stream && !w.wroteHeader {
+		w.Header().Set("Content-Type", ndjsonContentType)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gatewayResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends each message of a stream as soon as it is written
+func (w *gatewayResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
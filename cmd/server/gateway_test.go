@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/13thuser/exampleauth/datastore"
+)
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(4))
+	lis, closer := createTestListener(t, db)
+	defer closer()
+
+	gateway, err := newGateway(ctx, "bufnet",
+		grpc.WithContextDialer(bufDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("newGateway() error = %v", err)
+	}
+	httpServer := httptest.NewServer(gateway)
+	defer httpServer.Close()
+
+	userToken, err := createTestingJWTToken("user@example.com", false)
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+	adminToken, err := createTestingJWTToken("admin@example.com", true)
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+
+	call := func(method, path, body string, headers ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v error = %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Bearer tokens reach the interceptors
+	resp := call("POST", "/v1/bookings", `{"user": {"emailAddress": "user@example.com", "firstName": "john", "lastName": "doe"}, "seat": {"sectionId": "A", "seatId": "1"}}`,
+		"Authorization", "Bearer "+userToken)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST /v1/bookings status = %v, body %s", resp.StatusCode, body)
+	}
+	var booking struct {
+		BookingID string `json:"bookingId"`
+		Purchaser string `json:"purchaser"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&booking); err != nil || booking.BookingID == "" || booking.Purchaser != "user@example.com" {
+		t.Errorf("POST /v1/bookings booking = %+v, %v", booking, err)
+	}
+
+	// Guests can purchase without a token, other calls need one
+	if resp := call("POST", "/v1/bookings", `{"user": {"emailAddress": "guest@example.com"}, "seat": {"sectionId": "A", "seatId": "2"}}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("guest POST /v1/bookings status = %v, want 200", resp.StatusCode)
+	}
+	for _, body := range []string{`{}`, `{"user": {"emailAddress": "guest@example.com"}}`, `{"seat": {"sectionId": "A", "seatId": "2"}}`} {
+		if resp := call("POST", "/v1/bookings", body, "Authorization", "Bearer "+userToken); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /v1/bookings of %s status = %v, want 400", body, resp.StatusCode)
+		}
+	}
+	if resp := call("GET", "/v1/bookings", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /v1/bookings without token status = %v, want 401", resp.StatusCode)
+	}
+	if resp := call("DELETE", "/v1/bookings/"+booking.BookingID, "", "Authorization", "Bearer "+userToken); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("DELETE /v1/bookings by the user status = %v, want 403", resp.StatusCode)
+	}
+
+	resp = call("GET", "/v1/bookings:list?pageSize=10&filter=status%20%3D%20active", "", "Authorization", "Bearer "+userToken)
+	var list struct {
+		Bookings []struct {
+			BookingID string `json:"bookingId"`
+			Status    string `json:"status"`
+		} `json:"bookings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || resp.StatusCode != http.StatusOK || len(list.Bookings) != 1 || list.Bookings[0].Status != "active" {
+		t.Errorf("GET /v1/bookings:list status = %v, bookings %+v, %v", resp.StatusCode, list.Bookings, err)
+	}
+
+	// API keys are passed on too
+	apiKeys = db
+	defer func() { apiKeys = nil }()
+	_, apiKey, err := db.CreateAPIKey(ctx, "user@example.com", []string{string(PermBookingsReadSelf)}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	if resp := call("GET", "/v1/bookings", "", apiKeyHeader, apiKey); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /v1/bookings with API key status = %v, want 200", resp.StatusCode)
+	}
+
+	// Admins move and remove bookings
+	resp = call("PUT", "/v1/bookings/"+booking.BookingID+"/seat", `{"newSectionId": "B", "newSeatId": "3"}`, "Authorization", "Bearer "+adminToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT /v1/bookings/{id}/seat status = %v, want 200", resp.StatusCode)
+	}
+
+	// Streams are sent as NDJSON, one result per line
+	resp = call("GET", "/v1/sections/B/bookings", "", "Authorization", "Bearer "+adminToken)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("GET /v1/sections/B/bookings status = %v, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 1 {
+		t.Fatalf("GET /v1/sections/B/bookings lines = %q, want 1", lines)
+	}
+	var line struct {
+		Result struct {
+			BookingID string `json:"bookingId"`
+			Seat      struct {
+				SeatID string `json:"seatId"`
+			} `json:"seat"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil || line.Result.BookingID != booking.BookingID || line.Result.Seat.SeatID != "3" {
+		t.Errorf("GET /v1/sections/B/bookings line = %s, %v", lines[0], err)
+	}
+
+	resp = call("GET", "/v1/bookings:search?query=doe&seat.sectionId=B", "", "Authorization", "Bearer "+adminToken)
+	var found struct {
+		Bookings []struct {
+			BookingID string `json:"bookingId"`
+		} `json:"bookings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil || resp.StatusCode != http.StatusOK || len(found.Bookings) != 1 || found.Bookings[0].BookingID != booking.BookingID {
+		t.Errorf("GET /v1/bookings:search status = %v, bookings %+v, %v", resp.StatusCode, found.Bookings, err)
+	}
+
+	if resp := call("DELETE", "/v1/bookings/"+booking.BookingID, "", "Authorization", "Bearer "+adminToken); resp.StatusCode != http.StatusOK {
+		t.Errorf("DELETE /v1/bookings by an admin status = %v, want 200", resp.StatusCode)
+	}
+
+	// The OpenAPI spec describes the gateway
+	resp = call("GET", "/openapi.yaml", "")
+	spec, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(spec), "openapi: 3.") || !strings.Contains(string(spec), "/v1/bookings") {
+		t.Errorf("GET /openapi.yaml status = %v, spec %.100s", resp.StatusCode, spec)
+	}
+}
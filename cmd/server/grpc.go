@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"os"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/13thuser/exampleauth/datastore"
 	pb "github.com/13thuser/exampleauth/grpc"
@@ -19,13 +22,43 @@ type BookingServer struct {
 
 	// Datastore - it can be interface to support different implementations
 	db *datastore.Datastore
+
+	// Delivers booking access tokens to guests
+	notifier Notifier
+
+	// Validate the passenger of purchases
+	identity IdentityRules
+}
+
+type BookingServerOption func(*BookingServer)
+
+// WithNotifier sets the notifier used to deliver booking access tokens to guests.
+func WithNotifier(notifier Notifier) BookingServerOption {
+	return func(s *BookingServer) {
+		s.notifier = notifier
+	}
+}
+
+// WithIdentityRules sets the rules used to validate the passenger of purchases.
+func WithIdentityRules(rules IdentityRules) BookingServerOption {
+	return func(s *BookingServer) {
+		s.identity = rules
+	}
 }
 
 // NewBookingServer creates a new instance of the BookingServer
-func NewBookingServer(db *datastore.Datastore) *BookingServer {
-	return &BookingServer{
-		db: db,
+func NewBookingServer(db *datastore.Datastore, options ...BookingServerOption) *BookingServer {
+	s := &BookingServer{
+		db:       db,
+		notifier: NewWriterNotifier(os.Stdout, ""),
+		identity: DefaultIdentityRules(),
+	}
+
+	for _, option := range options {
+		option(s)
 	}
+
+	return s
 }
 
 // isUserAuthenticated checks if the user is authenticated and returns the emailID
@@ -37,31 +70,80 @@ func (s *BookingServer) isUserAuthenticated(ctx context.Context) (string, bool)
 	return emailID, true
 }
 
-// isAdmin checks if the user is an admin
-func (s *BookingServer) isAdmin(ctx context.Context) bool {
-	isAdmin, ok := ctx.Value(isAdminKey).(bool)
-	if !ok {
-		return false
+// checkBookingAccess makes sure the caller may change the booking: callers with
+// PermBookingsWriteAny can change every booking, others only their own
+func (s *BookingServer) checkBookingAccess(ctx context.Context, bookingID string) error {
+	if permissionsFromContext(ctx).Has(PermBookingsWriteAny) {
+		return nil
+	}
+
+	email, authenticated := s.isUserAuthenticated(ctx)
+	if !authenticated {
+		return status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	booking, err := s.db.GetBooking(ctx, datastore.BookingID(bookingID))
+	if err != nil || booking.Owner() != email {
+		// Don't reveal bookings of other users
+		return reasonStatus(codes.NotFound, pb.REASON_BOOKING_NOT_FOUND, "booking not found: "+bookingID)
 	}
-	return isAdmin
+	return nil
 }
 
-// Implement the gRPC service methods
-func (s *BookingServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
-	log.Printf("Received: %v\n", req)
+// toPBBooking converts a datastore booking to its protobuf representation
+func toPBBooking(booking datastore.Booking) *pb.Booking {
+	// Bookings restored from snapshots written before the creation time was kept have none
+	var createdAt *timestamppb.Timestamp
+	if !booking.CreatedAt.IsZero() {
+		createdAt = timestamppb.New(booking.CreatedAt)
+	}
+	return &pb.Booking{
+		BookingId: booking.BookingID,
+		User: &pb.User{
+			EmailAddress: booking.User.EmailAddress,
+			FirstName:    booking.User.FirstName,
+			LastName:     booking.User.LastName,
+		},
+		Seat: &pb.Seat{
+			SectionId: booking.Seat.SectionID,
+			SeatId:    booking.Seat.SeatID,
+		},
+		JourneyId: booking.JourneyID,
+		From:      booking.From,
+		To:        booking.To,
+		Departure: timestamppb.New(booking.Departure),
+		PricePaid: booking.PricePaid,
+		Purchaser: booking.Owner(),
+		Status:    booking.Status,
+		CreatedAt: createdAt,
+	}
+}
+
+// newBooking checks a purchase request and returns the purchaser with the booking to make. The
+// purchaser is the caller's account, or the passenger for guests.
+func (s *BookingServer) newBooking(ctx context.Context, req *pb.PurchaseRequest) (string, datastore.Booking, error) {
+	// The REST gateway and Connect accept requests without the messages
+	if req.User == nil || req.Seat == nil {
+		return "", datastore.Booking{}, status.Errorf(codes.InvalidArgument, "user and seat are required")
+	}
 
 	// Check if user is authenticated otherwise use email from request to allow guest to make a purchase
 	email, authenticated := s.isUserAuthenticated(ctx)
-	if !authenticated {
-		email = strings.ToLower(req.User.EmailAddress)
+	if !authenticated && req.User.EmailAddress == "" {
+		return "", datastore.Booking{}, status.Errorf(codes.Unauthenticated, "Email is not provided")
 	}
-	if email == "" {
-		return nil, status.Errorf(codes.Unauthenticated, "Email is not provided")
+
+	// The purchaser is the account, the passenger is checked against the identity rules
+	passenger, err := s.identity.PassengerEmail(req.User.EmailAddress, email, authenticated, permissionsFromContext(ctx).Has(PermBookingsWriteAny))
+	if err != nil {
+		return "", datastore.Booking{}, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if !authenticated {
+		email = passenger
 	}
 
 	booking := datastore.Booking{
 		User: datastore.User{
-			EmailAddress: req.User.EmailAddress,
+			EmailAddress: passenger,
 			FirstName:    req.User.FirstName,
 			LastName:     req.User.LastName,
 		},
@@ -69,34 +151,67 @@ func (s *BookingServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (
 			SectionID: req.Seat.SectionId,
 			SeatID:    req.Seat.SeatId,
 		},
-		From:      "London", // From and to is fixed and hardcoded for now
-		To:        "Paris",
+		// From, to and departure are filled in from the datastore's journey
 		PricePaid: 20.00, // Currency field is eliminated because of timing constraints
 	}
+	return email, booking, nil
+}
+
+// purchaseStatus converts the errors of the purchases of the user to their status
+func purchaseStatus(err error, email string) error {
+	if limitErr := (*datastore.LimitExceeded)(nil); errors.As(err, &limitErr) {
+		return limitStatus(limitErr, email)
+	}
+	return datastoreStatus(err, "failed to purchase")
+}
+
+// Implement the gRPC service methods
+func (s *BookingServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
+	email, booking, err := s.newBooking(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
 	// email is the user's id
-	booking, err := s.db.Purchase(email, booking)
+	booking, err = s.db.Purchase(limitsContext(ctx), email, booking)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "failed to purchase: %v", err)
+		return nil, purchaseStatus(err, email)
 	}
 
-	pbBooking := &pb.Booking{
-		BookingId: booking.BookingID,
-		User: &pb.User{
-			EmailAddress: booking.User.EmailAddress,
-			FirstName:    booking.User.FirstName,
-			LastName:     booking.User.LastName,
-		},
-		Seat: &pb.Seat{
-			SectionId: booking.Seat.SectionID,
-			SeatId:    booking.Seat.SeatID,
-		},
-		From:      booking.From,
-		To:        booking.To,
-		PricePaid: booking.PricePaid,
+	return toPBBooking(booking), nil
+}
+
+// PurchaseBookings buys the seats of all the purchases or, when one of them fails, none. The
+// seats count against the seats per purchase limit. Guests buy them for a single email address.
+func (s *BookingServer) PurchaseBookings(ctx context.Context, req *pb.PurchaseBookingsRequest) (*pb.PurchaseBookingsResponse, error) {
+	if len(req.Purchases) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "purchases are required")
+	}
+
+	var email string
+	var bookings []datastore.Booking
+	for i, purchase := range req.Purchases {
+		purchaser, booking, err := s.newBooking(ctx, purchase)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && purchaser != email {
+			return nil, status.Errorf(codes.InvalidArgument, "the purchases of a guest must be for the same email address")
+		}
+		email = purchaser
+		bookings = append(bookings, booking)
 	}
 
-	return pbBooking, nil
+	created, err := s.db.PurchaseBookings(limitsContext(ctx), email, bookings)
+	if err != nil {
+		return nil, purchaseStatus(err, email)
+	}
+
+	resp := &pb.PurchaseBookingsResponse{}
+	for _, booking := range created {
+		resp.Bookings = append(resp.Bookings, toPBBooking(booking))
+	}
+	return resp, nil
 }
 
 func (s *BookingServer) GetUserBookings(req *emptypb.Empty, stream pb.BookingService_GetUserBookingsServer) error {
@@ -112,22 +227,8 @@ func (s *BookingServer) GetUserBookings(req *emptypb.Empty, stream pb.BookingSer
 	userId := email
 
 	// Stream the bookings response
-	for _, booking := range s.db.GetUserBookings(userId) {
-		err := stream.Send(&pb.Booking{
-			BookingId: booking.BookingID,
-			User: &pb.User{
-				EmailAddress: booking.User.EmailAddress,
-				FirstName:    booking.User.FirstName,
-				LastName:     booking.User.LastName,
-			},
-			Seat: &pb.Seat{
-				SectionId: booking.Seat.SectionID,
-				SeatId:    booking.Seat.SeatID,
-			},
-			From:      booking.From,
-			To:        booking.To,
-			PricePaid: booking.PricePaid,
-		})
+	for _, booking := range s.db.GetUserBookings(ctx, userId) {
+		err := stream.Send(toPBBooking(booking))
 		if err != nil {
 			return status.Errorf(codes.Unknown, "failed to stream booking: %v", err)
 		}
@@ -137,30 +238,11 @@ func (s *BookingServer) GetUserBookings(req *emptypb.Empty, stream pb.BookingSer
 }
 
 func (s *BookingServer) GetBookingsBySection(req *pb.GetBookingsBySectionRequest, stream pb.BookingService_GetBookingsBySectionServer) error {
-	ctx := stream.Context()
-
-	// Check if the user is an admin
-	if !s.isAdmin(ctx) {
-		return status.Errorf(codes.PermissionDenied, "user is not an admin")
-	}
+	// Admin permission is enforced by the authorization policy in the interceptors
 
 	// Stream the bookings response
-	for _, booking := range s.db.GetBookingsBySection(datastore.SectionID(req.Section)) {
-		err := stream.Send(&pb.Booking{
-			BookingId: booking.BookingID,
-			User: &pb.User{
-				EmailAddress: booking.User.EmailAddress,
-				FirstName:    booking.User.FirstName,
-				LastName:     booking.User.LastName,
-			},
-			Seat: &pb.Seat{
-				SectionId: booking.Seat.SectionID,
-				SeatId:    booking.Seat.SeatID,
-			},
-			From:      booking.From,
-			To:        booking.To,
-			PricePaid: booking.PricePaid,
-		})
+	for _, booking := range s.db.GetBookingsBySection(stream.Context(), datastore.SectionID(req.Section)) {
+		err := stream.Send(toPBBooking(booking))
 		if err != nil {
 			return status.Errorf(codes.Unknown, "failed to stream booking: %v", err)
 		}
@@ -170,50 +252,91 @@ func (s *BookingServer) GetBookingsBySection(req *pb.GetBookingsBySectionRequest
 }
 
 func (s *BookingServer) RemoveUserFromTrain(ctx context.Context, req *pb.RemoveBookingRequest) (*emptypb.Empty, error) {
-	log.Printf("Received: %v\n", req)
-
-	// Check if the user is an admin
-	if !s.isAdmin(ctx) {
-		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	if err := s.checkBookingAccess(ctx, req.BookingId); err != nil {
+		return nil, err
 	}
 
-	// Remove the user from the train
-	err := s.db.RemoveUserFromTrain(datastore.BookingID(req.BookingId))
+	// Remove the user from the train, the cooldown only starts when the owners cancel themselves
+	err := s.db.RemoveUserFromTrain(cancellationContext(ctx), datastore.BookingID(req.BookingId))
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "failed to remove user with booking ID (%v) from train: %v", req.BookingId, err)
+		return nil, datastoreStatus(err, "failed to remove user with booking ID (%v) from train", req.BookingId)
 	}
 
 	return nil, nil
 }
 
 func (s *BookingServer) ModifySeat(ctx context.Context, req *pb.ModifySeatRequest) (*pb.Booking, error) {
-	log.Printf("Received: %v\n", req)
+	if err := s.checkBookingAccess(ctx, req.BookingId); err != nil {
+		return nil, err
+	}
+
+	booking, err := s.db.ModifySeat(ctx, datastore.BookingID(req.BookingId), datastore.SectionID(req.NewSectionId), datastore.SeatID(req.NewSeatId))
+	if err != nil {
+		return nil, datastoreStatus(err, "failed to modify seat")
+	}
+
+	return toPBBooking(booking), nil
+}
 
-	// Check if the user is an admin
-	if !s.isAdmin(ctx) {
-		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+// toPBAPIKey converts a datastore API key to its protobuf representation, the secret is never included
+func toPBAPIKey(key datastore.APIKey) *pb.APIKey {
+	pbKey := &pb.APIKey{
+		KeyId:     key.ID,
+		Owner:     key.Owner,
+		Scopes:    key.Scopes,
+		CreatedAt: timestamppb.New(key.CreatedAt),
+		Revoked:   key.Revoked,
+	}
+	if !key.ExpiresAt.IsZero() {
+		pbKey.ExpiresAt = timestamppb.New(key.ExpiresAt)
+	}
+	if !key.LastUsedAt.IsZero() {
+		pbKey.LastUsedAt = timestamppb.New(key.LastUsedAt)
+	}
+	return pbKey
+}
+
+func (s *BookingServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	if req.Owner == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "owner is not provided")
+	}
+	if len(req.Scopes) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "at least one scope is required")
+	}
+	for _, scope := range req.Scopes {
+		if !isKnownPermission(Permission(scope)) {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown scope: %v", scope)
+		}
 	}
 
-	booking, err := s.db.ModifySeat(datastore.BookingID(req.BookingId), datastore.SectionID(req.NewSectionId), datastore.SeatID(req.NewSeatId))
+	var expiresAt time.Time
+	if req.Ttl != nil {
+		if err := req.Ttl.CheckValid(); err != nil || req.Ttl.AsDuration() <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "ttl must be a positive duration")
+		}
+		expiresAt = time.Now().Add(req.Ttl.AsDuration())
+	}
+
+	key, plainKey, err := s.db.CreateAPIKey(ctx, strings.ToLower(req.Owner), req.Scopes, expiresAt)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "failed to modify seat: %v", err)
+		return nil, status.Errorf(codes.Unknown, "failed to create API key: %v", err)
 	}
 
-	updatedBooking := &pb.Booking{
-		BookingId: booking.BookingID,
-		User: &pb.User{
-			EmailAddress: booking.User.EmailAddress,
-			FirstName:    booking.User.FirstName,
-			LastName:     booking.User.LastName,
-		},
-		Seat: &pb.Seat{
-			SectionId: booking.Seat.SectionID,
-			SeatId:    booking.Seat.SeatID,
-		},
-		From:      booking.From,
-		To:        booking.To,
-		PricePaid: booking.PricePaid,
+	return &pb.CreateAPIKeyResponse{ApiKey: toPBAPIKey(key), Key: plainKey}, nil
+}
+
+func (s *BookingServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	resp := &pb.ListAPIKeysResponse{}
+	for _, key := range s.db.ListAPIKeys(ctx, strings.ToLower(req.Owner)) {
+		resp.ApiKeys = append(resp.ApiKeys, toPBAPIKey(key))
 	}
+	return resp, nil
+}
 
-	return updatedBooking, nil
+func (s *BookingServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.APIKey, error) {
+	key, err := s.db.RevokeAPIKey(ctx, req.KeyId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to revoke API key: %v", err)
+	}
+	return toPBAPIKey(key), nil
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"io"
 	"net"
+	"os"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
@@ -20,16 +22,72 @@ import (
 
 const bufSize = 1024 * 1024 // 1MB
 
+// testSecretKey signs the tokens of the tests, main reads it from JWT_SECRET_KEY
+const testSecretKey = "my-secret-key"
+
+func TestMain(m *testing.M) {
+	JWT_SECRET_KEY = testSecretKey
+	// The tests of the guest booking access don't wait, TestRequestBookingAccess_ResponseTime does
+	BOOKING_ACCESS_RESPONSE_TIME = 0
+	os.Exit(m.Run())
+}
+
+// TestGetSecretKey tests that the server requires JWT_SECRET_KEY rather than use a default secret
+func TestGetSecretKey(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "")
+	if secret, err := getSecretKey(); err == nil {
+		t.Fatalf("Expected an error without JWT_SECRET_KEY, got secret %q", secret)
+	}
+
+	t.Setenv("JWT_SECRET_KEY", "configured-secret")
+	secret, err := getSecretKey()
+	if err != nil {
+		t.Fatalf("Failed to read JWT_SECRET_KEY: %v", err)
+	}
+	if secret != "configured-secret" {
+		t.Errorf("Expected secret %q, got %q", "configured-secret", secret)
+	}
+}
+
 // createTestServer creates a new gRPC server and returns a client
 // to communicate with the server
-func createTestServer(t *testing.T, ctx context.Context, db *datastore.Datastore) (pb.BookingServiceClient, func()) {
+func createTestServer(t *testing.T, ctx context.Context, db *datastore.Datastore, options ...BookingServerOption) (pb.BookingServiceClient, func()) {
+	lis, closer := createTestListener(t, db, options...)
+
+	conn, err := grpc.DialContext(
+		ctx, "bufnet",
+		grpc.WithContextDialer(bufDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+
+	// create a client
+	client := pb.NewBookingServiceClient(conn)
+
+	// Return the client and the closer function
+	return client, closer
+}
+
+// bufDialer dials the in-memory listener
+func bufDialer(lis *bufconn.Listener) func(context.Context, string) (net.Conn, error) {
+	return func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}
+}
+
+// Create a test server with the interceptors of the server, serving on an in-memory listener
+func createTestListener(t *testing.T, db *datastore.Datastore, options ...BookingServerOption) (*bufconn.Listener, func()) {
 	lis := bufconn.Listen(bufSize)
+	// Every test server starts with empty buckets, like a new server process
+	rateLimiter = NewMemoryRateLimiter()
 
 	srvr := grpc.NewServer(
-		grpc.UnaryInterceptor(validateTokenUnaryInterceptor),
-		grpc.StreamInterceptor(validateTokenStreamInterceptor),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(metricsUnaryInterceptor, loggingUnaryInterceptor, validateTokenUnaryInterceptor, rateLimitUnaryInterceptor),
+		grpc.ChainStreamInterceptor(metricsStreamInterceptor, loggingStreamInterceptor, validateTokenStreamInterceptor, rateLimitStreamInterceptor),
 	)
-	pb.RegisterBookingServiceServer(srvr, NewBookingServer(db))
+	pb.RegisterBookingServiceServer(srvr, NewBookingServer(db, options...))
 
 	go func(t *testing.T) {
 		if err := srvr.Serve(lis); err != nil {
@@ -37,18 +95,6 @@ func createTestServer(t *testing.T, ctx context.Context, db *datastore.Datastore
 		}
 	}(t)
 
-	bufDialer := func(context.Context, string) (net.Conn, error) {
-		return lis.Dial()
-	}
-
-	conn, err := grpc.DialContext(
-		ctx, "bufnet",
-		grpc.WithContextDialer(bufDialer),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		t.Fatalf("error connecting to server: %v", err)
-	}
-
 	closer := func() {
 		err := lis.Close()
 		if err != nil {
@@ -56,12 +102,7 @@ func createTestServer(t *testing.T, ctx context.Context, db *datastore.Datastore
 		}
 		srvr.Stop()
 	}
-
-	// create a client
-	client := pb.NewBookingServiceClient(conn)
-
-	// Return the client and the closer function
-	return client, closer
+	return lis, closer
 }
 
 // Create a JWT token for testing
@@ -77,7 +118,7 @@ func createTestingJWTToken(subject string, isAdmin bool) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	// Sign the token with a secret key
-	tokenString, err := token.SignedString([]byte("my-secret-key"))
+	tokenString, err := token.SignedString([]byte(testSecretKey))
 	if err != nil {
 		return "", err
 	}
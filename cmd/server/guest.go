@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Guests prove they own an email address with a single-use booking access token delivered
+// by the Notifier, and exchange it for a short-lived session token scoped to their bookings.
+const (
+	// Value of the "typ" claim of booking access tokens, they are rejected as authorization tokens
+	bookingAccessTokenType = "booking_access"
+
+	BOOKING_ACCESS_TOKEN_TTL = 15 * time.Minute
+	GUEST_SESSION_TTL        = time.Hour
+)
+
+// BOOKING_ACCESS_RESPONSE_TIME is how long RequestBookingAccess takes at least, whether the address has
+// bookings or not. It should be above the usual latency of the notifier.
+var BOOKING_ACCESS_RESPONSE_TIME = time.Second
+
+// GuestSessionScopes are the permissions of a guest session token
+var GuestSessionScopes = []Permission{PermBookingsReadSelf, PermBookingsManageSelf}
+
+// signToken signs the claims with the JWT secret key
+func signToken(claims jwt.MapClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(JWT_SECRET_KEY))
+}
+
+// newTokenID generates a random id for single-use tokens
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %v", err)
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// bookingAccessToken holds the claims of a verified booking access token
+type bookingAccessToken struct {
+	Email     string
+	ID        string
+	ExpiresAt time.Time
+}
+
+// parseBookingAccessToken verifies the signature, type and expiry of a booking access token
+func parseBookingAccessToken(token string) (bookingAccessToken, error) {
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(JWT_SECRET_KEY), nil
+	})
+	if err != nil {
+		return bookingAccessToken{}, fmt.Errorf("invalid access token: %v", err)
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid || claims["typ"] != bookingAccessTokenType {
+		return bookingAccessToken{}, fmt.Errorf("invalid access token")
+	}
+
+	email, _ := claims["sub"].(string)
+	id, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if email == "" || id == "" || exp == 0 {
+		return bookingAccessToken{}, fmt.Errorf("incomplete access token")
+	}
+	return bookingAccessToken{Email: email, ID: id, ExpiresAt: time.Unix(int64(exp), 0)}, nil
+}
+
+// redeemBookingAccessToken verifies the booking access token and marks it as used
+func (s *BookingServer) redeemBookingAccessToken(ctx context.Context, token string) (bookingAccessToken, error) {
+	access, err := parseBookingAccessToken(token)
+	if err != nil {
+		return bookingAccessToken{}, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	if err := s.db.UseToken(ctx, access.ID, access.ExpiresAt); err != nil {
+		return bookingAccessToken{}, status.Errorf(codes.Unauthenticated, "access token was already used")
+	}
+	return access, nil
+}
+
+func (s *BookingServer) RequestBookingAccess(ctx context.Context, req *pb.RequestBookingAccessRequest) (*emptypb.Empty, error) {
+	if req.EmailAddress == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Email is not provided")
+	}
+	// Guest bookings are stored under the normalized email
+	email, err := NormalizeEmail(req.EmailAddress)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// Only addresses with bookings get a message. The response is the same either way and takes
+	// the same time, so it can't be used to find out who has bookings.
+	start := time.Now()
+	defer func() {
+		timer := time.NewTimer(time.Until(start.Add(BOOKING_ACCESS_RESPONSE_TIME)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}()
+
+	// The token is signed for every address, the work doesn't depend on the bookings either
+	tokenID, err := newTokenID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	expiresAt := time.Now().Add(BOOKING_ACCESS_TOKEN_TTL)
+	token, err := signToken(jwt.MapClaims{
+		"sub": email,
+		"typ": bookingAccessTokenType,
+		"jti": tokenID,
+		"exp": expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sign access token: %v", err)
+	}
+	if len(s.db.GetUserBookings(ctx, email)) == 0 {
+		return &emptypb.Empty{}, nil
+	}
+
+	// A failure to send is logged rather than returned, it would tell the address has bookings
+	if err := s.notifier.SendBookingAccess(ctx, email, token, expiresAt); err != nil {
+		slog.ErrorContext(ctx, "failed to send booking access token", "subject", logPseudonym(email), "error", err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *BookingServer) RedeemBookingAccess(ctx context.Context, req *pb.RedeemBookingAccessRequest) (*pb.BookingAccessSession, error) {
+	access, err := s.redeemBookingAccessToken(ctx, req.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := make([]string, len(GuestSessionScopes))
+	for i, scope := range GuestSessionScopes {
+		scopes[i] = string(scope)
+	}
+	expiresAt := time.Now().Add(GUEST_SESSION_TTL)
+	token, err := signToken(jwt.MapClaims{
+		"sub":   access.Email,
+		"scope": strings.Join(scopes, " "),
+		"guest": true,
+		"exp":   expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sign session token: %v", err)
+	}
+
+	return &pb.BookingAccessSession{Token: token, ExpiresAt: timestamppb.New(expiresAt)}, nil
+}
+
+func (s *BookingServer) ClaimGuestBookings(ctx context.Context, req *pb.ClaimGuestBookingsRequest) (*pb.ClaimGuestBookingsResponse, error) {
+	email, authenticated := s.isUserAuthenticated(ctx)
+	if !authenticated {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+
+	// The access token proves the user owns the email address the guest bookings were made with
+	access, err := s.redeemBookingAccessToken(ctx, req.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// The claimed bookings count towards the booking limits of the user
+	bookings, err := s.db.ClaimBookings(limitsContext(ctx), access.Email, email)
+	if limitErr := (*datastore.LimitExceeded)(nil); errors.As(err, &limitErr) {
+		return nil, limitStatus(limitErr, email)
+	}
+	if err != nil {
+		return nil, datastoreStatus(err, "failed to claim bookings")
+	}
+	slog.InfoContext(ctx, "claimed guest bookings", "subject", logPseudonym(email), "guest", logPseudonym(access.Email), "bookings", len(bookings))
+
+	resp := &pb.ClaimGuestBookingsResponse{}
+	for _, booking := range bookings {
+		resp.Bookings = append(resp.Bookings, toPBBooking(booking))
+	}
+	return resp, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// recordingNotifier keeps the booking access tokens instead of sending them
+type recordingNotifier struct {
+	tokens map[string]string
+}
+
+func (n *recordingNotifier) SendBookingAccess(ctx context.Context, email string, token string, expiresAt time.Time) error {
+	n.tokens[email] = token
+	return nil
+}
+
+func TestBookingServer_GuestBookingAccess(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	notifier := &recordingNotifier{tokens: map[string]string{}}
+	client, closer := createTestServer(t, ctx, db, WithNotifier(notifier))
+	defer closer()
+
+	// Two guests purchase without an account
+	var bookings []*pb.Booking
+	for i, email := range []string{"guest@example.com", "other@example.com"} {
+		booking, err := client.Purchase(ctx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: email, FirstName: "guest", LastName: "user"},
+			Seat: &pb.Seat{SectionId: "A", SeatId: []string{"1", "2"}[i]},
+		})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		bookings = append(bookings, booking)
+	}
+
+	// Addresses without bookings get the same answer but no message
+	if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "nobody@example.com"}); err != nil {
+		t.Fatalf("RequestBookingAccess() error = %v", err)
+	}
+	if len(notifier.tokens) != 0 {
+		t.Errorf("RequestBookingAccess() sent a message to an address without bookings")
+	}
+
+	if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "Guest@Example.com"}); err != nil {
+		t.Fatalf("RequestBookingAccess() error = %v", err)
+	}
+	accessToken := notifier.tokens["guest@example.com"]
+	if accessToken == "" {
+		t.Fatalf("RequestBookingAccess() didn't send the access token")
+	}
+
+	// The access token itself can't be used as authorization token
+	accessCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", accessToken))
+	if _, err := client.RemoveUserFromTrain(accessCtx, &pb.RemoveBookingRequest{BookingId: bookings[0].BookingId}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("RemoveUserFromTrain() with access token: got %v, want Unauthenticated", status.Code(err))
+	}
+
+	session, err := client.RedeemBookingAccess(ctx, &pb.RedeemBookingAccessRequest{AccessToken: accessToken})
+	if err != nil {
+		t.Fatalf("RedeemBookingAccess() error = %v", err)
+	}
+	if _, err := client.RedeemBookingAccess(ctx, &pb.RedeemBookingAccessRequest{AccessToken: accessToken}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("RedeemBookingAccess() reusing the token: got %v, want Unauthenticated", status.Code(err))
+	}
+
+	// The guest lists and manages only their own bookings
+	guestCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", session.Token))
+	stream, err := client.GetUserBookings(guestCtx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("GetUserBookings() error = %v", err)
+	}
+	gotNumBookings := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("GetUserBookings() error = %v", err)
+		}
+		gotNumBookings++
+	}
+	if gotNumBookings != 1 {
+		t.Errorf("GetUserBookings() gotNumBookings = %v, want 1", gotNumBookings)
+	}
+
+	if _, err := client.ModifySeat(guestCtx, &pb.ModifySeatRequest{BookingId: bookings[1].BookingId, NewSectionId: "B", NewSeatId: "1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("ModifySeat() of another guest's booking: got %v, want NotFound", status.Code(err))
+	}
+	if _, err := client.RemoveUserFromTrain(guestCtx, &pb.RemoveBookingRequest{BookingId: bookings[1].BookingId}); status.Code(err) != codes.NotFound {
+		t.Errorf("RemoveUserFromTrain() of another guest's booking: got %v, want NotFound", status.Code(err))
+	}
+
+	if _, err := client.ModifySeat(guestCtx, &pb.ModifySeatRequest{BookingId: bookings[0].BookingId, NewSectionId: "B", NewSeatId: "1"}); err != nil {
+		t.Errorf("ModifySeat() of own booking error = %v", err)
+	}
+	if _, err := client.RemoveUserFromTrain(guestCtx, &pb.RemoveBookingRequest{BookingId: bookings[0].BookingId}); err != nil {
+		t.Errorf("RemoveUserFromTrain() of own booking error = %v", err)
+	}
+	if got := db.GetUserBookings(ctx, "guest@example.com"); len(got) != 0 {
+		t.Errorf("RemoveUserFromTrain() bookings left = %v, want none", len(got))
+	}
+}
+
+func TestWriterNotifier_SendBookingAccess(t *testing.T) {
+	var buf bytes.Buffer
+	notifier := NewWriterNotifier(&buf, "https://example.com/bookings?lang=en")
+	if err := notifier.SendBookingAccess(context.Background(), "guest@example.com", "abc.def", time.Now()); err != nil {
+		t.Fatalf("SendBookingAccess() error = %v", err)
+	}
+	for _, want := range []string{"To: guest@example.com", "https://example.com/bookings?lang=en&token=abc.def"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("SendBookingAccess() message = %q, want it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+// failingNotifier takes some time and fails to deliver the tokens
+type failingNotifier struct{}
+
+func (failingNotifier) SendBookingAccess(ctx context.Context, email string, token string, expiresAt time.Time) error {
+	time.Sleep(10 * time.Millisecond)
+	return errors.New("mail server unavailable")
+}
+
+func TestRequestBookingAccess_ResponseTime(t *testing.T) {
+	defer func(responseTime time.Duration) { BOOKING_ACCESS_RESPONSE_TIME = responseTime }(BOOKING_ACCESS_RESPONSE_TIME)
+	BOOKING_ACCESS_RESPONSE_TIME = 100 * time.Millisecond
+
+	ctx := context.Background()
+	db := datastore.NewDatastore(datastore.WithSections("A"), datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db, WithNotifier(failingNotifier{}))
+	defer closer()
+	if _, err := client.Purchase(ctx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "guest@example.com", FirstName: "guest", LastName: "user"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	}); err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+
+	// Addresses with and without bookings get the same answer after the same time, even when the
+	// message can't be sent
+	for _, email := range []string{"guest@example.com", "nobody@example.com"} {
+		start := time.Now()
+		if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: email}); err != nil {
+			t.Errorf("RequestBookingAccess(%v) error = %v", email, err)
+		}
+		if elapsed := time.Since(start); elapsed < BOOKING_ACCESS_RESPONSE_TIME {
+			t.Errorf("RequestBookingAccess(%v) answered after %v, want at least %v", email, elapsed, BOOKING_ACCESS_RESPONSE_TIME)
+		}
+	}
+}
+
+func TestBookingServer_ClaimGuestBookings(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	notifier := &recordingNotifier{tokens: map[string]string{}}
+	client, closer := createTestServer(t, ctx, db, WithNotifier(notifier))
+	defer closer()
+
+	// The guest booking is stored under the request email, the account uses a different subject
+	guestBooking, err := client.Purchase(ctx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "Traveller@Example.com", FirstName: "travel", LastName: "ler"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	})
+	if err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	accountCtx := getCtxWithToken(t, ctx, "account-42", false)
+
+	if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "traveller@example.com"}); err != nil {
+		t.Fatalf("RequestBookingAccess() error = %v", err)
+	}
+	accessToken := notifier.tokens["traveller@example.com"]
+
+	// Guest sessions can't claim bookings into another account
+	session, err := client.RedeemBookingAccess(ctx, &pb.RedeemBookingAccessRequest{AccessToken: accessToken})
+	if err != nil {
+		t.Fatalf("RedeemBookingAccess() error = %v", err)
+	}
+	guestCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", session.Token))
+	if _, err := client.ClaimGuestBookings(guestCtx, &pb.ClaimGuestBookingsRequest{AccessToken: accessToken}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ClaimGuestBookings() with guest session: got %v, want PermissionDenied", status.Code(err))
+	}
+
+	// The redeemed token is no proof of ownership anymore
+	if _, err := client.ClaimGuestBookings(accountCtx, &pb.ClaimGuestBookingsRequest{AccessToken: accessToken}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("ClaimGuestBookings() with used token: got %v, want Unauthenticated", status.Code(err))
+	}
+
+	if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "traveller@example.com"}); err != nil {
+		t.Fatalf("RequestBookingAccess() error = %v", err)
+	}
+	claimed, err := client.ClaimGuestBookings(accountCtx, &pb.ClaimGuestBookingsRequest{AccessToken: notifier.tokens["traveller@example.com"]})
+	if err != nil {
+		t.Fatalf("ClaimGuestBookings() error = %v", err)
+	}
+	if len(claimed.Bookings) != 1 || claimed.Bookings[0].BookingId != guestBooking.BookingId {
+		t.Fatalf("ClaimGuestBookings() = %v, want the guest booking", claimed.Bookings)
+	}
+
+	if got := db.GetUserBookings(ctx, "account-42"); len(got) != 1 || got[0].Owner() != "account-42" {
+		t.Errorf("GetUserBookings() of account = %v, want the claimed booking", got)
+	}
+	if got := db.GetUserBookings(ctx, "traveller@example.com"); len(got) != 0 {
+		t.Errorf("GetUserBookings() of guest = %v, want none", got)
+	}
+
+	trail := db.AuditTrail()
+	if len(trail) != 1 {
+		t.Fatalf("AuditTrail() = %v, want one event", trail)
+	}
+	if event := trail[0]; event.Action != datastore.AUDIT_CLAIM_GUEST_BOOKINGS || event.Actor != "account-42" ||
+		event.Subject != "traveller@example.com" || event.Details["booking_ids"] != guestBooking.BookingId {
+		t.Errorf("AuditTrail() event = %+v", event)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// Health service names of the subsystems, "" is the status of the whole server
+const (
+	healthServer    = ""
+	healthBooking   = "BookingService"
+	healthDatastore = "datastore"
+	healthKeys      = "keys"
+)
+
+// Methods of the reflection services, they are public when reflection is enabled
+var reflectionMethods = []string{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+}
+
+// registerHealth registers the health service with every subsystem not serving yet,
+// they are marked serving once they are ready
+func registerHealth(server *grpc.Server) *health.Server {
+	healthSrv := health.NewServer()
+	for _, service := range []string{healthServer, healthBooking, healthDatastore, healthKeys} {
+		healthSrv.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	healthpb.RegisterHealthServer(server, healthSrv)
+	return healthSrv
+}
+
+// registerReflection registers the reflection service and makes it public
+func registerReflection(server *grpc.Server) error {
+	for _, method := range reflectionMethods {
+		if err := addPublicMethod(PublicMethods, method, AccessPublic); err != nil {
+			return err
+		}
+	}
+	reflection.Register(server)
+	return nil
+}
+
+// keysStatus returns the status of the keys subsystem. It serves once the JWT secret is configured
+// and, when TLS is enabled, the listener has a certificate loaded to serve.
+func keysStatus(secret string, tlsConfig *TLSConfig, listenerTLS *tls.Config) healthpb.HealthCheckResponse_ServingStatus {
+	if secret == "" {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if tlsConfig != nil {
+		if listenerTLS == nil || listenerTLS.GetConfigForClient == nil {
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		config, err := listenerTLS.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil || config == nil || len(config.Certificates) == 0 {
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/13thuser/exampleauth/datastore"
+)
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	lis := bufconn.Listen(bufSize)
+	srvr := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(loggingUnaryInterceptor, validateTokenUnaryInterceptor),
+		grpc.ChainStreamInterceptor(loggingStreamInterceptor, validateTokenStreamInterceptor),
+	)
+	healthSrv := registerHealth(srvr)
+	go srvr.Serve(lis)
+	defer srvr.Stop()
+
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		// Health checks are public, no token is sent
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Check(%q) error = %v", service, err)
+		}
+		return resp.Status
+	}
+
+	for _, service := range []string{healthServer, healthBooking, healthDatastore, healthKeys} {
+		if got := check(service); got != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("Check(%q) before ready = %v, want NOT_SERVING", service, got)
+		}
+	}
+
+	healthSrv.SetServingStatus(healthDatastore, healthpb.HealthCheckResponse_SERVING)
+	if got := check(healthDatastore); got != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Check(datastore) after ready = %v, want SERVING", got)
+	}
+	if got := check(healthKeys); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check(keys) = %v, want NOT_SERVING, subsystems report separately", got)
+	}
+
+	healthSrv.Shutdown()
+	if got := check(healthDatastore); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check(datastore) after shutdown = %v, want NOT_SERVING", got)
+	}
+}
+
+func TestDatastorePersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "datastore.json")
+	options := []datastore.DatastoreOption{datastore.WithSections("A", "B"), datastore.WithSectionSize(2)}
+
+	db := datastore.NewDatastore(options...)
+	booking, err := db.Purchase(ctx, "user@example.com", datastore.Booking{
+		User: datastore.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: datastore.Seat{SectionID: "A", SeatID: "1"},
+	})
+	if err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	_, secret, err := db.CreateAPIKey(ctx, "service@example.com", []string{string(PermBookingsReadAny)}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	if err := db.SaveFile(ctx, path); err != nil {
+		t.Fatalf("SaveFile() error = %v", err)
+	}
+
+	restored := datastore.NewDatastore(options...)
+	if err := restored.LoadFile(ctx, path); err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	bookings := restored.GetUserBookings(ctx, "user@example.com")
+	if len(bookings) != 1 || bookings[0].BookingID != booking.BookingID || bookings[0].Owner() != "user@example.com" {
+		t.Errorf("restored bookings = %+v, want %+v", bookings, booking)
+	}
+	// The seat stays taken
+	if _, err := restored.Purchase(ctx, "other@example.com", datastore.Booking{
+		User: datastore.User{EmailAddress: "other@example.com"},
+		Seat: datastore.Seat{SectionID: "A", SeatID: "1"},
+	}); err == nil {
+		t.Errorf("Purchase() of a restored seat succeeded")
+	}
+	if _, err := restored.AuthenticateAPIKey(ctx, secret); err != nil {
+		t.Errorf("AuthenticateAPIKey() of a restored key error = %v", err)
+	}
+
+	// A snapshot that doesn't fit the sections is rejected and leaves the datastore unchanged
+	small := datastore.NewDatastore(datastore.WithSections("B"))
+	if err := small.LoadFile(ctx, path); err == nil {
+		t.Errorf("LoadFile() into other sections succeeded")
+	}
+
+	// Nothing to restore on the first start
+	if err := datastore.NewDatastore().LoadFile(ctx, filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("LoadFile() of a missing file error = %v", err)
+	}
+}
+
+func TestKeysStatus(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	tlsConfig := &TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	}
+	cert, key := ca.issue(t, 20, "server", []string{"localhost"}, nil, x509.ExtKeyUsageServerAuth)
+	writeFile(t, tlsConfig.CertFile, cert)
+	writeFile(t, tlsConfig.KeyFile, key)
+	listenerTLS, err := webTLSConfig(*tlsConfig)
+	if err != nil {
+		t.Fatalf("webTLSConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		secret      string
+		tlsConfig   *TLSConfig
+		listenerTLS *tls.Config
+		want        healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{"no secret", "", nil, nil, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"no secret with TLS", "", tlsConfig, listenerTLS, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"secret without TLS", "secret", nil, nil, healthpb.HealthCheckResponse_SERVING},
+		{"TLS certificates not loaded", "secret", tlsConfig, nil, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"TLS without certificate", "secret", tlsConfig, &tls.Config{}, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"secret and TLS certificates", "secret", tlsConfig, listenerTLS, healthpb.HealthCheckResponse_SERVING},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keysStatus(tt.secret, tt.tlsConfig, tt.listenerTLS); got != tt.want {
+				t.Errorf("keysStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
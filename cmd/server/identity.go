@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// IdentityMode decides whose email address an authenticated purchase may be made for
+type IdentityMode string
+
+const (
+	// The passenger must be the token subject, only callers with PermBookingsWriteAny book for others
+	IdentityMatchSubject IdentityMode = "match_subject"
+	// The token subject is the purchaser and may book for any passenger
+	IdentityPassenger IdentityMode = "passenger"
+)
+
+// DefaultDisposableEmailDomains are well known throwaway email providers
+var DefaultDisposableEmailDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"maildrop.cc",
+	"sharklasers.com",
+	"temp-mail.org",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// IdentityRules validate the passenger of a purchase
+type IdentityRules struct {
+	Mode IdentityMode
+
+	// Purchases for addresses of these domains and their subdomains are rejected
+	DisposableDomains map[string]struct{}
+}
+
+// DefaultIdentityRules allows booking for others and blocks the default disposable domains
+func DefaultIdentityRules() IdentityRules {
+	rules := IdentityRules{Mode: IdentityPassenger, DisposableDomains: make(map[string]struct{})}
+	for _, domain := range DefaultDisposableEmailDomains {
+		rules.DisposableDomains[domain] = struct{}{}
+	}
+	return rules
+}
+
+// isDisposable checks the ASCII domain and its parent domains against the disposable domains
+func (r IdentityRules) isDisposable(domain string) bool {
+	for {
+		if _, ok := r.DisposableDomains[domain]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return false
+		}
+		domain = parent
+	}
+}
+
+// ValidateEmail normalizes the email address and rejects addresses of disposable domains
+func (r IdentityRules) ValidateEmail(email string) (string, error) {
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return "", err
+	}
+	if r.isDisposable(normalized[strings.LastIndex(normalized, "@")+1:]) {
+		return "", fmt.Errorf("disposable email addresses are not accepted: %v", normalized)
+	}
+	return normalized, nil
+}
+
+// PassengerEmail returns the validated passenger email of a purchase. Guests always book for
+// themselves, authenticated callers are checked against the identity mode.
+func (r IdentityRules) PassengerEmail(requested string, subject string, authenticated bool, bookForOthers bool) (string, error) {
+	if authenticated && requested == "" {
+		requested = subject
+	}
+	passenger, err := r.ValidateEmail(requested)
+	if err != nil {
+		return "", err
+	}
+	if !authenticated || bookForOthers || r.Mode != IdentityMatchSubject {
+		return passenger, nil
+	}
+
+	if normalizedSubject, err := NormalizeEmail(subject); err != nil || normalizedSubject != passenger {
+		return "", fmt.Errorf("passenger email must be the email address of the account")
+	}
+	return passenger, nil
+}
+
+// Characters allowed in the local part besides letters and digits (RFC 5322 dot-atom)
+const emailLocalSpecials = "!#$%&'*+/=?^_`{|}~-."
+
+// NormalizeEmail validates the syntax of the email address and returns its canonical form:
+// compatibility characters are folded (NFKC, e.g. fullwidth letters), the address is lowercased and
+// the domain is converted to its ASCII (punycode) form. The local part must be ASCII and domain labels
+// must not mix scripts, which rejects lookalikes such as a Cyrillic "а" in a Latin name.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(norm.NFKC.String(strings.TrimSpace(email)))
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", fmt.Errorf("invalid email address %q", email)
+	}
+	local, domain := email[:at], email[at+1:]
+
+	if len(local) > 64 {
+		return "", fmt.Errorf("invalid email address %q: local part is too long", email)
+	}
+	if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return "", fmt.Errorf("invalid email address %q: misplaced dot", email)
+	}
+	for _, c := range local {
+		if c > unicode.MaxASCII || !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune(emailLocalSpecials, c)) {
+			return "", fmt.Errorf("invalid email address %q: character %q is not allowed", email, c)
+		}
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if mixedScript(label) {
+			return "", fmt.Errorf("invalid email address %q: domain mixes scripts", email)
+		}
+	}
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid email address %q: %v", email, err)
+	}
+	labels := strings.Split(asciiDomain, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("invalid email address %q: domain must have a top level domain", email)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("invalid email address %q: invalid domain", email)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("invalid email address %q: invalid domain", email)
+			}
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", fmt.Errorf("invalid email address %q: invalid top level domain", email)
+	}
+
+	normalized := local + "@" + asciiDomain
+	if len(normalized) > 254 {
+		return "", fmt.Errorf("invalid email address %q: address is too long", email)
+	}
+	return normalized, nil
+}
+
+// Scripts that are written together, e.g. Japanese mixes Han, Hiragana and Katakana
+var scriptGroups = map[string]string{
+	"Han":      "CJK",
+	"Hiragana": "CJK",
+	"Katakana": "CJK",
+	"Hangul":   "CJK",
+	"Bopomofo": "CJK",
+}
+
+// mixedScript checks if the label has letters of more than one script, common characters
+// such as digits and hyphens belong to every script
+func mixedScript(label string) bool {
+	seen := ""
+	for _, c := range label {
+		if c <= unicode.MaxASCII {
+			if unicode.IsLetter(c) {
+				if seen != "" && seen != "Latin" {
+					return true
+				}
+				seen = "Latin"
+			}
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name == "Common" || name == "Inherited" || !unicode.Is(table, c) {
+				continue
+			}
+			if group, ok := scriptGroups[name]; ok {
+				name = group
+			}
+			if seen != "" && seen != name {
+				return true
+			}
+			seen = name
+			break
+		}
+	}
+	return false
+}
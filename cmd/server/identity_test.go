@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := map[string]struct {
+		email   string
+		want    string
+		wantErr bool
+	}{
+		"plain":                {email: "john.doe@example.com", want: "john.doe@example.com"},
+		"case and spaces":      {email: "  John.Doe@Example.COM ", want: "john.doe@example.com"},
+		"plus tag":             {email: "john+trains@example.co.uk", want: "john+trains@example.co.uk"},
+		"fullwidth letters":    {email: "ｊｏｈｎ@ｅｘａｍｐｌｅ.com", want: "john@example.com"},
+		"unicode domain":       {email: "anna@bücher.de", want: "anna@xn--bcher-kva.de"},
+		"japanese domain":      {email: "taro@例え.テスト", want: "taro@xn--r8jz45g.xn--zckzah"},
+		"missing at":           {email: "john.example.com", wantErr: true},
+		"missing local part":   {email: "@example.com", wantErr: true},
+		"missing domain":       {email: "john@", wantErr: true},
+		"display name":         {email: "John <john@example.com>", wantErr: true},
+		"consecutive dots":     {email: "john..doe@example.com", wantErr: true},
+		"no top level domain":  {email: "john@localhost", wantErr: true},
+		"numeric tld":          {email: "john@10.0.0.1", wantErr: true},
+		"hyphen label":         {email: "john@-example.com", wantErr: true},
+		"cyrillic local part":  {email: "аdmin@example.com", wantErr: true},
+		"mixed script domain":  {email: "john@pаypal.com", wantErr: true},
+		"underscore in domain": {email: "john@ex_ample.com", wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := NormalizeEmail(tt.email)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeEmail(%q) error = %v, wantErr %v", tt.email, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityRules_PassengerEmail(t *testing.T) {
+	passengerRules := DefaultIdentityRules()
+	matchRules := DefaultIdentityRules()
+	matchRules.Mode = IdentityMatchSubject
+
+	tests := map[string]struct {
+		rules         IdentityRules
+		requested     string
+		subject       string
+		authenticated bool
+		bookForOthers bool
+		want          string
+		wantErr       bool
+	}{
+		"guest":                       {rules: matchRules, requested: "Guest@Example.com", want: "guest@example.com"},
+		"guest with disposable email": {rules: passengerRules, requested: "guest@mailinator.com", wantErr: true},
+		"disposable subdomain":        {rules: passengerRules, requested: "guest@eu.mailinator.com", wantErr: true},
+		"passenger mode books for others": {
+			rules: passengerRules, requested: "friend@example.com", subject: "user@example.com", authenticated: true, want: "friend@example.com",
+		},
+		"match mode books for self": {
+			rules: matchRules, requested: "USER@example.com", subject: "user@example.com", authenticated: true, want: "user@example.com",
+		},
+		"match mode defaults to subject": {
+			rules: matchRules, subject: "user@example.com", authenticated: true, want: "user@example.com",
+		},
+		"match mode rejects others": {
+			rules: matchRules, requested: "friend@example.com", subject: "user@example.com", authenticated: true, wantErr: true,
+		},
+		"match mode lets agents book for others": {
+			rules: matchRules, requested: "friend@example.com", subject: "agent@example.com", authenticated: true, bookForOthers: true, want: "friend@example.com",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.rules.PassengerEmail(tt.requested, tt.subject, tt.authenticated, tt.bookForOthers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PassengerEmail() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("PassengerEmail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBookingServer_PurchaseIdentityRules(t *testing.T) {
+	ctx := context.Background()
+
+	rules := DefaultIdentityRules()
+	rules.Mode = IdentityMatchSubject
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db, WithIdentityRules(rules))
+	defer closer()
+
+	userCtx := getCtxWithToken(t, ctx, "user@example.com", false)
+	_, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "someone.else@example.com", FirstName: "some", LastName: "one"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Purchase() for someone else: got %v, want InvalidArgument", status.Code(err))
+	}
+
+	booking, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "User@Example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	})
+	if err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	if booking.User.EmailAddress != "user@example.com" || booking.Purchaser != "user@example.com" {
+		t.Errorf("Purchase() passenger = %v, purchaser = %v", booking.User.EmailAddress, booking.Purchaser)
+	}
+
+	// Guests always book for themselves, under the normalized email
+	guestBooking, err := client.Purchase(ctx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "ｇｕｅｓｔ@Example.com", FirstName: "guest", LastName: "user"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "2"},
+	})
+	if err != nil {
+		t.Fatalf("Purchase() by guest error = %v", err)
+	}
+	if guestBooking.Purchaser != "guest@example.com" {
+		t.Errorf("Purchase() by guest purchaser = %v, want guest@example.com", guestBooking.Purchaser)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Admins impersonate a customer with a token whose "sub" is the customer and whose "act" claim
+// names the admin, as in RFC 8693: {"sub": "customer@example.com", "act": {"sub": "admin@example.com"}}.
+// The roles and scopes of the token are the admin's, they must grant PermUsersImpersonate.
+// The call runs with the permissions of a plain user so the admin sees what the customer sees.
+
+// actorKey is the context key of the subject of the admin impersonating the caller
+const actorKey contextKey = "actor"
+
+// ImpersonationMethods are the exact gRPC FullMethods that can be called while impersonating,
+// every other method is denied. It can be configured with IMPERSONATION_METHODS, see env.go.
+var ImpersonationMethods = map[string]struct{}{
+	"/BookingService/GetUserBookings": {},
+	"/BookingService/ListBookings":    {},
+}
+
+// actorFromContext returns the subject of the admin impersonating the caller
+func actorFromContext(ctx context.Context) (string, bool) {
+	actor, ok := ctx.Value(actorKey).(string)
+	return actor, ok
+}
+
+// impersonate checks the "act" claim of the validated token and switches the context to the
+// impersonated user's permissions. Tokens without an "act" claim are left alone.
+func impersonate(ctx context.Context, fullMethod string) (context.Context, error) {
+	claims, _ := ctx.Value(claimsKey).(jwt.MapClaims)
+	act, ok := claims["act"]
+	if !ok {
+		return ctx, nil
+	}
+
+	actClaims, ok := act.(map[string]interface{})
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid act claim")
+	}
+	actor, _ := actClaims["sub"].(string)
+	if actor == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "act claim has no subject")
+	}
+	if _, ok := actClaims["act"]; ok {
+		return nil, status.Errorf(codes.Unauthenticated, "delegation chains are not supported")
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" || subject == actor {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid impersonated subject")
+	}
+
+	if !permissionsFromContext(ctx).Has(PermUsersImpersonate) {
+		slog.WarnContext(ctx, "impersonation denied", "actor", logPseudonym(actor), "subject", logPseudonym(subject), "method", fullMethod, "reason", "missing permission")
+		return nil, status.Errorf(codes.PermissionDenied, "%v may not impersonate users", actor)
+	}
+	if _, ok := ImpersonationMethods[fullMethod]; !ok {
+		slog.WarnContext(ctx, "impersonation denied", "actor", logPseudonym(actor), "subject", logPseudonym(subject), "method", fullMethod, "reason", "method not allowed")
+		return nil, status.Errorf(codes.PermissionDenied, "%v can't be called while impersonating", fullMethod)
+	}
+	slog.InfoContext(ctx, "impersonation", "actor", logPseudonym(actor), "subject", logPseudonym(subject), "method", fullMethod)
+
+	perms := make(Permissions)
+	for _, perm := range RolePermissions[RoleUser] {
+		perms[perm] = struct{}{}
+	}
+	ctx = context.WithValue(ctx, actorKey, actor)
+	ctx = context.WithValue(ctx, permissionsKey, perms)
+	return ctx, nil
+}
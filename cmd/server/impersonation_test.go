@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestImpersonation(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	customerCtx := getCtxWithToken(t, ctx, "customer@example.com", false)
+	booking, err := client.Purchase(customerCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "customer@example.com", FirstName: "cust", LastName: "omer"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	})
+	if err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	// The admin sees the customer's bookings
+	adminCtx := getCtxWithClaims(t, ctx, jwt.MapClaims{
+		"sub":   "customer@example.com",
+		"act":   map[string]interface{}{"sub": "admin@example.com"},
+		"roles": []string{RoleAdmin},
+	})
+	stream, err := client.GetUserBookings(adminCtx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("GetUserBookings() error = %v", err)
+	}
+	var got []*pb.Booking
+	for {
+		b, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("GetUserBookings() error = %v", err)
+		}
+		got = append(got, b)
+	}
+	if len(got) != 1 || got[0].BookingId != booking.BookingId {
+		t.Errorf("GetUserBookings() while impersonating = %v, want the customer's booking", got)
+	}
+	if !strings.Contains(logs.String(), "msg=impersonation actor="+logPseudonym("admin@example.com")+" subject="+logPseudonym("customer@example.com")+" method=/BookingService/GetUserBookings") {
+		t.Errorf("impersonated call is not logged with both identities: %q", logs.String())
+	}
+
+	// Methods outside the allow list are denied even though the admin could call them directly
+	if _, err := client.ModifySeat(adminCtx, &pb.ModifySeatRequest{BookingId: booking.BookingId, NewSectionId: "B", NewSeatId: "1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ModifySeat() while impersonating: got %v, want PermissionDenied", status.Code(err))
+	}
+
+	tests := map[string]struct {
+		claims jwt.MapClaims
+		want   codes.Code
+	}{
+		"agent can't impersonate": {
+			claims: jwt.MapClaims{"sub": "customer@example.com", "act": map[string]interface{}{"sub": "agent@example.com"}, "roles": []string{RoleAgent}},
+			want:   codes.PermissionDenied,
+		},
+		"user can't impersonate": {
+			claims: jwt.MapClaims{"sub": "customer@example.com", "act": map[string]interface{}{"sub": "other@example.com"}},
+			want:   codes.PermissionDenied,
+		},
+		"act without subject": {
+			claims: jwt.MapClaims{"sub": "customer@example.com", "act": map[string]interface{}{}, "roles": []string{RoleAdmin}},
+			want:   codes.Unauthenticated,
+		},
+		"act is not an object": {
+			claims: jwt.MapClaims{"sub": "customer@example.com", "act": "admin@example.com", "roles": []string{RoleAdmin}},
+			want:   codes.Unauthenticated,
+		},
+		"delegation chain": {
+			claims: jwt.MapClaims{
+				"sub":   "customer@example.com",
+				"act":   map[string]interface{}{"sub": "admin@example.com", "act": map[string]interface{}{"sub": "root@example.com"}},
+				"roles": []string{RoleAdmin},
+			},
+			want: codes.Unauthenticated,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			stream, err := client.GetUserBookings(getCtxWithClaims(t, ctx, tt.claims), &emptypb.Empty{})
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if status.Code(err) != tt.want {
+				t.Errorf("GetUserBookings() got %v, want %v", status.Code(err), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// limitsContext exempts callers with PermBookingsLimitsExempt from the datastore's booking limits
+func limitsContext(ctx context.Context) context.Context {
+	if permissionsFromContext(ctx).Has(PermBookingsLimitsExempt) {
+		return datastore.ExemptFromLimits(ctx)
+	}
+	return ctx
+}
+
+// cancellationContext is limitsContext for the cancellations, it names the caller as the canceller.
+// An admin impersonating the owner cancels on the owner's behalf.
+func cancellationContext(ctx context.Context) context.Context {
+	canceller, _ := ctx.Value(emailIDKey).(string)
+	if actor, ok := actorFromContext(ctx); ok {
+		canceller = actor
+	}
+	return datastore.CancelledBy(limitsContext(ctx), canceller)
+}
+
+// limitStatus converts a booking limit violation to ResourceExhausted with QuotaFailure and
+// ErrorInfo details, and a RetryInfo detail telling when the cancellation cooldown ends
+func limitStatus(limitErr *datastore.LimitExceeded, userID string) error {
+	details := []protoadapt.MessageV1{&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+		Subject:     fmt.Sprintf("user:%v/%v", userID, limitErr.Rule),
+		Description: limitErr.Error(),
+	}}}, &errdetails.ErrorInfo{
+		Reason:   pb.REASON_BOOKING_LIMIT_EXCEEDED,
+		Domain:   pb.ErrorDomain,
+		Metadata: map[string]string{"rule": limitErr.Rule},
+	}}
+	if limitErr.RetryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(limitErr.RetryAfter)})
+	}
+
+	st, err := status.New(codes.ResourceExhausted, limitErr.Error()).WithDetails(details...)
+	if err != nil {
+		return status.Errorf(codes.ResourceExhausted, "%v", limitErr)
+	}
+	return st.Err()
+}
+
+func (s *BookingServer) GetMyLimits(ctx context.Context, req *emptypb.Empty) (*pb.UserLimits, error) {
+	email, authenticated := s.isUserAuthenticated(ctx)
+	if !authenticated {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+
+	limits := s.db.GetUserLimits(limitsContext(ctx), email)
+	resp := &pb.UserLimits{
+		MaxActiveBookings:    int32(limits.MaxActiveBookings),
+		ActiveBookings:       int32(limits.ActiveBookings),
+		MaxSeatsPerPurchase:  int32(limits.MaxSeatsPerPurchase),
+		CancellationCooldown: durationpb.New(limits.CancellationCooldown),
+		Exempt:               limits.Exempt,
+	}
+	if !limits.CooldownEnds.IsZero() {
+		resp.CooldownEnds = timestamppb.New(limits.CooldownEnds)
+	}
+	return resp, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestBookingLimits(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(4),
+		datastore.WithBookingLimits(datastore.BookingLimits{MaxActiveBookings: 2, MaxSeatsPerPurchase: 2, CancellationCooldown: time.Hour}))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	purchase := func(callCtx context.Context, email, section, seat string) (*pb.Booking, error) {
+		return client.Purchase(callCtx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: email, FirstName: "john", LastName: "doe"},
+			Seat: &pb.Seat{SectionId: section, SeatId: seat},
+		})
+	}
+
+	userCtx := getCtxWithToken(t, ctx, "user@example.com", false)
+	for _, seat := range []string{"1", "2"} {
+		if _, err := purchase(userCtx, "user@example.com", "A", seat); err != nil {
+			t.Fatalf("Purchase() within the limit error = %v", err)
+		}
+	}
+
+	// The third booking is over the limit
+	_, err := purchase(userCtx, "user@example.com", "A", "3")
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Purchase() over the limit error = %v, want ResourceExhausted", err)
+	}
+	if len(st.Details()) != 2 {
+		t.Fatalf("Purchase() over the limit details = %v, want QuotaFailure and ErrorInfo", st.Details())
+	}
+	if quota, ok := st.Details()[0].(*errdetails.QuotaFailure); !ok || quota.Violations[0].Subject != "user:user@example.com/"+datastore.LIMIT_ACTIVE_BOOKINGS {
+		t.Errorf("Purchase() over the limit details = %v, want an active bookings violation", st.Details())
+	}
+	if info, ok := st.Details()[1].(*errdetails.ErrorInfo); !ok || info.Reason != pb.REASON_BOOKING_LIMIT_EXCEEDED || info.Metadata["rule"] != datastore.LIMIT_ACTIVE_BOOKINGS {
+		t.Errorf("Purchase() over the limit details = %v, want a BOOKING_LIMIT_EXCEEDED reason", st.Details())
+	}
+
+	// Guests are limited by the email they book with
+	for i, seat := range []string{"1", "2", "3"} {
+		_, err := purchase(ctx, "guest@example.com", "B", seat)
+		if i < 2 && err != nil {
+			t.Fatalf("guest Purchase() within the limit error = %v", err)
+		}
+		if i == 2 && status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("guest Purchase() over the limit error = %v, want ResourceExhausted", err)
+		}
+	}
+
+	limits, err := client.GetMyLimits(userCtx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("GetMyLimits() error = %v", err)
+	}
+	if limits.MaxActiveBookings != 2 || limits.ActiveBookings != 2 || limits.MaxSeatsPerPurchase != 2 ||
+		limits.CancellationCooldown.AsDuration() != time.Hour || limits.CooldownEnds != nil || limits.Exempt {
+		t.Errorf("GetMyLimits() = %v", limits)
+	}
+
+	// A cancellation blocks purchases until the cooldown ends
+	booking := db.GetUserBookings(ctx, "user@example.com")[0]
+	if err := db.RemoveUserFromTrain(ctx, datastore.BookingID(booking.BookingID)); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	_, err = purchase(userCtx, "user@example.com", "A", "3")
+	st = status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Purchase() during the cooldown error = %v, want ResourceExhausted", err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if detail, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = detail
+		}
+	}
+	if retryInfo == nil || retryInfo.RetryDelay.AsDuration() <= 0 || retryInfo.RetryDelay.AsDuration() > time.Hour {
+		t.Errorf("Purchase() during the cooldown RetryInfo = %v, want the rest of the cooldown", retryInfo)
+	}
+	if limits, err := client.GetMyLimits(userCtx, &emptypb.Empty{}); err != nil || limits.CooldownEnds == nil || limits.ActiveBookings != 1 {
+		t.Errorf("GetMyLimits() during the cooldown = %v, %v, want the end of the cooldown", limits, err)
+	}
+
+	// Admins are exempt, and their cancellations don't start a cooldown
+	adminCtx := getCtxWithToken(t, ctx, "admin@example.com", true)
+	for _, seat := range [][2]string{{"A", "3"}, {"A", "4"}, {"B", "4"}} {
+		if _, err := purchase(adminCtx, "admin@example.com", seat[0], seat[1]); err != nil {
+			t.Errorf("admin Purchase() over the limit error = %v", err)
+		}
+	}
+	adminBookings := db.GetUserBookings(ctx, "admin@example.com")
+	if _, err := client.RemoveUserFromTrain(adminCtx, &pb.RemoveBookingRequest{BookingId: adminBookings[0].BookingID}); err != nil {
+		t.Fatalf("admin RemoveUserFromTrain() error = %v", err)
+	}
+	limits, err = client.GetMyLimits(adminCtx, &emptypb.Empty{})
+	if err != nil || !limits.Exempt || limits.CooldownEnds != nil {
+		t.Errorf("admin GetMyLimits() = %v, %v, want exempt without cooldown", limits, err)
+	}
+}
+
+func TestCancellationCooldown(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(
+		datastore.WithSections("A"),
+		datastore.WithSectionSize(4),
+		datastore.WithBookingLimits(datastore.BookingLimits{CancellationCooldown: time.Hour}))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	// Users cancel their own bookings with the manage scope, guest sessions have it too
+	userCtx := getCtxWithClaims(t, ctx, jwt.MapClaims{"sub": "user@example.com", "roles": []string{RoleUser}, "scope": string(PermBookingsManageSelf)})
+	var bookings []*pb.Booking
+	for _, seat := range []string{"1", "2", "3"} {
+		booking, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+			Seat: &pb.Seat{SectionId: "A", SeatId: seat},
+		})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		bookings = append(bookings, booking)
+	}
+	cooldown := func() bool {
+		limits, err := client.GetMyLimits(userCtx, &emptypb.Empty{})
+		if err != nil {
+			t.Fatalf("GetMyLimits() error = %v", err)
+		}
+		return limits.CooldownEnds != nil
+	}
+
+	// Staff cancelling the booking of a customer don't start the customer's cooldown, whether
+	// they are exempt from the limits or not
+	staff := map[string]context.Context{
+		"agent": getCtxWithClaims(t, ctx, jwt.MapClaims{"sub": "agent@example.com", "roles": []string{RoleAgent}}),
+		"admin": getCtxWithToken(t, ctx, "admin@example.com", true),
+	}
+	for i, name := range []string{"agent", "admin"} {
+		if _, err := client.RemoveUserFromTrain(staff[name], &pb.RemoveBookingRequest{BookingId: bookings[i].BookingId}); err != nil {
+			t.Fatalf("%v RemoveUserFromTrain() error = %v", name, err)
+		}
+		if cooldown() {
+			t.Errorf("cooldown after the %v cancelled the booking, want none", name)
+		}
+	}
+
+	// The owner's own cancellation starts it
+	if _, err := client.RemoveUserFromTrain(userCtx, &pb.RemoveBookingRequest{BookingId: bookings[2].BookingId}); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	if !cooldown() {
+		t.Errorf("no cooldown after the owner cancelled the booking")
+	}
+}
+
+func TestClaimGuestBookingsLimits(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(
+		datastore.WithSections("A"),
+		datastore.WithSectionSize(4),
+		datastore.WithBookingLimits(datastore.BookingLimits{MaxActiveBookings: 2, CancellationCooldown: time.Hour}))
+	notifier := &recordingNotifier{tokens: map[string]string{}}
+	client, closer := createTestServer(t, ctx, db, WithNotifier(notifier))
+	defer closer()
+
+	purchase := func(callCtx context.Context, email, seat string) *pb.Booking {
+		t.Helper()
+		booking, err := client.Purchase(callCtx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: email, FirstName: "john", LastName: "doe"},
+			Seat: &pb.Seat{SectionId: "A", SeatId: seat},
+		})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		return booking
+	}
+	claim := func(callCtx context.Context) (*pb.ClaimGuestBookingsResponse, error) {
+		t.Helper()
+		if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "guest@example.com"}); err != nil {
+			t.Fatalf("RequestBookingAccess() error = %v", err)
+		}
+		return client.ClaimGuestBookings(callCtx, &pb.ClaimGuestBookingsRequest{AccessToken: notifier.tokens["guest@example.com"]})
+	}
+	rule := func(err error) string {
+		for _, detail := range status.Convert(err).Details() {
+			if info, ok := detail.(*errdetails.ErrorInfo); ok {
+				return info.Metadata["rule"]
+			}
+		}
+		return ""
+	}
+
+	userCtx := getCtxWithClaims(t, ctx, jwt.MapClaims{"sub": "user@example.com", "roles": []string{RoleUser}, "scope": string(PermBookingsManageSelf)})
+	booking := purchase(userCtx, "user@example.com", "1")
+	purchase(ctx, "guest@example.com", "2")
+	purchase(ctx, "guest@example.com", "3")
+
+	// The guest bookings would take the user over the active bookings limit
+	_, err := claim(userCtx)
+	if status.Code(err) != codes.ResourceExhausted || rule(err) != datastore.LIMIT_ACTIVE_BOOKINGS {
+		t.Fatalf("ClaimGuestBookings() over the limit error = %v, want ResourceExhausted on %v", err, datastore.LIMIT_ACTIVE_BOOKINGS)
+	}
+	if got := db.GetUserBookings(ctx, "guest@example.com"); len(got) != 2 {
+		t.Errorf("guest bookings after the failed claim = %v, want both left", len(got))
+	}
+
+	// Claiming seats during the cooldown is like purchasing them
+	if _, err := client.RemoveUserFromTrain(userCtx, &pb.RemoveBookingRequest{BookingId: booking.BookingId}); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	_, err = claim(userCtx)
+	if status.Code(err) != codes.ResourceExhausted || rule(err) != datastore.LIMIT_CANCELLATION_COOLDOWN {
+		t.Fatalf("ClaimGuestBookings() during the cooldown error = %v, want ResourceExhausted on %v", err, datastore.LIMIT_CANCELLATION_COOLDOWN)
+	}
+
+	// Admins are exempt
+	claimed, err := claim(getCtxWithToken(t, ctx, "admin@example.com", true))
+	if err != nil || len(claimed.Bookings) != 2 {
+		t.Errorf("admin ClaimGuestBookings() = %v, %v, want the guest bookings", claimed, err)
+	}
+}
+
+func TestPurchaseBookings(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(
+		datastore.WithSections("A"),
+		datastore.WithSectionSize(5),
+		datastore.WithBookingLimits(datastore.BookingLimits{MaxSeatsPerPurchase: 2}))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	seats := func(email string, ids ...string) *pb.PurchaseBookingsRequest {
+		req := &pb.PurchaseBookingsRequest{}
+		for _, id := range ids {
+			req.Purchases = append(req.Purchases, &pb.PurchaseRequest{
+				User: &pb.User{EmailAddress: email, FirstName: "john", LastName: "doe"},
+				Seat: &pb.Seat{SectionId: "A", SeatId: id},
+			})
+		}
+		return req
+	}
+
+	_, err := client.PurchaseBookings(ctx, seats("group@example.com", "1", "2", "3"))
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("PurchaseBookings() of 3 seats error = %v, want ResourceExhausted", err)
+	}
+	if quota, ok := st.Details()[0].(*errdetails.QuotaFailure); !ok || quota.Violations[0].Subject != "user:group@example.com/"+datastore.LIMIT_SEATS_PER_PURCHASE {
+		t.Errorf("PurchaseBookings() of 3 seats details = %v, want a seats per purchase violation", st.Details())
+	}
+
+	adminCtx := getCtxWithToken(t, ctx, "admin@example.com", true)
+	resp, err := client.PurchaseBookings(adminCtx, seats("group@example.com", "1", "2", "3"))
+	if err != nil || len(resp.Bookings) != 3 {
+		t.Fatalf("exempt PurchaseBookings() of 3 seats = %v, %v", resp, err)
+	}
+
+	// Guests buy the seats for a single email address
+	req := seats("guest@example.com", "4")
+	req.Purchases = append(req.Purchases, seats("other@example.com", "4").Purchases...)
+	if _, err := client.PurchaseBookings(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("guest PurchaseBookings() for two emails error = %v, want InvalidArgument", err)
+	}
+	if _, err := client.PurchaseBookings(ctx, &pb.PurchaseBookingsRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("PurchaseBookings() without purchases error = %v, want InvalidArgument", err)
+	}
+
+	// Either all seats are booked or none
+	if _, err := client.PurchaseBookings(ctx, seats("other@example.com", "4", "1")); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("PurchaseBookings() of a taken seat error = %v, want AlreadyExists", err)
+	}
+	if bookings := db.GetBookingsBySection(ctx, "A"); len(bookings) != 3 {
+		t.Errorf("bookings after the failed purchase = %v, want the 3 bookings before it", bookings)
+	}
+	if created := db.Stats().BookingsCreated; created != 3 {
+		t.Errorf("BookingsCreated = %v, want 3", created)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Page sizes of ListBookings
+const (
+	DEFAULT_PAGE_SIZE = 50
+	MAX_PAGE_SIZE     = 1000
+)
+
+// bookingFilter is a parsed AIP-160 filter. The query finds the bookings with the datastore
+// indexes, the exact name comparisons are checked on the bookings it returns.
+type bookingFilter struct {
+	query datastore.BookingQuery
+	names []func(datastore.Booking) bool
+}
+
+func (f bookingFilter) matches(booking datastore.Booking) bool {
+	for _, matches := range f.names {
+		if !matches(booking) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterTokens splits a filter into fields, operators, values and the AND keyword
+func filterTokens(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"':
+			quoted, err := strconv.QuotedPrefix(filter[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, quoted)
+			i += len(quoted)
+		case strings.IndexByte("=<>!", c) >= 0:
+			j := i + 1
+			if j < len(filter) && filter[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(filter) && strings.IndexByte(" \t\n\"=<>!", filter[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseFilter parses comparisons joined with AND, the subset of AIP-160 the indexes of the
+// datastore can answer
+func parseFilter(filter string) (bookingFilter, error) {
+	var f bookingFilter
+	tokens, err := filterTokens(filter)
+	if err != nil {
+		return f, err
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < len(tokens); i += 4 {
+		if i+3 > len(tokens) {
+			return f, fmt.Errorf("incomplete comparison %q", strings.Join(tokens[i:], " "))
+		}
+		if i+3 < len(tokens) && tokens[i+3] != "AND" {
+			return f, fmt.Errorf("comparisons must be joined with AND, got %q", tokens[i+3])
+		}
+		if i+3 == len(tokens)-1 {
+			return f, fmt.Errorf("filter ends with AND")
+		}
+		field, operator, value := tokens[i], tokens[i+1], tokens[i+2]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		if field == "created_at" {
+			if err := f.filterCreatedAt(operator, value); err != nil {
+				return f, err
+			}
+			continue
+		}
+		if seen[field] {
+			return f, fmt.Errorf("%v is filtered twice", field)
+		}
+		seen[field] = true
+		if operator != "=" {
+			return f, fmt.Errorf("%v only supports =", field)
+		}
+		switch field {
+		case "journey_id":
+			f.query.JourneyID = value
+		case "seat.section_id":
+			f.query.SectionID = datastore.SectionID(value)
+		case "purchaser":
+			f.query.Owner = strings.ToLower(value)
+		case "status":
+			if value != datastore.BOOKING_ACTIVE && value != datastore.BOOKING_CANCELLED {
+				return f, fmt.Errorf("status must be %v or %v", datastore.BOOKING_ACTIVE, datastore.BOOKING_CANCELLED)
+			}
+			f.query.Status = value
+		case "user.first_name", "user.last_name":
+			if f.query.PassengerName == "" {
+				f.query.PassengerName = value
+			}
+			name := func(user datastore.User) string { return user.FirstName }
+			if field == "user.last_name" {
+				name = func(user datastore.User) string { return user.LastName }
+			}
+			f.names = append(f.names, func(booking datastore.Booking) bool {
+				return strings.EqualFold(strings.TrimSpace(name(booking.User)), strings.TrimSpace(value))
+			})
+		default:
+			return f, fmt.Errorf("unknown filter field %q", field)
+		}
+	}
+	return f, nil
+}
+
+// filterCreatedAt sets the creation time range of the filter
+func (f *bookingFilter) filterCreatedAt(operator string, value string) error {
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return fmt.Errorf("created_at must be an RFC 3339 time: %v", err)
+	}
+	lower := operator == "=" || operator == ">=" || operator == ">"
+	upper := operator == "=" || operator == "<=" || operator == "<"
+	if (lower && !f.query.CreatedAfter.IsZero()) || (upper && !f.query.CreatedBefore.IsZero()) {
+		return fmt.Errorf("created_at is bounded twice")
+	}
+	switch operator {
+	case "=":
+		f.query.CreatedAfter, f.query.CreatedBefore = at, at.Add(time.Nanosecond)
+	case ">=":
+		f.query.CreatedAfter = at
+	case ">":
+		f.query.CreatedAfter = at.Add(time.Nanosecond)
+	case "<":
+		f.query.CreatedBefore = at
+	case "<=":
+		f.query.CreatedBefore = at.Add(time.Nanosecond)
+	default:
+		return fmt.Errorf("unsupported operator %q", operator)
+	}
+	return nil
+}
+
+// orderComparers compare the bookings by the fields of order_by
+var orderComparers = map[string]func(a, b datastore.Booking) int{
+	"created_at":      func(a, b datastore.Booking) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"booking_id":      func(a, b datastore.Booking) int { return cmp.Compare(a.BookingID, b.BookingID) },
+	"status":          func(a, b datastore.Booking) int { return cmp.Compare(a.Status, b.Status) },
+	"seat.section_id": func(a, b datastore.Booking) int { return cmp.Compare(a.Seat.SectionID, b.Seat.SectionID) },
+	"seat.seat_id":    func(a, b datastore.Booking) int { return compareSeatIDs(a.Seat.SeatID, b.Seat.SeatID) },
+	"user.first_name": func(a, b datastore.Booking) int {
+		return cmp.Compare(strings.ToLower(a.User.FirstName), strings.ToLower(b.User.FirstName))
+	},
+	"user.last_name": func(a, b datastore.Booking) int {
+		return cmp.Compare(strings.ToLower(a.User.LastName), strings.ToLower(b.User.LastName))
+	},
+}
+
+// compareSeatIDs compares seat numbers as numbers
+func compareSeatIDs(a, b string) int {
+	x, errX := strconv.Atoi(a)
+	y, errY := strconv.Atoi(b)
+	if errX != nil || errY != nil {
+		return cmp.Compare(a, b)
+	}
+	return cmp.Compare(x, y)
+}
+
+// orderField is a field of order_by
+type orderField struct {
+	field string
+	desc  bool
+}
+
+// bookingOrder is a parsed AIP-132 order_by, it ends with the creation time and the booking
+// id so that every booking has its own place in the order
+type bookingOrder []orderField
+
+// has checks if the order compares the field
+func (order bookingOrder) has(field string) bool {
+	return slices.ContainsFunc(order, func(o orderField) bool { return o.field == field })
+}
+
+// parseOrderBy parses comma separated fields with an optional " desc" or " asc"
+func parseOrderBy(orderBy string) (bookingOrder, error) {
+	var order bookingOrder
+	for _, entry := range strings.Split(orderBy, ",") {
+		words := strings.Fields(entry)
+		if len(words) == 0 {
+			if strings.TrimSpace(orderBy) == "" {
+				break
+			}
+			return nil, fmt.Errorf("empty order_by field")
+		}
+		if len(words) > 2 || (len(words) == 2 && words[1] != "desc" && words[1] != "asc") {
+			return nil, fmt.Errorf("invalid order_by field %q, want <field> [desc]", strings.TrimSpace(entry))
+		}
+		if _, ok := orderComparers[words[0]]; !ok {
+			return nil, fmt.Errorf("unknown order_by field %q", words[0])
+		}
+		if order.has(words[0]) {
+			return nil, fmt.Errorf("%v is ordered twice", words[0])
+		}
+		order = append(order, orderField{field: words[0], desc: len(words) == 2 && words[1] == "desc"})
+	}
+	for _, field := range []string{"created_at", "booking_id"} {
+		if !order.has(field) {
+			order = append(order, orderField{field: field})
+		}
+	}
+	return order, nil
+}
+
+// compare compares two bookings in the order
+func (order bookingOrder) compare(a, b datastore.Booking) int {
+	for _, o := range order {
+		if c := orderComparers[o.field](a, b); c != 0 {
+			if o.desc {
+				return -c
+			}
+			return c
+		}
+	}
+	return 0
+}
+
+// pageCursor holds the fields of the last booking of a page that order_by can compare
+type pageCursor struct {
+	CreatedAt time.Time `json:"c"`
+	BookingID string    `json:"i"`
+	Status    string    `json:"s,omitempty"`
+	SectionID string    `json:"sec,omitempty"`
+	SeatID    string    `json:"seat,omitempty"`
+	FirstName string    `json:"fn,omitempty"`
+	LastName  string    `json:"ln,omitempty"`
+}
+
+func newPageCursor(booking datastore.Booking) pageCursor {
+	return pageCursor{
+		CreatedAt: booking.CreatedAt,
+		BookingID: booking.BookingID,
+		Status:    booking.Status,
+		SectionID: booking.Seat.SectionID,
+		SeatID:    booking.Seat.SeatID,
+		FirstName: booking.User.FirstName,
+		LastName:  booking.User.LastName,
+	}
+}
+
+// booking returns a booking with the fields of the cursor, to compare it with the bookings
+func (c pageCursor) booking() datastore.Booking {
+	return datastore.Booking{
+		CreatedAt: c.CreatedAt,
+		BookingID: c.BookingID,
+		Status:    c.Status,
+		Seat:      datastore.Seat{SectionID: c.SectionID, SeatID: c.SeatID},
+		User:      datastore.User{FirstName: c.FirstName, LastName: c.LastName},
+	}
+}
+
+// pageToken is the content of a next_page_token. It is encrypted and authenticated with
+// AES-GCM, so it is opaque and can't be forged or changed: the names of the passengers it may
+// hold are not readable and a changed token is rejected.
+type pageToken struct {
+	// Request is a hash of the filter, the order and the caller the token continues
+	Request string     `json:"r"`
+	After   pageCursor `json:"a"`
+}
+
+// pageTokenAEAD returns the cipher of the page tokens, its key is derived from JWT_SECRET_KEY
+func pageTokenAEAD() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("page-token:" + JWT_SECRET_KEY))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// requestHash identifies the listing a page token belongs to
+func requestHash(req *pb.ListBookingsRequest, scope string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{req.Filter, req.OrderBy, scope}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(hash[:16])
+}
+
+// encodePageToken seals the token
+func encodePageToken(token pageToken) (string, error) {
+	aead, err := pageTokenAEAD()
+	if err != nil {
+		return "", err
+	}
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// decodePageToken opens a token sealed by encodePageToken
+func decodePageToken(value string) (pageToken, error) {
+	var token pageToken
+	aead, err := pageTokenAEAD()
+	if err != nil {
+		return token, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return token, fmt.Errorf("malformed page token")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return token, fmt.Errorf("invalid page token")
+	}
+	if err := json.Unmarshal(plain, &token); err != nil {
+		return token, fmt.Errorf("invalid page token")
+	}
+	return token, nil
+}
+
+// ListBookings returns a page of the bookings that match the filter, in the order of order_by.
+// The page token holds the last booking of the previous page, so bookings created or cancelled
+// between the pages don't shift the next page.
+func (s *BookingServer) ListBookings(ctx context.Context, req *pb.ListBookingsRequest) (*pb.ListBookingsResponse, error) {
+	email, authenticated := s.isUserAuthenticated(ctx)
+	if !authenticated {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	if req.PageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must not be negative")
+	}
+	pageSize := int(req.PageSize)
+	if pageSize == 0 {
+		pageSize = DEFAULT_PAGE_SIZE
+	}
+	pageSize = min(pageSize, MAX_PAGE_SIZE)
+
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+	}
+	order, err := parseOrderBy(req.OrderBy)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid order_by: %v", err)
+	}
+	if filter.query.Status == "" {
+		filter.query.Status = datastore.BOOKING_ACTIVE
+	}
+
+	// Callers who can't read every booking list the bookings they made
+	scope := "*"
+	permissions := permissionsFromContext(ctx)
+	if !permissions.Has(PermBookingsReadAny) && !permissions.Has(PermSectionsAdmin) {
+		scope = email
+		if filter.query.Owner != "" && filter.query.Owner != email {
+			return &pb.ListBookingsResponse{}, nil
+		}
+		filter.query.Owner = email
+	}
+
+	var after *datastore.Booking
+	if req.PageToken != "" {
+		token, err := decodePageToken(req.PageToken)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if token.Request != requestHash(req, scope) {
+			return nil, status.Errorf(codes.InvalidArgument, "the page token belongs to another filter, order or caller")
+		}
+		booking := token.After.booking()
+		after = &booking
+	}
+
+	var bookings []datastore.Booking
+	for _, booking := range s.db.ListBookings(ctx, filter.query) {
+		if filter.matches(booking) {
+			bookings = append(bookings, booking)
+		}
+	}
+	slices.SortStableFunc(bookings, order.compare)
+	if after != nil {
+		bookings = bookings[sort.Search(len(bookings), func(i int) bool {
+			return order.compare(bookings[i], *after) > 0
+		}):]
+	}
+
+	resp := &pb.ListBookingsResponse{}
+	for _, booking := range bookings[:min(pageSize, len(bookings))] {
+		resp.Bookings = append(resp.Bookings, toPBBooking(booking))
+	}
+	if len(bookings) > pageSize {
+		resp.NextPageToken, err = encodePageToken(pageToken{Request: requestHash(req, scope), After: newPageCursor(bookings[pageSize-1])})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create page token: %v", err)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// seatIDs returns the seats of the bookings
+func seatIDs(bookings []*pb.Booking) string {
+	var seats []string
+	for _, booking := range bookings {
+		seats = append(seats, booking.Seat.SectionId+booking.Seat.SeatId)
+	}
+	return strings.Join(seats, ",")
+}
+
+func TestListBookings(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore()
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	purchase := func(owner string, first string, last string, section string, seat string) datastore.Booking {
+		booking, err := db.Purchase(ctx, owner, datastore.Booking{
+			User: datastore.User{EmailAddress: owner, FirstName: first, LastName: last},
+			Seat: datastore.Seat{SectionID: section, SeatID: seat},
+		})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		return booking
+	}
+	purchase("user@example.com", "John", "Doe", "A", "1")
+	purchase("user@example.com", "Jane", "Doe", "A", "2")
+	cancelled := purchase("user@example.com", "John", "Doe", "B", "3")
+	purchase("other@example.com", "Bob", "Smith", "A", "4")
+	purchase("other@example.com", "Ann", "Lee", "B", "5")
+	if err := db.RemoveUserFromTrain(ctx, datastore.BookingID(cancelled.BookingID)); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	userCtx := getCtxWithToken(t, ctx, "user@example.com", false)
+	adminCtx := getCtxWithToken(t, ctx, "admin@example.com", true)
+
+	t.Run("filters", func(t *testing.T) {
+		tests := []struct {
+			name string
+			ctx  context.Context
+			req  *pb.ListBookingsRequest
+			want string
+		}{
+			{"own bookings", userCtx, &pb.ListBookingsRequest{}, "A1,A2"},
+			{"own cancelled bookings", userCtx, &pb.ListBookingsRequest{Filter: `status = "cancelled"`}, "B3"},
+			{"bookings of another user", userCtx, &pb.ListBookingsRequest{Filter: "purchaser = other@example.com"}, ""},
+			{"all bookings", adminCtx, &pb.ListBookingsRequest{}, "A1,A2,A4,B5"},
+			{"section", adminCtx, &pb.ListBookingsRequest{Filter: `seat.section_id = "B" AND status = active`}, "B5"},
+			{"purchaser", adminCtx, &pb.ListBookingsRequest{Filter: "purchaser = OTHER@example.com"}, "A4,B5"},
+			{"last name", adminCtx, &pb.ListBookingsRequest{Filter: `user.last_name = "doe"`}, "A1,A2"},
+			{"first and last name", adminCtx, &pb.ListBookingsRequest{Filter: `user.last_name="Doe" AND user.first_name="Jane"`}, "A2"},
+			{"first name isn't the last name", adminCtx, &pb.ListBookingsRequest{Filter: `user.first_name = "Doe"`}, ""},
+			{"created range", adminCtx, &pb.ListBookingsRequest{Filter: `created_at >= "2000-01-01T00:00:00Z" AND created_at < "2100-01-01T00:00:00Z"`}, "A1,A2,A4,B5"},
+			{"created later", adminCtx, &pb.ListBookingsRequest{Filter: `created_at > "2100-01-01T00:00:00Z"`}, ""},
+			{"ordered", adminCtx, &pb.ListBookingsRequest{OrderBy: "seat.section_id desc, user.first_name"}, "B5,A4,A2,A1"},
+		}
+		for _, tt := range tests {
+			resp, err := client.ListBookings(tt.ctx, tt.req)
+			if err != nil {
+				t.Errorf("ListBookings(%v) error = %v", tt.name, err)
+				continue
+			}
+			if got := seatIDs(resp.Bookings); got != tt.want || resp.NextPageToken != "" {
+				t.Errorf("ListBookings(%v) = %v, %q, want %v", tt.name, got, resp.NextPageToken, tt.want)
+			}
+		}
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		req := &pb.ListBookingsRequest{PageSize: 2, OrderBy: "seat.seat_id desc"}
+		var pages []string
+		for {
+			resp, err := client.ListBookings(adminCtx, req)
+			if err != nil {
+				t.Fatalf("ListBookings() error = %v", err)
+			}
+			pages = append(pages, seatIDs(resp.Bookings))
+			if len(pages) == 1 {
+				// A booking made between the pages doesn't shift them
+				purchase("user@example.com", "Jim", "Doe", "A", "3")
+			}
+			if resp.NextPageToken == "" {
+				break
+			}
+			req.PageToken = resp.NextPageToken
+		}
+		if got := strings.Join(pages, " "); got != "B5,A4 A3,A2 A1" {
+			t.Errorf("pages = %v, want B5,A4 A3,A2 A1", got)
+		}
+	})
+
+	t.Run("page tokens", func(t *testing.T) {
+		first, err := client.ListBookings(adminCtx, &pb.ListBookingsRequest{PageSize: 1, Filter: "status = active"})
+		if err != nil || first.NextPageToken == "" {
+			t.Fatalf("ListBookings() = %v, %v, want a next page", first, err)
+		}
+		token := first.NextPageToken
+		tampered := []byte(token)
+		tampered[len(tampered)/2] ^= 1
+
+		tests := []struct {
+			name string
+			ctx  context.Context
+			req  *pb.ListBookingsRequest
+		}{
+			{"tampered token", adminCtx, &pb.ListBookingsRequest{PageToken: string(tampered), Filter: "status = active"}},
+			{"made up token", adminCtx, &pb.ListBookingsRequest{PageToken: "bm90IGEgdG9rZW4", Filter: "status = active"}},
+			{"other filter", adminCtx, &pb.ListBookingsRequest{PageToken: token}},
+			{"other order", adminCtx, &pb.ListBookingsRequest{PageToken: token, Filter: "status = active", OrderBy: "booking_id"}},
+			{"other caller", userCtx, &pb.ListBookingsRequest{PageToken: token, Filter: "status = active"}},
+		}
+		for _, tt := range tests {
+			if _, err := client.ListBookings(tt.ctx, tt.req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("ListBookings(%v) error = %v, want InvalidArgument", tt.name, err)
+			}
+		}
+		if next, err := client.ListBookings(adminCtx, &pb.ListBookingsRequest{PageSize: 1, PageToken: token, Filter: "status = active"}); err != nil || seatIDs(next.Bookings) != "A2" {
+			t.Errorf("ListBookings() of the next page = %v, %v, want A2", next, err)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, req := range []*pb.ListBookingsRequest{
+			{PageSize: -1},
+			{Filter: "seat.section_id = A OR seat.section_id = B"},
+			{Filter: "status = active AND"},
+			{Filter: "status = booked"},
+			{Filter: "status != active"},
+			{Filter: "price_paid = 10"},
+			{Filter: "purchaser = a AND purchaser = b"},
+			{Filter: `created_at >= yesterday`},
+			{Filter: `created_at > "2024-01-01T00:00:00Z" AND created_at >= "2024-01-02T00:00:00Z"`},
+			{Filter: `user.last_name = "Doe`},
+			{OrderBy: "price_paid"},
+			{OrderBy: "created_at up"},
+			{OrderBy: "booking_id, booking_id desc"},
+			{OrderBy: "booking_id,"},
+		} {
+			if _, err := client.ListBookings(adminCtx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("ListBookings(%v) error = %v, want InvalidArgument", req, err)
+			}
+		}
+		if _, err := client.ListBookings(ctx, &pb.ListBookingsRequest{}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("ListBookings() without a token error = %v, want Unauthenticated", err)
+		}
+	})
+
+	t.Run("page size", func(t *testing.T) {
+		for i := 6; i <= 10; i++ {
+			purchase("other@example.com", "Bob", "Smith", "B", strconv.Itoa(i))
+		}
+		resp, err := client.ListBookings(adminCtx, &pb.ListBookingsRequest{PageSize: MAX_PAGE_SIZE + 1})
+		if err != nil || len(resp.Bookings) != 10 || resp.NextPageToken != "" {
+			t.Errorf("ListBookings() = %v bookings, %v, want all 10", len(resp.GetBookings()), err)
+		}
+	})
+}
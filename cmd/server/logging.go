@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Every call gets a request id, taken from the x-request-id header when the client sends one.
+// It is returned to the client in the x-request-id response header.
+const requestIDHeader = "x-request-id"
+
+// Value of string fields marked debug_redact in the logged requests
+const redactedValue = "[REDACTED]"
+
+// LogSampleRate is the share of successful calls that are logged, failed calls are always logged
+var LogSampleRate = 1.0
+
+// callLogKey is the context key of the callLog of the current call
+const callLogKey contextKey = "call_log"
+
+// callLog collects what the interceptors learn about a call for its log line
+type callLog struct {
+	requestID string
+	subject   string
+	actor     string
+}
+
+// startCallLog adds a callLog with the call's request id to the context
+func startCallLog(ctx context.Context) (context.Context, *callLog) {
+	call := &callLog{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDHeader); len(ids) > 0 && len(ids[0]) <= 128 {
+			call.requestID = ids[0]
+		}
+	}
+	if call.requestID == "" {
+		call.requestID, _ = newTokenID()
+	}
+	return context.WithValue(ctx, callLogKey, call), call
+}
+
+// logCaller records the authenticated caller of the call for its log line
+func logCaller(ctx context.Context) {
+	call, ok := ctx.Value(callLogKey).(*callLog)
+	if !ok {
+		return
+	}
+	call.subject, _ = ctx.Value(emailIDKey).(string)
+	call.actor, _ = actorFromContext(ctx)
+}
+
+// logPseudonym returns a stable id of a subject for the log lines, so that the calls of a caller
+// can be followed without logging their email address
+func logPseudonym(subject string) string {
+	mac := hmac.New(sha256.New, []byte("log-subject:"+JWT_SECRET_KEY))
+	mac.Write([]byte(subject))
+	return "sub-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// errorReason returns the reason of the ErrorInfo detail of the error, if it has one
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+// logCall writes the log line of a finished call. The subject and the actor are logged as
+// pseudonyms and errors by their ErrorInfo reason, as the messages may contain what the caller
+// sent. The request is only logged at debug level.
+func logCall(ctx context.Context, fullMethod string, call *callLog, req interface{}, start time.Time, err error) {
+	code := status.Code(err)
+	if code == codes.OK && LogSampleRate < 1 && rand.Float64() >= LogSampleRate {
+		return
+	}
+
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK:
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unavailable:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", fullMethod),
+		slog.String("code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("request_id", call.requestID),
+	}
+	if call.subject != "" {
+		attrs = append(attrs, slog.String("subject", logPseudonym(call.subject)))
+	}
+	if call.actor != "" {
+		attrs = append(attrs, slog.String("actor", logPseudonym(call.actor)))
+	}
+	if reason := errorReason(err); reason != "" {
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	if msg, ok := req.(proto.Message); ok && slog.Default().Enabled(ctx, slog.LevelDebug) {
+		attrs = append(attrs, slog.String("request", redactedJSON(msg)))
+	}
+	slog.LogAttrs(ctx, level, "rpc", attrs...)
+}
+
+// redactedJSON returns the message as JSON with the fields marked debug_redact redacted
+func redactedJSON(msg proto.Message) string {
+	clone := proto.Clone(msg)
+	redactMessage(clone.ProtoReflect())
+	b, err := protojson.Marshal(clone)
+	if err != nil {
+		return redactedValue
+	}
+	return string(b)
+}
+
+// redactMessage replaces string fields marked debug_redact with redactedValue and clears
+// other marked fields, nested messages are redacted too
+func redactMessage(m protoreflect.Message) {
+	var fields []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, fd)
+		return true
+	})
+
+	for _, fd := range fields {
+		if opts, ok := fd.Options().(*descriptorpb.FieldOptions); ok && opts.GetDebugRedact() {
+			if fd.Kind() == protoreflect.StringKind && fd.Cardinality() != protoreflect.Repeated {
+				m.Set(fd, protoreflect.ValueOfString(redactedValue))
+			} else {
+				m.Clear(fd)
+			}
+			continue
+		}
+
+		value := m.Get(fd)
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				value.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					redactMessage(v.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				for i := 0; i < value.List().Len(); i++ {
+					redactMessage(value.List().Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			redactMessage(value.Message())
+		}
+	}
+}
+
+// Logging interceptor for unary RPCs, it runs before the token validation
+func loggingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, call := startCallLog(ctx)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, call.requestID))
+
+	resp, err := handler(ctx, req)
+	logCall(ctx, info.FullMethod, call, req, start, err)
+	return resp, err
+}
+
+// loggingStream keeps the first request message of a stream for the log line
+type loggingStream struct {
+	*wrappedStream
+	req interface{}
+}
+
+// RecvMsg receives a message and keeps the first one
+func (s *loggingStream) RecvMsg(m interface{}) error {
+	err := s.wrappedStream.RecvMsg(m)
+	if err == nil && s.req == nil {
+		s.req = m
+	}
+	return err
+}
+
+// Logging interceptor for streaming RPCs, it runs before the token validation
+func loggingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, call := startCallLog(ss.Context())
+	_ = ss.SetHeader(metadata.Pairs(requestIDHeader, call.requestID))
+
+	stream := &loggingStream{wrappedStream: &wrappedStream{ServerStream: ss, ctx: ctx}}
+	err := handler(srv, stream)
+	logCall(ctx, info.FullMethod, call, stream.req, start, err)
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRedactedJSON(t *testing.T) {
+	got := redactedJSON(&pb.ClaimGuestBookingsResponse{Bookings: []*pb.Booking{{
+		BookingId: "b1",
+		User:      &pb.User{EmailAddress: "john@example.com", FirstName: "john", LastName: "doe"},
+		Seat:      &pb.Seat{SectionId: "A", SeatId: "1"},
+		Purchaser: "john@example.com",
+	}}})
+
+	for _, secret := range []string{"john", "doe"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redactedJSON() = %v, contains %q", got, secret)
+		}
+	}
+	for _, want := range []string{`"bookingId":"b1"`, `"sectionId":"A"`, `"emailAddress":"[REDACTED]"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("redactedJSON() = %v, want it to contain %v", got, want)
+		}
+	}
+}
+
+func TestLoggingInterceptor(t *testing.T) {
+	ctx := context.Background()
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(defaultLogger)
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	var header metadata.MD
+	userCtx := metadata.AppendToOutgoingContext(getCtxWithToken(t, ctx, "user@example.com", false), requestIDHeader, "req-42")
+	if _, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	}, grpc.Header(&header)); err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	if got := header.Get(requestIDHeader); len(got) != 1 || got[0] != "req-42" {
+		t.Errorf("Purchase() request id header = %v, want req-42", got)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log is not a single JSON line: %v: %q", err, logs.String())
+	}
+	for key, want := range map[string]string{
+		"msg":        "rpc",
+		"method":     "/BookingService/Purchase",
+		"code":       "OK",
+		"request_id": "req-42",
+		"subject":    logPseudonym("user@example.com"),
+	} {
+		if entry[key] != want {
+			t.Errorf("log %v = %v, want %v", key, entry[key], want)
+		}
+	}
+	if strings.Contains(logs.String(), "user@example.com") {
+		t.Errorf("log contains the subject's email: %q", logs.String())
+	}
+	if _, ok := entry["latency"]; !ok {
+		t.Errorf("log has no latency: %v", entry)
+	}
+	if request, _ := entry["request"].(string); !strings.Contains(request, redactedValue) || strings.Contains(request, "doe") {
+		t.Errorf("log request = %v, want it redacted", request)
+	}
+
+	// Successful calls are sampled, failures are always logged
+	LogSampleRate = 0
+	defer func() { LogSampleRate = 1 }()
+	logs.Reset()
+	if _, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "2"},
+	}); err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("sampled out call was logged: %q", logs.String())
+	}
+	if _, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "C", SeatId: "1"},
+	}); err == nil {
+		t.Fatalf("Purchase() in unknown section succeeded")
+	}
+	// An unknown section is the caller's mistake, it is logged as a warning
+	if !strings.Contains(logs.String(), `"level":"WARN"`) || !strings.Contains(logs.String(), `"code":"NotFound"`) {
+		t.Errorf("failed call was not logged: %q", logs.String())
+	}
+
+	// Rejected emails are in the error messages but not in the logs
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	for _, email := range []string{"not an email@example.com", "john@mailinator.com"} {
+		logs.Reset()
+		if _, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: email, FirstName: "john", LastName: "doe"},
+			Seat: &pb.Seat{SectionId: "B", SeatId: "1"},
+		}); status.Code(err) != codes.InvalidArgument || !strings.Contains(status.Convert(err).Message(), email) {
+			t.Fatalf("Purchase(%v) error = %v, want InvalidArgument naming the email", email, err)
+		}
+		if logs.Len() == 0 || strings.Contains(logs.String(), "@") {
+			t.Errorf("log of the rejected Purchase(%v) = %q, want it without emails", email, logs.String())
+		}
+	}
+}
+
+func TestLogIdentities(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	notifier := &recordingNotifier{tokens: map[string]string{}}
+	client, closer := createTestServer(t, ctx, db, WithNotifier(notifier))
+	defer closer()
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	// records returns the log records with the message and checks they hold no email
+	records := func(msg string) int {
+		n := 0
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil || entry["msg"] != msg {
+				continue
+			}
+			n++
+			if strings.Contains(line, "@") {
+				t.Errorf("%v record contains an email: %q", msg, line)
+			}
+		}
+		return n
+	}
+
+	// Impersonation, allowed and denied
+	impersonation := func(actorRoles []string) context.Context {
+		return getCtxWithClaims(t, ctx, jwt.MapClaims{
+			"sub":   "customer@example.com",
+			"act":   map[string]interface{}{"sub": "staff@example.com"},
+			"roles": actorRoles,
+		})
+	}
+	if _, err := client.ListBookings(impersonation([]string{RoleAdmin}), &pb.ListBookingsRequest{}); err != nil {
+		t.Fatalf("ListBookings() while impersonating error = %v", err)
+	}
+	if _, err := client.ListBookings(impersonation([]string{RoleAgent}), &pb.ListBookingsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("ListBookings() impersonating without permission error = %v, want PermissionDenied", err)
+	}
+	if n := records("impersonation"); n != 1 {
+		t.Errorf("impersonation records = %v, want 1", n)
+	}
+	if n := records("impersonation denied"); n != 1 {
+		t.Errorf("impersonation denied records = %v, want 1", n)
+	}
+
+	// Claim of guest bookings
+	if _, err := client.Purchase(ctx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "traveller@example.com", FirstName: "travel", LastName: "ler"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	}); err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "traveller@example.com"}); err != nil {
+		t.Fatalf("RequestBookingAccess() error = %v", err)
+	}
+	accountCtx := getCtxWithToken(t, ctx, "account@example.com", false)
+	if _, err := client.ClaimGuestBookings(accountCtx, &pb.ClaimGuestBookingsRequest{AccessToken: notifier.tokens["traveller@example.com"]}); err != nil {
+		t.Fatalf("ClaimGuestBookings() error = %v", err)
+	}
+	if n := records("claimed guest bookings"); n != 1 {
+		t.Errorf("claimed guest bookings records = %v, want 1", n)
+	}
+
+	// Audit of the policy rules
+	policy, err := ParsePolicy(`deny /BookingService/ListBookings if "agent" in subject.roles`)
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	claims := jwt.MapClaims{"sub": "agent@example.com", "roles": []interface{}{RoleAgent}}
+	authorizer := &RuleAuthorizer{Policy: policy, Next: PolicyTableAuthorizer{}, AuditOnly: true}
+	authorizer.Authorize(ctx, &AuthzRequest{Claims: claims, Permissions: permissionsFromClaims(claims), FullMethod: "/BookingService/ListBookings"})
+	if n := records("policy audit"); n != 1 {
+		t.Errorf("policy audit records = %v, want 1", n)
+	}
+}
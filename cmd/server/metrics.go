@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+)
+
+// Reasons of authentication failures
+const (
+	authFailureMissingToken     = "missing_token"
+	authFailureMalformed        = "malformed"
+	authFailureBadSignature     = "bad_signature"
+	authFailureExpired          = "expired"
+	authFailureInvalidToken     = "invalid_token"
+	authFailureWrongTokenType   = "wrong_token_type"
+	authFailureInvalidAPIKey    = "invalid_api_key"
+	authFailurePermissionDenied = "permission_denied"
+)
+
+// metricsRegistry holds the server's metrics, it is served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	rpcHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "Number of RPCs completed on the server by method and status code.",
+	}, []string{"method", "code"})
+
+	rpcLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Latency of the RPCs handled by the server by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "booking_auth_failures_total",
+		Help: "Number of rejected callers by reason.",
+	}, []string{"reason"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "booking_rate_limited_total",
+		Help: "Number of calls rejected by the rate limiter by method.",
+	}, []string{"method"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		rpcHandled,
+		rpcLatency,
+		authFailures,
+		rateLimited,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// recordAuthFailure counts a rejected caller
+func recordAuthFailure(reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+}
+
+// recordRateLimited counts a call rejected by the rate limiter
+func recordRateLimited(fullMethod string) {
+	rateLimited.WithLabelValues(fullMethod).Inc()
+}
+
+// tokenFailureReason classifies the error of parsing a JWT token
+func tokenFailureReason(err error) string {
+	var validationErr *jwt.ValidationError
+	if !errors.As(err, &validationErr) {
+		return authFailureInvalidToken
+	}
+	switch {
+	case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return authFailureMalformed
+	case validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return authFailureBadSignature
+	case validationErr.Errors&jwt.ValidationErrorExpired != 0:
+		return authFailureExpired
+	}
+	return authFailureInvalidToken
+}
+
+// observeRPC records the status code and latency of a finished call
+func observeRPC(fullMethod string, start time.Time, err error) {
+	rpcHandled.WithLabelValues(fullMethod, status.Code(err).String()).Inc()
+	rpcLatency.WithLabelValues(fullMethod).Observe(time.Since(start).Seconds())
+}
+
+// Metrics interceptor for unary RPCs, it runs first to measure the whole call
+func metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// Metrics interceptor for streaming RPCs, it runs first to measure the whole call
+func metricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+// datastoreCollector exports the datastore's business counters when the metrics are scraped
+type datastoreCollector struct {
+	db *datastore.Datastore
+
+	seatsSold         *prometheus.Desc
+	seatsFree         *prometheus.Desc
+	bookingsCreated   *prometheus.Desc
+	bookingsCancelled *prometheus.Desc
+	bookingsModified  *prometheus.Desc
+}
+
+// newDatastoreCollector creates a collector for the datastore's business metrics
+func newDatastoreCollector(db *datastore.Datastore) *datastoreCollector {
+	return &datastoreCollector{
+		db:                db,
+		seatsSold:         prometheus.NewDesc("booking_seats_sold", "Number of seats sold by section.", []string{"section"}, nil),
+		seatsFree:         prometheus.NewDesc("booking_seats_free", "Number of free seats by section.", []string{"section"}, nil),
+		bookingsCreated:   prometheus.NewDesc("booking_bookings_created_total", "Number of bookings created.", nil, nil),
+		bookingsCancelled: prometheus.NewDesc("booking_bookings_cancelled_total", "Number of bookings cancelled.", nil, nil),
+		bookingsModified:  prometheus.NewDesc("booking_bookings_modified_total", "Number of seat changes of bookings.", nil, nil),
+	}
+}
+
+// Describe sends the descriptions of the datastore metrics
+func (c *datastoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.seatsSold
+	ch <- c.seatsFree
+	ch <- c.bookingsCreated
+	ch <- c.bookingsCancelled
+	ch <- c.bookingsModified
+}
+
+// Collect reads the datastore stats and sends them as metrics
+func (c *datastoreCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.Stats()
+	for section, seats := range stats.Sections {
+		ch <- prometheus.MustNewConstMetric(c.seatsSold, prometheus.GaugeValue, float64(seats.Sold), string(section))
+		ch <- prometheus.MustNewConstMetric(c.seatsFree, prometheus.GaugeValue, float64(seats.Free), string(section))
+	}
+	ch <- prometheus.MustNewConstMetric(c.bookingsCreated, prometheus.CounterValue, float64(stats.BookingsCreated))
+	ch <- prometheus.MustNewConstMetric(c.bookingsCancelled, prometheus.CounterValue, float64(stats.BookingsCancelled))
+	ch <- prometheus.MustNewConstMetric(c.bookingsModified, prometheus.CounterValue, float64(stats.BookingsModified))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	return mux
+}
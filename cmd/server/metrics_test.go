@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	handledBefore := testutil.ToFloat64(rpcHandled.WithLabelValues("/BookingService/Purchase", "OK"))
+	failures := map[string]float64{}
+	for _, reason := range []string{authFailureMissingToken, authFailureBadSignature, authFailureExpired, authFailureMalformed} {
+		failures[reason] = testutil.ToFloat64(authFailures.WithLabelValues(reason))
+	}
+
+	userCtx := getCtxWithToken(t, ctx, "user@example.com", false)
+	booking, err := client.Purchase(userCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	})
+	if err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	adminCtx := getCtxWithToken(t, ctx, "admin@example.com", true)
+	if _, err := client.ModifySeat(adminCtx, &pb.ModifySeatRequest{BookingId: booking.BookingId, NewSectionId: "A", NewSeatId: "2"}); err != nil {
+		t.Fatalf("ModifySeat() error = %v", err)
+	}
+
+	// Rejected callers are counted by reason
+	expired := getCtxWithClaims(t, ctx, jwt.MapClaims{"sub": "user@example.com", "exp": time.Now().Add(-time.Hour).Unix()})
+	badSignature, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user@example.com"}).SignedString([]byte("wrong-key"))
+	for _, callCtx := range []context.Context{
+		ctx,
+		expired,
+		metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", badSignature)),
+		metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "not-a-token")),
+	} {
+		stream, err := client.GetUserBookings(callCtx, &emptypb.Empty{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if err == nil {
+			t.Fatalf("GetUserBookings() succeeded without a valid token")
+		}
+	}
+
+	if got := testutil.ToFloat64(rpcHandled.WithLabelValues("/BookingService/Purchase", "OK")) - handledBefore; got != 1 {
+		t.Errorf("grpc_server_handled_total for Purchase increased by %v, want 1", got)
+	}
+	for reason, before := range failures {
+		if got := testutil.ToFloat64(authFailures.WithLabelValues(reason)) - before; got != 1 {
+			t.Errorf("booking_auth_failures_total{reason=%q} increased by %v, want 1", reason, got)
+		}
+	}
+
+	expected := `
+# HELP booking_bookings_created_total Number of bookings created.
+# TYPE booking_bookings_created_total counter
+booking_bookings_created_total 1
+# HELP booking_bookings_modified_total Number of seat changes of bookings.
+# TYPE booking_bookings_modified_total counter
+booking_bookings_modified_total 1
+# HELP booking_seats_free Number of free seats by section.
+# TYPE booking_seats_free gauge
+booking_seats_free{section="A"} 1
+booking_seats_free{section="B"} 2
+# HELP booking_seats_sold Number of seats sold by section.
+# TYPE booking_seats_sold gauge
+booking_seats_sold{section="A"} 1
+booking_seats_sold{section="B"} 0
+`
+	if err := testutil.CollectAndCompare(newDatastoreCollector(db), strings.NewReader(expected),
+		"booking_bookings_created_total", "booking_bookings_modified_total", "booking_seats_free", "booking_seats_sold"); err != nil {
+		t.Errorf("datastore metrics: %v", err)
+	}
+
+	// The endpoint serves the RPC metrics in the Prometheus text format
+	recorder := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Result().Body)
+	for _, want := range []string{`grpc_server_handled_total{code="OK",method="/BookingService/Purchase"}`, "grpc_server_handling_seconds_bucket"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics doesn't contain %v", want)
+		}
+	}
+}
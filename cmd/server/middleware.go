@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"log"
 	"strings"
 
 	"google.golang.org/grpc"
@@ -10,52 +9,197 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
+	"github.com/13thuser/exampleauth/datastore"
 	"github.com/dgrijalva/jwt-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Context key for the email ID and is_admin claims
+// tracer of the server's spans, the RPC spans are created by the otelgrpc stats handler
+var tracer = otel.Tracer("github.com/13thuser/exampleauth/cmd/server")
+
+// Context key for the email ID claim, all the token claims, the caller's permissions
+// and the identity of the client certificate
 type contextKey string
 
 const (
-	emailIDKey contextKey = "email_id"
-	isAdminKey contextKey = "is_admin"
+	emailIDKey      contextKey = "email_id"
+	claimsKey       contextKey = "claims"
+	permissionsKey  contextKey = "permissions"
+	peerIdentityKey contextKey = "peer_identity"
+)
+
+// MethodAccess tells the interceptors how callers of a method are authenticated
+type MethodAccess string
+
+const (
+	// AccessAuthenticated requires a valid token, it applies to every method not in PublicMethods
+	AccessAuthenticated MethodAccess = "authenticated"
+	// AccessOptional validates the token when one is provided and lets guests through otherwise
+	AccessOptional MethodAccess = "optional"
+	// AccessPublic never looks at the token
+	AccessPublic MethodAccess = "public"
 )
 
-// You can also use a configuration file or environment variables
-var PublicURLs = []string{"/BookingService/Purchase"}
+// PublicMethods maps the exact gRPC FullMethod of the methods that can be called without a token
+// to their access mode. It can be configured with environment variables or a file, see env.go.
+var PublicMethods = map[string]MethodAccess{
+	"/BookingService/Purchase":             AccessOptional,
+	"/BookingService/PurchaseBookings":     AccessOptional,
+	"/BookingService/RequestBookingAccess": AccessPublic,
+	"/BookingService/RedeemBookingAccess":  AccessPublic,
+	"/grpc.health.v1.Health/Check":         AccessPublic,
+	"/grpc.health.v1.Health/Watch":         AccessPublic,
+}
+
+// hasToken checks if the caller sent an authorization token or an API key
+func hasToken(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && (len(md.Get("authorization")) > 0 || len(md.Get(apiKeyHeader)) > 0)
+}
+
+// apiKeyHeader is the metadata key of the API keys used by machine clients
+const apiKeyHeader = "x-api-key"
+
+// APIKeyAuthenticator checks the API keys sent in the x-api-key header
+type APIKeyAuthenticator interface {
+	AuthenticateAPIKey(ctx context.Context, plainKey string) (datastore.APIKey, error)
+}
+
+// apiKeys authenticates API keys, they are rejected when it is not set
+var apiKeys APIKeyAuthenticator
+
+// apiKeyValidator authenticates the caller with the API key and adds the key's
+// owner and scopes to the context the same way tokenValidator does for claims
+func apiKeyValidator(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(apiKeyHeader)
+	if len(md.Get("authorization")) > 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "send either an API key or an authorization token, not both")
+	}
+	if apiKeys == nil {
+		recordAuthFailure(authFailureInvalidAPIKey)
+		return nil, status.Errorf(codes.Unauthenticated, "API keys are not supported")
+	}
+
+	key, err := apiKeys.AuthenticateAPIKey(ctx, keys[0])
+	if err != nil {
+		recordAuthFailure(authFailureInvalidAPIKey)
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key: %v", err)
+	}
+
+	claims := jwt.MapClaims{
+		"sub":        key.Owner,
+		"scp":        key.Scopes,
+		"api_key_id": key.ID,
+	}
+	ctx = context.WithValue(ctx, emailIDKey, key.Owner)
+	ctx = context.WithValue(ctx, claimsKey, claims)
+	ctx = context.WithValue(ctx, permissionsKey, permissionsFromClaims(claims))
+	return ctx, nil
+}
+
+// authenticate validates the caller's token according to the access mode of the method.
+// Callers with a client certificate listed in ServiceIdentities don't need a token.
+// It returns false when the call goes ahead without an authenticated caller.
+func authenticate(ctx context.Context, fullMethod string) (context.Context, bool, error) {
+	ctx = withPeerIdentity(ctx)
+
+	if PublicMethods[fullMethod] == AccessPublic {
+		return ctx, false, nil
+	}
+	if !hasToken(ctx) {
+		if serviceCtx, ok := serviceAuthenticator(ctx); ok {
+			logCaller(serviceCtx)
+			return serviceCtx, true, nil
+		}
+		if PublicMethods[fullMethod] == AccessOptional {
+			return ctx, false, nil
+		}
+	}
+
+	validator, credential := tokenValidator, "jwt"
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(apiKeyHeader)) > 0 {
+		validator, credential = apiKeyValidator, "api_key"
+	}
+	ctx, err := traceValidator(ctx, credential, validator)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Admins acting as another user are restricted to the impersonation methods
+	ctx, err = impersonate(ctx, fullMethod)
+	if err != nil {
+		return nil, false, err
+	}
+	logCaller(ctx)
+	return ctx, true, nil
+}
+
+// traceValidator runs the validator in a span of its own. The returned context keeps
+// the RPC span as the current span so the handler's spans are not nested in it.
+func traceValidator(ctx context.Context, credential string, validator func(context.Context) (context.Context, error)) (context.Context, error) {
+	rpcSpan := trace.SpanFromContext(ctx)
+	spanCtx, span := tracer.Start(ctx, "validate_credentials", trace.WithAttributes(attribute.String("auth.credential", credential)))
+	defer span.End()
+
+	validatedCtx, err := validator(spanCtx)
+	if err != nil {
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+		return nil, err
+	}
+	return trace.ContextWithSpan(validatedCtx, rpcSpan), nil
+}
 
 // tokenValidator is a helper function to validate the JWT token
 func tokenValidator(ctx context.Context) (context.Context, error) {
 	// Extract the JWT token from the gRPC metadata
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
+		recordAuthFailure(authFailureMissingToken)
 		return nil, status.Errorf(codes.Unauthenticated, "metadata is not provided")
 	}
 	token := md.Get("authorization")
 	if len(token) == 0 {
+		recordAuthFailure(authFailureMissingToken)
 		return nil, status.Errorf(codes.Unauthenticated, "authorization token is not provided")
 	}
 
+	// Accept both "Bearer <token>" and the bare token
+	rawToken := token[0]
+	if len(rawToken) > len("bearer ") && strings.EqualFold(rawToken[:len("bearer ")], "bearer ") {
+		rawToken = rawToken[len("bearer "):]
+	}
+
 	// Parse the JWT token and extract the claims
-	parsedToken, err := jwt.Parse(token[0], func(token *jwt.Token) (interface{}, error) {
+	parsedToken, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
 		// Provide the key or public key to verify the token's signature
 		// You can customize this based on your JWT implementation
 		return []byte(JWT_SECRET_KEY), nil
 	})
 	if err != nil {
+		recordAuthFailure(tokenFailureReason(err))
 		return nil, status.Errorf(codes.Unauthenticated, "failed to parse JWT token: %v", err)
 	}
 
 	claims, ok := parsedToken.Claims.(jwt.MapClaims)
 	if !ok || !parsedToken.Valid {
+		recordAuthFailure(authFailureInvalidToken)
 		return nil, status.Errorf(codes.Unauthenticated, "invalid JWT token")
 	}
 
-	log.Printf("Claims: %v\n", claims)
+	// Booking access tokens must be redeemed for a session token first
+	if claims["typ"] == bookingAccessTokenType {
+		recordAuthFailure(authFailureWrongTokenType)
+		return nil, status.Errorf(codes.Unauthenticated, "booking access tokens can't be used as authorization token")
+	}
 
-	// Access the sub and is_admin claims and add them to the context
+	// Access the sub claim and the permissions granted by roles and scopes, and add them to the context
 	ctx = context.WithValue(ctx, emailIDKey, claims["sub"])
-	ctx = context.WithValue(ctx, isAdminKey, claims["is_admin"])
+	ctx = context.WithValue(ctx, claimsKey, claims)
+	ctx = context.WithValue(ctx, permissionsKey, permissionsFromClaims(claims))
 
 	return ctx, nil
 }
@@ -66,16 +210,17 @@ func validateTokenUnaryInterceptor(ctx context.Context, req interface{}, info *g
 		return nil, status.Errorf(codes.Unauthenticated, "metadata is not provided")
 	}
 
-	// check if incoming request is a public URL
-	for _, url := range PublicURLs {
-		if strings.Contains(info.FullMethod, url) {
-			return handler(ctx, req)
-		}
+	// Validate the token unless the method is public and create a new context
+	ctx, authenticated, err := authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if !authenticated {
+		return handler(ctx, req)
 	}
 
-	// Validate the token and create a new context
-	ctx, err := tokenValidator(ctx)
-	if err != nil {
+	// Check the caller is allowed to make this request
+	if err := authorize(ctx, info.FullMethod, req); err != nil {
 		return nil, err
 	}
 
@@ -102,15 +247,48 @@ func validateTokenStreamInterceptor(srv interface{}, ss grpc.ServerStream, info
 		return status.Errorf(codes.DataLoss, "myStreamInterceptor: failed to get metadata from context")
 	}
 
-	// Validate the token and create a new context
-	newCtx, err := tokenValidator(ss.Context())
+	// Validate the token unless the method is public and create a new context
+	newCtx, authenticated, err := authenticate(ss.Context(), info.FullMethod)
 	if err != nil {
 		return err
 	}
+	if !authenticated {
+		return handler(srv, ss)
+	}
 
 	// Create a new stream with the updated context
 	wrapped := &wrappedStream{ServerStream: ss, ctx: newCtx}
 
-	// Call the next handler in the chain with the wrapped stream
-	return handler(srv, wrapped)
+	// Client streams have no single request message, authorize them on the method alone
+	if info.IsClientStream {
+		if err := authorize(newCtx, info.FullMethod, nil); err != nil {
+			return err
+		}
+		return handler(srv, wrapped)
+	}
+
+	// Call the next handler in the chain with the wrapped stream,
+	// authorizing the call once the request message is decoded
+	return handler(srv, &authorizingStream{wrappedStream: wrapped, fullMethod: info.FullMethod})
+}
+
+// authorizingStream authorizes the call when the request message of a server stream is received
+type authorizingStream struct {
+	*wrappedStream
+	fullMethod string
+	authorized bool
+}
+
+// RecvMsg receives the request message and checks the caller is allowed to make the request
+func (s *authorizingStream) RecvMsg(m interface{}) error {
+	if err := s.wrappedStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !s.authorized {
+		if err := authorize(s.ctx, s.fullMethod, m); err != nil {
+			return err
+		}
+		s.authorized = true
+	}
+	return nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// withPublicMethods replaces PublicMethods for the duration of the test
+func withPublicMethods(t *testing.T, methods map[string]MethodAccess) {
+	previous := PublicMethods
+	PublicMethods = methods
+	t.Cleanup(func() { PublicMethods = previous })
+}
+
+func TestPublicMethods_AccessModes(t *testing.T) {
+	ctx := context.Background()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	badTokenCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "not-a-jwt"))
+	purchase := func(ctx context.Context, seat string) error {
+		_, err := client.Purchase(ctx, &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: "guest@example.com", FirstName: "guest", LastName: "user"},
+			Seat: &pb.Seat{SectionId: "A", SeatId: seat},
+		})
+		return err
+	}
+	section := func(ctx context.Context) error {
+		stream, err := client.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: "A"})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+
+	// Optional: guests go through, but a token that is sent must be valid
+	withPublicMethods(t, map[string]MethodAccess{"/BookingService/Purchase": AccessOptional})
+	if err := purchase(ctx, "1"); err != nil {
+		t.Errorf("optional access without token: error = %v", err)
+	}
+	if err := purchase(badTokenCtx, "2"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("optional access with invalid token: got %v, want Unauthenticated", status.Code(err))
+	}
+	// A valid token is authorized rather than ignored, without a write scope it isn't a guest
+	readerCtx := getCtxWithClaims(t, ctx, jwt.MapClaims{"sub": "reader@example.com", "scope": string(PermBookingsReadSelf)})
+	if err := purchase(readerCtx, "2"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("optional access with a read only token: got %v, want PermissionDenied", status.Code(err))
+	}
+
+	// Public: the token is never looked at, for streams too
+	withPublicMethods(t, map[string]MethodAccess{
+		"/BookingService/Purchase":             AccessPublic,
+		"/BookingService/GetBookingsBySection": AccessPublic,
+	})
+	if err := purchase(badTokenCtx, "2"); err != nil {
+		t.Errorf("public access with invalid token: error = %v", err)
+	}
+	if err := section(ctx); status.Code(err) == codes.Unauthenticated || status.Code(err) == codes.PermissionDenied {
+		t.Errorf("public stream without token: error = %v", err)
+	}
+
+	// Only exact FullMethods are public
+	withPublicMethods(t, map[string]MethodAccess{"/BookingService/Purchas": AccessPublic})
+	if err := purchase(ctx, "0"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("method prefix: got %v, want Unauthenticated", status.Code(err))
+	}
+	stream, err := client.GetUserBookings(ctx, &emptypb.Empty{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("stream without token: got %v, want Unauthenticated", status.Code(err))
+	}
+}
+
+func TestGetPublicMethods(t *testing.T) {
+	defaults := map[string]MethodAccess{
+		"/BookingService/Purchase":     AccessOptional,
+		"/grpc.health.v1.Health/Check": AccessPublic,
+		"/grpc.health.v1.Health/Watch": AccessPublic,
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		t.Setenv("PUBLIC_METHODS_FILE", "")
+		t.Setenv("PUBLIC_METHODS", "")
+		t.Setenv("OPTIONAL_AUTH_METHODS", "")
+		t.Setenv("AUTHENTICATED_METHODS", "")
+		methods, err := getPublicMethods(defaults)
+		if err != nil {
+			t.Fatalf("getPublicMethods() error = %v", err)
+		}
+		if !reflect.DeepEqual(methods, defaults) {
+			t.Errorf("getPublicMethods() = %v, want the defaults %v", methods, defaults)
+		}
+		methods["/BookingService/Purchase"] = AccessPublic
+		if defaults["/BookingService/Purchase"] != AccessOptional {
+			t.Errorf("getPublicMethods() returned the defaults rather than a copy")
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("PUBLIC_METHODS_FILE", "")
+		t.Setenv("PUBLIC_METHODS", "/BookingService/GetBookingsBySection")
+		t.Setenv("OPTIONAL_AUTH_METHODS", " /BookingService/Purchase ,")
+		t.Setenv("AUTHENTICATED_METHODS", "")
+		methods, err := getPublicMethods(defaults)
+		if err != nil {
+			t.Fatalf("getPublicMethods() error = %v", err)
+		}
+		want := map[string]MethodAccess{
+			"/BookingService/GetBookingsBySection": AccessPublic,
+			"/BookingService/Purchase":             AccessOptional,
+			"/grpc.health.v1.Health/Check":         AccessPublic,
+			"/grpc.health.v1.Health/Watch":         AccessPublic,
+		}
+		if !reflect.DeepEqual(methods, want) {
+			t.Errorf("getPublicMethods() = %v, want %v", methods, want)
+		}
+	})
+
+	// A partial override changes and removes the listed methods only, the health checks stay public
+	t.Run("partial override", func(t *testing.T) {
+		t.Setenv("PUBLIC_METHODS_FILE", "")
+		t.Setenv("PUBLIC_METHODS", "/BookingService/Purchase")
+		t.Setenv("OPTIONAL_AUTH_METHODS", "")
+		t.Setenv("AUTHENTICATED_METHODS", "/grpc.health.v1.Health/Watch")
+		methods, err := getPublicMethods(defaults)
+		if err != nil {
+			t.Fatalf("getPublicMethods() error = %v", err)
+		}
+		want := map[string]MethodAccess{
+			"/BookingService/Purchase":     AccessPublic,
+			"/grpc.health.v1.Health/Check": AccessPublic,
+		}
+		if !reflect.DeepEqual(methods, want) {
+			t.Errorf("getPublicMethods() = %v, want %v", methods, want)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "public_methods")
+		content := "# only signed in users buy tickets\nauthenticated /BookingService/Purchase\npublic /BookingService/GetBookingsBySection\n"
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PUBLIC_METHODS_FILE", path)
+		methods, err := getPublicMethods(defaults)
+		if err != nil {
+			t.Fatalf("getPublicMethods() error = %v", err)
+		}
+		want := map[string]MethodAccess{
+			"/BookingService/GetBookingsBySection": AccessPublic,
+			"/grpc.health.v1.Health/Check":         AccessPublic,
+			"/grpc.health.v1.Health/Watch":         AccessPublic,
+		}
+		if !reflect.DeepEqual(methods, want) {
+			t.Errorf("getPublicMethods() = %v, want %v", methods, want)
+		}
+	})
+
+	invalid := map[string]string{
+		"missing service": "Purchase",
+		"prefix only":     "/BookingService",
+		"trailing slash":  "/BookingService/Purchase/",
+	}
+	for name, method := range invalid {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PUBLIC_METHODS_FILE", "")
+			t.Setenv("PUBLIC_METHODS", method)
+			if _, err := getPublicMethods(defaults); err == nil {
+				t.Errorf("getPublicMethods() expected an error for %q", method)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to guests, e.g. by email
+type Notifier interface {
+	// SendBookingAccess delivers the single-use booking access token to the email address
+	SendBookingAccess(ctx context.Context, email string, token string, expiresAt time.Time) error
+}
+
+// WriterNotifier writes the messages to a writer instead of sending them.
+// It stands in for a real email sender during development.
+type WriterNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// LinkURL is the page the guest opens with the token, the token is added as "token" query parameter
+	LinkURL string
+}
+
+// NewWriterNotifier creates a notifier that writes the messages to w
+func NewWriterNotifier(w io.Writer, linkURL string) *WriterNotifier {
+	return &WriterNotifier{w: w, LinkURL: linkURL}
+}
+
+// NewFileNotifier creates a notifier that appends the messages to the file at path
+func NewFileNotifier(path string, linkURL string) (*WriterNotifier, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open notifier file: %v", err)
+	}
+	return NewWriterNotifier(file, linkURL), nil
+}
+
+// SendBookingAccess writes the booking access message
+func (n *WriterNotifier) SendBookingAccess(ctx context.Context, email string, token string, expiresAt time.Time) error {
+	link := token
+	if n.LinkURL != "" {
+		u, err := url.Parse(n.LinkURL)
+		if err != nil {
+			return fmt.Errorf("invalid link url: %v", err)
+		}
+		query := u.Query()
+		query.Set("token", token)
+		u.RawQuery = query.Encode()
+		link = u.String()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.w, "To: %s\nSubject: Access your bookings\n\nUse this link to see and manage your bookings, it can be used once until %s:\n%s\n\n",
+		email, expiresAt.Format(time.RFC1123), link)
+	return err
+}
@@ -0,0 +1,752 @@
+package main
+
+// Policy rules add attribute based authorization on top of the static MethodPolicies
+// table. A policy file holds one rule per line, "#" starts a comment:
+//
+//	<allow|deny> <method> [if <condition>]
+//
+// method is a gRPC FullMethod, a prefix ending in "*", or "*" for every method.
+// A condition compares attributes and literals with ==, !=, <, <=, >, >= and in,
+// combined with and, or, not and parentheses. The attributes are:
+//
+//	method           the FullMethod being called
+//	subject.<claim>  claims of the caller's token, e.g. subject.sub. subject.roles lists the
+//	                 roles of the token, admin for the legacy is_admin claim, and is empty
+//	                 rather than missing when it has none
+//	request.<field>  fields of the request message, e.g. request.seat.section_id
+//	resource.<attr>  the booking named by request.booking_id: owner, section, seat,
+//	                 journey, departure and departs_in
+//
+// Literals are "strings", numbers, true, false and durations such as 24h.
+// A comparison involving a missing attribute, e.g. a claim the token doesn't have, is an
+// error rather than false, so not (subject.tier == "free") doesn't hold for tokens
+// without a tier. "and" and "or" are decided without the error when their other side
+// is false, respectively true. A deny rule that fails denies the call, an allow rule
+// that fails doesn't grant anything.
+//
+// Deny rules win over allow rules, a matching allow rule grants access on its own,
+// and calls matched by no rule are decided by the next Authorizer.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	"github.com/dgrijalva/jwt-go"
+)
+
+type ruleEffect string
+
+const (
+	effectAllow ruleEffect = "allow"
+	effectDeny  ruleEffect = "deny"
+)
+
+// policyRule is a single parsed line of the policy file
+type policyRule struct {
+	line   int
+	effect ruleEffect
+	method string
+	cond   condition // nil means the rule always applies
+}
+
+// matchesMethod checks the rule's method pattern against the FullMethod
+func (r policyRule) matchesMethod(fullMethod string) bool {
+	if strings.HasSuffix(r.method, "*") {
+		return strings.HasPrefix(fullMethod, strings.TrimSuffix(r.method, "*"))
+	}
+	return r.method == fullMethod
+}
+
+// Policy is a parsed set of rules
+type Policy struct {
+	rules []policyRule
+}
+
+// LoadPolicyFile reads and parses the policy file at path
+func LoadPolicyFile(path string) (*Policy, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %v", err)
+	}
+	return ParsePolicy(string(src))
+}
+
+// ParsePolicy parses the rules of a policy
+func ParsePolicy(src string) (*Policy, error) {
+	policy := &Policy{}
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("policy line %d: %v", i+1, err)
+		}
+		rule.line = i + 1
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+// parseRule parses "<effect> <method> [if <condition>]"
+func parseRule(line string) (policyRule, error) {
+	var rule policyRule
+
+	effect, rest, _ := strings.Cut(line, " ")
+	switch ruleEffect(effect) {
+	case effectAllow, effectDeny:
+		rule.effect = ruleEffect(effect)
+	default:
+		return rule, fmt.Errorf("unknown effect %q, want allow or deny", effect)
+	}
+
+	method, rest, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	if method == "" {
+		return rule, fmt.Errorf("missing method")
+	}
+	rule.method = method
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return rule, nil
+	}
+	if !strings.HasPrefix(rest, "if ") {
+		return rule, fmt.Errorf("expected \"if\" after method, got %q", rest)
+	}
+	parsed, err := parseCondition(strings.TrimPrefix(rest, "if "))
+	if err != nil {
+		return rule, err
+	}
+	rule.cond = parsed
+	return rule, nil
+}
+
+// decide returns the rule that decides the call, if any. Deny rules take precedence, a deny
+// rule whose condition fails decides the call with the error.
+func (p *Policy) decide(fullMethod string, attrs attributes) (policyRule, bool, error) {
+	var allowed *policyRule
+	for i, rule := range p.rules {
+		if !rule.matchesMethod(fullMethod) {
+			continue
+		}
+		if rule.cond != nil {
+			applies, err := rule.cond.eval(attrs)
+			if err != nil && rule.effect == effectDeny {
+				return rule, true, err
+			}
+			if err != nil || !applies {
+				continue
+			}
+		}
+		if rule.effect == effectDeny {
+			return rule, true, nil
+		}
+		if allowed == nil {
+			allowed = &p.rules[i]
+		}
+	}
+	if allowed != nil {
+		return *allowed, true, nil
+	}
+	return policyRule{}, false, nil
+}
+
+// ResourceResolver returns the attributes of the booking with the given id
+type ResourceResolver func(ctx context.Context, bookingID string) (map[string]interface{}, bool)
+
+// bookingResources resolves resource attributes from the datastore
+func bookingResources(db *datastore.Datastore) ResourceResolver {
+	return func(ctx context.Context, bookingID string) (map[string]interface{}, bool) {
+		booking, err := db.GetBooking(ctx, datastore.BookingID(bookingID))
+		if err != nil {
+			return nil, false
+		}
+		return map[string]interface{}{
+			"owner":      booking.Owner(),
+			"section":    booking.Seat.SectionID,
+			"seat":       booking.Seat.SeatID,
+			"journey":    booking.JourneyID,
+			"departure":  booking.Departure,
+			"departs_in": time.Until(booking.Departure),
+		}, true
+	}
+}
+
+// RuleAuthorizer evaluates a Policy and falls back to the Next authorizer when no rule applies
+type RuleAuthorizer struct {
+	Policy *Policy
+	Next   Authorizer
+
+	// Resources resolves the resource.* attributes, may be nil
+	Resources ResourceResolver
+
+	// AuditOnly is the dry-run mode: rules are evaluated and logged, but the
+	// decision of the Next authorizer is enforced
+	AuditOnly bool
+}
+
+// Authorize decides the call using the policy rules
+func (a *RuleAuthorizer) Authorize(ctx context.Context, req *AuthzRequest) error {
+	attrs := &callAttributes{ctx: ctx, req: req, resolver: a.Resources}
+	rule, matched, evalErr := a.Policy.decide(req.FullMethod, attrs)
+
+	var ruleErr error
+	if matched && rule.effect == effectDeny {
+		ruleErr = status.Errorf(codes.PermissionDenied, "permission denied for %v by policy", req.FullMethod)
+	}
+	if evalErr != nil && !a.AuditOnly {
+		slog.WarnContext(ctx, "policy rule failed", "method", req.FullMethod, "rule", rule.line, "error", evalErr)
+	}
+
+	if a.AuditOnly {
+		err := a.Next.Authorize(ctx, req)
+		if matched {
+			subject, _ := req.Claims["sub"].(string)
+			fields := []interface{}{"method", req.FullMethod, "subject", logPseudonym(subject),
+				"rule", rule.line, "effect", rule.effect, "enforced", decisionString(err)}
+			if evalErr != nil {
+				fields = append(fields, "error", evalErr)
+			}
+			slog.InfoContext(ctx, "policy audit", fields...)
+		}
+		return err
+	}
+
+	if !matched {
+		return a.Next.Authorize(ctx, req)
+	}
+	return ruleErr
+}
+
+func decisionString(err error) ruleEffect {
+	if err != nil {
+		return effectDeny
+	}
+	return effectAllow
+}
+
+// attributes resolves the attribute paths used in conditions
+type attributes interface {
+	lookup(path []string) (interface{}, bool)
+}
+
+// callAttributes exposes the attributes of an authorization request
+type callAttributes struct {
+	ctx      context.Context
+	req      *AuthzRequest
+	resolver ResourceResolver
+
+	resource map[string]interface{}
+	resolved bool
+}
+
+func (c *callAttributes) lookup(path []string) (interface{}, bool) {
+	switch {
+	case len(path) == 1 && path[0] == "method":
+		return c.req.FullMethod, true
+	case len(path) == 2 && path[0] == "subject" && path[1] == "roles":
+		return subjectRoles(c.req.Claims), true
+	case len(path) == 2 && path[0] == "subject":
+		claim, ok := c.req.Claims[path[1]]
+		if !ok {
+			return nil, false
+		}
+		return normalizeValue(claim)
+	case len(path) >= 2 && path[0] == "request":
+		if c.req.Request == nil {
+			return nil, false
+		}
+		return messageField(c.req.Request.ProtoReflect(), path[1:])
+	case len(path) == 2 && path[0] == "resource":
+		if !c.resolved {
+			c.resolved = true
+			if bookingID, ok := c.lookup([]string{"request", "booking_id"}); ok && c.resolver != nil {
+				c.resource, _ = c.resolver(c.ctx, bookingID.(string))
+			}
+		}
+		value, ok := c.resource[path[1]]
+		return value, ok
+	}
+	return nil, false
+}
+
+// subjectRoles returns the roles of the token, like permissionsFromClaims reads them
+func subjectRoles(claims jwt.MapClaims) []string {
+	roles := append([]string{}, claimStrings(claims["roles"])...)
+	if isAdmin, _ := claims["is_admin"].(bool); isAdmin {
+		roles = append(roles, RoleAdmin)
+	}
+	return roles
+}
+
+// messageField walks the field path in the message and returns the scalar value found
+func messageField(msg protoreflect.Message, path []string) (interface{}, bool) {
+	field := msg.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if field == nil || field.IsList() || field.IsMap() {
+		return nil, false
+	}
+	value := msg.Get(field)
+
+	if field.Kind() == protoreflect.MessageKind {
+		if !msg.Has(field) {
+			return nil, false
+		}
+		if ts, ok := value.Message().Interface().(*timestamppb.Timestamp); ok && len(path) == 1 {
+			return ts.AsTime(), true
+		}
+		if len(path) == 1 {
+			return nil, false
+		}
+		return messageField(value.Message(), path[1:])
+	}
+	if len(path) != 1 {
+		return nil, false
+	}
+
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return value.String(), true
+	case protoreflect.BoolKind:
+		return value.Bool(), true
+	case protoreflect.EnumKind:
+		if enum := field.Enum().Values().ByNumber(value.Enum()); enum != nil {
+			return string(enum.Name()), true
+		}
+		return nil, false
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return value.Float(), true
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		return float64(value.Int()), true
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		return float64(value.Uint()), true
+	}
+	return nil, false
+}
+
+// normalizeValue converts claim values to the types used by conditions
+func normalizeValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string, bool, float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case []string:
+		return v, true
+	case []interface{}:
+		return claimStrings(v), true
+	}
+	return nil, false
+}
+
+// condition is a node of a parsed rule condition, it fails when a comparison it depends on
+// involves a missing attribute
+type condition interface {
+	eval(attrs attributes) (bool, error)
+}
+
+type andCond struct{ left, right condition }
+type orCond struct{ left, right condition }
+type notCond struct{ cond condition }
+type compareCond struct {
+	op          string
+	left, right operand
+}
+
+// eval is false when either side is false, even if the other side fails
+func (c andCond) eval(attrs attributes) (bool, error) {
+	left, leftErr := c.left.eval(attrs)
+	if leftErr == nil && !left {
+		return false, nil
+	}
+	right, rightErr := c.right.eval(attrs)
+	if rightErr == nil && !right {
+		return false, nil
+	}
+	if leftErr != nil {
+		return false, leftErr
+	}
+	if rightErr != nil {
+		return false, rightErr
+	}
+	return true, nil
+}
+
+// eval is true when either side is true, even if the other side fails
+func (c orCond) eval(attrs attributes) (bool, error) {
+	left, leftErr := c.left.eval(attrs)
+	if leftErr == nil && left {
+		return true, nil
+	}
+	right, rightErr := c.right.eval(attrs)
+	if rightErr == nil && right {
+		return true, nil
+	}
+	if leftErr != nil {
+		return false, leftErr
+	}
+	return false, rightErr
+}
+
+func (c notCond) eval(attrs attributes) (bool, error) {
+	value, err := c.cond.eval(attrs)
+	if err != nil {
+		return false, err
+	}
+	return !value, nil
+}
+
+func (c compareCond) eval(attrs attributes) (bool, error) {
+	left, err := c.left.value(attrs)
+	if err != nil {
+		return false, err
+	}
+	right, err := c.right.value(attrs)
+	if err != nil {
+		return false, err
+	}
+	return c.compare(left, right), nil
+}
+
+// compare applies the operator to the values of the operands
+func (c compareCond) compare(left, right interface{}) bool {
+	if c.op == "in" {
+		switch list := right.(type) {
+		case []string:
+			for _, item := range list {
+				if item == left {
+					return true
+				}
+			}
+			return false
+		default:
+			return left == right
+		}
+	}
+
+	cmp, ok := compareValues(left, right)
+	if !ok {
+		// Values of different types are never equal and cannot be ordered
+		return c.op == "!="
+	}
+	switch c.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareValues orders two values of the same type
+func compareValues(left, right interface{}) (int, bool) {
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), true
+		}
+	case float64:
+		if r, ok := right.(float64); ok {
+			return compareOrdered(l, r), true
+		}
+	case time.Duration:
+		if r, ok := right.(time.Duration); ok {
+			return compareOrdered(l, r), true
+		}
+	case time.Time:
+		if r, ok := right.(time.Time); ok {
+			return compareOrdered(l.Sub(r), 0), true
+		}
+	case bool:
+		if r, ok := right.(bool); ok && l == r {
+			return 0, true
+		} else if ok {
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T float64 | time.Duration](l, r T) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// operand is either a literal or an attribute reference
+type operand struct {
+	literal interface{}
+	path    []string
+}
+
+func (o operand) value(attrs attributes) (interface{}, error) {
+	if o.path == nil {
+		return o.literal, nil
+	}
+	value, ok := attrs.lookup(o.path)
+	if !ok {
+		return nil, fmt.Errorf("attribute %v is missing", strings.Join(o.path, "."))
+	}
+	return value, nil
+}
+
+// parseCondition parses the condition of a rule
+func parseCondition(src string) (condition, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{tokens: tokens}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return cond, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits a condition into words, quoted strings and operators
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			text, err := strconv.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %v: %v", src[i:end+1], err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text})
+			i = end + 1
+		case c == '(' || c == ')':
+			tokens = append(tokens, token{kind: tokenOp, text: string(c)})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			op := string(c)
+			if i+1 < len(src) && src[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op})
+			i += len(op)
+		default:
+			end := i
+			for end < len(src) && isWordChar(rune(src[end])) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: src[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-+:/@", r)
+}
+
+// condParser is a recursive descent parser for conditions:
+//
+//	or      = and { "or" and }
+//	and     = unary { "and" unary }
+//	unary   = "not" unary | "(" or ")" | operand op operand
+type condParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *condParser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *condParser) next() (token, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return token{}, fmt.Errorf("unexpected end of condition")
+	}
+	p.pos++
+	return tok, nil
+}
+
+// accept consumes the next token if it is the given word or operator
+func (p *condParser) accept(text string) bool {
+	if tok, ok := p.peek(); ok && tok.kind != tokenString && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *condParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCond{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andCond{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseUnary() (condition, error) {
+	if p.accept("not") {
+		cond, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notCond{cond: cond}, nil
+	}
+	if p.accept("(") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return cond, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case op.kind == tokenOp && op.text != "(" && op.text != ")":
+	case op.kind == tokenWord && op.text == "in":
+	default:
+		return nil, fmt.Errorf("expected comparison operator, got %q", op.text)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareCond{op: op.text, left: left, right: right}, nil
+}
+
+func (p *condParser) parseOperand() (operand, error) {
+	tok, err := p.next()
+	if err != nil {
+		return operand{}, err
+	}
+	if tok.kind == tokenString {
+		return operand{literal: tok.text}, nil
+	}
+	if tok.kind != tokenWord {
+		return operand{}, fmt.Errorf("expected value, got %q", tok.text)
+	}
+
+	switch tok.text {
+	case "true", "false":
+		return operand{literal: tok.text == "true"}, nil
+	case "and", "or", "not", "in":
+		return operand{}, fmt.Errorf("expected value, got %q", tok.text)
+	}
+	if n, err := strconv.ParseFloat(tok.text, 64); err == nil {
+		return operand{literal: n}, nil
+	}
+	if d, err := time.ParseDuration(tok.text); err == nil {
+		return operand{literal: d}, nil
+	}
+
+	path := strings.Split(tok.text, ".")
+	switch path[0] {
+	case "method":
+		if len(path) != 1 {
+			return operand{}, fmt.Errorf("unknown attribute %q", tok.text)
+		}
+	case "subject", "request", "resource":
+		if len(path) < 2 {
+			return operand{}, fmt.Errorf("incomplete attribute %q", tok.text)
+		}
+	default:
+		return operand{}, fmt.Errorf("unknown attribute %q", tok.text)
+	}
+	return operand{path: path}, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestParsePolicy_Errors(t *testing.T) {
+	tests := map[string]string{
+		"unknown effect":       `permit /BookingService/Purchase`,
+		"missing method":       `allow`,
+		"missing if":           `allow /BookingService/Purchase when true`,
+		"unknown attribute":    `allow * if user.sub == "a"`,
+		"unterminated string":  `allow * if subject.sub == "a`,
+		"missing operator":     `allow * if subject.sub "a"`,
+		"unbalanced":           `allow * if (subject.sub == "a"`,
+		"single equals":        `allow * if subject.sub = "a"`,
+		"trailing tokens":      `allow * if subject.sub == "a" "b"`,
+		"incomplete attribute": `allow * if subject == "a"`,
+	}
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParsePolicy(src); err == nil {
+				t.Errorf("ParsePolicy(%q) expected an error", src)
+			}
+		})
+	}
+}
+
+func TestRuleAuthorizer_BookingPolicy(t *testing.T) {
+	policy, err := LoadPolicyFile("../../policies/booking.policy")
+	if err != nil {
+		t.Fatalf("LoadPolicyFile() error = %v", err)
+	}
+
+	departures := map[string]time.Time{
+		"soon":     time.Now().Add(2 * time.Hour),
+		"later":    time.Now().Add(72 * time.Hour),
+		"departed": time.Now().Add(-time.Hour),
+	}
+	resources := func(ctx context.Context, bookingID string) (map[string]interface{}, bool) {
+		departure, ok := departures[bookingID]
+		if !ok {
+			return nil, false
+		}
+		return map[string]interface{}{"departs_in": time.Until(departure)}, true
+	}
+
+	tests := map[string]struct {
+		claims  jwt.MapClaims
+		method  string
+		request proto.Message
+		want    codes.Code
+	}{
+		"agent modifies seat departing soon": {
+			claims:  jwt.MapClaims{"sub": "agent@example.com", "roles": []interface{}{"agent"}},
+			method:  "/BookingService/ModifySeat",
+			request: &pb.ModifySeatRequest{BookingId: "soon"},
+			want:    codes.OK,
+		},
+		"agent cannot modify seat departing later": {
+			claims:  jwt.MapClaims{"sub": "agent@example.com", "roles": []interface{}{"agent"}},
+			method:  "/BookingService/ModifySeat",
+			request: &pb.ModifySeatRequest{BookingId: "later"},
+			want:    codes.PermissionDenied,
+		},
+		"agent cannot modify seat of departed journey": {
+			claims:  jwt.MapClaims{"sub": "agent@example.com", "roles": []interface{}{"agent"}},
+			method:  "/BookingService/ModifySeat",
+			request: &pb.ModifySeatRequest{BookingId: "departed"},
+			want:    codes.PermissionDenied,
+		},
+		"admin modifies seat departing later": {
+			claims:  jwt.MapClaims{"sub": "admin@example.com", "roles": []interface{}{"agent", "admin"}},
+			method:  "/BookingService/ModifySeat",
+			request: &pb.ModifySeatRequest{BookingId: "later"},
+			want:    codes.OK,
+		},
+		"legacy admin modifies seat departing later": {
+			claims:  jwt.MapClaims{"sub": "admin@example.com", "is_admin": true},
+			method:  "/BookingService/ModifySeat",
+			request: &pb.ModifySeatRequest{BookingId: "later"},
+			want:    codes.OK,
+		},
+		"section manager lists own section": {
+			claims:  jwt.MapClaims{"sub": "manager@example.com", "roles": []interface{}{"section_manager"}, "section": "A"},
+			method:  "/BookingService/GetBookingsBySection",
+			request: &pb.GetBookingsBySectionRequest{Section: "A"},
+			want:    codes.OK,
+		},
+		"section manager cannot list other section": {
+			claims:  jwt.MapClaims{"sub": "manager@example.com", "roles": []interface{}{"section_manager"}, "section": "A"},
+			method:  "/BookingService/GetBookingsBySection",
+			request: &pb.GetBookingsBySectionRequest{Section: "B"},
+			want:    codes.PermissionDenied,
+		},
+		"unmatched call falls back to the policy table": {
+			claims:  jwt.MapClaims{"sub": "user@example.com"},
+			method:  "/BookingService/GetUserBookings",
+			request: nil,
+			want:    codes.OK,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, auditOnly := range []bool{false, true} {
+				a := &RuleAuthorizer{Policy: policy, Next: PolicyTableAuthorizer{}, Resources: resources, AuditOnly: auditOnly}
+				err := a.Authorize(context.Background(), &AuthzRequest{
+					Claims:      tt.claims,
+					Permissions: permissionsFromClaims(tt.claims),
+					FullMethod:  tt.method,
+					Request:     tt.request,
+				})
+
+				want := tt.want
+				if auditOnly {
+					// In audit mode only the static policy table is enforced
+					want = status.Code(PolicyTableAuthorizer{}.Authorize(context.Background(), &AuthzRequest{
+						Permissions: permissionsFromClaims(tt.claims),
+						FullMethod:  tt.method,
+					}))
+				}
+				if got := status.Code(err); got != want {
+					t.Errorf("Authorize(audit only: %v) = %v, want %v", auditOnly, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCondition_Operators(t *testing.T) {
+	claims := jwt.MapClaims{"sub": "user@example.com", "level": float64(3), "verified": true}
+	request := &pb.PurchaseRequest{Seat: &pb.Seat{SectionId: "A", SeatId: "7"}}
+
+	tests := map[string]struct {
+		want    bool
+		wantErr bool
+	}{
+		`subject.level >= 3 and subject.level < 4`:           {want: true},
+		`subject.level != 3`:                                 {want: false},
+		`subject.verified == true`:                           {want: true},
+		`not subject.verified == true or subject.sub == "x"`: {want: false},
+		`request.seat.section_id == "B" or (subject.level > 1 and method == "/BookingService/Purchase")`: {want: true},
+		`subject.sub == 3`: {want: false},
+		`subject.sub != 3`: {want: true},
+		// Comparisons of missing attributes fail, negated or not, unless the other side decides
+		`request.seat.section_id == "A" and request.seat.seat_id in subject.missing`: {wantErr: true},
+		`subject.missing != "anything"`:                                              {wantErr: true},
+		`not (subject.missing == "anything")`:                                        {wantErr: true},
+		`subject.missing == "anything" or subject.level == 4`:                        {wantErr: true},
+		`subject.missing == "anything" and subject.level == 4`:                       {want: false},
+		`subject.level == 3 or not (subject.missing == "anything")`:                  {want: true},
+		// Tokens without roles have none rather than a missing attribute
+		`"admin" in subject.roles`:       {want: false},
+		`not ("agent" in subject.roles)`: {want: true},
+	}
+	for src, tt := range tests {
+		t.Run(src, func(t *testing.T) {
+			cond, err := parseCondition(src)
+			if err != nil {
+				t.Fatalf("parseCondition() error = %v", err)
+			}
+			attrs := &callAttributes{ctx: context.Background(), req: &AuthzRequest{
+				Claims:     claims,
+				FullMethod: "/BookingService/Purchase",
+				Request:    request,
+			}}
+			got, err := cond.eval(attrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("eval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleAuthorizer_MissingAttributes(t *testing.T) {
+	policy, err := ParsePolicy(`
+deny /BookingService/Purchase if subject.tier != "paid"
+allow /BookingService/GetBookingsBySection if not (subject.tier == "free")
+`)
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	authorize := func(claims jwt.MapClaims, method string) codes.Code {
+		a := &RuleAuthorizer{Policy: policy, Next: PolicyTableAuthorizer{}}
+		return status.Code(a.Authorize(context.Background(), &AuthzRequest{
+			Claims:      claims,
+			Permissions: permissionsFromClaims(claims),
+			FullMethod:  method,
+		}))
+	}
+
+	tests := map[string]struct {
+		claims jwt.MapClaims
+		method string
+		want   codes.Code
+	}{
+		"deny rule applies":                {jwt.MapClaims{"sub": "user@example.com", "tier": "free"}, "/BookingService/Purchase", codes.PermissionDenied},
+		"deny rule doesn't apply":          {jwt.MapClaims{"sub": "user@example.com", "tier": "paid"}, "/BookingService/Purchase", codes.OK},
+		"deny rule on a missing claim":     {jwt.MapClaims{"sub": "user@example.com"}, "/BookingService/Purchase", codes.PermissionDenied},
+		"allow rule grants":                {jwt.MapClaims{"sub": "user@example.com", "tier": "paid"}, "/BookingService/GetBookingsBySection", codes.OK},
+		"allow rule doesn't apply":         {jwt.MapClaims{"sub": "user@example.com", "tier": "free"}, "/BookingService/GetBookingsBySection", codes.PermissionDenied},
+		"negated allow on a missing claim": {jwt.MapClaims{"sub": "user@example.com"}, "/BookingService/GetBookingsBySection", codes.PermissionDenied},
+		"missing claim left to the table":  {jwt.MapClaims{"sub": "admin@example.com", "roles": []interface{}{RoleAdmin}}, "/BookingService/GetBookingsBySection", codes.OK},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := authorize(tt.claims, tt.method); got != tt.want {
+				t.Errorf("Authorize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// RateLimit allows Count calls per Period with bursts of up to Burst calls
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+	Burst  int
+}
+
+// String formats the limit the way ParseRateLimit reads it
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%v %d", l.Count, l.Period, l.Burst)
+}
+
+// rate is the number of tokens added to the bucket per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Count) / l.Period.Seconds()
+}
+
+// ParseRateLimit parses a limit written as "<count>/<period> [burst]", e.g. "10/m" or "5/30s 10".
+// The period is a duration, a bare unit means one of it. The burst defaults to the count.
+func ParseRateLimit(value string) (RateLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, want \"<count>/<period> [burst]\"", value)
+	}
+	count, period, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, want \"<count>/<period> [burst]\"", value)
+	}
+
+	var limit RateLimit
+	var err error
+	if limit.Count, err = strconv.Atoi(count); err != nil || limit.Count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit count %q", count)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	if limit.Period, err = time.ParseDuration(period); err != nil || limit.Period <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit period %q", period)
+	}
+	limit.Burst = limit.Count
+	if len(fields) == 2 {
+		if limit.Burst, err = strconv.Atoi(fields[1]); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit burst %q", fields[1])
+		}
+	}
+	return limit, nil
+}
+
+// RateLimits maps gRPC FullMethods to their limit, "*" applies to the methods not listed.
+// Methods without a limit are not rate limited. It can be configured with RATE_LIMITS or
+// RATE_LIMITS_FILE, see env.go.
+var RateLimits = map[string]RateLimit{
+	"/BookingService/Purchase":             {Count: 10, Period: time.Minute, Burst: 5},
+	"/BookingService/PurchaseBookings":     {Count: 10, Period: time.Minute, Burst: 5},
+	"/BookingService/RequestBookingAccess": {Count: 5, Period: time.Hour, Burst: 3},
+	"/BookingService/RedeemBookingAccess":  {Count: 10, Period: time.Minute, Burst: 5},
+}
+
+// rateLimitTargets returns the keys of the targets of a call, for the methods limited per target
+// on top of per caller. The email of RequestBookingAccess has its own bucket, so rotating IP
+// addresses doesn't flood an inbox.
+var rateLimitTargets = map[string]func(req interface{}) []string{
+	"/BookingService/RequestBookingAccess": func(req interface{}) []string {
+		r, ok := req.(*pb.RequestBookingAccessRequest)
+		if !ok {
+			return nil
+		}
+		// Invalid addresses are rejected by the handler, the caller's bucket limits them
+		email, err := NormalizeEmail(r.EmailAddress)
+		if err != nil {
+			return nil
+		}
+		return []string{"email:" + email}
+	},
+}
+
+// rateLimitFor returns the limit of the method
+func rateLimitFor(fullMethod string) (RateLimit, bool) {
+	if limit, ok := RateLimits[fullMethod]; ok {
+		return limit, true
+	}
+	limit, ok := RateLimits["*"]
+	return limit, ok
+}
+
+// RateLimiter keeps the token buckets of the callers. The in-process MemoryRateLimiter is used by
+// default, a limiter backed by a shared store lets several servers enforce the limits together.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key. When the bucket is empty it returns false and
+	// how long until a token is available.
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// rateLimiter is called by the interceptors for every call of a limited method
+var rateLimiter RateLimiter = NewMemoryRateLimiter()
+
+// tokenBucket holds the tokens left at the time of the last update and when the bucket is full
+// again at the rate of its limit
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryRateLimiter keeps the token buckets in memory
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryRateLimiter creates an in-process rate limiter
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// How often buckets of idle callers are dropped
+const rateLimiterSweepInterval = time.Minute
+
+// Allow refills the bucket for the time passed since its last update and takes a token
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.rate())
+	bucket.updated = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	bucket.full = now.Add(time.Duration((float64(limit.Burst) - bucket.tokens) / limit.rate() * float64(time.Second)))
+
+	if !allowed {
+		wait := time.Duration((1 - bucket.tokens) / limit.rate() * float64(time.Second))
+		return false, wait, nil
+	}
+	return true, 0, nil
+}
+
+// sweep drops the buckets that had time to refill completely at the rate of their own limit, a
+// new bucket starts full anyway
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if now.After(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the caller: the API key, the authenticated subject or, for
+// anonymous callers, the peer's IP address
+func rateLimitKey(ctx context.Context) string {
+	if claims, ok := ctx.Value(claimsKey).(jwt.MapClaims); ok {
+		if id, ok := claims["api_key_id"].(string); ok && id != "" {
+			return "key:" + id
+		}
+	}
+	if subject, ok := ctx.Value(emailIDKey).(string); ok && subject != "" {
+		return "sub:" + subject
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		// The REST gateway of this process appends the address of its client to X-Forwarded-For,
+		// the header of other callers isn't trusted
+		if fromGateway(ctx) {
+			if forwarded := metadata.ValueFromIncomingContext(ctx, "x-forwarded-for"); len(forwarded) > 0 {
+				hops := strings.Split(forwarded[len(forwarded)-1], ",")
+				host = strings.TrimSpace(hops[len(hops)-1])
+			}
+		}
+		return "ip:" + host
+	}
+	return "ip:unknown"
+}
+
+// rateLimit checks the caller's bucket for the method, and the buckets of the targets of req. It
+// returns ResourceExhausted with RetryInfo, QuotaFailure and ErrorInfo details when a bucket is
+// empty. Errors of the limiter are logged and let the call through, so an unavailable backend
+// doesn't stop the service.
+func rateLimit(ctx context.Context, fullMethod string, req interface{}) error {
+	limit, ok := rateLimitFor(fullMethod)
+	if !ok {
+		return nil
+	}
+
+	keys := []string{rateLimitKey(ctx)}
+	if targets, ok := rateLimitTargets[fullMethod]; ok && req != nil {
+		keys = append(keys, targets(req)...)
+	}
+	for _, key := range keys {
+		if err := allowCall(ctx, fullMethod, key, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowCall takes a token from the bucket of key for the method
+func allowCall(ctx context.Context, fullMethod, key string, limit RateLimit) error {
+	allowed, retryAfter, err := rateLimiter.Allow(ctx, fullMethod+" "+key, limit)
+	if err != nil {
+		slog.WarnContext(ctx, "rate limiter failed", "method", fullMethod, "error", err)
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+
+	recordRateLimited(fullMethod)
+	st, err := status.New(codes.ResourceExhausted, fmt.Sprintf("rate limit of %v exceeded, retry in %v", fullMethod, retryAfter.Round(time.Millisecond))).WithDetails(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     key,
+			Description: fmt.Sprintf("%d calls per %v with bursts of %d", limit.Count, limit.Period, limit.Burst),
+		}}},
+		&errdetails.ErrorInfo{Reason: pb.REASON_RATE_LIMITED, Domain: pb.ErrorDomain, Metadata: map[string]string{"rule": fullMethod}},
+	)
+	if err != nil {
+		return status.Errorf(codes.ResourceExhausted, "rate limit of %v exceeded", fullMethod)
+	}
+	return st.Err()
+}
+
+// Rate limiting interceptor for unary RPCs, it runs after the token validation to know the caller
+func rateLimitUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := rateLimit(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Rate limiting interceptor for streaming RPCs, a stream takes a single token of the caller's bucket
+// when it starts
+func rateLimitStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := rateLimit(ss.Context(), info.FullMethod, nil); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
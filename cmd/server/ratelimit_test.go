@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{value: "10/m", want: RateLimit{Count: 10, Period: time.Minute, Burst: 10}},
+		{value: "5/30s 10", want: RateLimit{Count: 5, Period: 30 * time.Second, Burst: 10}},
+		{value: "1/1h0m0s 1", want: RateLimit{Count: 1, Period: time.Hour, Burst: 1}},
+		{value: "10", wantErr: true},
+		{value: "0/s", wantErr: true},
+		{value: "10/fortnight", wantErr: true},
+		{value: "10/s 0", wantErr: true},
+		{value: "10/s 1 2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateLimit(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+		if !tt.wantErr {
+			if again, err := ParseRateLimit(got.String()); err != nil || again != got {
+				t.Errorf("ParseRateLimit(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+			}
+		}
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := RateLimit{Count: 1, Period: time.Second, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := limiter.Allow(ctx, "a", limit); !ok {
+			t.Fatalf("call %d within the burst was limited", i+1)
+		}
+	}
+	ok, retryAfter, _ := limiter.Allow(ctx, "a", limit)
+	if ok {
+		t.Fatalf("call over the burst was allowed")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retry after = %v, want 1s", retryAfter)
+	}
+
+	// Other callers have their own bucket
+	if ok, _, _ := limiter.Allow(ctx, "b", limit); !ok {
+		t.Errorf("other caller was limited")
+	}
+
+	// The bucket refills over time
+	now = now.Add(500 * time.Millisecond)
+	if ok, retryAfter, _ := limiter.Allow(ctx, "a", limit); ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("Allow() after 500ms = %v, %v, want false, 500ms", ok, retryAfter)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _, _ := limiter.Allow(ctx, "a", limit); !ok {
+		t.Errorf("call after the refill was limited")
+	}
+
+	// Buckets of idle callers are dropped
+	now = now.Add(time.Hour)
+	limiter.Allow(ctx, "c", limit)
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Errorf("bucket of an idle caller was kept")
+	}
+}
+
+func TestMemoryRateLimiterSweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	strict := RateLimit{Count: 1, Period: time.Minute, Burst: 5}
+	loose := RateLimit{Count: 100, Period: time.Second, Burst: 100}
+
+	// The strict bucket is exhausted, it takes a minute per token to refill
+	for i := 0; i < 5; i++ {
+		limiter.Allow(ctx, "purchase a", strict)
+	}
+	if ok, _, _ := limiter.Allow(ctx, "purchase a", strict); ok {
+		t.Fatalf("call over the burst was allowed")
+	}
+
+	// A sweep triggered by a call of the loose limit keeps the strict bucket
+	now = now.Add(rateLimiterSweepInterval + time.Second)
+	limiter.Allow(ctx, "other a", loose)
+	if _, ok := limiter.buckets["purchase a"]; !ok {
+		t.Fatalf("bucket of the strict limit was dropped before it refilled")
+	}
+	if ok, _, _ := limiter.Allow(ctx, "purchase a", strict); !ok {
+		t.Errorf("call with the refilled token was limited")
+	}
+	if ok, _, _ := limiter.Allow(ctx, "purchase a", strict); ok {
+		t.Errorf("call over the refilled token was allowed")
+	}
+
+	// Once refilled the buckets are dropped, each by its own limit
+	now = now.Add(20 * time.Second)
+	limiter.lastSweep = time.Time{}
+	limiter.Allow(ctx, "other b", loose)
+	if _, ok := limiter.buckets["purchase a"]; !ok {
+		t.Errorf("bucket of the strict limit was dropped before it refilled")
+	}
+	if _, ok := limiter.buckets["other a"]; ok {
+		t.Errorf("refilled bucket of the loose limit was kept")
+	}
+	now = now.Add(5 * time.Minute)
+	limiter.lastSweep = time.Time{}
+	limiter.Allow(ctx, "other b", loose)
+	if _, ok := limiter.buckets["purchase a"]; ok {
+		t.Errorf("refilled bucket of the strict limit was kept")
+	}
+}
+
+// recordingLimiter records the keys it is asked about and answers with allowed and err
+type recordingLimiter struct {
+	keys    []string
+	allowed bool
+	err     error
+}
+
+func (l *recordingLimiter) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	l.keys = append(l.keys, key)
+	return l.allowed, 1500 * time.Millisecond, l.err
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+	const method = "/BookingService/Purchase"
+	limiter := &recordingLimiter{}
+	defaultLimiter, defaultLimits := rateLimiter, RateLimits
+	rateLimiter = limiter
+	RateLimits = map[string]RateLimit{method: {Count: 1, Period: time.Second, Burst: 1}}
+	defer func() { rateLimiter, RateLimits = defaultLimiter, defaultLimits }()
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	call := func(ctx context.Context, fullMethod string) error {
+		_, err := rateLimitUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: fullMethod}, handler)
+		return err
+	}
+
+	anonymous := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}})
+	user := context.WithValue(anonymous, emailIDKey, "user@example.com")
+	apiKey := context.WithValue(user, claimsKey, jwt.MapClaims{"sub": "user@example.com", "api_key_id": "key1"})
+
+	// Limited calls are ResourceExhausted with details on when to retry
+	err := call(user, method)
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("limited call error = %v, want ResourceExhausted", err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	var quotaFailure *errdetails.QuotaFailure
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.RetryInfo:
+			retryInfo = detail
+		case *errdetails.QuotaFailure:
+			quotaFailure = detail
+		}
+	}
+	if retryInfo == nil || retryInfo.RetryDelay.AsDuration() != 1500*time.Millisecond {
+		t.Errorf("RetryInfo = %v, want a delay of 1.5s", retryInfo)
+	}
+	if quotaFailure == nil || len(quotaFailure.Violations) != 1 || quotaFailure.Violations[0].Subject != "sub:user@example.com" {
+		t.Errorf("QuotaFailure = %v, want a violation of the caller", quotaFailure)
+	}
+
+	// Callers are keyed by API key, subject or IP address
+	limiter.keys = nil
+	call(apiKey, method)
+	call(anonymous, method)
+	// Anonymous calls of the REST gateway are keyed by the address the gateway forwards, other
+	// local callers by their own address whatever they forward
+	loopback := &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}}
+	gateway := peer.NewContext(metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-forwarded-for", "198.51.100.7, 203.0.113.9", gatewayMarkerKey, gatewayMarker)), loopback)
+	call(gateway, method)
+	local := peer.NewContext(metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-forwarded-for", "203.0.113.10", gatewayMarkerKey, "guessed")), loopback)
+	call(local, method)
+	want := []string{method + " key:key1", method + " ip:192.0.2.1", method + " ip:203.0.113.9", method + " ip:127.0.0.1"}
+	if !slices.Equal(limiter.keys, want) {
+		t.Errorf("limiter keys = %q, want %q", limiter.keys, want)
+	}
+
+	// Methods without a limit don't reach the limiter
+	limiter.keys = nil
+	if err := call(user, "/BookingService/GetUserBookings"); err != nil || len(limiter.keys) != 0 {
+		t.Errorf("unlimited method error = %v, limiter keys = %q", err, limiter.keys)
+	}
+	RateLimits["*"] = RateLimit{Count: 1, Period: time.Second, Burst: 1}
+	if err := call(user, "/BookingService/GetUserBookings"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("method under the default limit error = %v, want ResourceExhausted", err)
+	}
+
+	// A failing limiter lets the calls through
+	limiter.err = errors.New("backend unavailable")
+	if err := call(user, method); err != nil {
+		t.Errorf("call with a failing limiter error = %v, want nil", err)
+	}
+	limiter.err, limiter.allowed = nil, true
+	if err := call(user, method); err != nil {
+		t.Errorf("allowed call error = %v", err)
+	}
+}
+
+func TestGuestAccessRateLimits(t *testing.T) {
+	ctx := context.Background()
+	client, closer := createTestServer(t, ctx, datastore.NewDatastore())
+	defer closer()
+
+	// Anonymous callers are limited by their IP address with the default limits
+	request := RateLimits["/BookingService/RequestBookingAccess"]
+	for i := 0; i < request.Burst; i++ {
+		if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: fmt.Sprintf("guest%d@example.com", i)}); err != nil {
+			t.Fatalf("RequestBookingAccess() call %d error = %v", i+1, err)
+		}
+	}
+	if _, err := client.RequestBookingAccess(ctx, &pb.RequestBookingAccessRequest{EmailAddress: "other@example.com"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("RequestBookingAccess() over the limit error = %v, want ResourceExhausted", err)
+	}
+	redeem := RateLimits["/BookingService/RedeemBookingAccess"]
+	for i := 0; i < redeem.Burst; i++ {
+		if _, err := client.RedeemBookingAccess(ctx, &pb.RedeemBookingAccessRequest{AccessToken: "guessed"}); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("RedeemBookingAccess() call %d error = %v, want Unauthenticated", i+1, err)
+		}
+	}
+	if _, err := client.RedeemBookingAccess(ctx, &pb.RedeemBookingAccessRequest{AccessToken: "guessed"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("RedeemBookingAccess() over the limit error = %v, want ResourceExhausted", err)
+	}
+
+	// The requests for an email share a bucket whatever the address and spelling of the caller
+	rateLimiter = NewMemoryRateLimiter()
+	const method = "/BookingService/RequestBookingAccess"
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	call := func(ip, email string) error {
+		ctx := peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}})
+		_, err := rateLimitUnaryInterceptor(ctx, &pb.RequestBookingAccessRequest{EmailAddress: email}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	for i := 0; i < request.Burst; i++ {
+		if err := call(fmt.Sprintf("192.0.2.%d", i+1), "Victim@Example.com"); err != nil {
+			t.Fatalf("call %d for the email error = %v", i+1, err)
+		}
+	}
+	err := call("198.51.100.1", " victim@example.com")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("call for the email from a new address error = %v, want ResourceExhausted", err)
+	}
+	for _, detail := range status.Convert(err).Details() {
+		if quotaFailure, ok := detail.(*errdetails.QuotaFailure); ok && quotaFailure.Violations[0].Subject != "email:victim@example.com" {
+			t.Errorf("QuotaFailure subject = %q, want the email's bucket", quotaFailure.Violations[0].Subject)
+		}
+	}
+	if err := call("198.51.100.1", "someone@example.com"); err != nil {
+		t.Errorf("call for another email from a new address error = %v", err)
+	}
+}
+
+func TestGatewayRateLimitKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The server records the rate limit key of the calls
+	keys := make(chan string, 1)
+	lis := bufconn.Listen(bufSize)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		keys <- rateLimitKey(ctx)
+		return nil, status.Error(codes.Unavailable, "recorded")
+	}))
+	pb.RegisterBookingServiceServer(srv, pb.UnimplementedBookingServiceServer{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	gateway, err := newGateway(ctx, "bufnet", grpc.WithContextDialer(bufDialer(lis)), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("newGateway() error = %v", err)
+	}
+	httpServer := httptest.NewServer(gateway)
+	defer httpServer.Close()
+
+	// The gateway appends the address of its client to the forwarded ones
+	req, _ := http.NewRequest("POST", httpServer.URL+"/v1/bookings", strings.NewReader(`{}`))
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /v1/bookings error = %v", err)
+	}
+	resp.Body.Close()
+	if key := <-keys; key != "ip:127.0.0.1" {
+		t.Errorf("rate limit key of the gateway's call = %v, want ip:127.0.0.1", key)
+	}
+
+	// Direct callers can't choose their key with the header
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer(lis)), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	pb.NewBookingServiceClient(conn).Purchase(metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", "198.51.100.8"), &pb.PurchaseRequest{})
+	if key := <-keys; key == "ip:198.51.100.8" {
+		t.Errorf("rate limit key of a direct call = %v, want the peer's address", key)
+	}
+}
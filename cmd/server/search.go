@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Number of bookings returned by SearchBookings by default and at most
+const (
+	DEFAULT_SEARCH_LIMIT = 20
+	MAX_SEARCH_LIMIT     = 100
+)
+
+// SearchBookings finds the active bookings of any user by the passenger's name or email address,
+// the start of the booking id or the seat, for support agents looking for a customer's booking.
+func (s *BookingServer) SearchBookings(ctx context.Context, req *pb.SearchBookingsRequest) (*pb.SearchBookingsResponse, error) {
+	// Permission to read any booking is enforced by the authorization policy in the interceptors
+
+	if req.Limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must not be negative")
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = DEFAULT_SEARCH_LIMIT
+	}
+	limit = min(limit, MAX_SEARCH_LIMIT)
+
+	query := datastore.SearchQuery{
+		Text:            req.Query,
+		BookingIDPrefix: strings.TrimSpace(req.BookingIdPrefix),
+		SectionID:       datastore.SectionID(req.Seat.GetSectionId()),
+		SeatID:          datastore.SeatID(req.Seat.GetSeatId()),
+		Limit:           limit,
+	}
+	if query.SeatID != "" && query.SectionID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "the seat needs a section")
+	}
+	if strings.TrimSpace(query.Text) == "" && query.BookingIDPrefix == "" && query.SectionID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "query, booking_id_prefix or seat is required")
+	}
+
+	resp := &pb.SearchBookingsResponse{}
+	for _, booking := range s.db.SearchBookings(ctx, query) {
+		resp.Bookings = append(resp.Bookings, toPBBooking(booking))
+	}
+	return resp, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+func TestSearchBookings(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(datastore.WithSectionSize(200))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	purchase := func(email string, first string, last string, section string, seat string) datastore.Booking {
+		booking, err := db.Purchase(ctx, email, datastore.Booking{
+			User: datastore.User{EmailAddress: email, FirstName: first, LastName: last},
+			Seat: datastore.Seat{SectionID: section, SeatID: seat},
+		})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		return booking
+	}
+	purchase("john.doe@example.com", "John", "Doe", "A", "1")
+	jane := purchase("jane@example.com", "Jane", "Doe", "B", "2")
+	cancelled := purchase("bob@example.com", "Bob", "Smith", "A", "3")
+	if err := db.RemoveUserFromTrain(ctx, datastore.BookingID(cancelled.BookingID)); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	adminCtx := getCtxWithToken(t, ctx, "admin@example.com", true)
+
+	tests := []struct {
+		name string
+		req  *pb.SearchBookingsRequest
+		want string
+	}{
+		{"surname", &pb.SearchBookingsRequest{Query: "Doe"}, "A1,B2"},
+		{"partial email", &pb.SearchBookingsRequest{Query: "john.d"}, "A1"},
+		{"typo", &pb.SearchBookingsRequest{Query: "Jnae"}, "B2"},
+		{"booking id prefix", &pb.SearchBookingsRequest{BookingIdPrefix: jane.BookingID[:6]}, "B2"},
+		{"seat", &pb.SearchBookingsRequest{Seat: &pb.Seat{SectionId: "A", SeatId: "1"}}, "A1"},
+		{"section and surname", &pb.SearchBookingsRequest{Query: "doe", Seat: &pb.Seat{SectionId: "B"}}, "B2"},
+		{"cancelled booking", &pb.SearchBookingsRequest{Query: "smith"}, ""},
+		{"limit", &pb.SearchBookingsRequest{Query: "doe", Limit: 1}, "A1"},
+	}
+	for _, tt := range tests {
+		resp, err := client.SearchBookings(adminCtx, tt.req)
+		if err != nil {
+			t.Errorf("SearchBookings(%v) error = %v", tt.name, err)
+			continue
+		}
+		if got := seatIDs(resp.Bookings); got != tt.want {
+			t.Errorf("SearchBookings(%v) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for i := 10; i < 10+MAX_SEARCH_LIMIT+1; i++ {
+		purchase("group-"+strconv.Itoa(i)+"@example.com", "Group", "Member", "B", strconv.Itoa(i))
+	}
+	if resp, err := client.SearchBookings(adminCtx, &pb.SearchBookingsRequest{Query: "member"}); err != nil || len(resp.Bookings) != DEFAULT_SEARCH_LIMIT {
+		t.Errorf("SearchBookings() = %v bookings, %v, want %v", len(resp.GetBookings()), err, DEFAULT_SEARCH_LIMIT)
+	}
+	if resp, err := client.SearchBookings(adminCtx, &pb.SearchBookingsRequest{Query: "member", Limit: MAX_SEARCH_LIMIT + 1}); err != nil || len(resp.Bookings) != MAX_SEARCH_LIMIT {
+		t.Errorf("SearchBookings() = %v bookings, %v, want %v", len(resp.GetBookings()), err, MAX_SEARCH_LIMIT)
+	}
+
+	for _, req := range []*pb.SearchBookingsRequest{
+		{},
+		{Query: "  "},
+		{Query: "doe", Limit: -1},
+		{Seat: &pb.Seat{SeatId: "1"}},
+	} {
+		if _, err := client.SearchBookings(adminCtx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SearchBookings(%v) error = %v, want InvalidArgument", req, err)
+		}
+	}
+	userCtx := getCtxWithToken(t, ctx, "jane@example.com", false)
+	if _, err := client.SearchBookings(userCtx, &pb.SearchBookingsRequest{Query: "doe"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SearchBookings() by a user error = %v, want PermissionDenied", err)
+	}
+}
@@ -1,41 +1,249 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"net"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	datastore "github.com/13thuser/exampleauth/datastore"
 	pb "github.com/13thuser/exampleauth/grpc"
+	"github.com/13thuser/exampleauth/telemetry"
 )
 
 // Define the gRPC server port. You can also use a configuration file or environment variables
 var GRPC_SERVER_PORT = "50051"
 
 func main() {
+	// Structured logging, the log package writes through it too
+	logger, err := getLogger()
+	if err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	slog.SetDefault(logger)
+	if LogSampleRate, err = getLogSampleRate(); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	if JWT_SECRET_KEY, err = getSecretKey(); err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+
+	// Configure TLS, and mutual TLS when a client CA bundle is set
+	var listenerTLS *tls.Config
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	if tlsConfig != nil {
+		if listenerTLS, err = webTLSConfig(*tlsConfig); err != nil {
+			log.Fatalf("Failed to load TLS certificates: %v", err)
+		}
+		log.Printf("TLS enabled (mutual TLS: %v)", tlsConfig.ClientCAFile != "")
+	}
+	corsConfig, err := getCORSConfig()
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	if ServiceIdentities, err = getServiceIdentities(); err != nil {
+		log.Fatalf("Invalid service identities: %v", err)
+	}
+
+	// Merge the configured public methods over the defaults
+	if PublicMethods, err = getPublicMethods(PublicMethods); err != nil {
+		log.Fatalf("Failed to load public methods: %v", err)
+	}
+	log.Printf("Public methods: %v", PublicMethods)
+
+	impersonationMethods, err := getImpersonationMethods()
+	if err != nil {
+		log.Fatalf("Failed to load impersonation methods: %v", err)
+	}
+	if impersonationMethods != nil {
+		ImpersonationMethods = impersonationMethods
+	}
+
+	rateLimits, err := getRateLimits()
+	if err != nil {
+		log.Fatalf("Failed to load rate limits: %v", err)
+	}
+	if rateLimits != nil {
+		RateLimits = rateLimits
+	}
+	log.Printf("Rate limits: %v", RateLimits)
+
+	// Trace the calls, the trace context is propagated from the incoming metadata
+	shutdownTracing, err := telemetry.Setup(context.Background(), "booking-server")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
 	// Create a new gRPC server with an interceptor
 	server := grpc.NewServer(
-		// Interceptors to validate the JWT token
-		grpc.UnaryInterceptor(validateTokenUnaryInterceptor),
-		grpc.StreamInterceptor(validateTokenStreamInterceptor),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		// Interceptors to measure and log the calls, validate the JWT token and limit the caller's rate
+		grpc.ChainUnaryInterceptor(metricsUnaryInterceptor, loggingUnaryInterceptor, validateTokenUnaryInterceptor, rateLimitUnaryInterceptor),
+		grpc.ChainStreamInterceptor(metricsStreamInterceptor, loggingStreamInterceptor, validateTokenStreamInterceptor, rateLimitStreamInterceptor),
 	)
 
-	// Create a new instance of the datastore
-	db := datastore.NewDatastore()
+	// Subsystems report serving on the health service once they are ready
+	healthSrv := registerHealth(server)
+	if GRPC_REFLECTION {
+		if err := registerReflection(server); err != nil {
+			log.Fatalf("Failed to enable reflection: %v", err)
+		}
+		log.Printf("Server reflection enabled")
+	}
+
+	// Business limits against hoarding seats
+	bookingLimits, err := getBookingLimits()
+	if err != nil {
+		log.Fatalf("Failed to load booking limits: %v", err)
+	}
+	log.Printf("Booking limits: %+v", bookingLimits)
+	cancelledRetention, err := getCancelledRetention()
+	if err != nil {
+		log.Fatalf("Failed to load the cancelled bookings retention: %v", err)
+	}
+
+	// Create a new instance of the datastore, restoring the snapshot when persistence is on
+	db := datastore.NewDatastore(datastore.WithBookingLimits(bookingLimits), datastore.WithCancelledRetention(cancelledRetention))
+	if DATASTORE_FILE != "" {
+		if err := db.LoadFile(context.Background(), DATASTORE_FILE); err != nil {
+			log.Fatalf("Failed to load datastore: %v", err)
+		}
+		log.Printf("Datastore persisted to %v", DATASTORE_FILE)
+	}
+	healthSrv.SetServingStatus(healthDatastore, healthpb.HealthCheckResponse_SERVING)
+
+	// API keys are stored in the datastore
+	apiKeys = db
+	healthSrv.SetServingStatus(healthKeys, keysStatus(JWT_SECRET_KEY, tlsConfig, listenerTLS))
+
+	// Serve the metrics next to the gRPC listener
+	metricsRegistry.MustRegister(newDatastoreCollector(db))
+	metricsServer := &http.Server{Addr: ":" + METRICS_PORT, Handler: metricsHandler()}
+	if METRICS_PORT != "" {
+		go func() {
+			log.Println("Metrics served on port", METRICS_PORT)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	// Load the attribute based authorization rules on top of the static policy table
+	if AUTHZ_POLICY_FILE != "" {
+		policy, err := LoadPolicyFile(AUTHZ_POLICY_FILE)
+		if err != nil {
+			log.Fatalf("Failed to load authorization policy: %v", err)
+		}
+		authorizer = &RuleAuthorizer{
+			Policy:    policy,
+			Next:      PolicyTableAuthorizer{},
+			Resources: bookingResources(db),
+			AuditOnly: AUTHZ_POLICY_MODE == "audit",
+		}
+		log.Printf("Loaded authorization policy from %v (audit only: %v)", AUTHZ_POLICY_FILE, AUTHZ_POLICY_MODE == "audit")
+	}
+
+	notifier, err := getNotifier()
+	if err != nil {
+		log.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	identityRules, err := getIdentityRules()
+	if err != nil {
+		log.Fatalf("Invalid identity rules: %v", err)
+	}
 
 	// Register the gRPC server
-	pb.RegisterBookingServiceServer(server, NewBookingServer(db))
+	pb.RegisterBookingServiceServer(server, NewBookingServer(db, WithNotifier(notifier), WithIdentityRules(identityRules)))
 
-	// Start the gRPC server
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", GRPC_SERVER_PORT))
+	// gRPC, gRPC-Web and Connect calls share the gRPC listener
+	webSrv, err := newWebServer(fmt.Sprintf(":%s", GRPC_SERVER_PORT), server, corsConfig, listenerTLS)
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		log.Fatalf("Failed to create server: %v", err)
 	}
-	log.Println("Server started on port", GRPC_SERVER_PORT)
-	// Start serving requests
-	if err := server.Serve(listener); err != nil {
+	log.Printf("CORS allowed origins: %v", corsConfig.AllowedOrigins)
+
+	// Serve the REST gateway, it calls the gRPC listener so the calls pass the interceptors
+	gatewayServer := &http.Server{Addr: ":" + GATEWAY_PORT}
+	gatewayCtx, stopGateway := context.WithCancel(context.Background())
+	defer stopGateway()
+	if GATEWAY_PORT != "" {
+		dialCreds := insecure.NewCredentials()
+		if tlsConfig != nil {
+			if tlsConfig.ClientCAFile != "" && tlsConfig.RequireClientCert {
+				log.Fatalf("The gateway can't call the server when client certificates are required, set GATEWAY_PORT=off or TLS_CLIENT_AUTH=optional")
+			}
+			dialCreds = loopbackCredentials(*tlsConfig)
+			if gatewayServer.TLSConfig, err = gatewayTLSConfig(*tlsConfig); err != nil {
+				log.Fatalf("Failed to load gateway TLS certificates: %v", err)
+			}
+		}
+		if gatewayServer.Handler, err = newGateway(gatewayCtx, "localhost:"+GRPC_SERVER_PORT, grpc.WithTransportCredentials(dialCreds)); err != nil {
+			log.Fatalf("Failed to create gateway: %v", err)
+		}
+		go func() {
+			log.Println("REST gateway served on port", GATEWAY_PORT)
+			serve := gatewayServer.ListenAndServe
+			if gatewayServer.TLSConfig != nil {
+				serve = func() error { return gatewayServer.ListenAndServeTLS("", "") }
+			}
+			if err := serve(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to serve gateway: %v", err)
+			}
+		}()
+	}
+	healthSrv.SetServingStatus(healthBooking, healthpb.HealthCheckResponse_SERVING)
+	healthSrv.SetServingStatus(healthServer, healthpb.HealthCheckResponse_SERVING)
+
+	// Start serving requests until the server is asked to stop
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Server started on port", GRPC_SERVER_PORT)
+		serveErr <- webSrv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
 		log.Fatalf("Failed to serve: %v", err)
+	case <-signals.Done():
+	}
+
+	// Drain the running calls, the health service reports not serving so load balancers move away
+	log.Printf("Shutting down, draining calls for up to %v", SHUTDOWN_TIMEOUT)
+	healthSrv.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := gatewayServer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop gateway: %v", err)
+	}
+	stopGateway()
+	webSrv.GracefulStop(SHUTDOWN_TIMEOUT)
+
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop metrics server: %v", err)
+	}
+	if DATASTORE_FILE != "" {
+		if err := db.SaveFile(ctx, DATASTORE_FILE); err != nil {
+			log.Printf("Failed to save datastore: %v", err)
+		} else {
+			log.Printf("Datastore saved to %v", DATASTORE_FILE)
+		}
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
 	}
+	log.Println("Server stopped")
 }
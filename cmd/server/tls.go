@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TLSConfig holds the TLS settings of the server, see getTLSConfig for the environment variables
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is the CA bundle used to verify client certificates, it enables mutual TLS
+	ClientCAFile string
+	// RequireClientCert rejects clients without a certificate, otherwise a certificate is verified when presented
+	RequireClientCert bool
+
+	MinVersion   uint16
+	CipherSuites []uint16
+
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration
+}
+
+// certReloader serves the certificate and client CA bundle from disk and reloads them when the files change
+type certReloader struct {
+	config TLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader loads the certificate files for the first time
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	r := &certReloader{config: config}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files watched for changes
+func (r *certReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the certificate, key and client CA bundle
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat %v: %v", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA bundle %v", r.config.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// reloadIfChanged reloads the files when one of them changed since the last load.
+// A failed reload keeps serving the previous certificate.
+func (r *certReloader) reloadIfChanged() {
+	r.mu.Lock()
+	if time.Since(r.lastCheck) < r.config.ReloadInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastCheck = time.Now()
+	modTimes := r.modTimes
+	r.mu.Unlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().Equal(modTimes[file]) {
+			continue
+		}
+		if err := r.load(); err != nil {
+			// Files are often replaced one at a time, the next check picks up the complete set
+			log.Printf("Failed to reload TLS certificates: %v", err)
+		} else {
+			log.Printf("Reloaded TLS certificates")
+		}
+		return
+	}
+}
+
+// tlsConfig returns a server configuration that picks up reloaded certificates on every handshake
+func (r *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:   r.config.MinVersion,
+		CipherSuites: r.config.CipherSuites,
+		// The configuration returned per client replaces the one gRPC sets up, so it needs ALPN too
+		NextProtos: []string{"h2"},
+	}
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.reloadIfChanged()
+
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.Certificates = []tls.Certificate{*r.cert}
+		if r.clientCAs != nil {
+			config.ClientCAs = r.clientCAs
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			if r.config.RequireClientCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return config, nil
+	}
+	return base
+}
+
+// webTLSConfig returns the configuration of the gRPC listener, which serves the browsers'
+// gRPC-Web and Connect calls over HTTP/1.1 next to HTTP/2
+func webTLSConfig(config TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := reloader.tlsConfig()
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "http/1.1")
+	return tlsConfig, nil
+}
+
+// gatewayTLSConfig returns the configuration of the gateway's HTTPS listener. It serves the
+// server's certificate, reloaded like the gRPC listener's, without asking for client certificates.
+func gatewayTLSConfig(config TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   config.MinVersion,
+		CipherSuites: config.CipherSuites,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			reloader.reloadIfChanged()
+
+			reloader.mu.RLock()
+			defer reloader.mu.RUnlock()
+			return reloader.cert, nil
+		},
+	}, nil
+}
+
+// loopbackCredentials are the credentials of the gateway's connection to the gRPC listener.
+// The gateway only accepts the certificate in CertFile, it is read on every handshake so
+// reloaded certificates are accepted too.
+func loopbackCredentials(config TLSConfig) credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: config.MinVersion,
+		// The certificate is pinned below, the loopback address is usually not one of its names
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			content, err := os.ReadFile(config.CertFile)
+			if err != nil {
+				return fmt.Errorf("failed to read server certificate: %v", err)
+			}
+			block, _ := pem.Decode(content)
+			if block == nil || len(rawCerts) == 0 || !bytes.Equal(block.Bytes, rawCerts[0]) {
+				return fmt.Errorf("server certificate doesn't match %v", config.CertFile)
+			}
+			return nil
+		},
+	})
+}
+
+// PeerIdentity is the identity of a client that presented a verified certificate
+type PeerIdentity struct {
+	CommonName     string
+	DNSNames       []string
+	URIs           []string
+	EmailAddresses []string
+}
+
+// Name returns the name used as subject for the peer: the first URI SAN
+// (e.g. a SPIFFE ID), otherwise the first DNS SAN, otherwise the CN.
+func (p PeerIdentity) Name() string {
+	switch {
+	case len(p.URIs) > 0:
+		return p.URIs[0]
+	case len(p.DNSNames) > 0:
+		return p.DNSNames[0]
+	}
+	return p.CommonName
+}
+
+// peerIdentityFromContext returns the identity of a peer authenticated with a verified client certificate
+func peerIdentityFromContext(ctx context.Context) (PeerIdentity, bool) {
+	if identity, ok := ctx.Value(peerIdentityKey).(PeerIdentity); ok {
+		return identity, true
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return PeerIdentity{}, false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return PeerIdentity{}, false
+	}
+
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	identity := PeerIdentity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity, true
+}
+
+// withPeerIdentity adds the verified client certificate identity, if any, to the context
+func withPeerIdentity(ctx context.Context) context.Context {
+	if identity, ok := peerIdentityFromContext(ctx); ok {
+		return context.WithValue(ctx, peerIdentityKey, identity)
+	}
+	return ctx
+}
+
+// ServiceIdentities maps the names of client certificates to the roles they are granted.
+// Callers with a mapped certificate are authenticated without a JWT token.
+var ServiceIdentities = map[string][]string{}
+
+// serviceAuthenticator authenticates a caller by its client certificate
+func serviceAuthenticator(ctx context.Context) (context.Context, bool) {
+	identity, ok := peerIdentityFromContext(ctx)
+	if !ok {
+		return ctx, false
+	}
+	roles, ok := ServiceIdentities[identity.Name()]
+	if !ok {
+		return ctx, false
+	}
+
+	claims := jwt.MapClaims{"sub": identity.Name(), "roles": roles}
+	ctx = context.WithValue(ctx, emailIDKey, identity.Name())
+	ctx = context.WithValue(ctx, claimsKey, claims)
+	ctx = context.WithValue(ctx, permissionsKey, permissionsFromClaims(claims))
+	return ctx, true
+}
+
+// tlsVersions are the accepted values of TLS_MIN_VERSION, versions before 1.2 are insecure
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites maps comma separated cipher suite names to their ids
+func parseCipherSuites(names string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate and key, returned PEM encoded
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, dnsNames []string, uris []string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, raw := range uris {
+		uri, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS_ServiceIdentity(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t)
+	dir := t.TempDir()
+
+	serverCert, serverKey := ca.issue(t, 2, "server", []string{"bufnet"}, nil, x509.ExtKeyUsageServerAuth)
+	config := TLSConfig{
+		CertFile:          filepath.Join(dir, "server.pem"),
+		KeyFile:           filepath.Join(dir, "server-key.pem"),
+		ClientCAFile:      filepath.Join(dir, "ca.pem"),
+		RequireClientCert: true,
+		MinVersion:        tls.VersionTLS12,
+	}
+	writeFile(t, config.CertFile, serverCert)
+	writeFile(t, config.KeyFile, serverKey)
+	writeFile(t, config.ClientCAFile, ca.pem)
+
+	// The listener serves the gRPC calls over net/http, the client certificate reaches the
+	// interceptors through the peer of the call
+	tlsConfig, err := webTLSConfig(config)
+	if err != nil {
+		t.Fatalf("webTLSConfig() error = %v", err)
+	}
+	srvr := grpc.NewServer(
+		grpc.UnaryInterceptor(validateTokenUnaryInterceptor),
+		grpc.StreamInterceptor(validateTokenStreamInterceptor),
+	)
+	pb.RegisterBookingServiceServer(srvr, NewBookingServer(datastore.NewDatastore()))
+	webSrv, err := newWebServer("", srvr, CORSConfig{}, tlsConfig)
+	if err != nil {
+		t.Fatalf("newWebServer() error = %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go webSrv.ServeTLS(lis, "", "")
+	defer webSrv.Close()
+
+	previous := ServiceIdentities
+	ServiceIdentities = map[string][]string{"spiffe://example.org/billing": {RoleAdmin}}
+	defer func() { ServiceIdentities = previous }()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(ca.pem)
+
+	dial := func(t *testing.T, uri string) pb.BookingServiceClient {
+		clientCert, clientKey := ca.issue(t, 3, "client", nil, []string{uri}, x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := grpc.DialContext(ctx, lis.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+				RootCAs:      rootCAs,
+				ServerName:   "bufnet",
+				Certificates: []tls.Certificate{cert},
+			})))
+		if err != nil {
+			t.Fatalf("error connecting to server: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewBookingServiceClient(conn)
+	}
+
+	sectionCode := func(client pb.BookingServiceClient) codes.Code {
+		stream, err := client.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: "A"})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		return status.Code(err)
+	}
+
+	if code := sectionCode(dial(t, "spiffe://example.org/billing")); code == codes.Unauthenticated || code == codes.PermissionDenied {
+		t.Errorf("mapped service identity: got %v, want access granted", code)
+	}
+	if code := sectionCode(dial(t, "spiffe://example.org/unknown")); code != codes.Unauthenticated {
+		t.Errorf("unmapped service identity: got %v, want Unauthenticated", code)
+	}
+}
+
+func TestCertReloader_ReloadsChangedFiles(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	}
+
+	cert, key := ca.issue(t, 10, "first", []string{"localhost"}, nil, x509.ExtKeyUsageServerAuth)
+	writeFile(t, config.CertFile, cert)
+	writeFile(t, config.KeyFile, key)
+
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	served := func() []byte {
+		tlsConfig, err := reloader.tlsConfig().GetConfigForClient(nil)
+		if err != nil {
+			t.Fatalf("GetConfigForClient() error = %v", err)
+		}
+		return tlsConfig.Certificates[0].Certificate[0]
+	}
+	first := served()
+
+	// Make sure the modification time changes on file systems with coarse timestamps
+	cert, key = ca.issue(t, 11, "second", []string{"localhost"}, nil, x509.ExtKeyUsageServerAuth)
+	writeFile(t, config.CertFile, cert)
+	writeFile(t, config.KeyFile, key)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{config.CertFile, config.KeyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bytes.Equal(first, served()) {
+		t.Errorf("certificate was not reloaded after the files changed")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil || len(suites) != 2 {
+		t.Errorf("parseCipherSuites() = %v, %v", suites, err)
+	}
+	if _, err := parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Errorf("parseCipherSuites() expected an error for an insecure suite")
+	}
+}
+
+func TestGetTLSConfig_MinVersion(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "server.pem")
+	t.Setenv("TLS_KEY_FILE", "server-key.pem")
+	for _, name := range []string{"TLS_CLIENT_CA_FILE", "TLS_CLIENT_AUTH", "TLS_CIPHER_SUITES", "TLS_RELOAD_INTERVAL"} {
+		t.Setenv(name, "")
+	}
+	tests := map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+	for value, want := range tests {
+		t.Setenv("TLS_MIN_VERSION", value)
+		if config, err := getTLSConfig(); err != nil || config.MinVersion != want {
+			t.Errorf("getTLSConfig() with TLS_MIN_VERSION %q = %v, %v, want version %x", value, config, err, want)
+		}
+	}
+	for _, value := range []string{"1.0", "1.1", "2"} {
+		t.Setenv("TLS_MIN_VERSION", value)
+		if _, err := getTLSConfig(); err == nil {
+			t.Errorf("getTLSConfig() expected an error for TLS_MIN_VERSION %q", value)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// spanRecorder records the spans of the global tracer provider. Tracers delegate to the first
+// provider set globally, so it is set once and not restored.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder
+})
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	recorder := spanRecorder()
+
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(2))
+	client, closer := createTestServer(t, ctx, db)
+	defer closer()
+
+	// The client's trace context is sent in the traceparent header
+	traceID, err := newTokenID()
+	if err != nil {
+		t.Fatalf("Failed to create trace id: %v", err)
+	}
+	const parentID = "00f067aa0ba902b7"
+	callCtx := metadata.AppendToOutgoingContext(getCtxWithToken(t, ctx, "user@example.com", false),
+		"traceparent", "00-"+traceID+"-"+parentID+"-01")
+	if _, err := client.Purchase(callCtx, &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	}); err != nil {
+		t.Fatalf("Purchase() error = %v", err)
+	}
+	closer()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+
+	rpc, ok := spans["BookingService/Purchase"]
+	if !ok {
+		t.Fatalf("no RPC span in the client's trace, got %v", spans)
+	}
+	if got := rpc.Parent().SpanID().String(); got != parentID {
+		t.Errorf("RPC span parent = %v, want %v", got, parentID)
+	}
+
+	for _, name := range []string{"validate_credentials", "datastore.Purchase"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %v span in the client's trace", name)
+			continue
+		}
+		if span.Parent().SpanID() != rpc.SpanContext().SpanID() {
+			t.Errorf("%v span is not a child of the RPC span", name)
+		}
+	}
+
+	lockWaitRecorded := false
+	for _, attr := range spans["datastore.Purchase"].Attributes() {
+		lockWaitRecorded = lockWaitRecorded || attr.Key == "datastore.lock_wait_us"
+	}
+	if !lockWaitRecorded {
+		t.Errorf("datastore span has no lock wait time")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"connectrpc.com/vanguard/vanguardgrpc"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// CORSConfig holds the cross-origin settings of the gRPC listener, see getCORSConfig for the
+// environment variables. Browsers only call the server from other origins when it is set.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to call the server, "*" allows every origin
+	AllowedOrigins []string
+	// MaxAge is how long browsers may cache the result of a preflight request
+	MaxAge time.Duration
+}
+
+// allows reports whether the origin may call the server
+func (c CORSConfig) allows(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsAllowedHeaders are the request headers used by the gRPC-Web and Connect clients,
+// and the headers read by the interceptors
+var corsAllowedHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"Connect-Protocol-Version",
+	"Connect-Timeout-Ms",
+	"Grpc-Timeout",
+	"X-Grpc-Web",
+	"X-User-Agent",
+	apiKeyHeader,
+	requestIDHeader,
+	"Traceparent",
+	"Tracestate",
+}
+
+// corsExposedHeaders are the response headers the browser clients read
+var corsExposedHeaders = []string{
+	"Grpc-Status",
+	"Grpc-Message",
+	"Grpc-Status-Details-Bin",
+	requestIDHeader,
+}
+
+// cors answers the preflight requests of the allowed origins and adds the CORS headers to
+// their calls. Requests of other origins are passed on without them, so browsers reject them.
+func cors(config CORSConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(config.AllowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !config.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			if config.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isGRPCRequest reports whether the request uses the gRPC protocol over HTTP/2, gRPC-Web
+// requests have a content type of their own
+func isGRPCRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return r.ProtoMajor == 2 && (contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+"))
+}
+
+// newWebHandler serves the gRPC, gRPC-Web and Connect protocols with the gRPC server.
+// gRPC-Web and Connect calls are translated to gRPC calls of server.ServeHTTP, so all
+// protocols pass the same interceptors and return the same errors. It must be created
+// after the services are registered.
+func newWebHandler(server *grpc.Server, corsConfig CORSConfig) (http.Handler, error) {
+	transcoder, err := vanguardgrpc.NewTranscoder(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC-Web and Connect transcoder: %v", err)
+	}
+
+	// Only the RPC paths are served, the REST routes of the annotations are the gateway's
+	methods := make(map[string]struct{})
+	for service, info := range server.GetServiceInfo() {
+		for _, method := range info.Methods {
+			methods["/"+service+"/"+method.Name] = struct{}{}
+		}
+	}
+
+	return cors(corsConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := methods[r.URL.Path]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if isGRPCRequest(r) {
+			server.ServeHTTP(w, r)
+			return
+		}
+		transcoder.ServeHTTP(w, r)
+	})), nil
+}
+
+// webServer serves the gRPC server over net/http, HTTP/2 without TLS is served for the gRPC
+// clients too. The gRPC server's GracefulStop doesn't support calls served over net/http, so
+// the server tracks the running calls itself.
+type webServer struct {
+	*http.Server
+	grpcServer *grpc.Server
+	// useTLS is kept apart from TLSConfig, which the HTTP/2 configuration always sets
+	useTLS bool
+
+	mu       sync.Mutex
+	calls    int
+	draining bool
+	idle     chan struct{}
+}
+
+// newWebServer creates the server of the gRPC listener. tlsConfig is nil for plain text.
+func newWebServer(addr string, server *grpc.Server, corsConfig CORSConfig, tlsConfig *tls.Config) (*webServer, error) {
+	handler, err := newWebHandler(server, corsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &webServer{grpcServer: server, useTLS: tlsConfig != nil, idle: make(chan struct{})}
+	h2s := &http2.Server{}
+	s.Server = &http.Server{
+		Addr:      addr,
+		Handler:   h2c.NewHandler(s.track(handler), h2s),
+		TLSConfig: tlsConfig,
+	}
+	// Shutdown sends GOAWAY to the HTTP/2 connections, including the h2c ones
+	if err := http2.ConfigureServer(s.Server, h2s); err != nil {
+		return nil, fmt.Errorf("failed to configure HTTP/2: %v", err)
+	}
+	return s, nil
+}
+
+// track counts the running calls, calls arriving while the server drains are refused
+func (s *webServer) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		if s.draining {
+			s.mu.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		s.calls++
+		s.mu.Unlock()
+
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.calls--; s.calls == 0 && s.draining {
+				close(s.idle)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves TLS when the server has a TLS configuration
+func (s *webServer) ListenAndServe() error {
+	if s.useTLS {
+		return s.Server.ListenAndServeTLS("", "")
+	}
+	return s.Server.ListenAndServe()
+}
+
+// GracefulStop stops accepting calls and waits for the running ones for up to timeout,
+// calls still running then are cancelled
+func (s *webServer) GracefulStop(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	s.mu.Lock()
+	s.draining = true
+	if s.calls == 0 {
+		close(s.idle)
+	}
+	s.mu.Unlock()
+
+	// Shutdown returns once the HTTP/1 connections are idle, the HTTP/2 ones get a GOAWAY
+	done := make(chan struct{})
+	go func() {
+		s.Server.Shutdown(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-s.idle:
+	case <-timer.C:
+		log.Printf("Calls still running after %v, stopping the server", timeout)
+	}
+	s.grpcServer.Stop()
+	s.Server.Close()
+	<-done
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/datastore"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// createTestWebServer serves the booking and health services on a TCP listener the way main does
+func createTestWebServer(t *testing.T, db *datastore.Datastore, corsConfig CORSConfig) (*webServer, string) {
+	srvr := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(metricsUnaryInterceptor, loggingUnaryInterceptor, validateTokenUnaryInterceptor),
+		grpc.ChainStreamInterceptor(metricsStreamInterceptor, loggingStreamInterceptor, validateTokenStreamInterceptor),
+	)
+	pb.RegisterBookingServiceServer(srvr, NewBookingServer(db))
+	registerHealth(srvr)
+
+	webSrv, err := newWebServer("", srvr, corsConfig, nil)
+	if err != nil {
+		t.Fatalf("newWebServer() error = %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go webSrv.Serve(lis)
+	return webSrv, lis.Addr().String()
+}
+
+// grpcWebFrame frames a message the way gRPC-Web clients send it
+func grpcWebFrame(t *testing.T, msg proto.Message) []byte {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// readGRPCWebFrames splits a gRPC-Web response into its messages and the trailers
+func readGRPCWebFrames(t *testing.T, body io.Reader) ([][]byte, string) {
+	var messages [][]byte
+	var trailers string
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(body, header); err == io.EOF {
+			return messages, trailers
+		} else if err != nil {
+			t.Fatalf("reading gRPC-Web frame: %v", err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(body, data); err != nil {
+			t.Fatalf("reading gRPC-Web frame: %v", err)
+		}
+		if header[0]&0x80 != 0 {
+			trailers += string(data)
+		} else {
+			messages = append(messages, data)
+		}
+	}
+}
+
+func TestWebProtocols(t *testing.T) {
+	ctx := context.Background()
+	db := datastore.NewDatastore(
+		datastore.WithSections("A", "B"),
+		datastore.WithSectionSize(4))
+	webSrv, addr := createTestWebServer(t, db, CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Hour})
+	defer webSrv.GracefulStop(time.Second)
+	baseURL := "http://" + addr
+
+	userToken, err := createTestingJWTToken("user@example.com", false)
+	if err != nil {
+		t.Fatalf("Failed to create JWT token: %v", err)
+	}
+
+	// gRPC clients use HTTP/2 without TLS
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewBookingServiceClient(conn)
+	if _, err := client.Purchase(getCtxWithToken(t, ctx, "user@example.com", false), &pb.PurchaseRequest{
+		User: &pb.User{EmailAddress: "user@example.com", FirstName: "john", LastName: "doe"},
+		Seat: &pb.Seat{SectionId: "A", SeatId: "1"},
+	}); err != nil {
+		t.Fatalf("gRPC Purchase() error = %v", err)
+	}
+
+	post := func(path, contentType string, body []byte, headers ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %v error = %v", path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Connect unary calls with JSON
+	resp := post("/BookingService/Purchase", "application/json",
+		[]byte(`{"user": {"emailAddress": "user@example.com", "firstName": "john", "lastName": "doe"}, "seat": {"sectionId": "A", "seatId": "2"}}`),
+		"Connect-Protocol-Version", "1", "Authorization", "Bearer "+userToken)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Connect Purchase status = %v, body %s", resp.StatusCode, body)
+	}
+	var booking struct {
+		Purchaser string `json:"purchaser"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&booking); err != nil || booking.Purchaser != "user@example.com" {
+		t.Errorf("Connect Purchase booking = %+v, %v", booking, err)
+	}
+
+	// The interceptors apply, errors use the Connect codes
+	resp = post("/BookingService/GetMyLimits", "application/json", []byte(`{}`), "Connect-Protocol-Version", "1")
+	var connectErr struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&connectErr); err != nil || resp.StatusCode != http.StatusUnauthorized || connectErr.Code != "unauthenticated" {
+		t.Errorf("Connect GetMyLimits without token = %v %+v, %v, want unauthenticated", resp.StatusCode, connectErr, err)
+	}
+
+	// Server streaming over gRPC-Web
+	resp = post("/BookingService/GetUserBookings", "application/grpc-web+proto", grpcWebFrame(t, &emptypb.Empty{}),
+		"Authorization", "Bearer "+userToken)
+	messages, trailers := readGRPCWebFrames(t, resp.Body)
+	if resp.StatusCode != http.StatusOK || len(messages) != 2 || !strings.Contains(strings.ToLower(trailers), "grpc-status: 0") {
+		t.Fatalf("gRPC-Web GetUserBookings = %v, %d messages, trailers %q, want 2 bookings", resp.StatusCode, len(messages), trailers)
+	}
+	var streamed pb.Booking
+	if err := proto.Unmarshal(messages[0], &streamed); err != nil || streamed.Purchaser != "user@example.com" {
+		t.Errorf("gRPC-Web GetUserBookings booking = %v, %v", &streamed, err)
+	}
+	resp = post("/BookingService/GetUserBookings", "application/grpc-web+proto", grpcWebFrame(t, &emptypb.Empty{}))
+	if _, trailers := readGRPCWebFrames(t, resp.Body); resp.Header.Get("Grpc-Status") != "16" && !strings.Contains(strings.ToLower(trailers), "grpc-status: 16") {
+		t.Errorf("gRPC-Web GetUserBookings without token trailers = %q, want Unauthenticated", trailers)
+	}
+
+	// Only the RPCs are served, REST is the gateway's
+	req, _ := http.NewRequest(http.MethodGet, baseURL+"/v1/bookings", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /v1/bookings = %v, %v, want 404", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestCORS(t *testing.T) {
+	db := datastore.NewDatastore()
+	webSrv, addr := createTestWebServer(t, db, CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Hour})
+	defer webSrv.GracefulStop(time.Second)
+
+	preflight := func(origin string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodOptions, "http://"+addr+"/BookingService/GetUserBookings", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type, x-grpc-web")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("OPTIONS error = %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "X-Grpc-Web") || resp.Header.Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("preflight of an allowed origin = %v %v", resp.StatusCode, resp.Header)
+	}
+	if resp := preflight("https://evil.example.com"); resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight of another origin allowed %v", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	// Calls of allowed origins expose the status headers
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/BookingService/GetMyLimits", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connect-Protocol-Version", "1")
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "Grpc-Status") {
+		t.Errorf("call of an allowed origin headers = %v", resp.Header)
+	}
+}
+
+func TestWebGracefulStop(t *testing.T) {
+	webSrv, addr := createTestWebServer(t, datastore.NewDatastore(), CORSConfig{})
+
+	// A stream that never ends is cancelled once the timeout passed
+	conn, err := grpc.DialContext(context.Background(), addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	defer conn.Close()
+	watch, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatalf("Watch() Recv error = %v", err)
+	}
+
+	start := time.Now()
+	webSrv.GracefulStop(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("GracefulStop() returned after %v, want about the timeout", elapsed)
+	}
+	if _, err := watch.Recv(); err == nil {
+		t.Errorf("Watch() still open after GracefulStop()")
+	}
+}
@@ -0,0 +1,118 @@
+// Command tui is the terminal UI of the booking service for station staff. It shows the seat
+// map of the sections, and purchases, moves and removes bookings with the keyboard.
+//
+//	tui [-profile <name>] [-address <address>] [-token <token>] [-sections A,B] [-size 10]
+//
+// The connection and authentication flags, the profiles and the environment variables are the
+// ones of cmd/client, e.g. "client login" stores the token used here. The seat map is loaded
+// with GetBookingsBySection, which needs an admin.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/13thuser/exampleauth/client"
+	"github.com/13thuser/exampleauth/client/profile"
+)
+
+// loop runs the TUI until the user quits or the keys end. The calls to the server run in the
+// background and their results are applied by the loop, the seat map is reloaded every
+// refreshEvery as the API has no stream of seat changes to watch.
+func loop(ctx context.Context, c *client.Client, m *model, keys <-chan key, draw func(string), refreshEvery, timeout time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result)
+	run := func(fn call) {
+		if fn == nil {
+			return
+		}
+		go func() {
+			callCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			select {
+			case results <- fn(callCtx, c):
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(refreshEvery)
+	defer ticker.Stop()
+	run(m.refresh())
+	for !m.quit {
+		draw(m.view())
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				return
+			}
+			run(m.handleKey(k))
+		case r := <-results:
+			run(m.apply(r))
+		case <-ticker.C:
+			run(m.refresh())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func main() {
+	var flagOptions profile.Options
+	profileName := flag.String("profile", "", "profile of the config file, BOOKING_PROFILE or the current profile by default")
+	flagOptions.RegisterFlags(flag.CommandLine)
+	sections := flag.String("sections", "A,B", "comma separated sections of the seat map")
+	size := flag.Int("size", 10, "number of seats per section")
+	refreshEvery := flag.Duration("refresh", 2*time.Second, "interval between reloads of the seat map")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of each call")
+	flag.Parse()
+
+	err := func() error {
+		sectionIDs := strings.FieldsFunc(*sections, func(r rune) bool { return r == ',' || r == ' ' })
+		if len(sectionIDs) == 0 || *size <= 0 || *refreshEvery <= 0 || *timeout <= 0 {
+			return fmt.Errorf("-sections, -size, -refresh and -timeout must be set")
+		}
+
+		path, err := profile.Path()
+		if err != nil {
+			return err
+		}
+		config, err := profile.Load(path)
+		if err != nil {
+			return err
+		}
+		options, err := config.Resolve(*profileName, flagOptions, true)
+		if err != nil {
+			return err
+		}
+		opts, err := options.ClientOptions()
+		if err != nil {
+			return err
+		}
+		c, err := client.Dial(options.Address, opts...)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		t, err := openTerminal(os.Stdin, os.Stdout)
+		if err != nil {
+			return err
+		}
+		defer t.close()
+		keys := make(chan key)
+		go readKeys(os.Stdin, keys)
+		loop(context.Background(), c, newModel(options.Address, sectionIDs, *size), keys, t.draw, *refreshEvery, *timeout)
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/13thuser/exampleauth/client"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// Modes of the seat map, they decide what the keys do
+type mode int
+
+const (
+	MODE_BROWSE mode = iota
+	// MODE_PURCHASE edits the passenger of a purchase of the selected seat
+	MODE_PURCHASE
+	// MODE_MOVE picks the new seat of the selected booking
+	MODE_MOVE
+	// MODE_REMOVE asks to confirm the removal of the selected booking
+	MODE_REMOVE
+)
+
+// Fields of the purchase form
+var formFields = []string{"email", "first name", "last name"}
+
+// result is the outcome of a call to the server, applied to the model by the event loop
+type result struct {
+	// bookings by section and seat, set by the calls loading the sections
+	bookings map[string]map[string]*pb.Booking
+	loaded   bool
+	status   string
+	err      error
+	// refresh loads the sections again after the call changed them
+	refresh bool
+}
+
+// call is a call to the server run outside of the event loop
+type call func(ctx context.Context, c *client.Client) result
+
+// model is the state of the TUI. It is only changed by the event loop, the calls to the server
+// return a result instead.
+type model struct {
+	address  string
+	sections []string
+	size     int
+
+	bookings  map[string]map[string]*pb.Booking
+	loading   bool
+	updatedAt time.Time
+
+	// cursor on the seat map, the section and the seat index
+	row, col int
+	mode     mode
+	// selected is the booking being moved or removed
+	selected *pb.Booking
+	form     []string
+	field    int
+
+	status string
+	quit   bool
+}
+
+func newModel(address string, sections []string, size int) *model {
+	return &model{address: address, sections: sections, size: size, bookings: make(map[string]map[string]*pb.Booking)}
+}
+
+// cursor returns the section and the seat under the cursor, and its booking
+func (m *model) cursor() (string, string, *pb.Booking) {
+	section, seat := m.sections[m.row], strconv.Itoa(m.col+1)
+	return section, seat, m.bookings[section][seat]
+}
+
+// moveCursor moves the cursor, it stays on the seat map
+func (m *model) moveCursor(rows, cols int) {
+	m.row = min(max(m.row+rows, 0), len(m.sections)-1)
+	m.col = min(max(m.col+cols, 0), m.size-1)
+}
+
+// handleKey updates the model for a key, it returns the call to run if the key makes one
+func (m *model) handleKey(k key) call {
+	if k == KEY_CTRL_C {
+		m.quit = true
+		return nil
+	}
+	switch m.mode {
+	case MODE_PURCHASE:
+		return m.handlePurchaseKey(k)
+	case MODE_REMOVE:
+		return m.handleRemoveKey(k)
+	}
+
+	switch k {
+	case KEY_UP, "k":
+		m.moveCursor(-1, 0)
+	case KEY_DOWN, "j":
+		m.moveCursor(1, 0)
+	case KEY_LEFT, "h":
+		m.moveCursor(0, -1)
+	case KEY_RIGHT, "l":
+		m.moveCursor(0, 1)
+	case KEY_ESC:
+		if m.mode == MODE_MOVE {
+			m.mode, m.selected, m.status = MODE_BROWSE, nil, "Move cancelled"
+		}
+	case KEY_ENTER:
+		if m.mode == MODE_MOVE {
+			return m.moveSelected()
+		}
+	case "r":
+		return m.refresh()
+	case "q":
+		m.quit = true
+	}
+	if m.mode != MODE_BROWSE {
+		return nil
+	}
+
+	section, seat, booking := m.cursor()
+	switch k {
+	case "p":
+		if booking != nil {
+			m.status = fmt.Sprintf("Seat %v%v is taken", section, seat)
+			return nil
+		}
+		m.mode, m.form, m.field, m.status = MODE_PURCHASE, make([]string, len(formFields)), 0, ""
+	case "m":
+		if booking == nil {
+			m.status = fmt.Sprintf("Seat %v%v is free, select a booking to move", section, seat)
+			return nil
+		}
+		m.mode, m.selected = MODE_MOVE, booking
+		m.status = fmt.Sprintf("Moving booking %v from %v%v", booking.BookingId, section, seat)
+	case "d", "x":
+		if booking == nil {
+			m.status = fmt.Sprintf("Seat %v%v is free, select a booking to remove", section, seat)
+			return nil
+		}
+		m.mode, m.selected, m.status = MODE_REMOVE, booking, ""
+	}
+	return nil
+}
+
+// handlePurchaseKey edits the purchase form, enter buys the seat under the cursor
+func (m *model) handlePurchaseKey(k key) call {
+	switch k {
+	case KEY_ESC:
+		m.mode, m.status = MODE_BROWSE, "Purchase cancelled"
+	case KEY_TAB, KEY_DOWN:
+		m.field = (m.field + 1) % len(m.form)
+	case KEY_UP:
+		m.field = (m.field + len(m.form) - 1) % len(m.form)
+	case KEY_BACKSPACE:
+		runes := []rune(m.form[m.field])
+		if len(runes) > 0 {
+			m.form[m.field] = string(runes[:len(runes)-1])
+		}
+	case KEY_ENTER:
+		if strings.TrimSpace(m.form[0]) == "" {
+			m.status = "The email is required"
+			return nil
+		}
+		m.mode = MODE_BROWSE
+		section, seat, _ := m.cursor()
+		req := &pb.PurchaseRequest{
+			User: &pb.User{EmailAddress: strings.TrimSpace(m.form[0]), FirstName: strings.TrimSpace(m.form[1]), LastName: strings.TrimSpace(m.form[2])},
+			Seat: &pb.Seat{SectionId: section, SeatId: seat},
+		}
+		m.status = fmt.Sprintf("Purchasing %v%v...", section, seat)
+		return func(ctx context.Context, c *client.Client) result {
+			booking, err := c.Purchase(ctx, req)
+			if err != nil {
+				return result{err: fmt.Errorf("purchase of %v%v failed: %w", section, seat, err), refresh: true}
+			}
+			return result{status: fmt.Sprintf("Booked %v%v for %v, booking %v", section, seat, booking.User.EmailAddress, booking.BookingId), refresh: true}
+		}
+	default:
+		if k.printable() {
+			m.form[m.field] += string(k)
+		}
+	}
+	return nil
+}
+
+// moveSelected moves the selected booking to the seat under the cursor
+func (m *model) moveSelected() call {
+	section, seat, booking := m.cursor()
+	if booking != nil {
+		if booking.BookingId == m.selected.BookingId {
+			m.mode, m.selected, m.status = MODE_BROWSE, nil, "Move cancelled"
+		} else {
+			m.status = fmt.Sprintf("Seat %v%v is taken, pick a free seat", section, seat)
+		}
+		return nil
+	}
+
+	req := &pb.ModifySeatRequest{BookingId: m.selected.BookingId, NewSectionId: section, NewSeatId: seat}
+	m.mode, m.selected = MODE_BROWSE, nil
+	m.status = fmt.Sprintf("Moving booking %v to %v%v...", req.BookingId, section, seat)
+	return func(ctx context.Context, c *client.Client) result {
+		if _, err := c.ModifySeat(ctx, req); err != nil {
+			return result{err: fmt.Errorf("move of booking %v failed: %w", req.BookingId, err), refresh: true}
+		}
+		return result{status: fmt.Sprintf("Moved booking %v to %v%v", req.BookingId, section, seat), refresh: true}
+	}
+}
+
+// handleRemoveKey removes the selected booking when confirmed
+func (m *model) handleRemoveKey(k key) call {
+	bookingID := m.selected.BookingId
+	m.mode, m.selected = MODE_BROWSE, nil
+	if k != "y" {
+		m.status = "Removal cancelled"
+		return nil
+	}
+	m.status = fmt.Sprintf("Removing booking %v...", bookingID)
+	return func(ctx context.Context, c *client.Client) result {
+		if err := c.RemoveUserFromTrain(ctx, &pb.RemoveBookingRequest{BookingId: bookingID}); err != nil {
+			return result{err: fmt.Errorf("removal of booking %v failed: %w", bookingID, err), refresh: true}
+		}
+		return result{status: fmt.Sprintf("Removed booking %v", bookingID), refresh: true}
+	}
+}
+
+// refresh returns the call loading the bookings of the sections, nil while one is running
+func (m *model) refresh() call {
+	if m.loading {
+		return nil
+	}
+	m.loading = true
+	sections := m.sections
+	return func(ctx context.Context, c *client.Client) result {
+		bookings := make(map[string]map[string]*pb.Booking)
+		for _, section := range sections {
+			sectionBookings, err := c.GetBookingsBySection(ctx, &pb.GetBookingsBySectionRequest{Section: section}).All()
+			if err != nil {
+				return result{loaded: true, err: fmt.Errorf("failed to load section %v: %w", section, err)}
+			}
+			bookings[section] = make(map[string]*pb.Booking)
+			for _, booking := range sectionBookings {
+				bookings[section][booking.Seat.SeatId] = booking
+			}
+		}
+		return result{loaded: true, bookings: bookings}
+	}
+}
+
+// apply updates the model with the result of a call, it returns the call to run next
+func (m *model) apply(r result) call {
+	if r.loaded {
+		m.loading = false
+	}
+	if r.bookings != nil {
+		m.bookings, m.updatedAt = r.bookings, time.Now()
+	}
+	if r.err != nil {
+		m.status = "Error: " + r.err.Error()
+	} else if r.status != "" {
+		m.status = r.status
+	}
+	if r.refresh {
+		return m.refresh()
+	}
+	return nil
+}
+
+// view renders the model, a line per section and the status of the selected seat and the mode
+func (m *model) view() string {
+	var b strings.Builder
+	updated := "loading"
+	if !m.updatedAt.IsZero() {
+		updated = "updated " + m.updatedAt.Format(time.TimeOnly)
+	}
+	fmt.Fprintf(&b, "Seat map of %v, %v\n\n", m.address, updated)
+
+	width := 0
+	for _, section := range m.sections {
+		width = max(width, len(section))
+	}
+	fmt.Fprintf(&b, "%*s ", width, "")
+	for col := 0; col < m.size; col++ {
+		fmt.Fprintf(&b, " %-3d", col+1)
+	}
+	b.WriteString("\n")
+	for row, section := range m.sections {
+		fmt.Fprintf(&b, "%-*s ", width, section)
+		for col := 0; col < m.size; col++ {
+			label := "."
+			if booking := m.bookings[section][strconv.Itoa(col+1)]; booking != nil {
+				label = "X"
+				if m.selected != nil && booking.BookingId == m.selected.BookingId {
+					label = "*"
+				}
+			}
+			if row == m.row && col == m.col {
+				fmt.Fprintf(&b, "[%v] ", label)
+			} else {
+				fmt.Fprintf(&b, " %v  ", label)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	section, seat, booking := m.cursor()
+	if booking == nil {
+		fmt.Fprintf(&b, "\n%v%v: free\n", section, seat)
+	} else {
+		name := strings.TrimSpace(booking.User.GetFirstName() + " " + booking.User.GetLastName())
+		fmt.Fprintf(&b, "\n%v%v: booking %v, %v <%v>, paid $%.2f\n", section, seat, booking.BookingId, name, booking.User.GetEmailAddress(), booking.PricePaid)
+	}
+
+	switch m.mode {
+	case MODE_PURCHASE:
+		fmt.Fprintf(&b, "\nPurchase of %v%v\n", section, seat)
+		for i, field := range formFields {
+			marker := " "
+			if i == m.field {
+				marker = ">"
+			}
+			fmt.Fprintf(&b, "%v %-10v %v\n", marker, field+":", m.form[i])
+		}
+	case MODE_REMOVE:
+		fmt.Fprintf(&b, "\nRemove booking %v of %v? (y/n)\n", m.selected.BookingId, m.selected.User.GetEmailAddress())
+	}
+
+	fmt.Fprintf(&b, "\n%v\n", m.status)
+	switch m.mode {
+	case MODE_BROWSE:
+		b.WriteString("arrows/hjkl move  p purchase  m move booking  d remove  r refresh  q quit\n")
+	case MODE_PURCHASE:
+		b.WriteString("tab/arrows next field  enter purchase  esc cancel\n")
+	case MODE_MOVE:
+		b.WriteString("arrows/hjkl pick the new seat  enter move  esc cancel\n")
+	}
+	return b.String()
+}
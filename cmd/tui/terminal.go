@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// key is a key pressed in the terminal, a special key or the typed character
+type key string
+
+const (
+	KEY_UP        key = "up"
+	KEY_DOWN      key = "down"
+	KEY_LEFT      key = "left"
+	KEY_RIGHT     key = "right"
+	KEY_ENTER     key = "enter"
+	KEY_TAB       key = "tab"
+	KEY_BACKSPACE key = "backspace"
+	KEY_ESC       key = "esc"
+	KEY_CTRL_C    key = "ctrl-c"
+)
+
+// Escape sequences of the special keys in raw mode
+var keySequences = []struct {
+	sequence string
+	key      key
+}{
+	{"\x1b[A", KEY_UP},
+	{"\x1b[B", KEY_DOWN},
+	{"\x1b[C", KEY_RIGHT},
+	{"\x1b[D", KEY_LEFT},
+	{"\x1bOA", KEY_UP},
+	{"\x1bOB", KEY_DOWN},
+	{"\x1bOC", KEY_RIGHT},
+	{"\x1bOD", KEY_LEFT},
+	{"\r\n", KEY_ENTER},
+	{"\r", KEY_ENTER},
+	{"\n", KEY_ENTER},
+	{"\t", KEY_TAB},
+	{"\x7f", KEY_BACKSPACE},
+	{"\x08", KEY_BACKSPACE},
+	{"\x03", KEY_CTRL_C},
+	{"\x1b", KEY_ESC},
+}
+
+// printable tells whether the key is a character that can be typed in a field
+func (k key) printable() bool {
+	r, size := utf8.DecodeRuneInString(string(k))
+	return size == len(k) && r != utf8.RuneError && unicode.IsPrint(r)
+}
+
+// parseKeys splits the input read from the terminal in keys, unknown escape sequences and
+// control characters are dropped
+func parseKeys(input []byte) []key {
+	var keys []key
+	for rest := string(input); rest != ""; {
+		matched := false
+		for _, candidate := range keySequences {
+			if strings.HasPrefix(rest, candidate.sequence) {
+				keys, rest, matched = append(keys, candidate.key), rest[len(candidate.sequence):], true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(rest)
+		if k := key(rest[:size]); k.printable() {
+			keys = append(keys, k)
+		}
+		rest = rest[size:]
+	}
+	return keys
+}
+
+// readKeys sends the keys read from r until it fails
+func readKeys(r io.Reader, keys chan<- key) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// terminal draws the TUI on the alternate screen of a terminal in raw mode
+type terminal struct {
+	in       *os.File
+	out      io.Writer
+	oldState *term.State
+}
+
+// openTerminal switches the terminal to raw mode and the alternate screen
+func openTerminal(in *os.File, out io.Writer) (*terminal, error) {
+	if !term.IsTerminal(int(in.Fd())) {
+		return nil, fmt.Errorf("the seat map needs a terminal")
+	}
+	oldState, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the terminal: %v", err)
+	}
+	// Alternate screen, hidden cursor
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	return &terminal{in: in, out: out, oldState: oldState}, nil
+}
+
+// draw replaces the screen with the view, raw mode needs carriage returns
+func (t *terminal) draw(view string) {
+	fmt.Fprint(t.out, "\x1b[H\x1b[2J"+strings.ReplaceAll(view, "\n", "\r\n"))
+}
+
+// close restores the screen and the terminal mode
+func (t *terminal) close() {
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	term.Restore(int(t.in.Fd()), t.oldState)
+}
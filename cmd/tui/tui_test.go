@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/13thuser/exampleauth/client"
+	pb "github.com/13thuser/exampleauth/grpc"
+)
+
+// fakeServer keeps the bookings in memory
+type fakeServer struct {
+	pb.UnimplementedBookingServiceServer
+
+	mu       sync.Mutex
+	bookings map[string]*pb.Booking
+	next     int
+}
+
+// taken returns the booking of a seat
+func (s *fakeServer) taken(seat *pb.Seat) *pb.Booking {
+	for _, booking := range s.bookings {
+		if booking.Seat.SectionId == seat.SectionId && booking.Seat.SeatId == seat.SeatId {
+			return booking
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) Purchase(ctx context.Context, req *pb.PurchaseRequest) (*pb.Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.taken(req.Seat) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "seat already allocated")
+	}
+	s.next++
+	booking := &pb.Booking{BookingId: fmt.Sprintf("b%d", s.next), User: req.User, Seat: req.Seat, PricePaid: 20}
+	s.bookings[booking.BookingId] = booking
+	return booking, nil
+}
+
+func (s *fakeServer) GetBookingsBySection(req *pb.GetBookingsBySectionRequest, stream pb.BookingService_GetBookingsBySectionServer) error {
+	s.mu.Lock()
+	var bookings []*pb.Booking
+	for _, booking := range s.bookings {
+		if booking.Seat.SectionId == req.Section {
+			bookings = append(bookings, booking)
+		}
+	}
+	s.mu.Unlock()
+	for _, booking := range bookings {
+		if err := stream.Send(booking); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) ModifySeat(ctx context.Context, req *pb.ModifySeatRequest) (*pb.Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	booking, ok := s.bookings[req.BookingId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "booking not found")
+	}
+	booking.Seat = &pb.Seat{SectionId: req.NewSectionId, SeatId: req.NewSeatId}
+	return booking, nil
+}
+
+func (s *fakeServer) RemoveUserFromTrain(ctx context.Context, req *pb.RemoveBookingRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bookings, req.BookingId)
+	return &emptypb.Empty{}, nil
+}
+
+// createTestClient serves the fake server on a local port and dials it
+func createTestClient(t *testing.T, fake *fakeServer) *client.Client {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterBookingServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	c, err := client.Dial(lis.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// press handles the keys and runs the calls they make, and the calls following them, in turn
+func press(m *model, c *client.Client, keys ...key) {
+	for _, k := range keys {
+		for fn := m.handleKey(k); fn != nil; {
+			fn = m.apply(fn(context.Background(), c))
+		}
+	}
+}
+
+// typeText returns the keys typing the text
+func typeText(text string) []key {
+	var keys []key
+	for _, r := range text {
+		keys = append(keys, key(string(r)))
+	}
+	return keys
+}
+
+// seatRow returns the seats of a section in the view
+func seatRow(view, section string) string {
+	for _, line := range strings.Split(view, "\n") {
+		if strings.HasPrefix(line, section+" ") {
+			return strings.Join(strings.Fields(line[len(section):]), " ")
+		}
+	}
+	return ""
+}
+
+func TestSeatMap(t *testing.T) {
+	fake := &fakeServer{bookings: map[string]*pb.Booking{
+		"b0": {BookingId: "b0", User: &pb.User{EmailAddress: "taken@example.com"}, Seat: &pb.Seat{SectionId: "B", SeatId: "1"}},
+	}}
+	c := createTestClient(t, fake)
+	m := newModel("test", []string{"A", "B"}, 4)
+	m.apply(m.refresh()(context.Background(), c))
+	if row := seatRow(m.view(), "B"); row != "X . . ." {
+		t.Fatalf("section B = %q, want the first seat taken", row)
+	}
+
+	// Purchase of A2
+	press(m, c, KEY_RIGHT, "p")
+	press(m, c, typeText("john@example.com")...)
+	press(m, c, KEY_TAB)
+	press(m, c, typeText("Johnx")...)
+	press(m, c, KEY_BACKSPACE, KEY_ENTER)
+	view := m.view()
+	if row := seatRow(view, "A"); row != ". [X] . ." {
+		t.Errorf("section A after the purchase = %q, want A2 taken under the cursor", row)
+	}
+	if !strings.Contains(view, "Booked A2 for john@example.com, booking b1") || !strings.Contains(view, "A2: booking b1, John <john@example.com>") {
+		t.Errorf("view after the purchase = %s", view)
+	}
+
+	// Taken seats can't be bought, the server's conflicts are shown
+	press(m, c, "p")
+	if m.mode != MODE_BROWSE || !strings.Contains(m.view(), "Seat A2 is taken") {
+		t.Errorf("purchase of a taken seat, view = %s", m.view())
+	}
+	press(m, c, KEY_LEFT, "p")
+	press(m, c, typeText("jane@example.com")...)
+	fake.Purchase(context.Background(), &pb.PurchaseRequest{User: &pb.User{EmailAddress: "other@example.com"}, Seat: &pb.Seat{SectionId: "A", SeatId: "1"}})
+	press(m, c, KEY_ENTER)
+	if view := m.view(); !strings.Contains(view, "purchase of A1 failed: AlreadyExists") || seatRow(view, "A") != "[X] X . ." {
+		t.Errorf("view after a conflict = %s", view)
+	}
+
+	// Move of A2 to B3
+	press(m, c, KEY_RIGHT, "m", KEY_DOWN)
+	if row := seatRow(m.view(), "A"); row != "X * . ." {
+		t.Errorf("section A while moving = %q, want the moved booking marked", row)
+	}
+	press(m, c, KEY_DOWN, KEY_LEFT, KEY_ENTER)
+	if m.status != "Seat B1 is taken, pick a free seat" || m.mode != MODE_MOVE {
+		t.Errorf("move to a taken seat status = %q", m.status)
+	}
+	press(m, c, KEY_RIGHT, KEY_RIGHT, KEY_ENTER)
+	if view := m.view(); seatRow(view, "A") != "X . . ." || seatRow(view, "B") != "X . [X] ." {
+		t.Errorf("view after the move = %s", view)
+	}
+
+	// Removal of B3 after the confirmation
+	press(m, c, "d", "n")
+	if _, ok := fake.bookings["b1"]; !ok || m.status != "Removal cancelled" {
+		t.Errorf("cancelled removal status = %q", m.status)
+	}
+	press(m, c, "d", "y")
+	if _, ok := fake.bookings["b1"]; ok || seatRow(m.view(), "B") != "X . [.] ." {
+		t.Errorf("view after the removal = %s", m.view())
+	}
+
+	press(m, c, "q")
+	if !m.quit {
+		t.Errorf("q didn't quit")
+	}
+}
+
+func TestLoop(t *testing.T) {
+	fake := &fakeServer{bookings: map[string]*pb.Booking{
+		"b0": {BookingId: "b0", User: &pb.User{EmailAddress: "taken@example.com"}, Seat: &pb.Seat{SectionId: "A", SeatId: "2"}},
+	}}
+	c := createTestClient(t, fake)
+
+	// The seat map is polled, changes made elsewhere show up without a key
+	keys := make(chan key)
+	views := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		loop(context.Background(), c, newModel("test", []string{"A"}, 3), keys, func(view string) {
+			select {
+			case views <- view:
+			default:
+			}
+		}, 10*time.Millisecond, time.Second)
+		close(done)
+	}()
+	waitForRow := func(want string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case view := <-views:
+				if seatRow(view, "A") == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("section A never became %q", want)
+			}
+		}
+	}
+	waitForRow("[.] X .")
+	fake.Purchase(context.Background(), &pb.PurchaseRequest{User: &pb.User{}, Seat: &pb.Seat{SectionId: "A", SeatId: "3"}})
+	waitForRow("[.] X X")
+
+	keys <- "q"
+	<-done
+}
+
+func TestParseKeys(t *testing.T) {
+	keys := parseKeys([]byte("a\x1b[A\x1b[D\r\x7fé\x1b\x03\x01\t"))
+	want := []key{"a", KEY_UP, KEY_LEFT, KEY_ENTER, KEY_BACKSPACE, "é", KEY_ESC, KEY_CTRL_C, KEY_TAB}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("parseKeys() = %q, want %q", keys, want)
+	}
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API keys are handed out as "<prefix>_<key id>_<secret>". Only the SHA-256 hash of the
+// secret is stored, the key id is used to find the key without scanning all of them.
+const API_KEY_PREFIX = "ea"
+
+type APIKeyNotFound error
+type APIKeyExpired error
+type APIKeyRevoked error
+
+// APIKey is a key used by machine clients such as partner integrations
+type APIKey struct {
+	ID         string
+	Owner      string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // zero means the key never expires
+	LastUsedAt time.Time
+	Revoked    bool
+	secretHash [sha256.Size]byte
+}
+
+// CreateAPIKey creates a key for the owner and returns it together with the plain key,
+// which is not stored and cannot be retrieved later
+func (ds *Datastore) CreateAPIKey(ctx context.Context, owner string, scopes []string, expiresAt time.Time) (APIKey, string, error) {
+	// Concurrency support
+	unlock := ds.lock(ctx, "CreateAPIKey")
+	defer unlock()
+
+	if owner == "" {
+		return APIKey{}, "", fmt.Errorf("api key owner must not be empty")
+	}
+
+	id, err := createRandomID()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", fmt.Errorf("failed to generate api key: %v", err)
+	}
+	plainSecret := hex.EncodeToString(secret)
+
+	key := APIKey{
+		ID:         id,
+		Owner:      owner,
+		Scopes:     append([]string(nil), scopes...),
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+		secretHash: sha256.Sum256([]byte(plainSecret)),
+	}
+	ds.apiKeys[id] = key
+
+	return key, fmt.Sprintf("%s_%s_%s", API_KEY_PREFIX, id, plainSecret), nil
+}
+
+// ListAPIKeys returns the keys of the owner, or all keys when owner is empty, oldest first
+func (ds *Datastore) ListAPIKeys(ctx context.Context, owner string) []APIKey {
+	// Concurrency support
+	unlock := ds.rlock(ctx, "ListAPIKeys")
+	defer unlock()
+
+	var keys []APIKey
+	for _, key := range ds.apiKeys {
+		if owner == "" || key.Owner == owner {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// RevokeAPIKey revokes the key, it can't be used anymore but stays listed
+func (ds *Datastore) RevokeAPIKey(ctx context.Context, id string) (APIKey, error) {
+	// Concurrency support
+	unlock := ds.lock(ctx, "RevokeAPIKey")
+	defer unlock()
+
+	key, ok := ds.apiKeys[id]
+	if !ok {
+		return APIKey{}, APIKeyNotFound(fmt.Errorf("api key not found: %v", id))
+	}
+	key.Revoked = true
+	ds.apiKeys[id] = key
+	return key, nil
+}
+
+// AuthenticateAPIKey checks the plain key and records its use
+func (ds *Datastore) AuthenticateAPIKey(ctx context.Context, plainKey string) (APIKey, error) {
+	// Concurrency support
+	unlock := ds.lock(ctx, "AuthenticateAPIKey")
+	defer unlock()
+
+	parts := strings.SplitN(plainKey, "_", 3)
+	if len(parts) != 3 || parts[0] != API_KEY_PREFIX {
+		return APIKey{}, APIKeyNotFound(fmt.Errorf("malformed api key"))
+	}
+
+	key, ok := ds.apiKeys[parts[1]]
+	secretHash := sha256.Sum256([]byte(parts[2]))
+	if !ok || subtle.ConstantTimeCompare(secretHash[:], key.secretHash[:]) != 1 {
+		return APIKey{}, APIKeyNotFound(fmt.Errorf("api key not found"))
+	}
+	if key.Revoked {
+		return APIKey{}, APIKeyRevoked(fmt.Errorf("api key revoked: %v", key.ID))
+	}
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return APIKey{}, APIKeyExpired(fmt.Errorf("api key expired: %v", key.ID))
+	}
+
+	key.LastUsedAt = time.Now()
+	ds.apiKeys[key.ID] = key
+	return key, nil
+}
@@ -0,0 +1,36 @@
+package datastore
+
+import (
+	"time"
+)
+
+// Audit actions
+const (
+	AUDIT_CLAIM_GUEST_BOOKINGS = "claim_guest_bookings"
+)
+
+// AuditEvent records a change made to the data on behalf of a user
+type AuditEvent struct {
+	Time    time.Time
+	Actor   string // id of the user who made the change
+	Action  string
+	Subject string // id of the user whose data changed
+	Details map[string]string
+}
+
+// recordAuditEvent appends the event to the audit trail, the caller must hold the lock
+func (ds *Datastore) recordAuditEvent(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	ds.auditTrail = append(ds.auditTrail, event)
+}
+
+// AuditTrail returns the recorded audit events, oldest first
+func (ds *Datastore) AuditTrail() []AuditEvent {
+	// Concurrency support
+	ds.RLock()
+	defer ds.RUnlock()
+
+	return append([]AuditEvent(nil), ds.auditTrail...)
+}
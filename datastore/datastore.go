@@ -1,10 +1,18 @@
 package datastore
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // See Datastore notes below
@@ -21,6 +29,15 @@ type SectionNotFound error
 type SeatNotAvailable error
 type InvalidSeatID error
 
+// The errors above wrap these, match them with errors.Is
+var (
+	ErrBookingNotFound  = errors.New("booking not found")
+	ErrSectionIsFull    = errors.New("section is full")
+	ErrSectionNotFound  = errors.New("section not found")
+	ErrSeatNotAvailable = errors.New("seat already allocated")
+	ErrInvalidSeatID    = errors.New("invalid seat id")
+)
+
 type User struct {
 	EmailAddress string // main id of the user, also subject of the JWT token
 	FirstName    string
@@ -32,14 +49,33 @@ type Seat struct {
 	SeatID    string
 }
 
+// Journey is the train trip the bookings are made for
+type Journey struct {
+	ID        string
+	From      string
+	To        string
+	Departure time.Time
+}
+
 type Booking struct {
 	owner     string
 	BookingID string
 	User      User
 	Seat      Seat
+	JourneyID string
 	From      string
 	To        string
+	Departure time.Time
 	PricePaid float64
+	// BOOKING_ACTIVE or BOOKING_CANCELLED
+	Status      string
+	CreatedAt   time.Time
+	CancelledAt time.Time
+}
+
+// Owner returns the id of the user who owns the booking
+func (b Booking) Owner() string {
+	return b.owner
 }
 
 type BookingID string
@@ -54,23 +90,90 @@ type BookingsMap map[BookingID]struct{}
 // - RemoveUserFromTrain: Removes a user's booking from the datastore
 // - ModifySeat: Updates the seat allocation for a given section and seat
 // Allows only one trian bookings with hard coded section size of 10 seats and 2 sections
+//
+// The bookings are sharded by section, each section has its own lock so that operations on
+// different sections don't wait for each other. The index lock guards the indexes of the
+// bookings by user and by id, and the embedded lock guards the rest of the store. Operations
+// that take several locks take them in this order: the store lock, the section locks in the
+// order of the section ids and the index lock, so no two operations wait for each other.
 type Datastore struct {
 	sync.RWMutex
 
+	// sections of the train with their seats and bookings, the set of sections doesn't change
+	// after the datastore is created
+	sections map[SectionID]*section
+
+	// ids of the sections in the order their locks are taken
+	sectionIDs []SectionID
+
+	// section size
+	sectionSize int
+
+	// the journey all bookings are made for
+	journey Journey
+
+	// lock of the indexes, the booking counters and the cancellations
+	index sync.RWMutex
+
 	// You can also map the user to the booking id to track all the users
 	userBookings map[string]BookingsMap
 
+	// map of booking ID to the section the booking is seated in
+	bookingIndex map[BookingID]indexEntry
+
+	// map of booking ID to the cancelled bookings, which hold no seat
+	cancelled map[BookingID]Booking
+
+	// ids of the cancelled bookings in the order they were cancelled, and how long they are kept
+	cancelledOrder     []BookingID
+	cancelledRetention time.Duration
+
+	// secondary indexes of ListBookings
+	queryIndex *queryIndex
+
+	// inverted index of SearchBookings
+	searchIndex *searchIndex
+
+	// booking counters, the section stats are computed when requested
+	stats Stats
+
+	// limits against hoarding seats and the time of each user's last cancellation
+	limits        BookingLimits
+	cancellations map[string]time.Time
+
+	// map of API key id to API key
+	apiKeys map[string]APIKey
+
+	// map of used single-use token ids to their expiry
+	usedTokens map[string]time.Time
+
+	// audit trail of changes made on behalf of users
+	auditTrail []AuditEvent
+
+	// tracer of the datastore operation spans
+	tracer trace.Tracer
+}
+
+// section is a shard of the bookings, its lock guards the seat allocation and the bookings
+// seated in the section
+type section struct {
+	sync.RWMutex
+
+	// map of seat allocation to the booking by seat id
+	seating Seating
+
 	// map of booking ID to booking that contains the user and
 	bookings map[BookingID]Booking
+}
 
-	// map of seat allocation to the user by section id and seat id
-	seatAllocation map[SectionID]Seating
-
-	// map of sections
-	sections map[SectionID]struct{}
+func newSection() *section {
+	return &section{seating: make(Seating), bookings: make(map[BookingID]Booking)}
+}
 
-	// section size
-	sectionSize int
+// indexEntry finds a booking without locking all the sections
+type indexEntry struct {
+	section   SectionID
+	journeyID string
 }
 
 type DatastoreOption func(*Datastore)
@@ -85,27 +188,58 @@ func WithSectionSize(size int) DatastoreOption {
 // WithSections sets the sections for the Datastore.
 func WithSections(sections ...SectionID) DatastoreOption {
 	return func(ds *Datastore) {
-		ds.sections = make(map[SectionID]struct{})
-		for _, section := range sections {
-			ds.sections[section] = struct{}{}
+		ds.sections = make(map[SectionID]*section)
+		for _, sectionID := range sections {
+			ds.sections[sectionID] = newSection()
 		}
 	}
 }
 
+// WithJourney sets the journey the bookings are made for.
+func WithJourney(journey Journey) DatastoreOption {
+	return func(ds *Datastore) {
+		ds.journey = journey
+	}
+}
+
+// defaultJourney is the London to Paris train leaving at 09:00 UTC the next day
+func defaultJourney() Journey {
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1)
+	return Journey{
+		ID:        "london-paris",
+		From:      "London",
+		To:        "Paris",
+		Departure: time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 9, 0, 0, 0, time.UTC),
+	}
+}
+
 // NewDatastore creates a new instance of the Datastore with the provided options.
 func NewDatastore(options ...DatastoreOption) *Datastore {
 	ds := &Datastore{
-		userBookings:   make(map[string]BookingsMap),
-		bookings:       make(map[BookingID]Booking),
-		seatAllocation: make(map[SectionID]Seating),
-		sections:       map[SectionID]struct{}{SECTION_A: {}, SECTION_B: {}},
-		sectionSize:    SECTION_SIZE,
+		sections:           map[SectionID]*section{SECTION_A: newSection(), SECTION_B: newSection()},
+		sectionSize:        SECTION_SIZE,
+		journey:            defaultJourney(),
+		userBookings:       make(map[string]BookingsMap),
+		bookingIndex:       make(map[BookingID]indexEntry),
+		cancelled:          make(map[BookingID]Booking),
+		cancelledRetention: CANCELLED_RETENTION,
+		queryIndex:         newQueryIndex(),
+		searchIndex:        newSearchIndex(),
+		cancellations:      make(map[string]time.Time),
+		apiKeys:            make(map[string]APIKey),
+		usedTokens:         make(map[string]time.Time),
+		tracer:             defaultTracer(),
 	}
 
 	for _, option := range options {
 		option(ds)
 	}
 
+	for sectionID := range ds.sections {
+		ds.sectionIDs = append(ds.sectionIDs, sectionID)
+	}
+	sort.Slice(ds.sectionIDs, func(i, j int) bool { return ds.sectionIDs[i] < ds.sectionIDs[j] })
+
 	return ds
 }
 
@@ -119,160 +253,418 @@ func createRandomID() (string, error) {
 	return fmt.Sprintf("%x", b), nil
 }
 
-// allocationSeating updates the seat allocation for a given section and seat
+// lockSections takes the locks of the sections, in the order of their ids, and then the index
+// lock. Unknown sections are skipped. The returned function releases the locks.
+func (ds *Datastore) lockSections(write bool, sectionIDs ...SectionID) func() {
+	for _, sectionID := range ds.sectionIDs {
+		if !slices.Contains(sectionIDs, sectionID) {
+			continue
+		}
+		if write {
+			ds.sections[sectionID].Lock()
+		} else {
+			ds.sections[sectionID].RLock()
+		}
+	}
+	if write {
+		ds.index.Lock()
+	} else {
+		ds.index.RLock()
+	}
+
+	return func() {
+		if write {
+			ds.index.Unlock()
+		} else {
+			ds.index.RUnlock()
+		}
+		for i := len(ds.sectionIDs) - 1; i >= 0; i-- {
+			if !slices.Contains(sectionIDs, ds.sectionIDs[i]) {
+				continue
+			}
+			if write {
+				ds.sections[ds.sectionIDs[i]].Unlock()
+			} else {
+				ds.sections[ds.sectionIDs[i]].RUnlock()
+			}
+		}
+	}
+}
+
+// lockIndexed is lockSections for the sections returned by sections, which reads the index.
+// A booking can move to another section before its lock is taken, the locks are then taken
+// again until sections returns sections that are locked.
+func (ds *Datastore) lockIndexed(write bool, sections func() []SectionID) func() {
+	for {
+		ds.index.RLock()
+		sectionIDs := sections()
+		ds.index.RUnlock()
+
+		unlock := ds.lockSections(write, sectionIDs...)
+		locked := true
+		for _, sectionID := range sections() {
+			locked = locked && slices.Contains(sectionIDs, sectionID)
+		}
+		if locked {
+			return unlock
+		}
+		unlock()
+	}
+}
+
+// onSections returns the sections of an operation that doesn't need to read the index to find them
+func onSections(sectionIDs ...SectionID) func() []SectionID {
+	return func() []SectionID {
+		return sectionIDs
+	}
+}
+
+// bookingSections returns the sections of the bookings, the caller must hold the index lock
+func (ds *Datastore) bookingSections(bookingIDs ...BookingID) []SectionID {
+	var sectionIDs []SectionID
+	for _, bookingID := range bookingIDs {
+		if entry, ok := ds.bookingIndex[bookingID]; ok {
+			sectionIDs = append(sectionIDs, entry.section)
+		}
+	}
+	return sectionIDs
+}
+
+// userSections returns the sections of the user's bookings, the caller must hold the index lock
+func (ds *Datastore) userSections(userID string) []SectionID {
+	var sectionIDs []SectionID
+	for bookingID := range ds.userBookings[userID] {
+		sectionIDs = append(sectionIDs, ds.bookingIndex[bookingID].section)
+	}
+	return sectionIDs
+}
+
+// booking returns the booking with the given id, the caller must hold the index lock and the
+// lock of the booking's section
+func (ds *Datastore) booking(bookingID BookingID) (Booking, bool) {
+	entry, ok := ds.bookingIndex[bookingID]
+	if !ok {
+		return Booking{}, false
+	}
+	return ds.sections[entry.section].bookings[bookingID], true
+}
+
+// allocationSeating updates the seat allocation for a given section and seat, the caller must
+// hold the lock of the section
 func (ds *Datastore) allocationSeating(sectionID SectionID, seatID SeatID, bookingID BookingID) error {
 	// check if sectionID exists in sections
-	if _, ok := ds.sections[sectionID]; !ok {
-		return SectionNotFound(fmt.Errorf("section not found: %v", sectionID))
+	s, ok := ds.sections[sectionID]
+	if !ok {
+		return SectionNotFound(fmt.Errorf("%w: %v", ErrSectionNotFound, sectionID))
 	}
 
-	if len(ds.seatAllocation[sectionID]) >= ds.sectionSize {
-		return SectionIsFull(fmt.Errorf("section is full: %v", sectionID))
+	if len(s.seating) >= ds.sectionSize {
+		return SectionIsFull(fmt.Errorf("%w: %v", ErrSectionIsFull, sectionID))
 	}
 
 	// convert seatID to int and check if it is within the section size
 	if seat, err := strconv.Atoi(string(seatID)); err != nil || seat < 0 || seat > ds.sectionSize {
-		return InvalidSeatID(fmt.Errorf("invalid seat id: %v", seatID))
-	}
-
-	if _, ok := ds.seatAllocation[sectionID]; !ok {
-		ds.seatAllocation[sectionID] = make(Seating)
+		return InvalidSeatID(fmt.Errorf("%w: %v", ErrInvalidSeatID, seatID))
 	}
 
 	// check if seat is already allocated
-	if _, ok := ds.seatAllocation[sectionID][seatID]; ok {
-		return SeatNotAvailable(fmt.Errorf("seat already allocated: %v", seatID))
+	if _, ok := s.seating[seatID]; ok {
+		return SeatNotAvailable(fmt.Errorf("%w: %v", ErrSeatNotAvailable, seatID))
 	}
 
-	ds.seatAllocation[sectionID][seatID] = bookingID
+	s.seating[seatID] = bookingID
 	return nil
 }
 
+// addBooking stores a booking whose seat is allocated and indexes it, the caller must hold the
+// lock of the booking's section and the index lock
+func (ds *Datastore) addBooking(booking Booking) {
+	ds.queryIndex.add(booking)
+	ds.searchIndex.add(booking)
+	bookingID := BookingID(booking.BookingID)
+	sectionID := SectionID(booking.Seat.SectionID)
+	ds.sections[sectionID].bookings[bookingID] = booking
+	ds.bookingIndex[bookingID] = indexEntry{section: sectionID, journeyID: booking.JourneyID}
+	if _, ok := ds.userBookings[booking.owner]; !ok {
+		ds.userBookings[booking.owner] = make(BookingsMap)
+	}
+	ds.userBookings[booking.owner][bookingID] = struct{}{}
+}
+
 // Purchase adds a new booking to the datastore
-func (ds *Datastore) Purchase(userID string, booking Booking) (Booking, error) {
+func (ds *Datastore) Purchase(ctx context.Context, userID string, booking Booking) (Booking, error) {
 	// Concurrency support
-	ds.Lock()
-	defer ds.Unlock()
+	unlock := ds.lockBookings(ctx, "Purchase", true, onSections(SectionID(booking.Seat.SectionID)))
+	defer unlock()
 
 	if booking.BookingID != "" {
 		return Booking{}, fmt.Errorf("booking id must be empty: %v", booking.BookingID)
 	}
+	if err := ds.checkLimits(ctx, userID, 1); err != nil {
+		return Booking{}, err
+	}
 
 	return ds.createBooking(userID, booking)
 }
 
-func (ds *Datastore) GetUserBookings(userID string) []Booking {
+// PurchaseBookings adds several bookings for the user at once. Either all seats are
+// allocated or, when one of them can't be, none are.
+func (ds *Datastore) PurchaseBookings(ctx context.Context, userID string, bookings []Booking) ([]Booking, error) {
+	var sectionIDs []SectionID
+	for _, booking := range bookings {
+		sectionIDs = append(sectionIDs, SectionID(booking.Seat.SectionID))
+	}
+
 	// Concurrency support
-	ds.RLock()
-	defer ds.RUnlock()
+	unlock := ds.lockBookings(ctx, "PurchaseBookings", true, onSections(sectionIDs...))
+	defer unlock()
 
-	return ds.getUserBookings(userID)
+	for _, booking := range bookings {
+		if booking.BookingID != "" {
+			return nil, fmt.Errorf("booking id must be empty: %v", booking.BookingID)
+		}
+	}
+	if err := ds.checkLimits(ctx, userID, len(bookings)); err != nil {
+		return nil, err
+	}
+
+	var created []Booking
+	for _, booking := range bookings {
+		booking, err := ds.createBooking(userID, booking)
+		if err != nil {
+			// Release the seats allocated so far
+			for _, booking := range created {
+				ds.deleteBooking(BookingID(booking.BookingID))
+				ds.queryIndex.remove(booking)
+				ds.stats.BookingsCreated--
+			}
+			return nil, err
+		}
+		created = append(created, booking)
+	}
+	return created, nil
+}
+
+func (ds *Datastore) GetUserBookings(ctx context.Context, userID string) []Booking {
+	// Concurrency support
+	unlock := ds.lockBookings(ctx, "GetUserBookings", false, func() []SectionID {
+		return ds.userSections(userID)
+	})
+	defer unlock()
+
+	bookings := ds.getUserBookings(userID)
+	sortBookings(bookings)
+	return bookings
+}
+
+// GetBooking returns the booking with the given id
+func (ds *Datastore) GetBooking(ctx context.Context, bookingID BookingID) (Booking, error) {
+	// Concurrency support
+	unlock := ds.lockBookings(ctx, "GetBooking", false, func() []SectionID {
+		return ds.bookingSections(bookingID)
+	})
+	defer unlock()
+
+	booking, ok := ds.booking(bookingID)
+	if !ok {
+		return Booking{}, BookingNotFound(fmt.Errorf("%w: %v", ErrBookingNotFound, bookingID))
+	}
+	return booking, nil
+}
+
+// Journey returns the journey the bookings are made for
+func (ds *Datastore) Journey() Journey {
+	return ds.journey
 }
 
 // Internal get user bookings function
 func (ds *Datastore) getUserBookings(userID string) []Booking {
 	var bookings []Booking
 	for bookingID := range ds.userBookings[userID] {
-		bookings = append(bookings, ds.bookings[bookingID])
+		booking, _ := ds.booking(bookingID)
+		bookings = append(bookings, booking)
 	}
 	return bookings
 }
 
 // Internal purchase function
 func (ds *Datastore) createBooking(userID string, booking Booking) (Booking, error) {
-	// Make sure use has bookings map
-	if _, ok := ds.userBookings[userID]; !ok {
-		ds.userBookings[userID] = make(BookingsMap)
-	}
-	bookingID := BookingID(booking.BookingID)
-	if bookingID != "" {
-		// check if not admin then check if the user is the owner of the booking
-		if _, ok := ds.userBookings[userID][bookingID]; !ok {
-			return Booking{}, BookingNotFound(fmt.Errorf("booking not found: %v", bookingID))
-		}
-	} else {
-		// create a new booking id
-		id, err := createRandomID()
-		if err != nil {
-			return Booking{}, fmt.Errorf("failed to generate booking id: %v", err)
-		}
-		booking.BookingID = id
-		bookingID = BookingID(id)
+	// create a new booking id
+	id, err := createRandomID()
+	if err != nil {
+		return Booking{}, fmt.Errorf("failed to generate booking id: %v", err)
 	}
-	if err := ds.allocationSeating(SectionID(booking.Seat.SectionID), SeatID(booking.Seat.SeatID), bookingID); err != nil {
-		return Booking{}, fmt.Errorf("failed to allocate seating: %v", err)
+	booking.BookingID = id
+	if err := ds.allocationSeating(SectionID(booking.Seat.SectionID), SeatID(booking.Seat.SeatID), BookingID(id)); err != nil {
+		return Booking{}, fmt.Errorf("failed to allocate seating: %w", err)
 	}
 
 	booking.owner = userID
-	ds.bookings[bookingID] = booking
-	ds.userBookings[userID][bookingID] = struct{}{}
+	booking.JourneyID = ds.journey.ID
+	booking.From = ds.journey.From
+	booking.To = ds.journey.To
+	booking.Departure = ds.journey.Departure
+	booking.Status = BOOKING_ACTIVE
+	booking.CreatedAt = time.Now()
+	ds.addBooking(booking)
+	ds.stats.BookingsCreated++
 	return booking, nil
 }
 
-// GetBookingsBySection returns the bookings for a given section
-func (ds *Datastore) GetBookingsBySection(sectionID SectionID) []Booking {
-	// Concurrency support
-	ds.RLock()
-	defer ds.RUnlock()
+// GetBookingsBySection returns the bookings for a given section. It only takes the lock of
+// the section, it doesn't wait for operations on the other sections.
+func (ds *Datastore) GetBookingsBySection(ctx context.Context, sectionID SectionID) []Booking {
+	s, ok := ds.sections[sectionID]
+	if !ok {
+		return nil
+	}
 
-	return ds.getBookingsBySection(sectionID)
+	// Concurrency support
+	unlock := ds.traceLock(ctx, "GetBookingsBySection", "read", func() func() {
+		s.RLock()
+		return s.RUnlock
+	})
+	defer unlock()
+
+	bookings := ds.getBookingsBySection(sectionID)
+	sortBookings(bookings)
+	return bookings
 }
 
 // Internal get bookings by section function
 func (ds *Datastore) getBookingsBySection(sectionID SectionID) []Booking {
 	// GetBookingsBySection returns the bookings for a given section
 	var booking []Booking
-	seating, ok := ds.seatAllocation[sectionID]
+	s, ok := ds.sections[sectionID]
 	if !ok {
 		return booking
 	}
-	for _, bookingID := range seating {
-		booking = append(booking, ds.bookings[bookingID])
+	for _, bookingID := range s.seating {
+		booking = append(booking, s.bookings[bookingID])
 	}
 	return booking
 }
 
-// RemoveUserFromTrain removes a user's booking from the datastore
-func (ds *Datastore) RemoveUserFromTrain(bookingID BookingID) error {
+// RemoveUserFromTrain removes a user's booking from the datastore and starts the
+// cancellation cooldown of the booking's owner. The booking is kept as cancelled for ListBookings
+// for the cancelled retention.
+func (ds *Datastore) RemoveUserFromTrain(ctx context.Context, bookingID BookingID) error {
 	// Concurrency support
-	ds.Lock()
-	defer ds.Unlock()
+	unlock := ds.lockBookings(ctx, "RemoveUserFromTrain", true, func() []SectionID {
+		return ds.bookingSections(bookingID)
+	})
+	defer unlock()
 
-	return ds.removeUserFromTrain(bookingID)
+	booking, err := ds.deleteBooking(bookingID)
+	if err != nil {
+		return err
+	}
+	cancelled := booking
+	cancelled.Status = BOOKING_CANCELLED
+	cancelled.CancelledAt = time.Now()
+	ds.cancelled[bookingID] = cancelled
+	ds.cancelledOrder = append(ds.cancelledOrder, bookingID)
+	ds.queryIndex.update(booking, cancelled)
+	ds.pruneCancelled(cancelled.CancelledAt)
+	ds.stats.BookingsCancelled++
+	ds.recordCancellation(ctx, booking.owner)
+	return nil
 }
 
-// Internal remove user from train function
-func (ds *Datastore) removeUserFromTrain(bookingID BookingID) error {
+// Internal delete booking function, it releases the seat and drops the booking from the index of
+// SearchBookings. The booking stays in the indexes of ListBookings. The caller must hold the lock
+// of the booking's section and the index lock.
+func (ds *Datastore) deleteBooking(bookingID BookingID) (Booking, error) {
 	// Check if booking exists
-	booking, ok := ds.bookings[bookingID]
+	entry, ok := ds.bookingIndex[bookingID]
 	if !ok {
-		return BookingNotFound(fmt.Errorf("booking not found: %v", bookingID))
+		return Booking{}, BookingNotFound(fmt.Errorf("%w: %v", ErrBookingNotFound, bookingID))
 	}
 
-	// Remove the allocation
-	seat := SeatID(booking.Seat.SeatID)
-	section := SectionID(booking.Seat.SectionID)
+	// remove the seat
+	s := ds.sections[entry.section]
+	booking := s.bookings[bookingID]
+	delete(s.seating, SeatID(booking.Seat.SeatID))
 
-	// Get the seating for the section
-	seating, ok := ds.seatAllocation[section]
-	if !ok {
-		return SectionNotFound(fmt.Errorf("section not found: %v", section))
+	// delete the bookings
+	delete(s.bookings, bookingID)
+	delete(ds.bookingIndex, bookingID)
+	delete(ds.userBookings[booking.owner], bookingID)
+	ds.searchIndex.remove(booking)
+
+	return booking, nil
+}
+
+// ClaimBookings moves all bookings of fromUserID to toUserID and records the merge in the audit trail.
+// It returns the moved bookings, or LimitExceeded without moving any when they would break the booking
+// limits of toUserID.
+func (ds *Datastore) ClaimBookings(ctx context.Context, fromUserID string, toUserID string) ([]Booking, error) {
+	// Concurrency support, the store lock guards the audit trail
+	unlock := ds.traceLock(ctx, "ClaimBookings", "write", func() func() {
+		ds.Lock()
+		unlockBookings := ds.lockIndexed(true, func() []SectionID {
+			return ds.userSections(fromUserID)
+		})
+		return func() {
+			unlockBookings()
+			ds.Unlock()
+		}
+	})
+	defer unlock()
+
+	if fromUserID == "" || toUserID == "" {
+		return nil, fmt.Errorf("user ids must not be empty")
+	}
+	if fromUserID == toUserID {
+		return nil, nil
+	}
+	// The claimed bookings count towards the limits of the user like the ones it purchased
+	if seats := ds.activeBookings(fromUserID); seats > 0 {
+		if err := ds.checkHoldLimits(ctx, toUserID, seats); err != nil {
+			return nil, err
+		}
 	}
 
-	// remove the seat
-	delete(seating, seat)
+	if _, ok := ds.userBookings[toUserID]; !ok {
+		ds.userBookings[toUserID] = make(BookingsMap)
+	}
 
-	// delete the bookings
-	delete(ds.bookings, bookingID)
+	var claimed []Booking
+	var bookingIDs []string
+	for bookingID := range ds.userBookings[fromUserID] {
+		s := ds.sections[ds.bookingIndex[bookingID].section]
+		old := s.bookings[bookingID]
+		booking := old
+		booking.owner = toUserID
+		s.bookings[bookingID] = booking
+		ds.queryIndex.update(old, booking)
+		ds.userBookings[toUserID][bookingID] = struct{}{}
+		claimed = append(claimed, booking)
+		bookingIDs = append(bookingIDs, string(bookingID))
+	}
+	delete(ds.userBookings, fromUserID)
+
+	if len(claimed) > 0 {
+		sort.Strings(bookingIDs)
+		ds.recordAuditEvent(AuditEvent{
+			Actor:   toUserID,
+			Action:  AUDIT_CLAIM_GUEST_BOOKINGS,
+			Subject: fromUserID,
+			Details: map[string]string{"booking_ids": strings.Join(bookingIDs, ",")},
+		})
+	}
 
-	return nil
+	return claimed, nil
 }
 
-// ModifySeat updates the seat allocation for a given section and seat
-func (ds *Datastore) ModifySeat(bookingID BookingID, sectionID SectionID, seatID SeatID) (Booking, error) {
+// ModifySeat updates the seat allocation for a given section and seat. A booking moving to
+// another section holds the locks of both sections.
+func (ds *Datastore) ModifySeat(ctx context.Context, bookingID BookingID, sectionID SectionID, seatID SeatID) (Booking, error) {
 	// Concurrency support
-	ds.Lock()
-	defer ds.Unlock()
+	unlock := ds.lockBookings(ctx, "ModifySeat", true, func() []SectionID {
+		return append(ds.bookingSections(bookingID), sectionID)
+	})
+	defer unlock()
 
 	return ds.modifySeat(bookingID, sectionID, seatID)
 }
@@ -280,25 +672,35 @@ func (ds *Datastore) ModifySeat(bookingID BookingID, sectionID SectionID, seatID
 // Internal modify seat function
 func (ds *Datastore) modifySeat(bookingID BookingID, sectionID SectionID, seatID SeatID) (Booking, error) {
 	// Check if booking exists
-	booking, ok := ds.bookings[bookingID]
+	entry, ok := ds.bookingIndex[bookingID]
 	if !ok {
-		return Booking{}, fmt.Errorf("booking not found: %v", bookingID)
+		return Booking{}, BookingNotFound(fmt.Errorf("%w: %v", ErrBookingNotFound, bookingID))
 	}
 
-	// Remove the existing seat allocation
-	if err := ds.removeUserFromTrain(bookingID); err != nil {
-		return Booking{}, err
+	// Free the existing seat so the booking can move within a full section
+	old := ds.sections[entry.section]
+	booking := old.bookings[bookingID]
+	oldSeat := SeatID(booking.Seat.SeatID)
+	delete(old.seating, oldSeat)
+
+	// Allocate the new seat, the booking keeps its seat when the new one can't be allocated
+	if err := ds.allocationSeating(sectionID, seatID, bookingID); err != nil {
+		old.seating[oldSeat] = bookingID
+		return Booking{}, fmt.Errorf("failed to allocate seating: %w", err)
 	}
 
-	// Update the seat
-	booking.Seat = Seat{
+	// Update the seat, moving the booking to the new section
+	delete(old.bookings, bookingID)
+	moved := booking
+	moved.Seat = Seat{
 		SectionID: string(sectionID),
 		SeatID:    string(seatID),
 	}
+	ds.queryIndex.update(booking, moved)
+	booking = moved
+	ds.sections[sectionID].bookings[bookingID] = booking
+	ds.bookingIndex[bookingID] = indexEntry{section: sectionID, journeyID: booking.JourneyID}
+	ds.stats.BookingsModified++
 
-	updatedBooking, err := ds.createBooking(booking.owner, booking)
-	if err != nil {
-		return Booking{}, err
-	}
-	return updatedBooking, nil
+	return booking, nil
 }
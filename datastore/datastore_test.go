@@ -0,0 +1,465 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBenchmarkDatastore creates a datastore with sections of size seats
+func newBenchmarkDatastore(sections int, size int) (*Datastore, []SectionID) {
+	var sectionIDs []SectionID
+	for i := 0; i < sections; i++ {
+		sectionIDs = append(sectionIDs, SectionID(fmt.Sprintf("S%d", i)))
+	}
+	return NewDatastore(WithSections(sectionIDs...), WithSectionSize(size)), sectionIDs
+}
+
+// bookingStore are the operations of the benchmarks, made on the datastore and on the single
+// lock baseline
+type bookingStore interface {
+	Purchase(ctx context.Context, userID string, booking Booking) (Booking, error)
+	GetBookingsBySection(ctx context.Context, sectionID SectionID) []Booking
+	ModifySeat(ctx context.Context, bookingID BookingID, sectionID SectionID, seatID SeatID) (Booking, error)
+	RemoveUserFromTrain(ctx context.Context, bookingID BookingID) error
+}
+
+// singleLockStore runs the operations of the datastore under one store wide lock, the way the
+// datastore locked before the locks were sharded by section. It is the baseline of the benchmarks.
+type singleLockStore struct {
+	mu sync.RWMutex
+	ds *Datastore
+}
+
+func (s *singleLockStore) Purchase(ctx context.Context, userID string, booking Booking) (Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ds.Purchase(ctx, userID, booking)
+}
+
+func (s *singleLockStore) GetBookingsBySection(ctx context.Context, sectionID SectionID) []Booking {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ds.GetBookingsBySection(ctx, sectionID)
+}
+
+func (s *singleLockStore) ModifySeat(ctx context.Context, bookingID BookingID, sectionID SectionID, seatID SeatID) (Booking, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ds.ModifySeat(ctx, bookingID, sectionID, seatID)
+}
+
+func (s *singleLockStore) RemoveUserFromTrain(ctx context.Context, bookingID BookingID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ds.RemoveUserFromTrain(ctx, bookingID)
+}
+
+// benchmarkStores runs the benchmark on a datastore with 8 sections of 1000 seats, with the
+// sharded locks and with the single lock baseline
+func benchmarkStores(b *testing.B, bench func(b *testing.B, store bookingStore, sectionIDs []SectionID)) {
+	for _, name := range []string{"sharded", "single-lock"} {
+		b.Run(name, func(b *testing.B) {
+			ds, sectionIDs := newBenchmarkDatastore(8, 1000)
+			var store bookingStore = ds
+			if name == "single-lock" {
+				store = &singleLockStore{ds: ds}
+			}
+			bench(b, store, sectionIDs)
+		})
+	}
+}
+
+// purchase books the seat for the user. The callers report the error, they may run in other
+// goroutines than the test's where Fatal can't be called.
+func purchase(store bookingStore, userID string, sectionID SectionID, seat int) (Booking, error) {
+	booking, err := store.Purchase(context.Background(), userID, Booking{
+		User: User{EmailAddress: userID},
+		Seat: Seat{SectionID: string(sectionID), SeatID: strconv.Itoa(seat)},
+	})
+	if err != nil {
+		return Booking{}, fmt.Errorf("Purchase() error = %v", err)
+	}
+	return booking, nil
+}
+
+// BenchmarkPurchase buys and cancels seats, each goroutine in its own seat of the sections
+func BenchmarkPurchase(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, store bookingStore, sectionIDs []SectionID) {
+		ctx := context.Background()
+		var goroutines atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			n := int(goroutines.Add(1) - 1)
+			userID := fmt.Sprintf("user-%d@example.com", n)
+			sectionID := sectionIDs[n%len(sectionIDs)]
+			for pb.Next() {
+				booking, err := purchase(store, userID, sectionID, n/len(sectionIDs))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if err := store.RemoveUserFromTrain(ctx, BookingID(booking.BookingID)); err != nil {
+					b.Errorf("RemoveUserFromTrain() error = %v", err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkGetBookingsBySection lists sections while every other goroutine purchases seats
+// in another section
+func BenchmarkGetBookingsBySection(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, store bookingStore, sectionIDs []SectionID) {
+		ctx := context.Background()
+		for i, sectionID := range sectionIDs {
+			for seat := 500; seat < 600; seat++ {
+				if _, err := purchase(store, fmt.Sprintf("owner-%d@example.com", i), sectionID, seat); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ResetTimer()
+		var goroutines atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			n := int(goroutines.Add(1) - 1)
+			userID := fmt.Sprintf("user-%d@example.com", n)
+			sectionID := sectionIDs[n%len(sectionIDs)]
+			for pb.Next() {
+				if n%2 == 0 {
+					if bookings := store.GetBookingsBySection(ctx, sectionIDs[(n+1)%len(sectionIDs)]); len(bookings) < 100 {
+						b.Errorf("GetBookingsBySection() = %v bookings, want at least 100", len(bookings))
+						return
+					}
+					continue
+				}
+				booking, err := purchase(store, userID, sectionID, n/len(sectionIDs))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if err := store.RemoveUserFromTrain(ctx, BookingID(booking.BookingID)); err != nil {
+					b.Errorf("RemoveUserFromTrain() error = %v", err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkModifySeat moves bookings back and forth between two sections, half of them
+// in each direction
+func BenchmarkModifySeat(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, store bookingStore, sectionIDs []SectionID) {
+		ctx := context.Background()
+		var goroutines atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			n := int(goroutines.Add(1) - 1)
+			from, to := sectionIDs[n%len(sectionIDs)], sectionIDs[(n+1)%len(sectionIDs)]
+			seat := n
+			booking, err := purchase(store, fmt.Sprintf("user-%d@example.com", n), from, seat)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			for pb.Next() {
+				if _, err := store.ModifySeat(ctx, BookingID(booking.BookingID), to, SeatID(strconv.Itoa(seat))); err != nil {
+					b.Errorf("ModifySeat() error = %v", err)
+					return
+				}
+				from, to = to, from
+			}
+		})
+	})
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	ctx := context.Background()
+	ds := NewDatastore(WithSectionSize(20))
+
+	// Bookings move between the sections in both directions while others are bought and cancelled
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("user-%d@example.com", i)
+			sections := []SectionID{SECTION_A, SECTION_B}
+			booking, err := purchase(ds, userID, sections[i%2], i)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < 200; j++ {
+				sectionID := sections[(i+j+1)%2]
+				if _, err := ds.ModifySeat(ctx, BookingID(booking.BookingID), sectionID, SeatID(strconv.Itoa(i))); err != nil {
+					t.Errorf("ModifySeat() error = %v", err)
+					return
+				}
+				extra, err := purchase(ds, userID, sectionID, 10+i)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(ds.GetUserBookings(ctx, userID)) != 2 {
+					t.Errorf("GetUserBookings() = %v, want 2 bookings", ds.GetUserBookings(ctx, userID))
+				}
+				if err := ds.RemoveUserFromTrain(ctx, BookingID(extra.BookingID)); err != nil {
+					t.Errorf("RemoveUserFromTrain() error = %v", err)
+				}
+				ds.GetBookingsBySection(ctx, sectionID)
+				ds.Stats()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := ds.Stats()
+	if sold := stats.Sections[SECTION_A].Sold + stats.Sections[SECTION_B].Sold; sold != 8 {
+		t.Errorf("sold seats = %v, want 8", sold)
+	}
+	for _, sectionID := range []SectionID{SECTION_A, SECTION_B} {
+		for _, booking := range ds.GetBookingsBySection(ctx, sectionID) {
+			if found, err := ds.GetBooking(ctx, BookingID(booking.BookingID)); err != nil || found.Seat.SectionID != string(sectionID) {
+				t.Errorf("GetBooking(%v) = %v, %v, want the booking in section %v", booking.BookingID, found, err, sectionID)
+			}
+		}
+	}
+	if stats.BookingsModified != 8*200 || stats.BookingsCreated != 8*201 || stats.BookingsCancelled != 8*200 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestListBookings(t *testing.T) {
+	ctx := context.Background()
+	ds := NewDatastore()
+	passengers := []User{
+		{EmailAddress: "john@example.com", FirstName: "John", LastName: "Doe"},
+		{EmailAddress: "jane@example.com", FirstName: "Jane", LastName: "Doe"},
+		{EmailAddress: "bob@example.com", FirstName: "Bob", LastName: "Smith"},
+		{EmailAddress: "guest@example.com", FirstName: "Ann", LastName: "Lee"},
+	}
+	var bookings []Booking
+	for i, passenger := range passengers {
+		booking, err := ds.Purchase(ctx, passenger.EmailAddress, Booking{User: passenger, Seat: Seat{SectionID: SECTION_A, SeatID: strconv.Itoa(i)}})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		bookings = append(bookings, booking)
+	}
+	if _, err := ds.ModifySeat(ctx, BookingID(bookings[1].BookingID), SECTION_B, "1"); err != nil {
+		t.Fatalf("ModifySeat() error = %v", err)
+	}
+	if err := ds.RemoveUserFromTrain(ctx, BookingID(bookings[2].BookingID)); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	if _, err := ds.ClaimBookings(ctx, "guest@example.com", "john@example.com"); err != nil {
+		t.Fatalf("ClaimBookings() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query BookingQuery
+		want  []int
+	}{
+		{"all", BookingQuery{}, []int{0, 1, 2, 3}},
+		{"journey", BookingQuery{JourneyID: ds.Journey().ID}, []int{0, 1, 2, 3}},
+		{"other journey", BookingQuery{JourneyID: "paris-london"}, nil},
+		{"moved to section", BookingQuery{SectionID: SECTION_B}, []int{1}},
+		{"section", BookingQuery{SectionID: SECTION_A}, []int{0, 2, 3}},
+		{"claimed owner", BookingQuery{Owner: "john@example.com"}, []int{0, 3}},
+		{"claimed from owner", BookingQuery{Owner: "guest@example.com"}, nil},
+		{"cancelled", BookingQuery{Status: BOOKING_CANCELLED}, []int{2}},
+		{"active in section", BookingQuery{Status: BOOKING_ACTIVE, SectionID: SECTION_A}, []int{0, 3}},
+		{"last name", BookingQuery{PassengerName: "DOE"}, []int{0, 1}},
+		{"full name", BookingQuery{PassengerName: " jane  doe "}, []int{1}},
+		{"created range", BookingQuery{CreatedAfter: bookings[1].CreatedAt, CreatedBefore: bookings[3].CreatedAt}, []int{1, 2}},
+		{"created range and name", BookingQuery{CreatedAfter: bookings[1].CreatedAt, PassengerName: "doe"}, []int{1}},
+	}
+	check := func(ds *Datastore) {
+		for _, tt := range tests {
+			var got []int
+			for _, booking := range ds.ListBookings(ctx, tt.query) {
+				got = append(got, slices.IndexFunc(bookings, func(b Booking) bool { return b.BookingID == booking.BookingID }))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListBookings(%v) = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+	check(ds)
+
+	// The cancelled bookings and the indexes are restored from a snapshot
+	var snapshot bytes.Buffer
+	if err := ds.Save(ctx, &snapshot); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded := NewDatastore()
+	if err := loaded.Load(ctx, &snapshot); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	check(loaded)
+	if _, err := loaded.GetBooking(ctx, BookingID(bookings[2].BookingID)); !errors.Is(err, ErrBookingNotFound) {
+		t.Errorf("GetBooking() of a cancelled booking error = %v, want %v", err, ErrBookingNotFound)
+	}
+	if stats := loaded.Stats(); stats.Sections[SECTION_A].Sold != 2 || stats.Sections[SECTION_B].Sold != 1 {
+		t.Errorf("Stats() = %+v, want the cancelled seat free", stats)
+	}
+}
+
+func TestCancelledRetention(t *testing.T) {
+	ctx := context.Background()
+	ds := NewDatastore(WithCancelledRetention(time.Hour))
+	var bookingIDs []BookingID
+	for i := 0; i < 3; i++ {
+		booking, err := ds.Purchase(ctx, "user@example.com", Booking{
+			User: User{EmailAddress: "user@example.com"},
+			Seat: Seat{SectionID: SECTION_A, SeatID: strconv.Itoa(i)},
+		})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		bookingIDs = append(bookingIDs, BookingID(booking.BookingID))
+	}
+	cancelled := func(ds *Datastore) int {
+		return len(ds.ListBookings(ctx, BookingQuery{Status: BOOKING_CANCELLED}))
+	}
+	// cancelledAgo moves the cancellation of the booking into the past
+	cancelledAgo := func(bookingID BookingID, ago time.Duration) {
+		booking := ds.cancelled[bookingID]
+		booking.CancelledAt = time.Now().Add(-ago)
+		ds.cancelled[bookingID] = booking
+	}
+
+	if err := ds.RemoveUserFromTrain(ctx, bookingIDs[0]); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	if n := cancelled(ds); n != 1 {
+		t.Errorf("cancelled bookings within the retention = %v, want 1", n)
+	}
+
+	// Listing drops the bookings past the retention without another cancellation
+	cancelledAgo(bookingIDs[0], 2*time.Hour)
+	if n := cancelled(ds); n != 0 {
+		t.Errorf("cancelled bookings past the retention = %v, want 0", n)
+	}
+	if bookings := ds.ListBookings(ctx, BookingQuery{}); len(bookings) != 2 {
+		t.Errorf("ListBookings() = %v, want the active bookings", bookings)
+	}
+
+	// So does a cancellation
+	if err := ds.RemoveUserFromTrain(ctx, bookingIDs[1]); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	cancelledAgo(bookingIDs[1], 2*time.Hour)
+	if err := ds.RemoveUserFromTrain(ctx, bookingIDs[2]); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+	if _, ok := ds.cancelled[bookingIDs[1]]; ok {
+		t.Errorf("booking cancelled past the retention kept after the next cancellation")
+	}
+
+	// Loading a snapshot drops them too
+	cancelledAgo(bookingIDs[2], 40*24*time.Hour)
+	var snapshot bytes.Buffer
+	if err := ds.Save(ctx, &snapshot); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	for _, tt := range []struct {
+		name    string
+		options []DatastoreOption
+		want    int
+	}{
+		{"default retention", nil, 0},
+		{"no retention", []DatastoreOption{WithCancelledRetention(0)}, 1},
+	} {
+		loaded := NewDatastore(tt.options...)
+		if err := loaded.Load(ctx, bytes.NewReader(snapshot.Bytes())); err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		if n := cancelled(loaded); n != tt.want {
+			t.Errorf("cancelled bookings after the load with %v = %v, want %v", tt.name, n, tt.want)
+		}
+	}
+}
+
+func TestSearchBookings(t *testing.T) {
+	ctx := context.Background()
+	ds := NewDatastore()
+	passengers := []User{
+		{EmailAddress: "john.doe@example.com", FirstName: "John", LastName: "Doe"},
+		{EmailAddress: "jane@example.com", FirstName: "Jane", LastName: "Doe"},
+		{EmailAddress: "bob@corp.example.org", FirstName: "Bob", LastName: "Smith"},
+		{EmailAddress: "ed@example.com", FirstName: "Ed", LastName: "Leeson"},
+		{EmailAddress: "ann@example.com", FirstName: "Ann", LastName: "Lee"},
+	}
+	var bookings []Booking
+	for i, passenger := range passengers {
+		booking, err := ds.Purchase(ctx, passenger.EmailAddress, Booking{User: passenger, Seat: Seat{SectionID: SECTION_A, SeatID: strconv.Itoa(i)}})
+		if err != nil {
+			t.Fatalf("Purchase() error = %v", err)
+		}
+		bookings = append(bookings, booking)
+	}
+	if _, err := ds.ModifySeat(ctx, BookingID(bookings[1].BookingID), SECTION_B, "1"); err != nil {
+		t.Fatalf("ModifySeat() error = %v", err)
+	}
+	if err := ds.RemoveUserFromTrain(ctx, BookingID(bookings[2].BookingID)); err != nil {
+		t.Fatalf("RemoveUserFromTrain() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  []int
+	}{
+		{"last name", SearchQuery{Text: "DOE"}, []int{0, 1}},
+		{"first name prefix", SearchQuery{Text: "ja"}, []int{1}},
+		{"full name", SearchQuery{Text: "john doe"}, []int{0}},
+		{"swapped letters", SearchQuery{Text: "jhon"}, []int{0}},
+		{"typo in a long word", SearchQuery{Text: "lesson"}, []int{3}},
+		{"short word without typos", SearchQuery{Text: "jon"}, nil},
+		{"email before a close one", SearchQuery{Text: "jane@example.com"}, []int{1, 4}},
+		{"part of an email", SearchQuery{Text: "doe@exa"}, []int{0}},
+		{"exact match first", SearchQuery{Text: "lee"}, []int{4, 3}},
+		{"cancelled", SearchQuery{Text: "smith"}, nil},
+		{"booking id prefix", SearchQuery{BookingIDPrefix: strings.ToUpper(bookings[4].BookingID[:8])}, []int{4}},
+		{"seat", SearchQuery{SectionID: SECTION_A, SeatID: "3"}, []int{3}},
+		{"freed seat", SearchQuery{SectionID: SECTION_A, SeatID: "1"}, nil},
+		{"section and name", SearchQuery{SectionID: SECTION_B, Text: "doe"}, []int{1}},
+		{"limit", SearchQuery{Text: "example", Limit: 2}, []int{0, 1}},
+		{"unknown section", SearchQuery{SectionID: "Z"}, nil},
+		{"no criteria", SearchQuery{}, nil},
+	}
+	check := func(ds *Datastore) {
+		for _, tt := range tests {
+			var got []int
+			for _, booking := range ds.SearchBookings(ctx, tt.query) {
+				got = append(got, slices.IndexFunc(bookings, func(b Booking) bool { return b.BookingID == booking.BookingID }))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SearchBookings(%v) = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+	check(ds)
+
+	// The index is rebuilt from a snapshot
+	var snapshot bytes.Buffer
+	if err := ds.Save(ctx, &snapshot); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded := NewDatastore()
+	if err := loaded.Load(ctx, &snapshot); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	check(loaded)
+}
@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Booking limit rules reported by LimitExceeded
+const (
+	LIMIT_ACTIVE_BOOKINGS       = "active_bookings"
+	LIMIT_SEATS_PER_PURCHASE    = "seats_per_purchase"
+	LIMIT_CANCELLATION_COOLDOWN = "cancellation_cooldown"
+)
+
+// BookingLimits are the business rules against hoarding seats, a zero value disables the rule
+type BookingLimits struct {
+	// Bookings a user can hold on the journey at the same time
+	MaxActiveBookings int
+	// Seats a user can buy in a single purchase
+	MaxSeatsPerPurchase int
+	// How long a user has to wait after cancelling a booking before purchasing again
+	CancellationCooldown time.Duration
+}
+
+// LimitExceeded is returned when a purchase breaks one of the booking limits
+type LimitExceeded struct {
+	Rule  string
+	Limit int
+	// RetryAfter is the rest of the cooldown, it is zero for the other rules
+	RetryAfter time.Duration
+}
+
+func (e *LimitExceeded) Error() string {
+	switch e.Rule {
+	case LIMIT_ACTIVE_BOOKINGS:
+		return fmt.Sprintf("limit of %d active bookings reached", e.Limit)
+	case LIMIT_SEATS_PER_PURCHASE:
+		return fmt.Sprintf("limit of %d seats per purchase exceeded", e.Limit)
+	case LIMIT_CANCELLATION_COOLDOWN:
+		return fmt.Sprintf("purchases are blocked for %v after a cancellation", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("booking limit %v exceeded", e.Rule)
+}
+
+// WithBookingLimits sets the booking limits, there are none by default.
+func WithBookingLimits(limits BookingLimits) DatastoreOption {
+	return func(ds *Datastore) {
+		ds.limits = limits
+	}
+}
+
+type exemptKey struct{}
+
+// ExemptFromLimits returns a context whose operations skip the booking limits and don't start a
+// cancellation cooldown, it is used for the calls of admins
+func ExemptFromLimits(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exemptKey{}, true)
+}
+
+type cancellerKey struct{}
+
+// CancelledBy returns a context whose cancellations are made by the user. Only owners cancelling
+// their own bookings start a cooldown, cancellations made by staff on behalf of the owner don't.
+// Cancellations without a canceller are the owner's.
+func CancelledBy(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, cancellerKey{}, userID)
+}
+
+// isExempt checks if the operation skips the booking limits
+func isExempt(ctx context.Context) bool {
+	exempt, _ := ctx.Value(exemptKey{}).(bool)
+	return exempt
+}
+
+// UserLimits are the booking limits of a user and how much of them the user used
+type UserLimits struct {
+	BookingLimits
+	ActiveBookings int
+	// End of the cooldown after the user's last cancellation, zero when there is none
+	CooldownEnds time.Time
+	// Exempt users are not limited
+	Exempt bool
+}
+
+// GetUserLimits returns the booking limits of the user
+func (ds *Datastore) GetUserLimits(ctx context.Context, userID string) UserLimits {
+	// Concurrency support
+	unlock := ds.lockBookings(ctx, "GetUserLimits", false, onSections())
+	defer unlock()
+
+	limits := UserLimits{
+		BookingLimits:  ds.limits,
+		ActiveBookings: ds.activeBookings(userID),
+		Exempt:         isExempt(ctx),
+	}
+	if ends := ds.cooldownEnds(userID); time.Now().Before(ends) {
+		limits.CooldownEnds = ends
+	}
+	return limits
+}
+
+// activeBookings counts the bookings the user holds on the journey, the caller must hold the index lock
+func (ds *Datastore) activeBookings(userID string) int {
+	active := 0
+	for bookingID := range ds.userBookings[userID] {
+		if ds.bookingIndex[bookingID].journeyID == ds.journey.ID {
+			active++
+		}
+	}
+	return active
+}
+
+// cooldownEnds returns the end of the cooldown after the user's last cancellation
+func (ds *Datastore) cooldownEnds(userID string) time.Time {
+	cancelled, ok := ds.cancellations[userID]
+	if !ok || ds.limits.CancellationCooldown == 0 {
+		return time.Time{}
+	}
+	return cancelled.Add(ds.limits.CancellationCooldown)
+}
+
+// checkLimits checks a purchase of seats by the user against the booking limits,
+// the caller must hold the index lock
+func (ds *Datastore) checkLimits(ctx context.Context, userID string, seats int) error {
+	if isExempt(ctx) {
+		return nil
+	}
+	if max := ds.limits.MaxSeatsPerPurchase; max > 0 && seats > max {
+		return &LimitExceeded{Rule: LIMIT_SEATS_PER_PURCHASE, Limit: max}
+	}
+	return ds.checkHoldLimits(ctx, userID, seats)
+}
+
+// checkHoldLimits checks that the user can take seats bought elsewhere, e.g. claimed guest
+// bookings, against the cooldown and the active bookings limits. The caller must hold the index lock.
+func (ds *Datastore) checkHoldLimits(ctx context.Context, userID string, seats int) error {
+	if isExempt(ctx) {
+		return nil
+	}
+	if wait := time.Until(ds.cooldownEnds(userID)); wait > 0 {
+		return &LimitExceeded{Rule: LIMIT_CANCELLATION_COOLDOWN, RetryAfter: wait}
+	}
+	if max := ds.limits.MaxActiveBookings; max > 0 && ds.activeBookings(userID)+seats > max {
+		return &LimitExceeded{Rule: LIMIT_ACTIVE_BOOKINGS, Limit: max}
+	}
+	return nil
+}
+
+// recordCancellation starts the cooldown of the booking's owner when the owner cancelled it, the
+// caller must hold the index lock
+func (ds *Datastore) recordCancellation(ctx context.Context, userID string) {
+	if isExempt(ctx) || ds.limits.CancellationCooldown == 0 {
+		return
+	}
+	if canceller, ok := ctx.Value(cancellerKey{}).(string); ok && canceller != userID {
+		return
+	}
+	ds.cancellations[userID] = time.Now()
+}
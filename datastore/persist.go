@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Version of the snapshot format written by Save
+const SNAPSHOT_VERSION = 1
+
+// snapshot is the persisted state of the datastore. Seat allocations and the indexes are
+// rebuilt from the bookings when it is loaded. Bookings of snapshots written before the
+// booking statuses are active.
+type snapshot struct {
+	Version    int                  `json:"version"`
+	Bookings   []bookingRecord      `json:"bookings"`
+	APIKeys    []apiKeyRecord       `json:"api_keys"`
+	UsedTokens map[string]time.Time `json:"used_tokens"`
+	AuditTrail []AuditEvent         `json:"audit_trail"`
+	Stats      Stats                `json:"stats"`
+	// Time of each user's last cancellation, for the cancellation cooldown
+	Cancellations map[string]time.Time `json:"cancellations"`
+}
+
+type bookingRecord struct {
+	Booking
+	Owner string
+}
+
+type apiKeyRecord struct {
+	APIKey
+	SecretHash string
+}
+
+// Save writes the state of the datastore as JSON
+func (ds *Datastore) Save(ctx context.Context, w io.Writer) error {
+	// Concurrency support
+	unlock := ds.rlock(ctx, "Save")
+	defer unlock()
+	unlockBookings := ds.lockSections(false, ds.sectionIDs...)
+	defer unlockBookings()
+
+	snap := snapshot{
+		Version:       SNAPSHOT_VERSION,
+		UsedTokens:    ds.usedTokens,
+		AuditTrail:    ds.auditTrail,
+		Cancellations: ds.cancellations,
+		Stats:         Stats{BookingsCreated: ds.stats.BookingsCreated, BookingsCancelled: ds.stats.BookingsCancelled, BookingsModified: ds.stats.BookingsModified},
+	}
+	for _, sectionID := range ds.sectionIDs {
+		for _, booking := range ds.sections[sectionID].bookings {
+			snap.Bookings = append(snap.Bookings, bookingRecord{Booking: booking, Owner: booking.owner})
+		}
+	}
+	for _, booking := range ds.cancelled {
+		snap.Bookings = append(snap.Bookings, bookingRecord{Booking: booking, Owner: booking.owner})
+	}
+	for _, key := range ds.apiKeys {
+		snap.APIKeys = append(snap.APIKeys, apiKeyRecord{APIKey: key, SecretHash: hex.EncodeToString(key.secretHash[:])})
+	}
+
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return nil
+}
+
+// Load replaces the state of the datastore with a snapshot written by Save. The sections
+// and section size of the datastore must fit the bookings of the snapshot.
+func (ds *Datastore) Load(ctx context.Context, r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	if snap.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("unsupported snapshot version: %v", snap.Version)
+	}
+
+	// Concurrency support
+	unlock := ds.lock(ctx, "Load")
+	defer unlock()
+	unlockBookings := ds.lockSections(true, ds.sectionIDs...)
+	defer unlockBookings()
+
+	// Build the new state aside so the datastore is unchanged when the snapshot doesn't fit
+	loaded := &Datastore{
+		sections:           make(map[SectionID]*section),
+		sectionSize:        ds.sectionSize,
+		userBookings:       make(map[string]BookingsMap),
+		bookingIndex:       make(map[BookingID]indexEntry),
+		cancelled:          make(map[BookingID]Booking),
+		queryIndex:         newQueryIndex(),
+		searchIndex:        newSearchIndex(),
+		apiKeys:            make(map[string]APIKey),
+		usedTokens:         make(map[string]time.Time),
+		auditTrail:         snap.AuditTrail,
+		cancelledRetention: ds.cancelledRetention,
+		cancellations:      make(map[string]time.Time),
+	}
+	for sectionID := range ds.sections {
+		loaded.sections[sectionID] = newSection()
+	}
+	for _, record := range snap.Bookings {
+		booking := record.Booking
+		booking.owner = record.Owner
+		bookingID := BookingID(booking.BookingID)
+		if booking.Status == BOOKING_CANCELLED {
+			loaded.cancelled[bookingID] = booking
+			loaded.cancelledOrder = append(loaded.cancelledOrder, bookingID)
+			loaded.queryIndex.add(booking)
+			continue
+		}
+		booking.Status = BOOKING_ACTIVE
+		if err := loaded.allocationSeating(SectionID(booking.Seat.SectionID), SeatID(booking.Seat.SeatID), bookingID); err != nil {
+			return fmt.Errorf("failed to load booking %v: %v", bookingID, err)
+		}
+		loaded.addBooking(booking)
+	}
+	// The snapshot lists the bookings in no particular order
+	sort.Slice(loaded.cancelledOrder, func(i, j int) bool {
+		return loaded.cancelled[loaded.cancelledOrder[i]].CancelledAt.Before(loaded.cancelled[loaded.cancelledOrder[j]].CancelledAt)
+	})
+	loaded.pruneCancelled(time.Now())
+	for _, record := range snap.APIKeys {
+		key := record.APIKey
+		hash, err := hex.DecodeString(record.SecretHash)
+		if err != nil || len(hash) != len(key.secretHash) {
+			return fmt.Errorf("invalid secret hash of api key %v", key.ID)
+		}
+		copy(key.secretHash[:], hash)
+		loaded.apiKeys[key.ID] = key
+	}
+	for id, expiry := range snap.UsedTokens {
+		loaded.usedTokens[id] = expiry
+	}
+	for userID, cancelled := range snap.Cancellations {
+		loaded.cancellations[userID] = cancelled
+	}
+
+	// The sections are replaced in place, their locks are held
+	for sectionID, s := range ds.sections {
+		s.seating = loaded.sections[sectionID].seating
+		s.bookings = loaded.sections[sectionID].bookings
+	}
+	ds.userBookings = loaded.userBookings
+	ds.bookingIndex = loaded.bookingIndex
+	ds.cancelled = loaded.cancelled
+	ds.cancelledOrder = loaded.cancelledOrder
+	ds.queryIndex = loaded.queryIndex
+	ds.searchIndex = loaded.searchIndex
+	ds.apiKeys = loaded.apiKeys
+	ds.usedTokens = loaded.usedTokens
+	ds.auditTrail = loaded.auditTrail
+	ds.cancellations = loaded.cancellations
+	ds.stats = Stats{BookingsCreated: snap.Stats.BookingsCreated, BookingsCancelled: snap.Stats.BookingsCancelled, BookingsModified: snap.Stats.BookingsModified}
+	return nil
+}
+
+// SaveFile writes the snapshot to a temporary file next to path and renames it,
+// so a crash while saving never leaves a partial snapshot behind
+func (ds *Datastore) SaveFile(ctx context.Context, path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := ds.Save(ctx, file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync snapshot file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot file: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot file: %v", err)
+	}
+	return nil
+}
+
+// LoadFile loads the snapshot at path, a missing file leaves the datastore empty
+func (ds *Datastore) LoadFile(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %v", err)
+	}
+	defer file.Close()
+	return ds.Load(ctx, file)
+}
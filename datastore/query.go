@@ -0,0 +1,289 @@
+package datastore
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Booking statuses, cancelled bookings are kept for ListBookings but hold no seat
+const (
+	BOOKING_ACTIVE    = "active"
+	BOOKING_CANCELLED = "cancelled"
+)
+
+// How long cancelled bookings are kept for ListBookings by default
+const CANCELLED_RETENTION = 30 * 24 * time.Hour
+
+// WithCancelledRetention sets how long cancelled bookings are kept for ListBookings, 0 keeps them
+// forever. They are dropped by the next ListBookings, cancellation or load after that.
+func WithCancelledRetention(retention time.Duration) DatastoreOption {
+	return func(ds *Datastore) {
+		ds.cancelledRetention = retention
+	}
+}
+
+// expiredCancelled checks if the oldest cancelled booking is past the retention, the caller must
+// hold the index lock
+func (ds *Datastore) expiredCancelled(now time.Time) bool {
+	if ds.cancelledRetention <= 0 || len(ds.cancelledOrder) == 0 {
+		return false
+	}
+	booking, ok := ds.cancelled[ds.cancelledOrder[0]]
+	return !ok || booking.CancelledAt.Before(now.Add(-ds.cancelledRetention))
+}
+
+// pruneCancelled drops the bookings cancelled longer than the retention ago, the caller must
+// hold the index lock
+func (ds *Datastore) pruneCancelled(now time.Time) {
+	for ds.expiredCancelled(now) {
+		if booking, ok := ds.cancelled[ds.cancelledOrder[0]]; ok {
+			delete(ds.cancelled, ds.cancelledOrder[0])
+			ds.queryIndex.remove(booking)
+		}
+		ds.cancelledOrder = ds.cancelledOrder[1:]
+	}
+}
+
+// pruneExpiredCancelled drops the cancelled bookings past the retention before a listing. The
+// index lock is only taken for writing when there are some.
+func (ds *Datastore) pruneExpiredCancelled() {
+	now := time.Now()
+	ds.index.RLock()
+	expired := ds.expiredCancelled(now)
+	ds.index.RUnlock()
+	if !expired {
+		return
+	}
+
+	ds.index.Lock()
+	defer ds.index.Unlock()
+	ds.pruneCancelled(now)
+}
+
+// BookingQuery filters the bookings of ListBookings, zero fields don't filter
+type BookingQuery struct {
+	JourneyID string
+	SectionID SectionID
+	Owner     string
+	Status    string
+	// Bookings created at or after CreatedAfter and before CreatedBefore
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// First name, last name or full name of the passenger, the case doesn't matter
+	PassengerName string
+}
+
+// matches checks the booking against all the filters of the query
+func (query BookingQuery) matches(booking Booking) bool {
+	return (query.JourneyID == "" || booking.JourneyID == query.JourneyID) &&
+		(query.SectionID == "" || SectionID(booking.Seat.SectionID) == query.SectionID) &&
+		(query.Owner == "" || booking.owner == query.Owner) &&
+		(query.Status == "" || booking.Status == query.Status) &&
+		(query.CreatedAfter.IsZero() || !booking.CreatedAt.Before(query.CreatedAfter)) &&
+		(query.CreatedBefore.IsZero() || booking.CreatedAt.Before(query.CreatedBefore)) &&
+		(query.PassengerName == "" || slices.Contains(passengerNames(booking.User), normalizeName(query.PassengerName)))
+}
+
+// normalizeName lower cases a name and collapses its spaces
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// passengerNames are the names the passenger of a booking is found by
+func passengerNames(user User) []string {
+	return []string{
+		normalizeName(user.FirstName),
+		normalizeName(user.LastName),
+		normalizeName(user.FirstName + " " + user.LastName),
+	}
+}
+
+// createdEntry is a booking in the order of ListBookings
+type createdEntry struct {
+	createdAt time.Time
+	bookingID BookingID
+}
+
+func (e createdEntry) before(other createdEntry) bool {
+	if !e.createdAt.Equal(other.createdAt) {
+		return e.createdAt.Before(other.createdAt)
+	}
+	return e.bookingID < other.bookingID
+}
+
+// queryIndex are the secondary indexes of ListBookings over the active and the cancelled
+// bookings, they are guarded by the index lock
+type queryIndex struct {
+	journeys   map[string]BookingsMap
+	sections   map[SectionID]BookingsMap
+	owners     map[string]BookingsMap
+	statuses   map[string]BookingsMap
+	passengers map[string]BookingsMap
+
+	// all the bookings sorted by creation time and id
+	created []createdEntry
+}
+
+func newQueryIndex() *queryIndex {
+	return &queryIndex{
+		journeys:   make(map[string]BookingsMap),
+		sections:   make(map[SectionID]BookingsMap),
+		owners:     make(map[string]BookingsMap),
+		statuses:   make(map[string]BookingsMap),
+		passengers: make(map[string]BookingsMap),
+	}
+}
+
+// indexKey adds the booking to the set of the key, or removes it
+func indexKey[K comparable](index map[K]BookingsMap, key K, bookingID BookingID, add bool) {
+	if add {
+		if _, ok := index[key]; !ok {
+			index[key] = make(BookingsMap)
+		}
+		index[key][bookingID] = struct{}{}
+		return
+	}
+	delete(index[key], bookingID)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// set adds the booking to the sets of its fields, or removes it
+func (q *queryIndex) set(booking Booking, add bool) {
+	bookingID := BookingID(booking.BookingID)
+	indexKey(q.journeys, booking.JourneyID, bookingID, add)
+	indexKey(q.sections, SectionID(booking.Seat.SectionID), bookingID, add)
+	indexKey(q.owners, booking.owner, bookingID, add)
+	indexKey(q.statuses, booking.Status, bookingID, add)
+	for _, name := range passengerNames(booking.User) {
+		if name != "" {
+			indexKey(q.passengers, name, bookingID, add)
+		}
+	}
+}
+
+// search returns the position of the entry in the created order
+func (q *queryIndex) search(entry createdEntry) int {
+	return sort.Search(len(q.created), func(i int) bool {
+		return !q.created[i].before(entry)
+	})
+}
+
+// add indexes a new booking
+func (q *queryIndex) add(booking Booking) {
+	q.set(booking, true)
+	entry := createdEntry{createdAt: booking.CreatedAt, bookingID: BookingID(booking.BookingID)}
+	q.created = slices.Insert(q.created, q.search(entry), entry)
+}
+
+// update indexes the changed fields of a booking, its id and creation time don't change
+func (q *queryIndex) update(old Booking, booking Booking) {
+	q.set(old, false)
+	q.set(booking, true)
+}
+
+// remove drops a booking from the indexes
+func (q *queryIndex) remove(booking Booking) {
+	q.set(booking, false)
+	entry := createdEntry{createdAt: booking.CreatedAt, bookingID: BookingID(booking.BookingID)}
+	if i := q.search(entry); i < len(q.created) && q.created[i] == entry {
+		q.created = slices.Delete(q.created, i, i+1)
+	}
+}
+
+// candidates returns the smallest set of the query's filters, or false when the query has
+// no filter with a set
+func (q *queryIndex) candidates(query BookingQuery) (BookingsMap, bool) {
+	var sets []BookingsMap
+	if query.JourneyID != "" {
+		sets = append(sets, q.journeys[query.JourneyID])
+	}
+	if query.SectionID != "" {
+		sets = append(sets, q.sections[query.SectionID])
+	}
+	if query.Owner != "" {
+		sets = append(sets, q.owners[query.Owner])
+	}
+	if query.Status != "" {
+		sets = append(sets, q.statuses[query.Status])
+	}
+	if query.PassengerName != "" {
+		sets = append(sets, q.passengers[normalizeName(query.PassengerName)])
+	}
+	if len(sets) == 0 {
+		return nil, false
+	}
+	smallest := sets[0]
+	for _, set := range sets[1:] {
+		if len(set) < len(smallest) {
+			smallest = set
+		}
+	}
+	return smallest, true
+}
+
+// sortBookings sorts bookings by creation time and id, the order of ListBookings
+func sortBookings(bookings []Booking) {
+	sort.Slice(bookings, func(i, j int) bool {
+		return createdEntry{bookings[i].CreatedAt, BookingID(bookings[i].BookingID)}.before(createdEntry{bookings[j].CreatedAt, BookingID(bookings[j].BookingID)})
+	})
+}
+
+// ListBookings returns the active and cancelled bookings that match the query, sorted by
+// creation time and id. It finds them with the index of the most selective filter, or in
+// the creation order when the query only filters on the creation time.
+func (ds *Datastore) ListBookings(ctx context.Context, query BookingQuery) []Booking {
+	sectionIDs := ds.sectionIDs
+	if query.SectionID != "" {
+		sectionIDs = []SectionID{query.SectionID}
+	}
+
+	ds.pruneExpiredCancelled()
+
+	// Concurrency support
+	unlock := ds.lockBookings(ctx, "ListBookings", false, onSections(sectionIDs...))
+	defer unlock()
+
+	return ds.listBookings(query)
+}
+
+// Internal list bookings function, the caller must hold the index lock and the locks of the
+// sections of the query
+func (ds *Datastore) listBookings(query BookingQuery) []Booking {
+	var bookings []Booking
+	if candidates, ok := ds.queryIndex.candidates(query); ok {
+		for bookingID := range candidates {
+			if booking := ds.listedBooking(bookingID); query.matches(booking) {
+				bookings = append(bookings, booking)
+			}
+		}
+		sortBookings(bookings)
+		return bookings
+	}
+
+	created := ds.queryIndex.created
+	start, end := 0, len(created)
+	if !query.CreatedAfter.IsZero() {
+		start = ds.queryIndex.search(createdEntry{createdAt: query.CreatedAfter})
+	}
+	if !query.CreatedBefore.IsZero() {
+		end = max(start, ds.queryIndex.search(createdEntry{createdAt: query.CreatedBefore}))
+	}
+	for _, entry := range created[start:end] {
+		bookings = append(bookings, ds.listedBooking(entry.bookingID))
+	}
+	return bookings
+}
+
+// listedBooking returns an active or cancelled booking, the caller must hold the index lock
+// and the lock of the section of an active booking
+func (ds *Datastore) listedBooking(bookingID BookingID) Booking {
+	if booking, ok := ds.booking(bookingID); ok {
+		return booking
+	}
+	return ds.cancelled[bookingID]
+}
@@ -0,0 +1,283 @@
+package datastore
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Scores of a search word matching a term, the bookings matching best come first
+const (
+	SEARCH_SCORE_EXACT  = 3
+	SEARCH_SCORE_PREFIX = 2
+	SEARCH_SCORE_FUZZY  = 1
+)
+
+// SearchQuery are the criteria of SearchBookings, the bookings match all the given ones
+type SearchQuery struct {
+	// Words of the passenger's name or email address, each matches by prefix or with a typo
+	Text string
+	// Start of the booking id
+	BookingIDPrefix string
+	// Section of the seat, and the seat when SeatID isn't empty
+	SectionID SectionID
+	SeatID    SeatID
+	// Maximum number of bookings, 0 doesn't limit them
+	Limit int
+}
+
+// isWordRune checks if the rune is part of a word rather than a separator like "." or "@"
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// searchTerms splits a name or an email address into the terms it is found by: each lower
+// cased word and the parts of it following a separator, e.g. "jane.doe@example.com",
+// "doe@example.com", "example.com" and "com"
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		terms = append(terms, word)
+		prev := ' '
+		for i, r := range word {
+			if i > 0 && isWordRune(r) && !isWordRune(prev) {
+				terms = append(terms, word[i:])
+			}
+			prev = r
+		}
+	}
+	return terms
+}
+
+// userTerms are the terms the passenger of a booking is found by
+func userTerms(user User) []string {
+	terms := append(searchTerms(user.FirstName), searchTerms(user.LastName)...)
+	return append(terms, searchTerms(user.EmailAddress)...)
+}
+
+// maxEdits is the number of typos a search word may have, none for short words
+func maxEdits(word string) int {
+	switch n := utf8.RuneCountInString(word); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// editDistance returns the number of inserted, deleted, replaced or swapped adjacent runes
+// between a and b, or limit+1 when it is over the limit
+func editDistance(a string, b string, limit int) int {
+	if n, m := utf8.RuneCountInString(a), utf8.RuneCountInString(b); n-m > limit || m-n > limit {
+		return limit + 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	// the rows of the distances of the prefixes of a, two rows back for the swaps
+	rows := make([]int, 3*(len(rb)+1))
+	prev2, prev, row := rows[:len(rb)+1], rows[len(rb)+1:2*(len(rb)+1)], rows[2*(len(rb)+1):]
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		row[0] = i
+		smallest := row[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			row[j] = min(prev[j]+1, row[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				row[j] = min(row[j], prev2[j-2]+1)
+			}
+			smallest = min(smallest, row[j])
+		}
+		if smallest > limit {
+			return limit + 1
+		}
+		prev2, prev, row = prev, row, prev2
+	}
+	return min(prev[len(rb)], limit+1)
+}
+
+// insertSorted adds the value to the sorted values once
+func insertSorted(values []string, value string) []string {
+	if i, found := slices.BinarySearch(values, value); !found {
+		return slices.Insert(values, i, value)
+	}
+	return values
+}
+
+// removeSorted drops the value from the sorted values
+func removeSorted(values []string, value string) []string {
+	if i, found := slices.BinarySearch(values, value); found {
+		return slices.Delete(values, i, i+1)
+	}
+	return values
+}
+
+// withPrefix returns the sorted values that start with the prefix
+func withPrefix(values []string, prefix string) []string {
+	start, _ := slices.BinarySearch(values, prefix)
+	end := start
+	for end < len(values) && strings.HasPrefix(values[end], prefix) {
+		end++
+	}
+	return values[start:end]
+}
+
+// searchIndex is the inverted index of SearchBookings over the active bookings, it is guarded
+// by the index lock. Seats are found with the seating of the sections.
+type searchIndex struct {
+	// map of the terms of the passengers' names and email addresses to their bookings
+	terms map[string]BookingsMap
+
+	// the terms and the booking ids, sorted for the prefix lookups
+	sortedTerms []string
+	bookingIDs  []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{terms: make(map[string]BookingsMap)}
+}
+
+// add indexes an active booking
+func (s *searchIndex) add(booking Booking) {
+	for _, term := range userTerms(booking.User) {
+		if _, ok := s.terms[term]; !ok {
+			s.sortedTerms = insertSorted(s.sortedTerms, term)
+		}
+		indexKey(s.terms, term, BookingID(booking.BookingID), true)
+	}
+	s.bookingIDs = insertSorted(s.bookingIDs, booking.BookingID)
+}
+
+// remove drops a booking that is cancelled or whose purchase is rolled back
+func (s *searchIndex) remove(booking Booking) {
+	for _, term := range userTerms(booking.User) {
+		indexKey(s.terms, term, BookingID(booking.BookingID), false)
+		if _, ok := s.terms[term]; !ok {
+			s.sortedTerms = removeSorted(s.sortedTerms, term)
+		}
+	}
+	s.bookingIDs = removeSorted(s.bookingIDs, booking.BookingID)
+}
+
+// match returns the bookings a search word matches with their scores. The word matches the
+// terms it starts, and the other terms within maxEdits typos, which are looked up one by one.
+func (s *searchIndex) match(word string) map[BookingID]int {
+	scores := make(map[BookingID]int)
+	score := func(term string, score int) {
+		for bookingID := range s.terms[term] {
+			scores[bookingID] = max(scores[bookingID], score)
+		}
+	}
+	for _, term := range withPrefix(s.sortedTerms, word) {
+		if term == word {
+			score(term, SEARCH_SCORE_EXACT)
+		} else {
+			score(term, SEARCH_SCORE_PREFIX)
+		}
+	}
+	if edits := maxEdits(word); edits > 0 {
+		for _, term := range s.sortedTerms {
+			if !strings.HasPrefix(term, word) && editDistance(word, term, edits) <= edits {
+				score(term, SEARCH_SCORE_FUZZY)
+			}
+		}
+	}
+	return scores
+}
+
+// SearchBookings finds the active bookings matching all the criteria of the query, the best
+// matches first and then in creation order. A query without criteria finds nothing.
+func (ds *Datastore) SearchBookings(ctx context.Context, query SearchQuery) []Booking {
+	sectionIDs := ds.sectionIDs
+	if query.SectionID != "" {
+		sectionIDs = []SectionID{query.SectionID}
+	}
+
+	// Concurrency support
+	unlock := ds.lockBookings(ctx, "SearchBookings", false, onSections(sectionIDs...))
+	defer unlock()
+
+	return ds.searchBookings(query)
+}
+
+// Internal search bookings function, the caller must hold the index lock and the locks of the
+// sections of the query
+func (ds *Datastore) searchBookings(query SearchQuery) []Booking {
+	// scores of the bookings matching the criteria so far, nil before the first criterion
+	var scores map[BookingID]int
+	narrow := func(matches map[BookingID]int) {
+		if scores == nil {
+			scores = matches
+			return
+		}
+		for bookingID, score := range scores {
+			if match, ok := matches[bookingID]; ok {
+				scores[bookingID] = score + match
+			} else {
+				delete(scores, bookingID)
+			}
+		}
+	}
+
+	if query.SectionID != "" {
+		s, ok := ds.sections[query.SectionID]
+		if !ok {
+			return nil
+		}
+		matches := make(map[BookingID]int)
+		if query.SeatID != "" {
+			if bookingID, ok := s.seating[query.SeatID]; ok {
+				matches[bookingID] = 0
+			}
+		} else {
+			for bookingID := range s.bookings {
+				matches[bookingID] = 0
+			}
+		}
+		narrow(matches)
+	}
+	if query.BookingIDPrefix != "" {
+		matches := make(map[BookingID]int)
+		for _, bookingID := range withPrefix(ds.searchIndex.bookingIDs, strings.ToLower(query.BookingIDPrefix)) {
+			matches[BookingID(bookingID)] = 0
+		}
+		narrow(matches)
+	}
+	for _, word := range strings.Fields(strings.ToLower(query.Text)) {
+		narrow(ds.searchIndex.match(word))
+	}
+
+	type found struct {
+		score int
+		entry createdEntry
+	}
+	results := make([]found, 0, len(scores))
+	for bookingID, score := range scores {
+		if booking, ok := ds.booking(bookingID); ok {
+			results = append(results, found{score, createdEntry{booking.CreatedAt, bookingID}})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].entry.before(results[j].entry)
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	bookings := make([]Booking, 0, len(results))
+	for _, result := range results {
+		booking, _ := ds.booking(result.entry.bookingID)
+		bookings = append(bookings, booking)
+	}
+	return bookings
+}
@@ -0,0 +1,30 @@
+package datastore
+
+// SectionStats counts the seats of a section
+type SectionStats struct {
+	Sold int
+	Free int
+}
+
+// Stats are the business counters of the datastore, the booking counters only grow
+type Stats struct {
+	BookingsCreated   uint64
+	BookingsCancelled uint64
+	BookingsModified  uint64
+	Sections          map[SectionID]SectionStats
+}
+
+// Stats returns the booking counters and the seats sold and free per section
+func (ds *Datastore) Stats() Stats {
+	// Concurrency support
+	unlock := ds.lockSections(false, ds.sectionIDs...)
+	defer unlock()
+
+	stats := ds.stats
+	stats.Sections = make(map[SectionID]SectionStats, len(ds.sections))
+	for sectionID, s := range ds.sections {
+		sold := len(s.seating)
+		stats.Sections[sectionID] = SectionStats{Sold: sold, Free: ds.sectionSize - sold}
+	}
+	return stats
+}
@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type TokenAlreadyUsed error
+
+// UseToken marks the single-use token id as used. It fails if the token was used before.
+// Ids are kept until the token expires, after which the token is rejected for its expiry anyway.
+func (ds *Datastore) UseToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	// Concurrency support
+	unlock := ds.lock(ctx, "UseToken")
+	defer unlock()
+
+	now := time.Now()
+	for id, expiry := range ds.usedTokens {
+		if now.After(expiry) {
+			delete(ds.usedTokens, id)
+		}
+	}
+
+	if _, ok := ds.usedTokens[tokenID]; ok {
+		return TokenAlreadyUsed(fmt.Errorf("token already used: %v", tokenID))
+	}
+	ds.usedTokens[tokenID] = expiresAt
+	return nil
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer used for the datastore spans
+const tracerName = "github.com/13thuser/exampleauth/datastore"
+
+// WithTracerProvider sets the tracer provider of the datastore spans, the global provider is used by default.
+func WithTracerProvider(provider trace.TracerProvider) DatastoreOption {
+	return func(ds *Datastore) {
+		ds.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// traceLock starts the span of an operation and calls lock, recording how long the operation
+// waited for its locks. The returned function releases the locks and ends the span.
+func (ds *Datastore) traceLock(ctx context.Context, operation string, mode string, lock func() func()) func() {
+	_, span := ds.tracer.Start(ctx, "datastore."+operation, trace.WithAttributes(attribute.String("datastore.lock", mode)))
+	start := time.Now()
+	unlock := lock()
+	span.SetAttributes(attribute.Int64("datastore.lock_wait_us", time.Since(start).Microseconds()))
+	return func() {
+		unlock()
+		span.End()
+	}
+}
+
+// lock is traceLock for the write operations on the store lock
+func (ds *Datastore) lock(ctx context.Context, operation string) func() {
+	return ds.traceLock(ctx, operation, "write", func() func() {
+		ds.Lock()
+		return ds.Unlock
+	})
+}
+
+// rlock is lock for read operations, it takes the read lock
+func (ds *Datastore) rlock(ctx context.Context, operation string) func() {
+	return ds.traceLock(ctx, operation, "read", func() func() {
+		ds.RLock()
+		return ds.RUnlock
+	})
+}
+
+// lockBookings is traceLock for the operations on the bookings, it takes the locks of the
+// sections returned by sections and the index lock, see lockIndexed
+func (ds *Datastore) lockBookings(ctx context.Context, operation string, write bool, sections func() []SectionID) func() {
+	mode := "read"
+	if write {
+		mode = "write"
+	}
+	return ds.traceLock(ctx, operation, mode, func() func() {
+		return ds.lockIndexed(write, sections)
+	})
+}
+
+// defaultTracer uses the global tracer provider, it picks up the provider set after the datastore is created
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
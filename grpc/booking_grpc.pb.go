@@ -25,12 +25,29 @@ const _ = grpc.SupportPackageIsVersion7
 type BookingServiceClient interface {
 	// Public APIs (Guest can use this)
 	Purchase(ctx context.Context, in *PurchaseRequest, opts ...grpc.CallOption) (*Booking, error)
+	// Buys several seats at once, all of them or none (Guest can use this)
+	PurchaseBookings(ctx context.Context, in *PurchaseBookingsRequest, opts ...grpc.CallOption) (*PurchaseBookingsResponse, error)
+	// Sends a single-use access token to a guest's email address (Public)
+	RequestBookingAccess(ctx context.Context, in *RequestBookingAccessRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Exchanges the access token for a session token scoped to the guest's bookings (Public)
+	RedeemBookingAccess(ctx context.Context, in *RedeemBookingAccessRequest, opts ...grpc.CallOption) (*BookingAccessSession, error)
 	// Gets bookings made by current user (user must be authenticated)
 	GetUserBookings(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (BookingService_GetUserBookingsClient, error)
+	// Lists bookings a page at a time with a filter and an order (user must be authenticated)
+	ListBookings(ctx context.Context, in *ListBookingsRequest, opts ...grpc.CallOption) (*ListBookingsResponse, error)
+	// Moves bookings made as a guest into the current user's account (user must be authenticated)
+	ClaimGuestBookings(ctx context.Context, in *ClaimGuestBookingsRequest, opts ...grpc.CallOption) (*ClaimGuestBookingsResponse, error)
+	// Gets the booking limits of the current user and how much of them is used (user must be authenticated)
+	GetMyLimits(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*UserLimits, error)
 	// Admin APIs
 	GetBookingsBySection(ctx context.Context, in *GetBookingsBySectionRequest, opts ...grpc.CallOption) (BookingService_GetBookingsBySectionClient, error)
+	SearchBookings(ctx context.Context, in *SearchBookingsRequest, opts ...grpc.CallOption) (*SearchBookingsResponse, error)
 	RemoveUserFromTrain(ctx context.Context, in *RemoveBookingRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	ModifySeat(ctx context.Context, in *ModifySeatRequest, opts ...grpc.CallOption) (*Booking, error)
+	// API keys for machine clients and partner integrations
+	CreateAPIKey(ctx context.Context, in *CreateAPIKeyRequest, opts ...grpc.CallOption) (*CreateAPIKeyResponse, error)
+	ListAPIKeys(ctx context.Context, in *ListAPIKeysRequest, opts ...grpc.CallOption) (*ListAPIKeysResponse, error)
+	RevokeAPIKey(ctx context.Context, in *RevokeAPIKeyRequest, opts ...grpc.CallOption) (*APIKey, error)
 }
 
 type bookingServiceClient struct {
@@ -50,6 +67,33 @@ func (c *bookingServiceClient) Purchase(ctx context.Context, in *PurchaseRequest
 	return out, nil
 }
 
+func (c *bookingServiceClient) PurchaseBookings(ctx context.Context, in *PurchaseBookingsRequest, opts ...grpc.CallOption) (*PurchaseBookingsResponse, error) {
+	out := new(PurchaseBookingsResponse)
+	err := c.cc.Invoke(ctx, "/BookingService/PurchaseBookings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingServiceClient) RequestBookingAccess(ctx context.Context, in *RequestBookingAccessRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/BookingService/RequestBookingAccess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingServiceClient) RedeemBookingAccess(ctx context.Context, in *RedeemBookingAccessRequest, opts ...grpc.CallOption) (*BookingAccessSession, error) {
+	out := new(BookingAccessSession)
+	err := c.cc.Invoke(ctx, "/BookingService/RedeemBookingAccess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *bookingServiceClient) GetUserBookings(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (BookingService_GetUserBookingsClient, error) {
 	stream, err := c.cc.NewStream(ctx, &BookingService_ServiceDesc.Streams[0], "/BookingService/GetUserBookings", opts...)
 	if err != nil {
@@ -82,6 +126,33 @@ func (x *bookingServiceGetUserBookingsClient) Recv() (*Booking, error) {
 	return m, nil
 }
 
+func (c *bookingServiceClient) ListBookings(ctx context.Context, in *ListBookingsRequest, opts ...grpc.CallOption) (*ListBookingsResponse, error) {
+	out := new(ListBookingsResponse)
+	err := c.cc.Invoke(ctx, "/BookingService/ListBookings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingServiceClient) ClaimGuestBookings(ctx context.Context, in *ClaimGuestBookingsRequest, opts ...grpc.CallOption) (*ClaimGuestBookingsResponse, error) {
+	out := new(ClaimGuestBookingsResponse)
+	err := c.cc.Invoke(ctx, "/BookingService/ClaimGuestBookings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingServiceClient) GetMyLimits(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*UserLimits, error) {
+	out := new(UserLimits)
+	err := c.cc.Invoke(ctx, "/BookingService/GetMyLimits", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *bookingServiceClient) GetBookingsBySection(ctx context.Context, in *GetBookingsBySectionRequest, opts ...grpc.CallOption) (BookingService_GetBookingsBySectionClient, error) {
 	stream, err := c.cc.NewStream(ctx, &BookingService_ServiceDesc.Streams[1], "/BookingService/GetBookingsBySection", opts...)
 	if err != nil {
@@ -114,6 +185,15 @@ func (x *bookingServiceGetBookingsBySectionClient) Recv() (*Booking, error) {
 	return m, nil
 }
 
+func (c *bookingServiceClient) SearchBookings(ctx context.Context, in *SearchBookingsRequest, opts ...grpc.CallOption) (*SearchBookingsResponse, error) {
+	out := new(SearchBookingsResponse)
+	err := c.cc.Invoke(ctx, "/BookingService/SearchBookings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *bookingServiceClient) RemoveUserFromTrain(ctx context.Context, in *RemoveBookingRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
 	out := new(emptypb.Empty)
 	err := c.cc.Invoke(ctx, "/BookingService/RemoveUserFromTrain", in, out, opts...)
@@ -132,18 +212,62 @@ func (c *bookingServiceClient) ModifySeat(ctx context.Context, in *ModifySeatReq
 	return out, nil
 }
 
+func (c *bookingServiceClient) CreateAPIKey(ctx context.Context, in *CreateAPIKeyRequest, opts ...grpc.CallOption) (*CreateAPIKeyResponse, error) {
+	out := new(CreateAPIKeyResponse)
+	err := c.cc.Invoke(ctx, "/BookingService/CreateAPIKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingServiceClient) ListAPIKeys(ctx context.Context, in *ListAPIKeysRequest, opts ...grpc.CallOption) (*ListAPIKeysResponse, error) {
+	out := new(ListAPIKeysResponse)
+	err := c.cc.Invoke(ctx, "/BookingService/ListAPIKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingServiceClient) RevokeAPIKey(ctx context.Context, in *RevokeAPIKeyRequest, opts ...grpc.CallOption) (*APIKey, error) {
+	out := new(APIKey)
+	err := c.cc.Invoke(ctx, "/BookingService/RevokeAPIKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BookingServiceServer is the server API for BookingService service.
 // All implementations must embed UnimplementedBookingServiceServer
 // for forward compatibility
 type BookingServiceServer interface {
 	// Public APIs (Guest can use this)
 	Purchase(context.Context, *PurchaseRequest) (*Booking, error)
+	// Buys several seats at once, all of them or none (Guest can use this)
+	PurchaseBookings(context.Context, *PurchaseBookingsRequest) (*PurchaseBookingsResponse, error)
+	// Sends a single-use access token to a guest's email address (Public)
+	RequestBookingAccess(context.Context, *RequestBookingAccessRequest) (*emptypb.Empty, error)
+	// Exchanges the access token for a session token scoped to the guest's bookings (Public)
+	RedeemBookingAccess(context.Context, *RedeemBookingAccessRequest) (*BookingAccessSession, error)
 	// Gets bookings made by current user (user must be authenticated)
 	GetUserBookings(*emptypb.Empty, BookingService_GetUserBookingsServer) error
+	// Lists bookings a page at a time with a filter and an order (user must be authenticated)
+	ListBookings(context.Context, *ListBookingsRequest) (*ListBookingsResponse, error)
+	// Moves bookings made as a guest into the current user's account (user must be authenticated)
+	ClaimGuestBookings(context.Context, *ClaimGuestBookingsRequest) (*ClaimGuestBookingsResponse, error)
+	// Gets the booking limits of the current user and how much of them is used (user must be authenticated)
+	GetMyLimits(context.Context, *emptypb.Empty) (*UserLimits, error)
 	// Admin APIs
 	GetBookingsBySection(*GetBookingsBySectionRequest, BookingService_GetBookingsBySectionServer) error
+	SearchBookings(context.Context, *SearchBookingsRequest) (*SearchBookingsResponse, error)
 	RemoveUserFromTrain(context.Context, *RemoveBookingRequest) (*emptypb.Empty, error)
 	ModifySeat(context.Context, *ModifySeatRequest) (*Booking, error)
+	// API keys for machine clients and partner integrations
+	CreateAPIKey(context.Context, *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error)
+	ListAPIKeys(context.Context, *ListAPIKeysRequest) (*ListAPIKeysResponse, error)
+	RevokeAPIKey(context.Context, *RevokeAPIKeyRequest) (*APIKey, error)
 	mustEmbedUnimplementedBookingServiceServer()
 }
 
@@ -154,18 +278,48 @@ type UnimplementedBookingServiceServer struct {
 func (UnimplementedBookingServiceServer) Purchase(context.Context, *PurchaseRequest) (*Booking, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Purchase not implemented")
 }
+func (UnimplementedBookingServiceServer) PurchaseBookings(context.Context, *PurchaseBookingsRequest) (*PurchaseBookingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PurchaseBookings not implemented")
+}
+func (UnimplementedBookingServiceServer) RequestBookingAccess(context.Context, *RequestBookingAccessRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestBookingAccess not implemented")
+}
+func (UnimplementedBookingServiceServer) RedeemBookingAccess(context.Context, *RedeemBookingAccessRequest) (*BookingAccessSession, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RedeemBookingAccess not implemented")
+}
 func (UnimplementedBookingServiceServer) GetUserBookings(*emptypb.Empty, BookingService_GetUserBookingsServer) error {
 	return status.Errorf(codes.Unimplemented, "method GetUserBookings not implemented")
 }
+func (UnimplementedBookingServiceServer) ListBookings(context.Context, *ListBookingsRequest) (*ListBookingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBookings not implemented")
+}
+func (UnimplementedBookingServiceServer) ClaimGuestBookings(context.Context, *ClaimGuestBookingsRequest) (*ClaimGuestBookingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClaimGuestBookings not implemented")
+}
+func (UnimplementedBookingServiceServer) GetMyLimits(context.Context, *emptypb.Empty) (*UserLimits, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMyLimits not implemented")
+}
 func (UnimplementedBookingServiceServer) GetBookingsBySection(*GetBookingsBySectionRequest, BookingService_GetBookingsBySectionServer) error {
 	return status.Errorf(codes.Unimplemented, "method GetBookingsBySection not implemented")
 }
+func (UnimplementedBookingServiceServer) SearchBookings(context.Context, *SearchBookingsRequest) (*SearchBookingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchBookings not implemented")
+}
 func (UnimplementedBookingServiceServer) RemoveUserFromTrain(context.Context, *RemoveBookingRequest) (*emptypb.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RemoveUserFromTrain not implemented")
 }
 func (UnimplementedBookingServiceServer) ModifySeat(context.Context, *ModifySeatRequest) (*Booking, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ModifySeat not implemented")
 }
+func (UnimplementedBookingServiceServer) CreateAPIKey(context.Context, *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAPIKey not implemented")
+}
+func (UnimplementedBookingServiceServer) ListAPIKeys(context.Context, *ListAPIKeysRequest) (*ListAPIKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAPIKeys not implemented")
+}
+func (UnimplementedBookingServiceServer) RevokeAPIKey(context.Context, *RevokeAPIKeyRequest) (*APIKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeAPIKey not implemented")
+}
 func (UnimplementedBookingServiceServer) mustEmbedUnimplementedBookingServiceServer() {}
 
 // UnsafeBookingServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -197,6 +351,60 @@ func _BookingService_Purchase_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BookingService_PurchaseBookings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurchaseBookingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).PurchaseBookings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/PurchaseBookings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).PurchaseBookings(ctx, req.(*PurchaseBookingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingService_RequestBookingAccess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RequestBookingAccessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).RequestBookingAccess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/RequestBookingAccess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).RequestBookingAccess(ctx, req.(*RequestBookingAccessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingService_RedeemBookingAccess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RedeemBookingAccessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).RedeemBookingAccess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/RedeemBookingAccess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).RedeemBookingAccess(ctx, req.(*RedeemBookingAccessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _BookingService_GetUserBookings_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(emptypb.Empty)
 	if err := stream.RecvMsg(m); err != nil {
@@ -218,6 +426,60 @@ func (x *bookingServiceGetUserBookingsServer) Send(m *Booking) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _BookingService_ListBookings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBookingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).ListBookings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/ListBookings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).ListBookings(ctx, req.(*ListBookingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingService_ClaimGuestBookings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClaimGuestBookingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).ClaimGuestBookings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/ClaimGuestBookings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).ClaimGuestBookings(ctx, req.(*ClaimGuestBookingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingService_GetMyLimits_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).GetMyLimits(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/GetMyLimits",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).GetMyLimits(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _BookingService_GetBookingsBySection_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(GetBookingsBySectionRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -239,6 +501,24 @@ func (x *bookingServiceGetBookingsBySectionServer) Send(m *Booking) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _BookingService_SearchBookings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchBookingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).SearchBookings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/SearchBookings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).SearchBookings(ctx, req.(*SearchBookingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _BookingService_RemoveUserFromTrain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(RemoveBookingRequest)
 	if err := dec(in); err != nil {
@@ -275,6 +555,60 @@ func _BookingService_ModifySeat_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BookingService_CreateAPIKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateAPIKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).CreateAPIKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/CreateAPIKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).CreateAPIKey(ctx, req.(*CreateAPIKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingService_ListAPIKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAPIKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).ListAPIKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/ListAPIKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).ListAPIKeys(ctx, req.(*ListAPIKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingService_RevokeAPIKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeAPIKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingServiceServer).RevokeAPIKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/BookingService/RevokeAPIKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingServiceServer).RevokeAPIKey(ctx, req.(*RevokeAPIKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BookingService_ServiceDesc is the grpc.ServiceDesc for BookingService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -286,6 +620,34 @@ var BookingService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Purchase",
 			Handler:    _BookingService_Purchase_Handler,
 		},
+		{
+			MethodName: "PurchaseBookings",
+			Handler:    _BookingService_PurchaseBookings_Handler,
+		},
+		{
+			MethodName: "RequestBookingAccess",
+			Handler:    _BookingService_RequestBookingAccess_Handler,
+		},
+		{
+			MethodName: "RedeemBookingAccess",
+			Handler:    _BookingService_RedeemBookingAccess_Handler,
+		},
+		{
+			MethodName: "ListBookings",
+			Handler:    _BookingService_ListBookings_Handler,
+		},
+		{
+			MethodName: "ClaimGuestBookings",
+			Handler:    _BookingService_ClaimGuestBookings_Handler,
+		},
+		{
+			MethodName: "GetMyLimits",
+			Handler:    _BookingService_GetMyLimits_Handler,
+		},
+		{
+			MethodName: "SearchBookings",
+			Handler:    _BookingService_SearchBookings_Handler,
+		},
 		{
 			MethodName: "RemoveUserFromTrain",
 			Handler:    _BookingService_RemoveUserFromTrain_Handler,
@@ -294,6 +656,18 @@ var BookingService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ModifySeat",
 			Handler:    _BookingService_ModifySeat_Handler,
 		},
+		{
+			MethodName: "CreateAPIKey",
+			Handler:    _BookingService_CreateAPIKey_Handler,
+		},
+		{
+			MethodName: "ListAPIKeys",
+			Handler:    _BookingService_ListAPIKeys_Handler,
+		},
+		{
+			MethodName: "RevokeAPIKey",
+			Handler:    _BookingService_RevokeAPIKey_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
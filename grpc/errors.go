@@ -0,0 +1,17 @@
+package protos
+
+// ErrorDomain is the domain of the google.rpc.ErrorInfo details of the service's errors
+const ErrorDomain = "booking.exampleauth"
+
+// Reasons of the google.rpc.ErrorInfo details. Clients tell the errors apart by the reason,
+// the messages are meant for people and may change.
+const (
+	REASON_BOOKING_NOT_FOUND  = "BOOKING_NOT_FOUND"
+	REASON_SECTION_NOT_FOUND  = "SECTION_NOT_FOUND"
+	REASON_SECTION_IS_FULL    = "SECTION_IS_FULL"
+	REASON_SEAT_NOT_AVAILABLE = "SEAT_NOT_AVAILABLE"
+	REASON_INVALID_SEAT_ID    = "INVALID_SEAT_ID"
+	// The ErrorInfo metadata "rule" is the limit that was exceeded
+	REASON_BOOKING_LIMIT_EXCEEDED = "BOOKING_LIMIT_EXCEEDED"
+	REASON_RATE_LIMITED           = "RATE_LIMITED"
+)
@@ -0,0 +1,8 @@
+package protos
+
+import _ "embed"
+
+// OpenAPISpec is the OpenAPI v3 spec of the REST gateway, it is generated from booking.proto
+//
+//go:embed openapi.yaml
+var OpenAPISpec []byte